@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/m-lab/pusher/control"
+	"github.com/m-lab/pusher/pipeline"
+)
+
+// restarter is the part of a pipeline.Pipeline the admin API uses.
+type restarter interface {
+	Restart(ctx context.Context) error
+}
+
+// restartHandler serves POST /restart?datatype=X, which restarts the pipeline
+// of datatype X, e.g. to recover from a wedged watch, without restarting
+// pusher and all the other pipelines with it. The response is sent once the
+// pipeline is running again.
+func restartHandler(pipelines map[string]restarter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "restarts must be POSTed", http.StatusMethodNotAllowed)
+			return
+		}
+		datatype := r.URL.Query().Get("datatype")
+		if datatype == "" {
+			http.Error(w, "no datatype to restart", http.StatusBadRequest)
+			return
+		}
+		p, ok := pipelines[datatype]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown datatype %q", datatype), http.StatusNotFound)
+			return
+		}
+		log.Printf("Restart of the pipeline for %s requested by %s\n", datatype, r.RemoteAddr)
+		if err := p.Restart(r.Context()); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, pipeline.ErrNotRunning) {
+				status = http.StatusServiceUnavailable
+			} else if errors.Is(err, pipeline.ErrNoRestart) {
+				status = http.StatusForbidden
+			}
+			http.Error(w, fmt.Sprintf("could not restart %s: %v", datatype, err), status)
+			return
+		}
+		fmt.Fprintf(w, "restarted %s\n", datatype)
+	}
+}
+
+// controlHandler serves POST requests for one of the control service's
+// methods which take a datatype, given by ?datatype=X, or every datatype if it
+// is missing.
+func controlHandler(call func(ctx context.Context, datatype string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "control requests must be POSTed", http.StatusMethodNotAllowed)
+			return
+		}
+		log.Printf("%s requested by %s\n", r.URL, r.RemoteAddr)
+		if err := call(r.Context(), r.URL.Query().Get("datatype")); err != nil {
+			http.Error(w, err.Error(), httpStatus(err))
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// statusHandler serves GET /status, the control service's status as JSON.
+func statusHandler(service *control.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(service.Status(r.Context()))
+	}
+}
+
+// httpStatus returns the HTTP status of the control service's error.
+func httpStatus(err error) int {
+	switch status.Code(err) {
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	}
+	return http.StatusInternalServerError
+}
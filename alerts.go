@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/m-lab/pusher/tarfile"
+)
+
+var pusherStuckAlerts = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pusher_stuck_upload_alerts_total",
+		Help: "The number of stuck upload events sent to --upload_stuck_webhook, by whether they were accepted",
+	},
+	[]string{"result"},
+)
+
+// stuckAlertTimeout is how long the webhook has to accept each alert.
+const stuckAlertTimeout = 30 * time.Second
+
+// A stuckAlert is a tarfile.StuckEvent, as sent to --upload_stuck_webhook,
+// with the pusher it came from.
+type stuckAlert struct {
+	tarfile.StuckEvent
+	Experiment string `json:"experiment"`
+	NodeName   string `json:"node_name"`
+	Hostname   string `json:"hostname"`
+}
+
+// stuckAlerter returns a function which POSTs each StuckEvent of the
+// experiment's tarfiles, as JSON, to the URL. Each is sent in the background,
+// once, so that the upload which is stuck is not held up further.
+func stuckAlerter(client *http.Client, url string, tn tenant) func(tarfile.StuckEvent) {
+	return func(e tarfile.StuckEvent) {
+		alert := stuckAlert{StuckEvent: e, Experiment: tn.Experiment, NodeName: tn.NodeName, Hostname: hostName()}
+		go func() {
+			if err := sendStuckAlert(client, url, alert); err != nil {
+				log.Printf("Could not send the %s alert for %s/%s to --upload_stuck_webhook (error: %q)\n", e.Event, e.Datatype, e.Subdir, err)
+				pusherStuckAlerts.WithLabelValues("error").Inc()
+				return
+			}
+			pusherStuckAlerts.WithLabelValues("ok").Inc()
+		}()
+	}
+}
+
+// sendStuckAlert makes one attempt to POST the alert to the URL.
+func sendStuckAlert(client *http.Client, url string, alert stuckAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), stuckAlertTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("the webhook answered %s", resp.Status)
+	}
+	return nil
+}
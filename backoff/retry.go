@@ -1,34 +1,53 @@
 // Package backoff provides a tool for repeatedly calling a function until it
-// returns a nil error.  It implements exponential backoff with a defined
-// maximum value, along with some time randomization.
+// returns a nil error, or until a maximum number of attempts have been made.
+// It implements exponential backoff with a defined maximum value, along with
+// some time randomization.
 package backoff
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"math/rand"
 	"time"
 
+	"github.com/m-lab/pusher/metrics"
+	"github.com/m-lab/pusher/ratelog"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+var collectors metrics.Collectors
+
+// RegisterMetrics registers the metrics of the retries on r, or on
+// prometheus.DefaultRegisterer if r is nil. Tarfiles register them when they
+// are made, so only programs which retry on their own need to call it.
+func RegisterMetrics(r prometheus.Registerer) {
+	collectors.Register(r)
+	ratelog.RegisterMetrics(r)
+}
+
 var (
-	pusherRetries = promauto.NewCounterVec(
+	pusherRetries = collectors.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "pusher_retries_total",
 			Help: "The number of times we have retried the function",
 		},
 		[]string{"function"},
 	)
-	pusherMaxRetries = promauto.NewCounterVec(
+	pusherMaxRetries = collectors.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "pusher_max_retries_total",
 			Help: "The number of times we have hit the max backoff time when retrying the function",
 		},
 		[]string{"function"},
 	)
-	retryTimes = promauto.NewHistogramVec(
+	pusherRetriesExhausted = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_retries_exhausted_total",
+			Help: "The number of times we have given up on the function after spending the whole retry budget",
+		},
+		[]string{"function"},
+	)
+	retryTimes = collectors.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name: "pusher_retry_runtime",
 			Help: "The number of seconds taken for each retry operation, e.g upload",
@@ -51,22 +70,125 @@ func timeOf(label string, f func() error) (time.Duration, error) {
 	return delta, err
 }
 
-// Retry retries calling a function until the function returns a non-nil error.
+// Retry retries calling a function until the function returns a nil error.
 // It increments two prometheus counters to keep track of how many errors it has
 // seen: one for all errors, and just when the max error count has been reached.
 // The counters are indexed by the passed-in label. For best results, make sure
 // that maxBackoff > 2*initialBackoff.
 func Retry(f func() error, initialBackoff, maxBackoff time.Duration, label string) {
-	waitTime := initialBackoff
-	for rt, err := timeOf(label, f); err != nil; rt, err = timeOf(label, f) {
-		if waitTime > maxBackoff {
+	RetryN(f, initialBackoff, maxBackoff, 0, label)
+}
+
+// RetryN is like Retry, but gives up after the function has been called
+// attempts times, and returns the last error. If attempts is not positive, it
+// never gives up, and so always returns nil.
+func RetryN(f func() error, initialBackoff, maxBackoff time.Duration, attempts int, label string) error {
+	return RetryBudget(f, initialBackoff, maxBackoff, Capped, Budget{Attempts: attempts}, label)
+}
+
+// Strategy is a way of choosing how long to wait before the next attempt.
+type Strategy string
+
+const (
+	// Capped doubles the wait after each attempt, starting from the initial
+	// backoff. Once the wait would exceed the max backoff, it is instead
+	// chosen at random between half the max backoff and the max backoff. The
+	// zero Strategy is Capped.
+	Capped = Strategy("capped")
+	// FullJitter chooses each wait at random between zero and a cap, where
+	// the cap doubles after each attempt, starting from the initial backoff,
+	// up to the max backoff. This keeps many clients that start retrying at
+	// the same moment, e.g. after an outage, from retrying in lockstep.
+	FullJitter = Strategy("full_jitter")
+)
+
+// Budget limits how much retrying RetryBudget does. A zero field means no
+// limit of that kind.
+type Budget struct {
+	// Attempts is the maximum number of calls to the function.
+	Attempts int
+	// Duration is the total time, from the first call, after which no more
+	// calls are started. RetryBudget gives up rather than wait past it.
+	Duration time.Duration
+	// OnRetry, if not nil, is called after each failed call that is going to
+	// be retried, with the number of calls so far, the error, and the wait
+	// before the next call. If it returns false, RetryBudget gives up
+	// instead, e.g. because the error is one that retrying can't fix.
+	OnRetry func(attempt int, err error, next time.Duration) bool
+	// Context, if not nil, ends the retrying when it is done. A wait for the
+	// next call is cut short, and RetryBudget gives up.
+	Context context.Context
+}
+
+// RetryBudget is like Retry, but waits between attempts according to the
+// strategy, and gives up when the budget is spent or its context is done,
+// returning the last error. If neither limit of the budget is set and it has no
+// context, it never gives up, and so always returns nil.
+func RetryBudget(f func() error, initialBackoff, maxBackoff time.Duration, strategy Strategy, budget Budget, label string) error {
+	start := time.Now()
+	ceiling := initialBackoff
+	for n := 1; ; n++ {
+		rt, err := timeOf(label, f)
+		if err == nil {
+			return nil
+		}
+		if budget.Context != nil && budget.Context.Err() != nil {
+			ratelog.Printf("Call to %s failed (error: %q) after running for %s, giving up because it was canceled", label, err, rt)
+			pusherRetriesExhausted.WithLabelValues(label).Inc()
+			return err
+		}
+		if budget.Attempts > 0 && n >= budget.Attempts {
+			ratelog.Printf("Call to %s failed (error: %q) after running for %s, giving up after %d attempts", label, err, rt, n)
+			pusherRetriesExhausted.WithLabelValues(label).Inc()
+			return err
+		}
+		if ceiling > maxBackoff {
 			pusherMaxRetries.WithLabelValues(label).Inc()
-			ns := maxBackoff.Nanoseconds()
-			waitTime = time.Duration((ns/2)+rand.Int63n(ns/2)) * time.Nanosecond
+			if strategy == FullJitter {
+				ceiling = maxBackoff
+			} else {
+				ns := maxBackoff.Nanoseconds()
+				ceiling = time.Duration((ns/2)+rand.Int63n(ns/2)) * time.Nanosecond
+			}
+		}
+		waitTime := ceiling
+		if strategy == FullJitter && ceiling > 0 {
+			waitTime = time.Duration(rand.Int63n(int64(ceiling)))
 		}
-		log.Printf("Call to %s failed (error: %q) after running for %s, will retry after %s", label, err, rt, waitTime.String())
+		if budget.Duration > 0 && time.Since(start)+waitTime >= budget.Duration {
+			ratelog.Printf("Call to %s failed (error: %q) after running for %s, giving up after %s", label, err, rt, time.Since(start))
+			pusherRetriesExhausted.WithLabelValues(label).Inc()
+			return err
+		}
+		if budget.OnRetry != nil && !budget.OnRetry(n, err, waitTime) {
+			ratelog.Printf("Call to %s failed (error: %q) after running for %s, giving up at the caller's request", label, err, rt)
+			pusherRetriesExhausted.WithLabelValues(label).Inc()
+			return err
+		}
+		ratelog.Printf("Call to %s failed (error: %q) after running for %s, will retry after %s", label, err, rt, waitTime)
 		pusherRetries.WithLabelValues(label).Inc()
-		time.Sleep(waitTime)
-		waitTime *= 2
+		if !wait(budget.Context, waitTime) {
+			ratelog.Printf("Call to %s failed (error: %q), giving up because it was canceled", label, err)
+			pusherRetriesExhausted.WithLabelValues(label).Inc()
+			return err
+		}
+		ceiling *= 2
+	}
+}
+
+// wait sleeps for the duration, and returns true, unless the context is done
+// first, in which case it returns false. A nil context is never done.
+func wait(ctx context.Context, d time.Duration) bool {
+	if ctx == nil {
+		time.Sleep(d)
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
 	}
 }
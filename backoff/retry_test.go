@@ -1,7 +1,9 @@
 package backoff_test
 
 import (
+	"context"
 	"fmt"
+	"reflect"
 	"testing"
 	"time"
 
@@ -26,3 +28,159 @@ func TestRetry(t *testing.T) {
 		t.Errorf("Retried %d times instead of 5", count)
 	}
 }
+
+func TestRetryN(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		attempts int
+		calls    int
+		wantErr  bool
+	}{
+		{name: "succeeds first time", failures: 0, attempts: 3, calls: 1},
+		{name: "succeeds on last attempt", failures: 2, attempts: 3, calls: 3},
+		{name: "gives up", failures: 5, attempts: 3, calls: 3, wantErr: true},
+		{name: "no limit", failures: 5, attempts: 0, calls: 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := backoff.RetryN(
+				func() error {
+					calls++
+					if calls <= tt.failures {
+						return fmt.Errorf("failure %d", calls)
+					}
+					return nil
+				},
+				time.Millisecond,
+				10*time.Millisecond,
+				tt.attempts,
+				"test",
+			)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("RetryN() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if calls != tt.calls {
+				t.Errorf("Called %d times instead of %d", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestRetryBudgetDuration(t *testing.T) {
+	calls := 0
+	start := time.Now()
+	err := backoff.RetryBudget(
+		func() error {
+			calls++
+			return fmt.Errorf("failure %d", calls)
+		},
+		10*time.Millisecond,
+		time.Second,
+		backoff.Capped,
+		backoff.Budget{Duration: 100 * time.Millisecond},
+		"test",
+	)
+	if err == nil {
+		t.Error("RetryBudget should have given up")
+	}
+	// Waits of 10, 20 and 40ms fit in the budget, but a wait of 80ms more
+	// does not. A slow machine may fit fewer.
+	if calls < 2 || calls > 4 {
+		t.Errorf("Called %d times instead of 4", calls)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("RetryBudget took %s, longer than its budget", d)
+	}
+}
+
+func TestRetryBudgetFullJitter(t *testing.T) {
+	calls := 0
+	start := time.Now()
+	err := backoff.RetryBudget(
+		func() error {
+			calls++
+			if calls < 10 {
+				return fmt.Errorf("failure %d", calls)
+			}
+			return nil
+		},
+		time.Millisecond,
+		4*time.Millisecond,
+		backoff.FullJitter,
+		backoff.Budget{},
+		"test",
+	)
+	if err != nil || calls != 10 {
+		t.Errorf("RetryBudget returned %v after %d calls instead of succeeding after 10", err, calls)
+	}
+	// Nine waits, none of them as long as the 4ms max.
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("RetryBudget waited %s, far longer than the max backoff allows", d)
+	}
+}
+
+func TestRetryBudgetOnRetry(t *testing.T) {
+	calls := 0
+	var attempts []int
+	var waits []time.Duration
+	err := backoff.RetryBudget(
+		func() error {
+			calls++
+			return fmt.Errorf("failure %d", calls)
+		},
+		time.Millisecond,
+		time.Second,
+		backoff.Capped,
+		backoff.Budget{OnRetry: func(attempt int, err error, next time.Duration) bool {
+			if err == nil {
+				t.Error("OnRetry should get the error")
+			}
+			attempts = append(attempts, attempt)
+			waits = append(waits, next)
+			return attempt < 3
+		}},
+		"test",
+	)
+	if err == nil || calls != 3 {
+		t.Errorf("RetryBudget returned %v after %d calls instead of giving up after 3", err, calls)
+	}
+	if !reflect.DeepEqual(attempts, []int{1, 2, 3}) {
+		t.Errorf("OnRetry got attempts %v", attempts)
+	}
+	if !reflect.DeepEqual(waits, []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond}) {
+		t.Errorf("OnRetry got waits %v", waits)
+	}
+}
+
+func TestRetryBudgetContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	start := time.Now()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	err := backoff.RetryBudget(
+		func() error {
+			calls++
+			return fmt.Errorf("failure %d", calls)
+		},
+		10*time.Millisecond,
+		time.Hour,
+		backoff.Capped,
+		backoff.Budget{Context: ctx},
+		"test",
+	)
+	if err == nil {
+		t.Error("RetryBudget should have given up when the context was canceled")
+	}
+	// Waits of 10, 20 and 40ms, the last of which is cut short.
+	if calls < 2 || calls > 4 {
+		t.Errorf("Called %d times instead of 3", calls)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("RetryBudget took %s to notice that it was canceled", d)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/m-lab/go/bytecount"
+	"github.com/m-lab/go/memoryless"
+
+	"github.com/m-lab/pusher/filename"
+	"github.com/m-lab/pusher/pipeline"
+	"github.com/m-lab/pusher/uploader"
+)
+
+// benchConfig describes the synthetic load that `pusher bench` generates.
+type benchConfig struct {
+	Files         int
+	FileSize      bytecount.ByteCount
+	Rate          float64
+	Subdirs       int
+	RandomData    bool
+	SizeThreshold bytecount.ByteCount
+	ArchiveWait   time.Duration
+	UploadLatency time.Duration
+	Timeout       time.Duration
+}
+
+// benchResult is what `pusher bench` measured.
+type benchResult struct {
+	Files         int
+	Bytes         int64
+	Tarfiles      int
+	UploadedBytes int64
+	Elapsed       time.Duration
+	MaxHeap       uint64
+	TotalAlloc    uint64
+	// Latencies holds, for every file, the time from when it was written to
+	// when the tarfile containing it was uploaded, in increasing order.
+	Latencies []time.Duration
+}
+
+// percentile returns the latency which p percent of files did not exceed.
+func (r *benchResult) percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(r.Latencies))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(r.Latencies) {
+		i = len(r.Latencies) - 1
+	}
+	return r.Latencies[i]
+}
+
+// report writes a human-readable summary of the result.
+func (r *benchResult) report(w io.Writer) {
+	seconds := r.Elapsed.Seconds()
+	ratio := 0.0
+	if r.UploadedBytes > 0 {
+		ratio = float64(r.Bytes) / float64(r.UploadedBytes)
+	}
+	fmt.Fprintf(w, "files uploaded:     %d in %d tarfiles\n", r.Files, r.Tarfiles)
+	fmt.Fprintf(w, "bytes:              %d written, %d uploaded (compression ratio %.2f)\n", r.Bytes, r.UploadedBytes, ratio)
+	fmt.Fprintf(w, "elapsed:            %s\n", r.Elapsed)
+	fmt.Fprintf(w, "throughput:         %.1f files/s, %.2f MB/s\n", float64(r.Files)/seconds, float64(r.Bytes)/seconds/1e6)
+	fmt.Fprintf(w, "memory:             %.1f MB max heap, %.1f MB allocated\n", float64(r.MaxHeap)/1e6, float64(r.TotalAlloc)/1e6)
+	fmt.Fprintf(w, "latency p50/p90/p99/max: %s / %s / %s / %s\n",
+		r.percentile(50), r.percentile(90), r.percentile(99), r.percentile(100))
+}
+
+// benchUploader is a fake uploader which records when each file was uploaded.
+type benchUploader struct {
+	latency time.Duration
+
+	mu       sync.Mutex
+	uploaded map[string]time.Time
+	tarfiles int
+	bytes    int64
+	errors   int
+}
+
+func (b *benchUploader) Upload(_ context.Context, _ uploader.ID, _ filename.System, contents []byte, _ map[string]string) (uploader.Result, error) {
+	start := time.Now()
+	time.Sleep(b.latency)
+	now := time.Now()
+	names, err := tarfileNames(contents)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		// The tarfile is broken, so it is accepted but its files are never
+		// counted as uploaded, and the benchmark fails.
+		b.errors++
+		return uploader.Result{}, nil
+	}
+	b.tarfiles++
+	b.bytes += int64(len(contents))
+	for _, name := range names {
+		if _, ok := b.uploaded[name]; !ok {
+			b.uploaded[name] = now
+		}
+	}
+	return uploader.Result{Size: int64(len(contents)), Duration: now.Sub(start)}, nil
+}
+
+// count returns the number of files uploaded so far.
+func (b *benchUploader) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.uploaded)
+}
+
+// tarfileNames returns the names of the regular files in a gzipped tarfile.
+func tarfileNames(contents []byte) ([]string, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(contents))
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	names := []string{}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.Typeflag == tar.TypeReg {
+			names = append(names, h.Name)
+		}
+	}
+}
+
+// bench writes synthetic files into a temporary spool directory, runs a
+// pipeline on it with a fake uploader, and measures how long files take to be
+// uploaded and how much memory that takes.
+func bench(ctx context.Context, config benchConfig) (*benchResult, error) {
+	if config.Files <= 0 || config.Subdirs <= 0 {
+		return nil, errors.New("the number of files and of subdirectories must be positive")
+	}
+	spool, err := ioutil.TempDir("", "pusher-bench")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(spool)
+
+	// Each subdirectory is a different day, as experiments write them.
+	today := time.Now().UTC()
+	subdirs := make([]string, config.Subdirs)
+	for i := range subdirs {
+		subdirs[i] = today.AddDate(0, 0, -i).Format("2006/01/02")
+		if err := os.MkdirAll(path.Join(spool, subdirs[i]), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	up := &benchUploader{latency: config.UploadLatency, uploaded: make(map[string]time.Time)}
+	p, err := pipeline.New(pipeline.Config{
+		Directory:     filename.System(spool),
+		Datatype:      "bench",
+		Ratio:         1,
+		SizeThreshold: config.SizeThreshold,
+		AgeThreshold:  memoryless.Config{Min: config.ArchiveWait, Expected: config.ArchiveWait, Max: config.ArchiveWait},
+		// Every file is found by the listener, so the finder never has
+		// anything to do.
+		MaxFileAge:      time.Hour,
+		CleanupInterval: memoryless.Config{Expected: time.Hour, Max: time.Hour},
+		Uploader:        up,
+	})
+	if err != nil {
+		return nil, err
+	}
+	pipelineDone := make(chan struct{})
+	go func() {
+		p.Run(ctx, ctx)
+		close(pipelineDone)
+	}()
+
+	// Sample the heap while the pipeline runs.
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	var maxHeap uint64
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var m runtime.MemStats
+		for {
+			runtime.ReadMemStats(&m)
+			if m.HeapAlloc > maxHeap {
+				maxHeap = m.HeapAlloc
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+
+	written := make(map[string]time.Time, config.Files)
+	data := make([]byte, config.FileSize)
+	var interval time.Duration
+	if config.Rate > 0 {
+		interval = time.Duration(float64(time.Second) / config.Rate)
+	}
+	start := time.Now()
+	for i := 0; i < config.Files; i++ {
+		if config.RandomData {
+			rand.Read(data)
+		}
+		name := path.Join(subdirs[i%len(subdirs)], fmt.Sprintf("bench-%08d.data", i))
+		if err := ioutil.WriteFile(path.Join(spool, name), data, 0644); err != nil {
+			return nil, err
+		}
+		written[name] = time.Now()
+		if interval > 0 {
+			time.Sleep(time.Until(start.Add(time.Duration(i+1) * interval)))
+		}
+	}
+
+	deadline := time.Now().Add(config.Timeout)
+	for up.count() < config.Files && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-pipelineDone
+	<-sampled
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if up.errors > 0 {
+		return nil, fmt.Errorf("%d tarfiles could not be read", up.errors)
+	}
+	result := &benchResult{
+		Tarfiles:      up.tarfiles,
+		UploadedBytes: up.bytes,
+		MaxHeap:       maxHeap - before.HeapAlloc,
+		TotalAlloc:    after.TotalAlloc - before.TotalAlloc,
+	}
+	if maxHeap < before.HeapAlloc {
+		result.MaxHeap = 0
+	}
+	var last time.Time
+	for name, w := range written {
+		u, ok := up.uploaded[name]
+		if !ok {
+			continue
+		}
+		result.Files++
+		result.Bytes += int64(config.FileSize)
+		result.Latencies = append(result.Latencies, u.Sub(w))
+		if u.After(last) {
+			last = u
+		}
+	}
+	sort.Slice(result.Latencies, func(i, j int) bool { return result.Latencies[i] < result.Latencies[j] })
+	result.Elapsed = last.Sub(start)
+	if result.Files < config.Files {
+		return result, fmt.Errorf("only %d of %d files were uploaded within %s", result.Files, config.Files, config.Timeout)
+	}
+	return result, nil
+}
+
+// benchMain runs `pusher bench` with the given arguments, which follow the
+// word "bench" on the command line.
+func benchMain(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.SetOutput(out)
+	config := benchConfig{
+		FileSize:      10 * bytecount.Kilobyte,
+		SizeThreshold: 20 * bytecount.Megabyte,
+	}
+	fs.IntVar(&config.Files, "files", 10000, "The number of files to write.")
+	fs.Var(&config.FileSize, "file_size", "The size of each file.")
+	fs.Float64Var(&config.Rate, "rate", 0, "The number of files to write per second. Zero writes them as fast as possible.")
+	fs.IntVar(&config.Subdirs, "subdirs", 1, "The number of date subdirectories to spread the files across, and so the number of tarfiles being filled at once.")
+	fs.BoolVar(&config.RandomData, "random_data", false, "Fill the files with random, incompressible data instead of zeros.")
+	fs.Var(&config.SizeThreshold, "archive_size_threshold", "The size at which a tarfile is uploaded.")
+	fs.DurationVar(&config.ArchiveWait, "archive_wait_time", time.Second, "How long a tarfile waits before it is uploaded, if it does not reach the size threshold.")
+	fs.DurationVar(&config.UploadLatency, "upload_latency", 0, "How long each fake upload takes.")
+	fs.DurationVar(&config.Timeout, "timeout", 5*time.Minute, "How long to wait for all the files to be uploaded.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s bench:\n", os.Args[0])
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), `
+Writes synthetic files into a temporary spool directory and runs the pusher
+pipeline on it, with an uploader that only records what it is given. It
+reports the throughput, the memory used, and the percentiles of the time from
+writing a file to uploading it.
+`)
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	result, err := bench(ctx, config)
+	if result != nil {
+		result.report(out)
+	}
+	return err
+}
@@ -0,0 +1,28 @@
+// Package bytesize formats byte totals for people to read, in logs and status
+// reports, with the same decimal units as the size flags (see
+// github.com/m-lab/go/bytecount).
+package bytesize
+
+import (
+	"fmt"
+	"strings"
+)
+
+var units = []string{"B", "KB", "MB", "GB", "TB", "PB", "EB"}
+
+// Format returns n bytes in the largest unit of which there is at least one,
+// to one decimal place, e.g. "512B", "20MB" or "1.5GB". Negative totals are
+// returned as they are, e.g. "-512B".
+func Format(n int64) string {
+	if n < 1000 {
+		return fmt.Sprintf("%dB", n)
+	}
+	size := float64(n)
+	unit := 0
+	// Sizes which would round up to 1000 of a unit are given in the next.
+	for size >= 999.95 && unit < len(units)-1 {
+		size /= 1000
+		unit++
+	}
+	return strings.TrimSuffix(fmt.Sprintf("%.1f", size), ".0") + units[unit]
+}
@@ -0,0 +1,33 @@
+package bytesize_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/m-lab/pusher/bytesize"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0B"},
+		{512, "512B"},
+		{999, "999B"},
+		{1000, "1KB"},
+		{1500, "1.5KB"},
+		{999949, "999.9KB"},
+		{999950, "1MB"},
+		{20000000, "20MB"},
+		{1234567890, "1.2GB"},
+		{5 * 1000 * 1000 * 1000 * 1000, "5TB"},
+		{math.MaxInt64, "9.2EB"},
+		{-512, "-512B"},
+	}
+	for _, tt := range tests {
+		if got := bytesize.Format(tt.n); got != tt.want {
+			t.Errorf("Format(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
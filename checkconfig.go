@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/m-lab/go/flagx"
+	"github.com/m-lab/go/memoryless"
+
+	"github.com/m-lab/pusher/control"
+	"github.com/m-lab/pusher/filename"
+	"github.com/m-lab/pusher/tarcache"
+	"github.com/m-lab/pusher/tarfile"
+)
+
+// A configCheck is the result of one check of the configuration.
+type configCheck struct {
+	Check string `json:"check"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// A configReport is what check-config prints.
+type configReport struct {
+	OK     bool          `json:"ok"`
+	Checks []configCheck `json:"checks"`
+}
+
+// add records the result of a check.
+func (r *configReport) add(check string, err error) {
+	c := configCheck{Check: check, OK: err == nil}
+	if err != nil {
+		c.Error = err.Error()
+		r.OK = false
+	}
+	r.Checks = append(r.Checks, c)
+}
+
+// checkConfig checks the configuration given by pusher's flags, as main would
+// use it, without starting anything. The buckets are only checked, which
+// takes credentials which can read their metadata, if checkBuckets is set.
+func checkConfig(ctx context.Context, checkBuckets bool) *configReport {
+	r := &configReport{OK: true}
+	if *nodeName == "" {
+		_, err := mlabNameToNodeName(*mlabNodeName)
+		r.add("node name", err)
+	}
+	tenants := []tenant{{
+		Experiment: *experiment,
+		NodeName:   *nodeName,
+		Directory:  *directory,
+		Buckets:    buckets,
+		Datatypes:  datatypes.Get(),
+	}}
+	if len(buckets) == 0 {
+		tenants[0].Buckets = []string{"pusher-mlab-sandbox"}
+	}
+	if *experimentsFile != "" {
+		var err error
+		tenants, err = loadTenants(*experimentsFile, tenants[0])
+		r.add("experiments file", err)
+	}
+	validateConfig(tenants, r)
+	for _, tn := range tenants {
+		for datatype := range tn.Datatypes {
+			id := datatypeID(tn, datatype, *experimentsFile != "")
+			r.add("directory of "+id, checkDatatypeDir(path.Join(tn.Directory, datatype)))
+		}
+	}
+
+	if checkBuckets {
+		opts, err := storageOptions(ctx, *credentialsFile, *impersonateSA, nil)
+		var client *storage.Client
+		if err == nil {
+			client, err = storage.NewClient(ctx, opts...)
+		}
+		r.add("GCS credentials", err)
+		if client != nil {
+			defer client.Close()
+			for _, bucket := range configBuckets(tenants) {
+				_, err := client.Bucket(bucket).Attrs(ctx)
+				r.add("bucket "+bucket, err)
+			}
+		}
+	}
+	return r
+}
+
+// validConfig is what validateConfig parses out of the flags for main to use.
+type validConfig struct {
+	owner        *tarfile.Owner
+	runAs        *tarfile.Owner
+	dirMode      os.FileMode
+	dirOwner     *tarfile.Owner
+	schedule     tarcache.Schedule
+	depthAges    map[int]time.Duration
+	subdirDepths map[string]int
+	controlTLS   *tls.Config
+}
+
+// validateConfig checks the configuration given by pusher's flags and the
+// tenants, adds the result of each check to the report, and returns what it
+// parsed. main and check-config both call it, so that check-config passes
+// exactly the configurations main accepts, apart from what only exists when
+// pusher runs, like its directories and buckets.
+func validateConfig(tenants []tenant, r *configReport) validConfig {
+	var v validConfig
+	r.add("experiments", checkTenants(tenants))
+	for _, tn := range tenants {
+		for datatype, value := range tn.Datatypes {
+			id := datatypeID(tn, datatype, *experimentsFile != "")
+			ratio, err := strconv.ParseFloat(value, 64)
+			if err == nil && (ratio < 0 || ratio > 1) {
+				err = fmt.Errorf("ratio %v is not between 0 and 1", ratio)
+			}
+			r.add("upload ratio of "+id, err)
+			if rule, ok := datatypeValue(renames.Get(), tn.Experiment, datatype); ok {
+				_, err := filename.NewRewriter(rule)
+				r.add("rewrite rule of "+id, err)
+			}
+		}
+	}
+	for _, f := range []struct {
+		flag string
+		keys []string
+	}{
+		{"archive_rename", mapKeys(renames.Get())},
+		{"datatype_bucket", mapKeys(dtBuckets.Get())},
+		{"datatype_prefix", mapKeys(dtPrefixes.Get())},
+		{"subdir_depth", mapKeys(subdirDepths.Get())},
+		{"priority_datatype", priorityDTs},
+		{"archive_uncompressed_datatype", uncompressedDTs},
+	} {
+		r.add("--"+f.flag, checkDatatypeKeys(tenants, f.keys))
+	}
+	var err error
+	v.subdirDepths, err = parseSubdirDepths(subdirDepths.Get())
+	r.add("--subdir_depth", err)
+
+	if sizeThreshold <= 0 {
+		r.add("archive size threshold", errors.New("it must be positive"))
+	} else {
+		r.add("archive size threshold", nil)
+	}
+	r.add("archive wait times", memoryless.Config{Min: *ageMin, Expected: *ageExpected, Max: *ageMax}.Check())
+	r.add("cleanup interval", memoryless.Config{Expected: *cleanupInterval, Max: *cleanupMax}.Check())
+	if *clockStep > 0 && *clockStep <= clockCheckInterval {
+		r.add("--clock_step_threshold", fmt.Errorf("it must be zero or more than %s", clockCheckInterval))
+	} else {
+		r.add("--clock_step_threshold", nil)
+	}
+	v.depthAges, err = parseDepthAges(depthFileAges.Get())
+	r.add("--max_file_age_by_depth", err)
+	for _, owner := range []struct {
+		flag   string
+		value  string
+		parsed **tarfile.Owner
+	}{
+		{"archive_owner", *archiveOwner, &v.owner},
+		{"run_as", *runAs, &v.runAs},
+		{"create_dirs_owner", *createDirsOwner, &v.dirOwner},
+	} {
+		*owner.parsed, err = parseOwner(owner.value)
+		r.add("--"+owner.flag, err)
+	}
+	if v.runAs != nil && *dirCheck > 0 {
+		r.add("--run_as", errors.New("it can't be combined with --directory_check_interval, whose restarts would watch the directories as the --run_as user; set that to 0"))
+	}
+	mode, err := strconv.ParseUint(*createDirsMode, 8, 32)
+	r.add("--create_dirs_mode", err)
+	v.dirMode = os.FileMode(mode)
+	v.schedule, err = parseSchedule(uploadWindows, uploadBlackouts, *uploadTimezone)
+	r.add("upload schedule", err)
+	r.add("--upload_boundary", tarcache.CheckBoundary(*uploadBoundary))
+	r.add("metadata templates", tarcache.CheckMetadata(metadata.Get()))
+	if *controlAddress != "" {
+		v.controlTLS, err = control.ServerTLS(*controlCert, *controlKey, *controlCA)
+		r.add("control TLS files", err)
+	}
+	return v
+}
+
+// checkDatatypeKeys checks that each key of a per-datatype flag names a
+// configured datatype, either as experiment/datatype or by the datatype alone.
+func checkDatatypeKeys(tenants []tenant, keys []string) error {
+	known := make(map[string]bool)
+	for _, tn := range tenants {
+		for datatype := range tn.Datatypes {
+			known[datatype] = true
+			known[qualifiedDatatype(tn.Experiment, datatype)] = true
+		}
+	}
+	for _, key := range keys {
+		if !known[key] {
+			return fmt.Errorf("%q is not a configured datatype", key)
+		}
+	}
+	return nil
+}
+
+// mapKeys returns the keys of the map, sorted.
+func mapKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// checkDatatypeDir checks that the directory of a datatype can be archived by
+// whoever runs the check, or that it will be created.
+func checkDatatypeDir(dir string) error {
+	info, err := os.Stat(dir)
+	switch {
+	case os.IsNotExist(err) && *createDirs:
+		return nil
+	case err != nil:
+		return err
+	case !info.IsDir():
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return checkAccess(dir)
+}
+
+// configBuckets returns every bucket the configuration uploads to, once each.
+func configBuckets(tenants []tenant) []string {
+	var all []string
+	seen := make(map[string]bool)
+	add := func(bucket string) {
+		if bucket != "" && !seen[bucket] {
+			seen[bucket] = true
+			all = append(all, bucket)
+		}
+	}
+	for _, tn := range tenants {
+		for _, bucket := range tn.Buckets {
+			add(bucket)
+		}
+	}
+	for _, bucket := range dtBuckets.Get() {
+		add(bucket)
+	}
+	add(*replicaBucket)
+	return all
+}
+
+// checkConfigMain is the check-config subcommand. It takes pusher's own flags,
+// and the environment variables, just as pusher does, checks the configuration
+// they make, and prints a JSON report of each check. It returns an error if
+// any check failed.
+func checkConfigMain(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	fs.SetOutput(out)
+	// The flags share their values with pusher's own.
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	checkBuckets := fs.Bool("check_buckets", false, "Also check that every bucket exists and that the GCS credentials can read its metadata, which takes the storage.buckets.get permission.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s check-config: %s check-config [-check_buckets] [pusher's flags]\n", os.Args[0], os.Args[0])
+		fmt.Fprintf(fs.Output(), `
+Checks the configuration given by pusher's flags and environment variables,
+and the --experiments_file, if any, without starting pusher: the names of the
+experiments and datatypes, the per-datatype flags, the thresholds, owners and
+schedule, the TLS files of the control service, and that the datatype
+directories can be archived by the user running the check. pusher makes the
+same checks, but for the directories, as it starts. Prints a JSON report, and
+exits with a nonzero status if any check failed.
+`)
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := flagx.ArgsFromEnv(fs); err != nil {
+		return err
+	}
+	report := checkConfig(ctx, *checkBuckets)
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	if !report.OK {
+		return errors.New("the configuration has problems")
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+// Package clock notices when the wall clock is stepped, as NTP does on edge
+// hardware whose clock has drifted by hours, and corrects the ages of files
+// for it. Without the correction, a forward step makes every file written
+// before it look old enough to upload at once, and a backward step leaves the
+// files written before it "in the future", where they never get old enough.
+//
+// Timers are not affected, because Go measures them with the monotonic clock.
+package clock
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/pusher/metrics"
+)
+
+var collectors metrics.Collectors
+
+// RegisterMetrics registers the metrics of the clock steps on r, or on
+// prometheus.DefaultRegisterer if r is nil.
+func RegisterMetrics(r prometheus.Registerer) {
+	collectors.Register(r)
+}
+
+var (
+	pusherClockSteps = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_clock_steps_total",
+			Help: "The number of times the wall clock was seen to step forward or backward by more than --clock_step_threshold",
+		},
+		[]string{"direction"})
+	pusherClockLastStep = collectors.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pusher_clock_last_step_seconds",
+			Help: "How far the wall clock last stepped, negative if it went backward, or zero if it has not stepped",
+		})
+)
+
+// maxSteps is how many steps are remembered. The ages of files written before
+// older steps are not corrected for them.
+const maxSteps = 16
+
+// A Step is a change of the wall clock that did not happen on the monotonic
+// clock.
+type Step struct {
+	// At is the time, by the wall clock from before the step, when the step
+	// was seen. Files written before the step have earlier mtimes.
+	At time.Time
+	// Size is how far the clock moved, negative if it went backward.
+	Size time.Duration
+}
+
+// watcher remembers the steps of the clock.
+type watcher struct {
+	mu    sync.Mutex
+	steps []Step
+	// The wall time and monotonic reading of the last check.
+	wall time.Time
+	mono time.Duration
+}
+
+// observe compares the wall time and monotonic reading with those of the last
+// check, and records a step if they differ by at least the threshold.
+func (w *watcher) observe(wall time.Time, mono time.Duration, threshold time.Duration) (Step, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	last, lastMono := w.wall, w.mono
+	w.wall, w.mono = wall, mono
+	if last.IsZero() {
+		return Step{}, false
+	}
+	expected := last.Add(mono - lastMono)
+	size := wall.Sub(expected)
+	if size < threshold && size > -threshold {
+		return Step{}, false
+	}
+	s := Step{At: expected, Size: size}
+	w.steps = append(w.steps, s)
+	if len(w.steps) > maxSteps {
+		w.steps = w.steps[len(w.steps)-maxSteps:]
+	}
+	return s, true
+}
+
+// age returns the age at now of a file with the given mtime, corrected for the
+// steps. A file written before a step has an mtime by the clock from before
+// it, which is off by the size of the step. Files with mtimes before a
+// forward step were surely written before it. After a backward step, only
+// files with mtimes still in the future surely were, so the others keep their
+// uncorrected ages, which are too small rather than too big.
+func (w *watcher) age(mtime, now time.Time) time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	age := now.Sub(mtime)
+	for _, s := range w.steps {
+		if mtime.Before(s.At) && (s.Size > 0 || mtime.After(now)) {
+			age -= s.Size
+		}
+	}
+	return age
+}
+
+// std is the watcher of the process's clock.
+var std = &watcher{}
+
+// Watch checks the wall clock against the monotonic clock every interval until
+// the context is done. Each step of at least the threshold is logged, counted
+// and remembered, so that Age can correct for it. The threshold should be more
+// than the interval, so that files written just after a forward step are not
+// mistaken for files written before it.
+func Watch(ctx context.Context, interval, threshold time.Duration) {
+	start := time.Now()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		if s, ok := std.observe(now.Round(0), now.Sub(start), threshold); ok {
+			direction := "forward"
+			if s.Size < 0 {
+				direction = "backward"
+			}
+			log.Printf("The wall clock stepped %s by %s at %s. File ages are corrected for it.\n", direction, s.Size, s.At.UTC().Format(time.RFC3339))
+			pusherClockSteps.WithLabelValues(direction).Inc()
+			pusherClockLastStep.Set(s.Size.Seconds())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Age returns the age at now of a file with the given mtime, corrected for the
+// steps of the clock seen by Watch. Without Watch, it is now.Sub(mtime).
+func Age(mtime, now time.Time) time.Duration {
+	return std.age(mtime, now)
+}
@@ -0,0 +1,82 @@
+package clock
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestObserve(t *testing.T) {
+	w := &watcher{}
+	start := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	if _, ok := w.observe(start, 0, time.Minute); ok {
+		t.Error("The first check can't see a step")
+	}
+	// Small differences are ignored.
+	if _, ok := w.observe(start.Add(10*time.Second+time.Millisecond), 10*time.Second, time.Minute); ok {
+		t.Error("A millisecond is not a step")
+	}
+	s, ok := w.observe(start.Add(3*time.Hour+20*time.Second), 20*time.Second, time.Minute)
+	if !ok || s.Size != 3*time.Hour-time.Millisecond || !s.At.Equal(start.Add(20*time.Second+time.Millisecond)) {
+		t.Errorf("observe() = %+v, %v, want a forward step of 3h", s, ok)
+	}
+	s, ok = w.observe(start.Add(30*time.Second), 30*time.Second, time.Minute)
+	if !ok || s.Size >= -time.Hour {
+		t.Errorf("observe() = %+v, %v, want a backward step", s, ok)
+	}
+	if len(w.steps) != 2 {
+		t.Errorf("Remembered %d steps instead of 2", len(w.steps))
+	}
+}
+
+func TestAge(t *testing.T) {
+	maxAge := time.Hour
+	step := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	// The clock jumps forward by 3h at 12:00, to 15:00.
+	forward := &watcher{steps: []Step{{At: step, Size: 3 * time.Hour}}}
+	now := step.Add(3*time.Hour + time.Minute)
+	for _, tt := range []struct {
+		mtime time.Time
+		want  time.Duration
+	}{
+		// Written just before the step: a minute and a bit old, not 3h.
+		{step.Add(-time.Second), time.Minute + time.Second},
+		// Written before the step, long enough ago to be old anyway.
+		{step.Add(-2 * time.Hour), 2*time.Hour + time.Minute},
+		// Written after the step.
+		{step.Add(3*time.Hour + 30*time.Second), 30 * time.Second},
+	} {
+		if got := forward.age(tt.mtime, now); got != tt.want {
+			t.Errorf("After a forward step, age(%s) = %s, want %s", tt.mtime, got, tt.want)
+		}
+	}
+
+	// The clock jumps backward by 3h at 12:00, to 09:00.
+	backward := &watcher{steps: []Step{{At: step, Size: -3 * time.Hour}}}
+	now = step.Add(-3*time.Hour + time.Minute)
+	// Written just before the step, so in the future now, and an hour old by
+	// the time the clock gets back to 10:00.
+	if got := backward.age(step.Add(-time.Second), step.Add(-2*time.Hour)); got < maxAge {
+		t.Errorf("After a backward step, a file from the future is %s old, want at least %s", got, maxAge)
+	}
+	// Written after the step.
+	if got := backward.age(now.Add(-30*time.Second), now); got != 30*time.Second {
+		t.Errorf("After a backward step, a new file is %s old, want 30s", got)
+	}
+
+	// Without steps, the age is uncorrected.
+	if got := (&watcher{}).age(step, step.Add(time.Hour)); got != time.Hour {
+		t.Errorf("age() = %s without steps, want 1h", got)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	// The clock doesn't step during the test, so Watch just returns.
+	Watch(ctx, 10*time.Millisecond, time.Minute)
+	if got := Age(time.Now().Add(-time.Hour), time.Now()); got < time.Hour || got > time.Hour+time.Second {
+		t.Errorf("Age() = %s without steps, want 1h", got)
+	}
+}
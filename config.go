@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/m-lab/go/flagx"
+	"github.com/m-lab/go/prometheusx"
+)
+
+// Where the value of a flag came from.
+const (
+	fromDefault     = "default"
+	fromCommandLine = "command line"
+	fromEnvironment = "environment"
+)
+
+// A configFlag is the value of a flag, with secrets redacted (see
+// loggedValue), and where it came from.
+type configFlag struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// effectiveConfig is the configuration pusher runs with, once the flags have
+// been read from the command line and the environment, and the experiments
+// from --experiments_file, if any.
+type effectiveConfig struct {
+	Version     string                `json:"version"`
+	GitCommit   string                `json:"git_commit"`
+	Hostname    string                `json:"hostname"`
+	Flags       map[string]configFlag `json:"flags"`
+	Experiments []tenant              `json:"experiments"`
+}
+
+// setFlags returns the names of the flags that have been set.
+func setFlags(fs *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// newEffectiveConfig returns the configuration of the flags and the tenants.
+// The flags set on the command line were those in commandLine, and the other
+// flags that have been set were set from the environment.
+func newEffectiveConfig(fs *flag.FlagSet, commandLine map[string]bool, redact, show flagx.StringArray, tenants []tenant) *effectiveConfig {
+	c := &effectiveConfig{
+		Version:     buildVersion(),
+		GitCommit:   prometheusx.GitShortCommit,
+		Hostname:    hostName(),
+		Flags:       make(map[string]configFlag),
+		Experiments: tenants,
+	}
+	set := setFlags(fs)
+	fs.VisitAll(func(f *flag.Flag) {
+		source := fromDefault
+		if commandLine[f.Name] {
+			source = fromCommandLine
+		} else if set[f.Name] {
+			source = fromEnvironment
+		}
+		c.Flags[f.Name] = configFlag{Value: loggedValue(f, redact, show), Source: source}
+	})
+	return c
+}
+
+// log logs the configuration as a single line of JSON.
+func (c *effectiveConfig) log() {
+	data, err := json.Marshal(c)
+	if err != nil {
+		log.Printf("Could not log the configuration (error: %q)\n", err)
+		return
+	}
+	log.Printf("Configuration: %s\n", data)
+}
+
+// ServeHTTP serves the configuration as JSON.
+func (c *effectiveConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "the configuration must be fetched with GET", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(c)
+}
@@ -0,0 +1,295 @@
+// Package control implements pusher's control service, with which fleet
+// automation can flush, pause, resume, inspect and drain pushers. The service
+// is served over gRPC (see control.proto) and its methods may also be called
+// directly, e.g. by an HTTP admin API.
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/m-lab/pusher/bytesize"
+	"github.com/m-lab/pusher/tarcache"
+	"github.com/m-lab/pusher/tarfile"
+)
+
+// ServiceName is the full name of the gRPC service.
+const ServiceName = "pusher.control.v1.Control"
+
+// A Pipeline is the part of a pipeline.Pipeline the service controls.
+type Pipeline interface {
+	Flush()
+	Pause()
+	Resume()
+	Paused() bool
+	Snapshot() []tarcache.TarfileState
+}
+
+// Service controls the pipelines of a pusher.
+type Service struct {
+	pipelines map[string]Pipeline
+	drain     func()
+	once      sync.Once
+	mu        sync.Mutex
+	draining  bool
+}
+
+// NewService returns a service which controls the pipelines, keyed by their
+// datatypes. Drain calls drain, once.
+func NewService(pipelines map[string]Pipeline, drain func()) *Service {
+	return &Service{pipelines: pipelines, drain: drain}
+}
+
+// each calls f for the pipeline of the datatype, or for every pipeline if the
+// datatype is empty.
+func (s *Service) each(datatype string, f func(Pipeline)) error {
+	if datatype == "" {
+		for _, p := range s.pipelines {
+			f(p)
+		}
+		return nil
+	}
+	p, ok := s.pipelines[datatype]
+	if !ok {
+		return status.Errorf(codes.NotFound, "unknown datatype %q", datatype)
+	}
+	f(p)
+	return nil
+}
+
+// Flush uploads every tarfile of the datatype now, or of every datatype if it
+// is empty.
+func (s *Service) Flush(ctx context.Context, datatype string) error {
+	log.Printf("Flush of %q requested\n", datatype)
+	return s.each(datatype, Pipeline.Flush)
+}
+
+// Pause stops the uploads of the datatype, or of every datatype if it is
+// empty, until Resume is called.
+func (s *Service) Pause(ctx context.Context, datatype string) error {
+	log.Printf("Pause of %q requested\n", datatype)
+	return s.each(datatype, Pipeline.Pause)
+}
+
+// Resume resumes the uploads stopped by Pause.
+func (s *Service) Resume(ctx context.Context, datatype string) error {
+	log.Printf("Resumption of %q requested\n", datatype)
+	return s.each(datatype, Pipeline.Resume)
+}
+
+// Status is the state of a pusher.
+type Status struct {
+	// Draining is whether Drain has been called.
+	Draining  bool                      `json:"draining"`
+	Datatypes map[string]DatatypeStatus `json:"datatypes"`
+}
+
+// DatatypeStatus is the state of the pipeline of one datatype.
+type DatatypeStatus struct {
+	Paused bool `json:"paused"`
+	// Tarfiles, Files and Bytes describe the tarfiles waiting to be
+	// uploaded. Size is Bytes for people to read, e.g. "1.5MB".
+	Tarfiles int    `json:"tarfiles"`
+	Files    int    `json:"files"`
+	Bytes    int64  `json:"bytes"`
+	Size     string `json:"size"`
+	// OldestSeconds is the age of the oldest of them.
+	OldestSeconds float64 `json:"oldest_seconds"`
+	// SinceSuccessSeconds is the time since a tarfile was last uploaded, or
+	// since pusher started if none has been.
+	SinceSuccessSeconds float64 `json:"since_success_seconds"`
+}
+
+// Status returns the state of every pipeline.
+func (s *Service) Status(ctx context.Context) Status {
+	s.mu.Lock()
+	st := Status{Draining: s.draining, Datatypes: make(map[string]DatatypeStatus)}
+	s.mu.Unlock()
+	datatypes := make([]string, 0, len(s.pipelines))
+	for datatype := range s.pipelines {
+		datatypes = append(datatypes, datatype)
+	}
+	sort.Strings(datatypes)
+	for _, datatype := range datatypes {
+		p := s.pipelines[datatype]
+		ds := DatatypeStatus{Paused: p.Paused()}
+		for _, tf := range p.Snapshot() {
+			ds.Tarfiles++
+			ds.Files += tf.Files
+			ds.Bytes += int64(tf.Size)
+			if age := tf.Age.Seconds(); age > ds.OldestSeconds {
+				ds.OldestSeconds = age
+			}
+		}
+		ds.Size = bytesize.Format(ds.Bytes)
+		if sinceSuccess, _, ok := tarfile.UploadAges(datatype); ok {
+			ds.SinceSuccessSeconds = sinceSuccess.Seconds()
+		}
+		st.Datatypes[datatype] = ds
+	}
+	return st
+}
+
+// ReloadConfig is not implemented, because there is nothing to reload:
+// pusher's configuration comes from its flags, and the files it reads, such as
+// its credentials and proxy, are read again whenever they change.
+func (s *Service) ReloadConfig(ctx context.Context) error {
+	return status.Error(codes.Unimplemented, "pusher is configured by its flags, which can't be reloaded; restart it to change them")
+}
+
+// Drain makes pusher upload everything and exit, as it does on SIGTERM. It
+// returns at once.
+func (s *Service) Drain(ctx context.Context) error {
+	s.once.Do(func() {
+		log.Println("Drain requested")
+		s.mu.Lock()
+		s.draining = true
+		s.mu.Unlock()
+		s.drain()
+	})
+	return nil
+}
+
+// Register registers the service on the gRPC server.
+func (s *Service) Register(g *grpc.Server) {
+	g.RegisterService(&serviceDesc, s)
+}
+
+// The service is registered by hand, rather than with code generated from
+// control.proto, because its messages are all well-known types. Each handler
+// is like a generated one.
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Flush", Handler: datatypeHandler("Flush", (*Service).Flush)},
+		{MethodName: "Pause", Handler: datatypeHandler("Pause", (*Service).Pause)},
+		{MethodName: "Resume", Handler: datatypeHandler("Resume", (*Service).Resume)},
+		{MethodName: "Status", Handler: statusHandler},
+		{MethodName: "ReloadConfig", Handler: emptyHandler("ReloadConfig", (*Service).ReloadConfig)},
+		{MethodName: "Drain", Handler: emptyHandler("Drain", (*Service).Drain)},
+	},
+	Metadata: "control.proto",
+}
+
+type methodHandler = func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error)
+
+// handle decodes the request into in and calls f, through the interceptor if
+// there is one.
+func handle(srv interface{}, ctx context.Context, method string, in interface{}, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor, f func(context.Context, interface{}) (interface{}, error)) (interface{}, error) {
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return f(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + ServiceName + "/" + method}
+	return interceptor(ctx, in, info, f)
+}
+
+// datatypeHandler handles the methods which take a datatype and return nothing.
+func datatypeHandler(method string, call func(*Service, context.Context, string) error) methodHandler {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		return handle(srv, ctx, method, new(wrapperspb.StringValue), dec, interceptor, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return &emptypb.Empty{}, call(srv.(*Service), ctx, req.(*wrapperspb.StringValue).GetValue())
+		})
+	}
+}
+
+// emptyHandler handles the methods which take and return nothing.
+func emptyHandler(method string, call func(*Service, context.Context) error) methodHandler {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		return handle(srv, ctx, method, new(emptypb.Empty), dec, interceptor, func(ctx context.Context, _ interface{}) (interface{}, error) {
+			return &emptypb.Empty{}, call(srv.(*Service), ctx)
+		})
+	}
+}
+
+func statusHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	return handle(srv, ctx, "Status", new(emptypb.Empty), dec, interceptor, func(ctx context.Context, _ interface{}) (interface{}, error) {
+		return statusStruct(srv.(*Service).Status(ctx))
+	})
+}
+
+// statusStruct converts the status to a Struct, with the same fields as its
+// JSON.
+func statusStruct(st Status) (*structpb.Struct, error) {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	s, err := structpb.NewStruct(fields)
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprint("could not convert the status: ", err))
+	}
+	return s, nil
+}
+
+// Client calls the control service of a pusher.
+type Client struct {
+	conn grpc.ClientConnInterface
+}
+
+// NewClient returns a client which calls the service over the connection.
+func NewClient(conn grpc.ClientConnInterface) *Client {
+	return &Client{conn: conn}
+}
+
+func (c *Client) invoke(ctx context.Context, method string, in, out interface{}) error {
+	return c.conn.Invoke(ctx, "/"+ServiceName+"/"+method, in, out)
+}
+
+// Flush calls Service.Flush.
+func (c *Client) Flush(ctx context.Context, datatype string) error {
+	return c.invoke(ctx, "Flush", wrapperspb.String(datatype), &emptypb.Empty{})
+}
+
+// Pause calls Service.Pause.
+func (c *Client) Pause(ctx context.Context, datatype string) error {
+	return c.invoke(ctx, "Pause", wrapperspb.String(datatype), &emptypb.Empty{})
+}
+
+// Resume calls Service.Resume.
+func (c *Client) Resume(ctx context.Context, datatype string) error {
+	return c.invoke(ctx, "Resume", wrapperspb.String(datatype), &emptypb.Empty{})
+}
+
+// Status calls Service.Status.
+func (c *Client) Status(ctx context.Context) (Status, error) {
+	out := &structpb.Struct{}
+	if err := c.invoke(ctx, "Status", &emptypb.Empty{}, out); err != nil {
+		return Status{}, err
+	}
+	data, err := out.MarshalJSON()
+	if err != nil {
+		return Status{}, err
+	}
+	var st Status
+	err = json.Unmarshal(data, &st)
+	return st, err
+}
+
+// ReloadConfig calls Service.ReloadConfig.
+func (c *Client) ReloadConfig(ctx context.Context) error {
+	return c.invoke(ctx, "ReloadConfig", &emptypb.Empty{}, &emptypb.Empty{})
+}
+
+// Drain calls Service.Drain.
+func (c *Client) Drain(ctx context.Context) error {
+	return c.invoke(ctx, "Drain", &emptypb.Empty{}, &emptypb.Empty{})
+}
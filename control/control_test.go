@@ -0,0 +1,127 @@
+package control_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/pusher/control"
+	"github.com/m-lab/pusher/tarcache"
+)
+
+type fakePipeline struct {
+	mu      sync.Mutex
+	flushes int
+	paused  bool
+	tarfile []tarcache.TarfileState
+}
+
+func (f *fakePipeline) Flush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.flushes++
+}
+
+func (f *fakePipeline) Pause() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paused = true
+}
+
+func (f *fakePipeline) Resume() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paused = false
+}
+
+func (f *fakePipeline) Paused() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.paused
+}
+
+func (f *fakePipeline) Snapshot() []tarcache.TarfileState {
+	return f.tarfile
+}
+
+// dial serves the service over an in-memory connection, and returns a client
+// of it.
+func dial(t *testing.T, s *control.Service) *control.Client {
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	s.Register(server)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	rtx.Must(err, "Could not dial")
+	t.Cleanup(func() { conn.Close() })
+	return control.NewClient(conn)
+}
+
+func TestService(t *testing.T) {
+	tcpinfo := &fakePipeline{tarfile: []tarcache.TarfileState{
+		{Files: 2, Size: 100, Age: time.Minute},
+		{Files: 1, Size: 50, Age: time.Hour},
+	}}
+	ndt := &fakePipeline{}
+	drains := 0
+	s := control.NewService(map[string]control.Pipeline{"tcpinfo": tcpinfo, "ndt": ndt}, func() { drains++ })
+	c := dial(t, s)
+	ctx := context.Background()
+
+	rtx.Must(c.Flush(ctx, "tcpinfo"), "Could not flush tcpinfo")
+	if tcpinfo.flushes != 1 || ndt.flushes != 0 {
+		t.Errorf("Flush of tcpinfo flushed %d tcpinfo and %d ndt", tcpinfo.flushes, ndt.flushes)
+	}
+	rtx.Must(c.Flush(ctx, ""), "Could not flush everything")
+	if tcpinfo.flushes != 2 || ndt.flushes != 1 {
+		t.Errorf("Flush of everything flushed %d tcpinfo and %d ndt", tcpinfo.flushes, ndt.flushes)
+	}
+	if err := c.Pause(ctx, "switch"); status.Code(err) != codes.NotFound {
+		t.Errorf("Pause of an unknown datatype returned %v, not NotFound", err)
+	}
+
+	rtx.Must(c.Pause(ctx, "ndt"), "Could not pause ndt")
+	st, err := c.Status(ctx)
+	rtx.Must(err, "Could not get the status")
+	if !st.Datatypes["ndt"].Paused || st.Datatypes["tcpinfo"].Paused {
+		t.Errorf("Only ndt should be paused: %+v", st)
+	}
+	want := control.DatatypeStatus{Tarfiles: 2, Files: 3, Bytes: 150, Size: "150B", OldestSeconds: 3600}
+	if got := st.Datatypes["tcpinfo"]; got.Tarfiles != want.Tarfiles || got.Files != want.Files || got.Bytes != want.Bytes || got.Size != want.Size || got.OldestSeconds != want.OldestSeconds {
+		t.Errorf("The status of tcpinfo is %+v, not %+v", got, want)
+	}
+	rtx.Must(c.Resume(ctx, ""), "Could not resume")
+	if ndt.Paused() {
+		t.Error("ndt was not resumed")
+	}
+
+	if err := c.ReloadConfig(ctx); status.Code(err) != codes.Unimplemented {
+		t.Errorf("ReloadConfig returned %v, not Unimplemented", err)
+	}
+
+	rtx.Must(c.Drain(ctx), "Could not drain")
+	rtx.Must(c.Drain(ctx), "Could not drain again")
+	st, err = c.Status(ctx)
+	rtx.Must(err, "Could not get the status")
+	if drains != 1 || !st.Draining {
+		t.Errorf("Draining twice called drain %d times, and the status is %+v", drains, st)
+	}
+}
+
+func TestServerTLS(t *testing.T) {
+	if _, err := control.ServerTLS("/nonexistent/cert", "/nonexistent/key", "/nonexistent/ca"); err == nil {
+		t.Error("ServerTLS should fail without its files")
+	}
+}
@@ -0,0 +1,222 @@
+// Package decisionlog keeps a local log of what pusher did with every file: when
+// it was added to a tarfile, skipped, refused, quarantined, uploaded (and to
+// which object), and deleted. When data is reported missing days later, the log
+// says what became of each of its files.
+//
+// The log is kept in one file per UTC day, of JSON entries one per line, named
+// decisions-YYYY-MM-DD.jsonl. Each day's file is capped in size, beyond which
+// that day's entries are dropped, and the files of old days are removed.
+package decisionlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/pusher/metrics"
+)
+
+var collectors metrics.Collectors
+
+// RegisterMetrics registers the decision log's metrics on r, or on
+// prometheus.DefaultRegisterer if r is nil. Open does not register them.
+func RegisterMetrics(r prometheus.Registerer) {
+	collectors.Register(r)
+}
+
+var (
+	pusherDecisionsDropped = collectors.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pusher_decision_log_dropped_total",
+			Help: "The number of decisions which were not logged because the day's decision log was full",
+		})
+	pusherDecisionLogErrors = collectors.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pusher_decision_log_errors_total",
+			Help: "The number of decisions which could not be written to the decision log",
+		})
+)
+
+// An Action is what pusher did with a file.
+type Action string
+
+const (
+	// Added files were put in a tarfile.
+	Added = Action("added")
+	// Skipped files were left out of their tarfile by sampling, and are
+	// deleted along with its members.
+	Skipped = Action("skipped")
+	// Refused files were not archived, e.g. because they could not be opened.
+	// They are refused again each time they are found.
+	Refused = Action("refused")
+	// Quarantined files are in directories whose names look like those of
+	// files, and are left alone.
+	Quarantined = Action("quarantined")
+	// Uploaded files were in a tarfile which was uploaded to Object.
+	Uploaded = Action("uploaded")
+	// Deleted files were removed once their tarfile was uploaded.
+	Deleted = Action("deleted")
+	// Kept files would have been deleted, but were kept on request.
+	Kept = Action("kept")
+)
+
+// An Entry records one decision about one file.
+type Entry struct {
+	Time     time.Time `json:"time"`
+	Datatype string    `json:"datatype"`
+	Action   Action    `json:"action"`
+	// File is the name of the file on disk.
+	File string `json:"file"`
+	// Object is where the file was uploaded, if it was.
+	Object string `json:"object,omitempty"`
+	// Reason says why, for the actions which can happen for several.
+	Reason string `json:"reason,omitempty"`
+}
+
+const (
+	filePrefix = "decisions-"
+	fileSuffix = ".jsonl"
+	dayFormat  = "2006-01-02"
+)
+
+// Log is a decision log. Its methods may be called from many goroutines. A nil
+// *Log records nothing.
+type Log struct {
+	dir     string
+	maxSize int64
+	keep    int
+
+	mu   sync.Mutex
+	day  string
+	file *os.File
+	size int64
+	// Whether the day's file has been reported full.
+	full bool
+}
+
+// Open returns a log which writes to the directory, which must exist. Each
+// day's file holds at most maxSize bytes, and the files of the last keep days
+// are kept, today's included. A keep of zero or less keeps every day's file.
+func Open(dir string, maxSize int64, keep int) (*Log, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &Log{dir: dir, maxSize: maxSize, keep: keep}, nil
+}
+
+// Record logs the decision about the file. The time of the entry is now.
+func (l *Log) Record(datatype string, action Action, file, object, reason string) {
+	if l == nil {
+		return
+	}
+	e := Entry{
+		Time:     time.Now().UTC(),
+		Datatype: datatype,
+		Action:   action,
+		File:     file,
+		Object:   object,
+		Reason:   reason,
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		pusherDecisionLogErrors.Inc()
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.rotate(e.Time.Format(dayFormat)); err != nil {
+		pusherDecisionLogErrors.Inc()
+		log.Printf("Could not open the decision log (error: %q)\n", err)
+		return
+	}
+	if l.maxSize > 0 && l.size+int64(len(line)) > l.maxSize {
+		pusherDecisionsDropped.Inc()
+		if !l.full {
+			l.full = true
+			log.Printf("The decision log %s is full. Dropping the rest of the day's decisions.\n", l.file.Name())
+		}
+		return
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		pusherDecisionLogErrors.Inc()
+	}
+}
+
+// rotate opens the file of the day, if it is not already open, and removes
+// the files of days that are no longer kept. The mutex must be held.
+func (l *Log) rotate(day string) error {
+	if l.file != nil && l.day == day {
+		return nil
+	}
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	f, err := os.OpenFile(filepath.Join(l.dir, filePrefix+day+fileSuffix), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.day = day
+	l.file = f
+	l.size = info.Size()
+	l.full = false
+	l.prune()
+	return nil
+}
+
+// prune removes the files of the days before the last keep. The names of the
+// files sort by day. The mutex must be held.
+func (l *Log) prune() {
+	if l.keep <= 0 {
+		return
+	}
+	names, err := filepath.Glob(filepath.Join(l.dir, filePrefix+"*"+fileSuffix))
+	if err != nil {
+		return
+	}
+	sort.Strings(names)
+	for len(names) > l.keep {
+		if !strings.HasSuffix(names[0], l.day+fileSuffix) {
+			if err := os.Remove(names[0]); err != nil {
+				log.Printf("Could not remove the old decision log %s (error: %q)\n", names[0], err)
+			}
+		}
+		names = names[1:]
+	}
+}
+
+// Close closes the file of the day.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,97 @@
+package decisionlog_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/pusher/decisionlog"
+)
+
+func today() string {
+	return "decisions-" + time.Now().UTC().Format("2006-01-02") + ".jsonl"
+}
+
+func TestRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "decisionlog.TestRecord")
+	rtx.Must(err, "Could not create the temp dir")
+	defer os.RemoveAll(dir)
+
+	l, err := decisionlog.Open(dir, 0, 0)
+	rtx.Must(err, "Could not open the log")
+	l.Record("ndt7", decisionlog.Uploaded, "/data/2026/10/16/a", "gs://bucket/a.tgz", "")
+	l.Record("ndt7", decisionlog.Deleted, "/data/2026/10/16/a", "", "add_file")
+	rtx.Must(l.Close(), "Could not close the log")
+
+	contents, err := ioutil.ReadFile(filepath.Join(dir, today()))
+	rtx.Must(err, "Could not read the log")
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Logged %d lines instead of 2: %q", len(lines), contents)
+	}
+	var e decisionlog.Entry
+	rtx.Must(json.Unmarshal([]byte(lines[0]), &e), "Could not parse %q", lines[0])
+	if e.Datatype != "ndt7" || e.Action != decisionlog.Uploaded || e.File != "/data/2026/10/16/a" || e.Object != "gs://bucket/a.tgz" || e.Time.IsZero() {
+		t.Errorf("Logged %+v", e)
+	}
+	if strings.Contains(lines[1], "object") || !strings.Contains(lines[1], `"reason":"add_file"`) {
+		t.Errorf("Logged %q", lines[1])
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "decisionlog.TestMaxSize")
+	rtx.Must(err, "Could not create the temp dir")
+	defer os.RemoveAll(dir)
+
+	l, err := decisionlog.Open(dir, 150, 0)
+	rtx.Must(err, "Could not open the log")
+	for i := 0; i < 10; i++ {
+		l.Record("ndt7", decisionlog.Added, "/data/2026/10/16/a", "", "")
+	}
+	rtx.Must(l.Close(), "Could not close the log")
+	info, err := os.Stat(filepath.Join(dir, today()))
+	rtx.Must(err, "Could not stat the log")
+	if info.Size() == 0 || info.Size() > 150 {
+		t.Errorf("The log holds %d bytes, which is not between 1 and 150", info.Size())
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "decisionlog.TestPrune")
+	rtx.Must(err, "Could not create the temp dir")
+	defer os.RemoveAll(dir)
+	old := []string{"decisions-2020-01-01.jsonl", "decisions-2020-01-02.jsonl", "decisions-2020-01-03.jsonl"}
+	for _, name := range old {
+		rtx.Must(ioutil.WriteFile(filepath.Join(dir, name), []byte("{}\n"), 0644), "Could not write %s", name)
+	}
+	rtx.Must(ioutil.WriteFile(filepath.Join(dir, "unrelated"), nil, 0644), "Could not write a file")
+
+	l, err := decisionlog.Open(dir, 0, 2)
+	rtx.Must(err, "Could not open the log")
+	l.Record("ndt7", decisionlog.Added, "/data/2026/10/16/a", "", "")
+	rtx.Must(l.Close(), "Could not close the log")
+
+	for name, want := range map[string]bool{old[0]: false, old[1]: false, old[2]: true, today(): true, "unrelated": true} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != want {
+			t.Errorf("%s exists: %v, want %v", name, err == nil, want)
+		}
+	}
+}
+
+func TestNil(t *testing.T) {
+	var l *decisionlog.Log
+	l.Record("ndt7", decisionlog.Added, "a", "", "")
+	if err := l.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, err := decisionlog.Open("/does/not/exist", 0, 0); err == nil {
+		t.Error("Open succeeded on a directory that does not exist")
+	}
+}
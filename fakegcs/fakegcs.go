@@ -0,0 +1,398 @@
+// Package fakegcs provides an in-memory GCS server for tests, so that the
+// uploader and the whole pipeline can be tested without GCS credentials. It
+// supports the parts of the JSON API that pusher uses (uploads, object
+// metadata and deletion) and downloads of object contents.
+package fakegcs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+// Object is an object stored by the Server.
+type Object struct {
+	Bucket             string
+	Name               string
+	ContentType        string
+	ContentEncoding    string
+	ContentDisposition string
+	Metadata           map[string]string
+	Contents           []byte
+	Generation         int64
+	Updated            time.Time
+}
+
+// upload is a resumable upload that has been started but not finished.
+type upload struct {
+	object   Object
+	contents []byte
+}
+
+// Server is a fake GCS server. Objects may only be uploaded to the buckets it
+// was created with.
+type Server struct {
+	server *httptest.Server
+
+	mu         sync.Mutex
+	buckets    map[string]map[string]*Object
+	uploads    map[string]*upload
+	generation int64
+}
+
+// NewServer starts a Server with the given buckets, all of them empty.
+func NewServer(buckets ...string) *Server {
+	s := &Server{
+		buckets: make(map[string]map[string]*Object),
+		uploads: make(map[string]*upload),
+	}
+	for _, b := range buckets {
+		s.buckets[b] = make(map[string]*Object)
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// URL returns the base URL of the server.
+func (s *Server) URL() string {
+	return s.server.URL
+}
+
+// Close shuts the server down.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Client returns a storage client which talks to the server, without
+// authentication.
+func (s *Server) Client(ctx context.Context) (*storage.Client, error) {
+	return storage.NewClient(ctx, option.WithEndpoint(s.server.URL+"/storage/v1/"), option.WithoutAuthentication())
+}
+
+// Object returns a copy of the named object, and whether it exists.
+func (s *Server) Object(bucket, name string) (Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.buckets[bucket][name]
+	if !ok {
+		return Object{}, false
+	}
+	return *o, true
+}
+
+// Objects returns the names of all the objects in the bucket.
+func (s *Server) Objects(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := []string{}
+	for name := range s.buckets[bucket] {
+		names = append(names, name)
+	}
+	return names
+}
+
+// validName returns whether GCS would accept the object name.
+func validName(name string) bool {
+	return name != "" && len(name) <= 1024 && utf8.ValidString(name) &&
+		!strings.ContainsAny(name, "\r\n") && name != "." && name != ".."
+}
+
+// writeError writes an error in the form of a JSON API error response.
+func writeError(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": fmt.Sprintf(format, args...),
+		},
+	})
+}
+
+// writeObject writes the JSON API representation of the object's metadata.
+func writeObject(w http.ResponseWriter, o *Object) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"kind":               "storage#object",
+		"bucket":             o.Bucket,
+		"name":               o.Name,
+		"contentType":        o.ContentType,
+		"contentEncoding":    o.ContentEncoding,
+		"contentDisposition": o.ContentDisposition,
+		"metadata":           o.Metadata,
+		"size":               strconv.Itoa(len(o.Contents)),
+		"generation":         strconv.FormatInt(o.Generation, 10),
+		"updated":            o.Updated.Format(time.RFC3339Nano),
+	})
+}
+
+// jsonObject is the part of an uploaded object's JSON metadata that the
+// server keeps.
+type jsonObject struct {
+	Name               string            `json:"name"`
+	ContentType        string            `json:"contentType"`
+	ContentEncoding    string            `json:"contentEncoding"`
+	ContentDisposition string            `json:"contentDisposition"`
+	Metadata           map[string]string `json:"metadata"`
+}
+
+// object returns an Object in the bucket with the metadata.
+func (j jsonObject) object(bucket string) Object {
+	return Object{
+		Bucket:             bucket,
+		Name:               j.Name,
+		ContentType:        j.ContentType,
+		ContentEncoding:    j.ContentEncoding,
+		ContentDisposition: j.ContentDisposition,
+		Metadata:           j.Metadata,
+	}
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	switch {
+	case strings.HasPrefix(path, "/upload/storage/v1/b/"):
+		s.serveUpload(w, r, strings.TrimPrefix(path, "/upload/storage/v1/b/"))
+	case strings.HasPrefix(path, "/storage/v1/b/"):
+		s.serveObject(w, r, strings.TrimPrefix(path, "/storage/v1/b/"))
+	case r.Method == http.MethodGet:
+		s.serveDownload(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "no such API: %s %s", r.Method, path)
+	}
+}
+
+// serveUpload handles uploads, to /upload/storage/v1/b/{bucket}/o.
+func (s *Server) serveUpload(w http.ResponseWriter, r *http.Request, path string) {
+	bucket, err := url.PathUnescape(strings.TrimSuffix(path, "/o"))
+	if err != nil || !strings.HasSuffix(path, "/o") {
+		writeError(w, http.StatusNotFound, "bad upload path %q", path)
+		return
+	}
+	q := r.URL.Query()
+	switch {
+	case q.Get("upload_id") != "":
+		s.continueResumableUpload(w, r, q.Get("upload_id"))
+	case r.Method == http.MethodPost && q.Get("uploadType") == "multipart":
+		s.multipartUpload(w, r, bucket)
+	case r.Method == http.MethodPost && q.Get("uploadType") == "media":
+		contents, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "could not read the upload: %v", err)
+			return
+		}
+		s.store(w, Object{Bucket: bucket, Name: q.Get("name"), ContentType: r.Header.Get("Content-Type")}, contents)
+	case r.Method == http.MethodPost && q.Get("uploadType") == "resumable":
+		s.startResumableUpload(w, r, bucket)
+	default:
+		writeError(w, http.StatusBadRequest, "unsupported upload: %s %s", r.Method, r.URL)
+	}
+}
+
+// multipartUpload handles an upload whose body holds the object's metadata and
+// then its contents.
+func (s *Server) multipartUpload(w http.ResponseWriter, r *http.Request, bucket string) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad content type: %v", err)
+		return
+	}
+	parts := multipart.NewReader(r.Body, params["boundary"])
+	var obj jsonObject
+	part, err := parts.NextPart()
+	if err == nil {
+		err = json.NewDecoder(part).Decode(&obj)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "could not read the object metadata: %v", err)
+		return
+	}
+	part, err = parts.NextPart()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "could not find the object contents: %v", err)
+		return
+	}
+	contents, err := ioutil.ReadAll(part)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "could not read the object contents: %v", err)
+		return
+	}
+	if obj.ContentType == "" {
+		obj.ContentType = part.Header.Get("Content-Type")
+	}
+	s.store(w, obj.object(bucket), contents)
+}
+
+// startResumableUpload handles the request that starts a resumable upload, and
+// tells the client where to send the contents.
+func (s *Server) startResumableUpload(w http.ResponseWriter, r *http.Request, bucket string) {
+	var obj jsonObject
+	if err := json.NewDecoder(r.Body).Decode(&obj); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, "could not read the object metadata: %v", err)
+		return
+	}
+	if ok, code, msg := s.canStore(bucket, obj.Name); !ok {
+		writeError(w, code, "%s", msg)
+		return
+	}
+	s.mu.Lock()
+	s.generation++
+	id := strconv.FormatInt(s.generation, 10)
+	s.uploads[id] = &upload{object: obj.object(bucket)}
+	s.mu.Unlock()
+	w.Header().Set("Location", s.server.URL+r.URL.Path+"?uploadType=resumable&upload_id="+id)
+	w.WriteHeader(http.StatusOK)
+}
+
+// continueResumableUpload handles a chunk of a resumable upload. The upload is
+// finished by the chunk which brings it to the total size.
+func (s *Server) continueResumableUpload(w http.ResponseWriter, r *http.Request, id string) {
+	chunk, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "could not read the chunk: %v", err)
+		return
+	}
+	// The Content-Range is "bytes first-last/total" or "bytes */total", and the
+	// total is "*" until the client knows it.
+	total := -1
+	if cr := r.Header.Get("Content-Range"); strings.HasPrefix(cr, "bytes ") {
+		if i := strings.LastIndex(cr, "/"); i >= 0 {
+			if n, err := strconv.Atoi(cr[i+1:]); err == nil {
+				total = n
+			}
+		}
+	}
+	s.mu.Lock()
+	u, ok := s.uploads[id]
+	if ok {
+		u.contents = append(u.contents, chunk...)
+	}
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such upload %q", id)
+		return
+	}
+	if total < 0 || len(u.contents) < total {
+		if len(u.contents) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(u.contents)-1))
+		}
+		// Clients that ask for it are told that the upload is incomplete with a
+		// header rather than a 308, which HTTP libraries treat as a redirect.
+		if r.Header.Get("X-GUploader-No-308") == "yes" {
+			w.Header().Set("X-Http-Status-Code-Override", "308")
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusPermanentRedirect)
+		}
+		return
+	}
+	s.mu.Lock()
+	delete(s.uploads, id)
+	s.mu.Unlock()
+	s.store(w, u.object, u.contents)
+}
+
+// canStore returns whether an object with the name may be stored in the bucket,
+// and if not, the status code and message to reply with.
+func (s *Server) canStore(bucket, name string) (bool, int, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.buckets[bucket]; !ok {
+		return false, http.StatusNotFound, fmt.Sprintf("no such bucket %q", bucket)
+	}
+	if !validName(name) {
+		return false, http.StatusBadRequest, fmt.Sprintf("invalid object name %q", name)
+	}
+	return true, 0, ""
+}
+
+// store saves the object, replacing any object with the same name, and replies
+// with its metadata.
+func (s *Server) store(w http.ResponseWriter, o Object, contents []byte) {
+	if ok, code, msg := s.canStore(o.Bucket, o.Name); !ok {
+		writeError(w, code, "%s", msg)
+		return
+	}
+	s.mu.Lock()
+	s.generation++
+	o.Contents = contents
+	o.Generation = s.generation
+	o.Updated = time.Now().UTC()
+	s.buckets[o.Bucket][o.Name] = &o
+	s.mu.Unlock()
+	writeObject(w, &o)
+}
+
+// serveObject handles requests for an object's metadata, and for its deletion,
+// to /storage/v1/b/{bucket}/o/{object}.
+func (s *Server) serveObject(w http.ResponseWriter, r *http.Request, path string) {
+	parts := strings.SplitN(path, "/o/", 2)
+	if len(parts) != 2 {
+		writeError(w, http.StatusNotFound, "bad object path %q", path)
+		return
+	}
+	bucket, err1 := url.PathUnescape(parts[0])
+	name, err2 := url.PathUnescape(parts[1])
+	if err1 != nil || err2 != nil {
+		writeError(w, http.StatusBadRequest, "bad object path %q", path)
+		return
+	}
+	s.mu.Lock()
+	o, ok := s.buckets[bucket][name]
+	if ok && r.Method == http.MethodDelete {
+		delete(s.buckets[bucket], name)
+	}
+	s.mu.Unlock()
+	switch {
+	case !ok:
+		writeError(w, http.StatusNotFound, "no such object %q in bucket %q", name, bucket)
+	case r.Method == http.MethodGet:
+		writeObject(w, o)
+	case r.Method == http.MethodDelete:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method %s", r.Method)
+	}
+}
+
+// serveDownload handles downloads of an object's contents, from
+// /{bucket}/{object}.
+func (s *Server) serveDownload(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) != 2 {
+		writeError(w, http.StatusNotFound, "bad download path %q", r.URL.Path)
+		return
+	}
+	s.mu.Lock()
+	o, ok := s.buckets[parts[0]][parts[1]]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such object %q in bucket %q", parts[1], parts[0])
+		return
+	}
+	w.Header().Set("Content-Type", o.ContentType)
+	if o.ContentEncoding != "" {
+		w.Header().Set("Content-Encoding", o.ContentEncoding)
+	}
+	if o.ContentDisposition != "" {
+		w.Header().Set("Content-Disposition", o.ContentDisposition)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(o.Contents)))
+	w.Header().Set("X-Goog-Generation", strconv.FormatInt(o.Generation, 10))
+	w.Write(o.Contents)
+}
@@ -0,0 +1,88 @@
+package fakegcs_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/pusher/fakegcs"
+)
+
+func TestServer(t *testing.T) {
+	server := fakegcs.NewServer("bucket")
+	defer server.Close()
+	ctx := context.Background()
+	client, err := server.Client(ctx)
+	rtx.Must(err, "Could not create the client")
+
+	tests := []struct {
+		name      string
+		object    string
+		size      int
+		chunkSize int
+	}{
+		{name: "multipart", object: "dir/small.tgz", size: 100},
+		{name: "resumable", object: "dir/large.tgz", size: 3*256*1024 + 17, chunkSize: 256 * 1024},
+		{name: "empty", object: "empty.tgz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contents := bytes.Repeat([]byte("x"), tt.size)
+			obj := client.Bucket("bucket").Object(tt.object)
+			w := obj.NewWriter(ctx)
+			w.ChunkSize = tt.chunkSize
+			w.Metadata = map[string]string{"key": "value"}
+			w.ContentDisposition = "attachment"
+			w.Write(contents)
+			if err := w.Close(); err != nil {
+				t.Fatalf("Could not upload %q: %v", tt.object, err)
+			}
+
+			stored, ok := server.Object("bucket", tt.object)
+			if !ok || !bytes.Equal(stored.Contents, contents) || stored.Metadata["key"] != "value" || stored.ContentDisposition != "attachment" {
+				t.Errorf("Stored object %+v is wrong", stored)
+			}
+			attrs, err := obj.Attrs(ctx)
+			if err != nil || attrs.Size != int64(tt.size) || attrs.Metadata["key"] != "value" || attrs.ContentDisposition != "attachment" {
+				t.Errorf("Attrs() = %+v, %v", attrs, err)
+			}
+			r, err := obj.NewReader(ctx)
+			rtx.Must(err, "Could not read %q", tt.object)
+			read, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil || !bytes.Equal(read, contents) {
+				t.Errorf("Read %d bytes (%v) instead of %d", len(read), err, tt.size)
+			}
+
+			rtx.Must(obj.Delete(ctx), "Could not delete %q", tt.object)
+			if _, err := obj.Attrs(ctx); err != storage.ErrObjectNotExist {
+				t.Errorf("Attrs() of a deleted object returned %v", err)
+			}
+		})
+	}
+}
+
+func TestServerRejectsBadUploads(t *testing.T) {
+	server := fakegcs.NewServer("bucket")
+	defer server.Close()
+	ctx := context.Background()
+	client, err := server.Client(ctx)
+	rtx.Must(err, "Could not create the client")
+
+	for _, target := range []struct{ bucket, object string }{
+		{"bucket", "Bad\nFilename"},
+		{"no-such-bucket", "object"},
+	} {
+		w := client.Bucket(target.bucket).Object(target.object).NewWriter(ctx)
+		w.Write([]byte("contents"))
+		if err := w.Close(); err == nil {
+			t.Errorf("Uploading %q to %q should have failed", target.object, target.bucket)
+		}
+	}
+	if names := server.Objects("bucket"); len(names) != 0 {
+		t.Errorf("Objects %v should not have been stored", names)
+	}
+}
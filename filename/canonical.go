@@ -0,0 +1,37 @@
+package filename
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Canonical returns the absolute name of the file, with "." and ".." elements
+// and symbolic links resolved. If followLink is false and the file itself is a
+// symbolic link, the link is not resolved, only the directories it is in, e.g.
+// for a link which is archived as a link.
+func (s System) Canonical(followLink bool) (System, error) {
+	abs, err := filepath.Abs(string(s))
+	if err != nil {
+		return "", err
+	}
+	if followLink {
+		resolved, err := filepath.EvalSymlinks(abs)
+		return System(resolved), err
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(abs))
+	if err != nil {
+		return "", err
+	}
+	return System(filepath.Join(dir, filepath.Base(abs))), nil
+}
+
+// IsWithin returns whether the file is inside the directory, or one of its
+// subdirectories. Both names must be canonical.
+func (s System) IsWithin(dir System) bool {
+	rel, err := filepath.Rel(string(dir), string(s))
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
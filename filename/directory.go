@@ -0,0 +1,51 @@
+package filename
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// DirectoryPolicy is how directories whose names look like those of files,
+// e.g. 2019/05/01/data.gz/, are treated. Experiments sometimes create them by
+// mistake where files are expected. A directory handed to the TarCache as if
+// it were a file is never archived, whatever the policy, but is counted and
+// treated as the policy says. Old, empty directories are removed by the finder
+// whatever the policy. The zero value means DirectoriesIgnore.
+type DirectoryPolicy string
+
+const (
+	// DirectoriesIgnore archives the files in such directories like any
+	// others, without saying so.
+	DirectoriesIgnore = DirectoryPolicy("ignore")
+	// DirectoriesWarn is like DirectoriesIgnore, but logs each file found
+	// in such a directory.
+	DirectoriesWarn = DirectoryPolicy("warn")
+	// DirectoriesQuarantine logs the files in such directories and leaves
+	// them alone for an operator to look at. They are neither archived nor
+	// deleted.
+	DirectoriesQuarantine = DirectoryPolicy("quarantine")
+)
+
+// DirectoryPolicies lists every DirectoryPolicy, e.g. for use in a flagx.Enum.
+var DirectoryPolicies = []string{string(DirectoriesIgnore), string(DirectoriesWarn), string(DirectoriesQuarantine)}
+
+// looksLikeFile returns whether the name has an extension, as most file names
+// do and directory names of the form YYYY/MM/DD don't. Hidden names, like
+// ".cache", have no extension.
+func looksLikeFile(name string) bool {
+	ext := path.Ext(name)
+	return ext != "" && ext != "." && ext != name
+}
+
+// FileLikeDir returns the first directory the file is in whose name looks like
+// that of a file, and whether there is one.
+func (l Internal) FileLikeDir() (Internal, bool) {
+	elements := strings.Split(filepath.ToSlash(string(l)), "/")
+	for i, element := range elements[:len(elements)-1] {
+		if element != ".." && looksLikeFile(element) {
+			return Internal(strings.Join(elements[:i+1], "/")), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,70 @@
+package filename
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ControlCharPolicy is how files whose names contain control characters, such
+// as newlines, or bytes which are not UTF-8, are treated. Such names would
+// otherwise end up in tar headers, logs, and GCS object names, which must be
+// UTF-8. The zero value means ControlCharsEscape.
+type ControlCharPolicy string
+
+const (
+	// ControlCharsEscape archives the file under its escaped name (see
+	// Internal.Escape).
+	ControlCharsEscape = ControlCharPolicy("escape")
+	// ControlCharsReject leaves the file alone. It is neither archived nor
+	// deleted.
+	ControlCharsReject = ControlCharPolicy("reject")
+)
+
+// ControlCharPolicies lists every ControlCharPolicy, e.g. for use in a
+// flagx.Enum.
+var ControlCharPolicies = []string{string(ControlCharsEscape), string(ControlCharsReject)}
+
+// needsEscape returns whether the byte at the start of s must be escaped, and
+// how many bytes long the character it starts is.
+func needsEscape(s string) (bool, int) {
+	r, size := utf8.DecodeRuneInString(s)
+	if r == utf8.RuneError && size <= 1 {
+		return true, 1
+	}
+	return r < 0x20 || r == 0x7f, size
+}
+
+// HasControlChars returns whether the name contains control characters or
+// bytes which are not UTF-8.
+func (l Internal) HasControlChars() bool {
+	for s := string(l); s != ""; {
+		escape, size := needsEscape(s)
+		if escape {
+			return true
+		}
+		s = s[size:]
+	}
+	return false
+}
+
+// Escape returns the name with its control characters, bytes which are not
+// UTF-8, and percent signs percent-encoded, e.g. "a\nb%" becomes "a%0Ab%25".
+// Percent signs are encoded in every name, whether or not it has control
+// characters, so that every escaped name decodes unambiguously to the one it
+// came from. Escaping a name twice encodes its percent signs twice, so each
+// name must be escaped exactly once.
+func (l Internal) Escape() Internal {
+	var escaped strings.Builder
+	for s := string(l); s != ""; {
+		escape, size := needsEscape(s)
+		if escape || s[0] == '%' {
+			fmt.Fprintf(&escaped, "%%%02X", s[0])
+			s = s[1:]
+			continue
+		}
+		escaped.WriteString(s[:size])
+		s = s[size:]
+	}
+	return Internal(escaped.String())
+}
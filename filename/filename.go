@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"log"
 	"path"
+	"path/filepath"
 	"regexp"
 	"strings"
 )
@@ -15,29 +16,101 @@ import (
 type System string
 
 // Internal removes the path information that is not relevant to the tarfile.
+// The returned name always uses '/' as its separator, no matter what the
+// separator is on the local operating system.
 func (s System) Internal(rootDirectory System) Internal {
-	return Internal(strings.TrimPrefix(string(s), string(rootDirectory)))
+	name := filepath.ToSlash(string(s))
+	root := filepath.ToSlash(string(rootDirectory))
+	return Internal(strings.TrimPrefix(name, root))
 }
 
 // Internal is the pathname of a data file inside of the tarfile.
 type Internal string
 
+// DefaultSubdirDepth is how many levels of directories Subdir keeps, which is
+// enough for the usual YYYY/MM/DD layout.
+const DefaultSubdirDepth = 3
+
 // Subdir returns the subdirectory of the Internal filename, up to 3 levels
 // deep. It is only guaranteed to work right on relative path names, suitable
 // for inclusion in tarfiles.
 func (l Internal) Subdir() string {
-	dirs := strings.Split(string(l), "/")
+	return l.SubdirDepth(DefaultSubdirDepth)
+}
+
+// SubdirDepth is like Subdir, but keeps up to depth levels of directories, for
+// datatypes laid out more deeply, e.g. YYYY/MM/DD/HH/run. A depth of zero or
+// less keeps every level.
+func (l Internal) SubdirDepth(depth int) string {
+	dirs := strings.Split(filepath.ToSlash(string(l)), "/")
 	if len(dirs) <= 1 {
 		log.Printf("File handed to the tarcache is not in a subdirectory: %v is not split by /", l)
 		return ""
 	}
 	k := len(dirs) - 1
-	if k > 3 {
-		k = 3
+	if depth > 0 && k > depth {
+		k = depth
 	}
 	return strings.Join(dirs[:k], "/")
 }
 
+// IsHidden returns whether the file, or any directory it is in, has a name
+// beginning with a dot. Such files are usually editor temporaries, or the
+// leftovers of deleting an open file on NFS.
+func (l Internal) IsHidden() bool {
+	for _, element := range strings.Split(filepath.ToSlash(string(l)), "/") {
+		if strings.HasPrefix(element, ".") && element != "." && element != ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// nfsSillyRename matches the names NFS clients give files that are deleted
+// while they are still open.
+var nfsSillyRename = regexp.MustCompile(`^\.nfs[0-9a-fA-F]+$`)
+
+// IsNFSSillyRename returns whether the file is one that an NFS client created
+// when a file was deleted while still open. Such a file disappears once it is
+// closed, and deleting it just creates another, so it must never be archived.
+func (s System) IsNFSSillyRename() bool {
+	return nfsSillyRename.MatchString(filepath.Base(string(s)))
+}
+
+// Rewriter transforms the Internal name of a file on disk into the name it
+// should have inside the tarfile. It allows legacy on-disk layouts to be mapped
+// onto the layout expected downstream without moving any files.
+type Rewriter struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// NewRewriter parses a rule of the form "<regexp>=><replacement>". The
+// replacement may refer to submatches of the regexp using the syntax of
+// regexp.Regexp.Expand, e.g. "^legacy/([0-9]{8})/(.*)$=>$1/$2".
+func NewRewriter(rule string) (*Rewriter, error) {
+	fields := strings.SplitN(rule, "=>", 2)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("Rewrite rule %q is not of the form <regexp>=><replacement>", rule)
+	}
+	pattern, err := regexp.Compile(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("Bad regexp in rewrite rule %q: %v", rule, err)
+	}
+	return &Rewriter{pattern: pattern, replacement: fields[1]}, nil
+}
+
+// Rewrite returns the transformed name. Names that do not match the rule are
+// returned unchanged, as are names that would be rewritten to the empty string.
+func (r *Rewriter) Rewrite(l Internal) Internal {
+	rewritten := r.pattern.ReplaceAllString(string(l), r.replacement)
+	if rewritten == "" {
+		log.Printf("Rewriting %q produced an empty name. Leaving it unchanged.", l)
+		return l
+	}
+	return Internal(rewritten)
+}
+
 // Lint returns nil if the file has a normal name, and an explanatory error
 // about why the name is strange otherwise.
 func (l Internal) Lint() error {
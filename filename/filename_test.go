@@ -1,8 +1,13 @@
 package filename_test
 
 import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/pusher/filename"
 )
 
@@ -21,6 +26,27 @@ func TestInternal(t *testing.T) {
 	}
 }
 
+// TestInternalUsesSlashes builds its paths with the local separator, so that on
+// Windows it verifies that backslashes are normalized and on everything else
+// it verifies that nothing changes.
+func TestInternalUsesSlashes(t *testing.T) {
+	root := filename.System(filepath.FromSlash("/var/spool/ndt/"))
+	for _, test := range []struct{ in, out, subdir string }{
+		{in: "/var/spool/ndt/2009/01/01/test", out: "2009/01/01/test", subdir: "2009/01/01"},
+		{in: "/var/spool/ndt/2009/01/01/subdir/test", out: "2009/01/01/subdir/test", subdir: "2009/01/01"},
+		{in: "/var/spool/ndt/2009/test", out: "2009/test", subdir: "2009"},
+		{in: "/var/spool/ndt/test", out: "test", subdir: ""},
+	} {
+		out := filename.System(filepath.FromSlash(test.in)).Internal(root)
+		if string(out) != test.out {
+			t.Errorf("The internal name should have been %q but was %q", test.out, out)
+		}
+		if subdir := out.Subdir(); subdir != test.subdir {
+			t.Errorf("The subdirectory should have been %q but was %q", test.subdir, subdir)
+		}
+	}
+}
+
 func TestLint(t *testing.T) {
 	for _, badString := range []string{
 		"/gfdgf/../fsdfds/data.txt",
@@ -61,3 +87,180 @@ func TestSubdir(t *testing.T) {
 		}
 	}
 }
+
+func TestSubdirDepth(t *testing.T) {
+	for _, test := range []struct {
+		in    string
+		depth int
+		out   string
+	}{
+		{in: "2009/01/01/05/run1/test", depth: 3, out: "2009/01/01"},
+		{in: "2009/01/01/05/run1/test", depth: 5, out: "2009/01/01/05/run1"},
+		{in: "2009/01/01/05/run1/test", depth: 7, out: "2009/01/01/05/run1"},
+		{in: "2009/01/01/05/run1/test", depth: 0, out: "2009/01/01/05/run1"},
+		{in: "2009/01/01/05/run1/test", depth: -1, out: "2009/01/01/05/run1"},
+		{in: "2009/01/test", depth: 5, out: "2009/01"},
+		{in: "test", depth: -1, out: ""},
+	} {
+		out := filename.Internal(test.in).SubdirDepth(test.depth)
+		if out != test.out {
+			t.Errorf("The subdirectory of %q at depth %d should have been %q but was %q", test.in, test.depth, test.out, out)
+		}
+	}
+}
+
+func TestRewriter(t *testing.T) {
+	r, err := filename.NewRewriter(`^legacy/([0-9]{4})([0-9]{2})([0-9]{2})/(.*)$=>$1/$2/$3/$4`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct{ in, out string }{
+		{in: "legacy/20190501/data.gz", out: "2019/05/01/data.gz"},
+		{in: "legacy/20190501/sub/data.gz", out: "2019/05/01/sub/data.gz"},
+		{in: "2019/05/01/data.gz", out: "2019/05/01/data.gz"},
+	} {
+		if out := r.Rewrite(filename.Internal(test.in)); string(out) != test.out {
+			t.Errorf("Rewrite(%q) should have been %q but was %q", test.in, test.out, out)
+		}
+	}
+	empty, err := filename.NewRewriter(`.*=>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := empty.Rewrite("2019/05/01/data.gz"); out != "2019/05/01/data.gz" {
+		t.Errorf("An empty rewrite should leave the name unchanged, not %q", out)
+	}
+	for _, bad := range []string{"no-arrow", "[=>x"} {
+		if _, err := filename.NewRewriter(bad); err == nil {
+			t.Errorf("NewRewriter(%q) should have failed", bad)
+		}
+	}
+}
+
+func TestIsHidden(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "2019/05/01/a.json", want: false},
+		{name: "2019/05/01/.a.json.swp", want: true},
+		{name: "2019/.tmp/01/a.json", want: true},
+		{name: ".nfs000000001234", want: true},
+		{name: "2019/05/01/a.b", want: false},
+	}
+	for _, tt := range tests {
+		if got := filename.Internal(tt.name).IsHidden(); got != tt.want {
+			t.Errorf("Internal(%q).IsHidden() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIsNFSSillyRename(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "/var/spool/ndt/2019/05/01/.nfs000000000123456700000001", want: true},
+		{name: ".nfsA1b2", want: true},
+		{name: "/var/spool/ndt/2019/05/01/.nfs", want: false},
+		{name: "/var/spool/ndt/2019/05/01/.nfsconfig", want: false},
+		{name: "/var/spool/ndt/.nfs0001/a.json", want: false},
+	}
+	for _, tt := range tests {
+		if got := filename.System(tt.name).IsNFSSillyRename(); got != tt.want {
+			t.Errorf("System(%q).IsNFSSillyRename() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFileLikeDir(t *testing.T) {
+	tests := []struct {
+		name string
+		dir  string
+	}{
+		{name: "2019/05/01/data.gz", dir: ""},
+		{name: "2019/05/01/data.gz/a.json", dir: "2019/05/01/data.gz"},
+		{name: "2019/05/01/data.gz/b.tgz/a.json", dir: "2019/05/01/data.gz"},
+		{name: "2019/05/01/.cache/a.json", dir: ""},
+		{name: "2019/05/01/host/a.json", dir: ""},
+		{name: "2019/05/01/../a.json", dir: ""},
+	}
+	for _, tt := range tests {
+		dir, ok := filename.Internal(tt.name).FileLikeDir()
+		if string(dir) != tt.dir || ok != (tt.dir != "") {
+			t.Errorf("Internal(%q).FileLikeDir() = %q, %v, want %q", tt.name, dir, ok, tt.dir)
+		}
+	}
+}
+
+func TestEscape(t *testing.T) {
+	for _, test := range []struct {
+		in, out string
+		control bool
+	}{
+		{in: "2009/01/01/test", out: "2009/01/01/test"},
+		{in: "2009/01/01/100%", out: "2009/01/01/100%25"},
+		{in: "2009/01/01/ünïcödé", out: "2009/01/01/ünïcödé"},
+		{in: "2009/01/01/a\nb", out: "2009/01/01/a%0Ab", control: true},
+		{in: "2009/01/01/100%\r", out: "2009/01/01/100%25%0D", control: true},
+		{in: "2009/01/01/\x00\x1b[31m\x7f", out: "2009/01/01/%00%1B[31m%7F", control: true},
+		{in: "2009/01/01/\xff\xfe", out: "2009/01/01/%FF%FE", control: true},
+		{in: "2009/01/01/\xe2\x82", out: "2009/01/01/%E2%82", control: true},
+		{in: "2009\n/01/01/test", out: "2009%0A/01/01/test", control: true},
+	} {
+		name := filename.Internal(test.in)
+		if name.HasControlChars() != test.control {
+			t.Errorf("%q.HasControlChars() should have been %v", test.in, test.control)
+		}
+		escaped := name.Escape()
+		if string(escaped) != test.out {
+			t.Errorf("%q.Escape() should have been %q but was %q", test.in, test.out, escaped)
+		}
+		if escaped.HasControlChars() {
+			t.Errorf("%q.Escape() = %q should need no more escaping", test.in, escaped)
+		}
+		if unescaped, err := url.PathUnescape(string(escaped)); err != nil || unescaped != test.in {
+			t.Errorf("%q.Escape() = %q should decode to the name, not %q (error: %v)", test.in, escaped, unescaped, err)
+		}
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "filename.TestCanonical")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	tempdir, err = filepath.EvalSymlinks(tempdir)
+	rtx.Must(err, "Could not resolve tempdir")
+	root := filename.System(tempdir + "/root")
+	rtx.Must(os.MkdirAll(tempdir+"/root/2009/01/01", 0777), "Could not create dirs")
+	rtx.Must(ioutil.WriteFile(tempdir+"/secret", []byte("secret"), 0666), "Could not write file")
+	rtx.Must(ioutil.WriteFile(tempdir+"/root/2009/01/01/data", []byte("data"), 0666), "Could not write file")
+	rtx.Must(os.Symlink(tempdir+"/secret", tempdir+"/root/2009/01/01/outside"), "Could not create link")
+	rtx.Must(os.Symlink("data", tempdir+"/root/2009/01/01/inside"), "Could not create link")
+	rtx.Must(os.Symlink(tempdir, tempdir+"/root/2009/01/02"), "Could not create link")
+	for _, test := range []struct {
+		name       string
+		followLink bool
+		within     bool
+	}{
+		{name: "2009/01/01/data", followLink: true, within: true},
+		{name: "2009/01/01/inside", followLink: true, within: true},
+		{name: "2009/01/01/outside", followLink: true, within: false},
+		{name: "2009/01/01/outside", followLink: false, within: true},
+		{name: "2009/01/01/../../../../secret", followLink: true, within: false},
+		{name: "2009/01/02/secret", followLink: true, within: false},
+		{name: "2009/01/02/secret", followLink: false, within: false},
+	} {
+		canonical, err := filename.System(string(root) + "/" + test.name).Canonical(test.followLink)
+		if err != nil {
+			t.Errorf("Could not resolve %q: %v", test.name, err)
+			continue
+		}
+		if canonical.IsWithin(root) != test.within {
+			t.Errorf("%q resolved to %q, which should have been within %q: %v", test.name, canonical, root, test.within)
+		}
+	}
+	if root.IsWithin(root) || filename.System(tempdir+"/rootless").IsWithin(root) {
+		t.Error("Neither the root nor a sibling with a longer name are within the root")
+	}
+}
@@ -0,0 +1,30 @@
+package filename
+
+import "os"
+
+// SymlinkPolicy is how symbolic links found in the directory being archived
+// are treated. The zero value means SymlinksFollow.
+type SymlinkPolicy string
+
+const (
+	// SymlinksIgnore leaves symbolic links alone. They are neither archived
+	// nor deleted.
+	SymlinksIgnore = SymlinkPolicy("ignore")
+	// SymlinksFollow archives the file that a symbolic link points to, under
+	// the name of the link, and then deletes the link, but not the file it
+	// points to. Links to directories are not followed, and the TarCache
+	// refuses links to files outside its root directory.
+	SymlinksFollow = SymlinkPolicy("follow")
+	// SymlinksArchiveAsLink archives a symbolic link as a symbolic link, and
+	// then deletes it.
+	SymlinksArchiveAsLink = SymlinkPolicy("archive-as-link")
+)
+
+// SymlinkPolicies lists every SymlinkPolicy, e.g. for use in a flagx.Enum.
+var SymlinkPolicies = []string{string(SymlinksIgnore), string(SymlinksFollow), string(SymlinksArchiveAsLink)}
+
+// IsSymlink returns whether the file is a symbolic link.
+func (s System) IsSymlink() bool {
+	info, err := os.Lstat(string(s))
+	return err == nil && info.Mode()&os.ModeSymlink != 0
+}
@@ -0,0 +1,34 @@
+//go:build linux
+
+package finder
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// createdAt returns when the file at the path, described by info, was created:
+// its birth time, if its filesystem records one, or otherwise the earlier of
+// its mtime and ctime, in which case ok is false. info describes the link
+// itself, not its target, if it is a symbolic link.
+func createdAt(path string, info os.FileInfo) (created time.Time, ok bool) {
+	flags := 0
+	if info.Mode()&os.ModeSymlink != 0 {
+		flags = unix.AT_SYMLINK_NOFOLLOW
+	}
+	var st unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, path, flags, unix.STATX_BTIME|unix.STATX_MTIME|unix.STATX_CTIME, &st); err != nil {
+		return info.ModTime(), false
+	}
+	if st.Mask&unix.STATX_BTIME != 0 {
+		return time.Unix(st.Btime.Sec, int64(st.Btime.Nsec)), true
+	}
+	mtime := time.Unix(st.Mtime.Sec, int64(st.Mtime.Nsec))
+	ctime := time.Unix(st.Ctime.Sec, int64(st.Ctime.Nsec))
+	if ctime.Before(mtime) {
+		return ctime, false
+	}
+	return mtime, false
+}
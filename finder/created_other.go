@@ -0,0 +1,14 @@
+//go:build !linux
+
+package finder
+
+import (
+	"os"
+	"time"
+)
+
+// createdAt reports that birth times are unavailable on systems without
+// statx(2), where the mtime is all there is to go by.
+func createdAt(path string, info os.FileInfo) (created time.Time, ok bool) {
+	return info.ModTime(), false
+}
@@ -11,6 +11,10 @@
 // recursive listener has been established. We work around this bug (and any
 // other bugs) by having a "cleanup" job that unconditionally adds any files
 // older than the max_file_age.
+//
+// The listener also drops events when too many are waiting to be handled. The
+// files of those events are found by RecoverForever soon afterwards, once they
+// are as old as the max_file_age, instead of waiting for the next cleanup.
 package finder
 
 import (
@@ -20,12 +24,15 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/m-lab/go/memoryless"
+	"github.com/m-lab/pusher/clock"
 	"github.com/m-lab/pusher/filename"
+	"github.com/m-lab/pusher/metrics"
+	"github.com/m-lab/pusher/ratelog"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 // The minimum age of a directory before it will be considered for removal, if
@@ -33,21 +40,78 @@ import (
 // removed prematurely.
 const minDirectoryAge time.Duration = 25 * time.Hour
 
+// The most files sent at once. Each batch is added to the TarCache in one go,
+// so a bigger batch saves more work, but holds up other work for longer.
+const batchSize = 1000
+
+var collectors metrics.Collectors
+
+// RegisterMetrics registers the finder's metrics on r, or on
+// prometheus.DefaultRegisterer if r is nil. The finder has no constructor to
+// do so, so programs which run it other than through a pipeline, which
+// registers them, must call this themselves.
+func RegisterMetrics(r prometheus.Registerer) {
+	collectors.Register(r)
+	ratelog.RegisterMetrics(r)
+}
+
 // Set up the prometheus metrics.
 var (
-	pusherFinderRuns = promauto.NewCounter(prometheus.CounterOpts{
+	pusherFinderRuns = collectors.NewCounter(prometheus.CounterOpts{
 		Name: "pusher_finder_runs_total",
 		Help: "How many times has FindFiles been called",
 	})
-	pusherFinderFiles = promauto.NewCounter(prometheus.CounterOpts{
+	pusherFinderRecoveryRuns = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_finder_recovery_runs_total",
+			Help: "How many times has FindFiles been called to recover the files of dropped listener events",
+		},
+		[]string{"datatype"},
+	)
+	pusherFinderStartupFiles = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_finder_startup_files_found_total",
+			Help: "How many files has FindFiles found in the pass made when a pipeline starts",
+		},
+		[]string{"datatype"},
+	)
+	pusherFinderFiles = collectors.NewCounter(prometheus.CounterOpts{
 		Name: "pusher_finder_files_found_total",
 		Help: "How many files has FindFiles found",
 	})
-	pusherFinderBytes = promauto.NewCounter(prometheus.CounterOpts{
+	pusherFinderBytes = collectors.NewCounter(prometheus.CounterOpts{
 		Name: "pusher_finder_bytes_found_total",
 		Help: "How many bytes has FindFiles found",
 	})
-	pusherFinderMtimeLowerBound = promauto.NewGaugeVec(
+	pusherFinderHiddenSkipped = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_finder_hidden_files_skipped_total",
+			Help: "How many hidden files and directories has FindFiles skipped",
+		},
+		[]string{"datatype"},
+	)
+	pusherFinderNFSSillyRenamesSkipped = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_finder_nfs_silly_renames_skipped_total",
+			Help: "How many NFS silly renames (.nfsXXXX files) of deleted files has FindFiles skipped",
+		},
+		[]string{"datatype"},
+	)
+	pusherFinderFutureFiles = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_finder_future_files_total",
+			Help: "How many files with mtimes too far in the future has FindFiles found, whose ages are counted from when they were first found instead",
+		},
+		[]string{"datatype"},
+	)
+	pusherFinderNoBirthTime = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_finder_birth_time_unavailable_total",
+			Help: "How many files has FindFiles judged by the earlier of their mtime and ctime, because their filesystem records no birth time",
+		},
+		[]string{"datatype"},
+	)
+	pusherFinderMtimeLowerBound = collectors.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "pusher_finder_mtime_lower_bound",
 			Help: "Timestamp of the oldest file discovered by the finder",
@@ -56,34 +120,131 @@ var (
 	)
 )
 
-// findFiles recursively searches through a given directory to find all the files which are old enough to be eligible for upload.
-// The list of files returned is sorted by mtime.
-func findFiles(datatype string, directory filename.System, maxFileAge time.Duration) []filename.System {
+// Options say which files of a datatype the finder finds, and how it judges
+// their ages.
+type Options struct {
+	// Datatype is the datatype whose files are found, for the metrics.
+	Datatype string
+	// Directory is the directory of the datatype, which is searched
+	// recursively.
+	Directory filename.System
+	// MaxFileAge is how old a file must be to be found.
+	MaxFileAge time.Duration
+	// DepthAges overrides MaxFileAge for the files at the given depths below
+	// the directory: 0 for the files directly in it, 1 for those in its
+	// subdirectories, and so on, so that e.g. stray files in the directory
+	// itself can be found sooner than those in date subdirectories. It may be
+	// nil.
+	DepthAges map[int]time.Duration
+	// MaxFuture, if positive, makes the files whose mtimes are more than that
+	// far in the future be judged by when they were first found instead.
+	MaxFuture time.Duration
+	// Future remembers when the files MaxFuture applies to were first found,
+	// and should be shared by all the finders of the directory, or else
+	// FindForever and RecoverForever each keep their own.
+	Future *FutureFiles
+	// BirthTime makes FindForever judge files by when they were created, or
+	// else by the earlier of their mtimes and ctimes, rather than by their
+	// mtimes.
+	BirthTime bool
+	// Symlinks says how symbolic links are treated. A link that is followed
+	// is as old as the file it points to.
+	Symlinks filename.SymlinkPolicy
+	// SkipHidden makes the finder skip hidden files and the contents of
+	// hidden directories.
+	SkipHidden bool
+	// Young, if not nil, is sent the files each run of FindForever finds too
+	// young to be archived, so that files which never get old enough can be
+	// reported.
+	Young chan<- []filename.System
+}
+
+// findFiles recursively searches through the directory to find all the files
+// which are old enough to be eligible for upload, according to the options.
+// The list of files returned is sorted by mtime. If o.Young is not nil, the
+// files which are too young are returned too, in no particular order.
+func findFiles(o Options) ([]filename.System, []filename.System) {
 	// Give an initial capacity to the slice. 1024 chosen because it's a nice round number.
 	// TODO: Choose a better default.
 	eligibleFiles := make(map[filename.System]os.FileInfo)
-	eligibleTime := time.Now().Add(-maxFileAge)
+	var youngFiles []filename.System
+	// The files whose mtimes are too far in the future.
+	futureFiles := make(map[filename.System]bool)
+	now := time.Now()
 	totalEligibleSize := int64(0)
 
-	err := filepath.Walk(string(directory), func(path string, info os.FileInfo, err error) error {
+	err := filepath.Walk(string(o.Directory), func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			// Any error terminates the walk.
 			return err
 		}
+		if !info.IsDir() && filename.System(path).IsNFSSillyRename() {
+			// These are never archived, hidden or not.
+			pusherFinderNFSSillyRenamesSkipped.WithLabelValues(o.Datatype).Inc()
+			return nil
+		}
+		if o.SkipHidden && path != string(o.Directory) && strings.HasPrefix(info.Name(), ".") {
+			pusherFinderHiddenSkipped.WithLabelValues(o.Datatype).Inc()
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 		// Check whether a directory is very old and empty, and removes it if so.
 		if info.IsDir() {
-			err = checkDirectory(datatype, path, info.ModTime())
+			err = checkDirectory(o.Datatype, path, info.ModTime())
 			return err
 		}
-		if eligibleTime.After(info.ModTime()) {
+		if info.Mode()&os.ModeSymlink != 0 {
+			switch o.Symlinks {
+			case filename.SymlinksIgnore:
+				return nil
+			case filename.SymlinksArchiveAsLink:
+				// The link itself is archived.
+			default:
+				target, err := os.Stat(path)
+				if err != nil || target.IsDir() {
+					// A dangling link, or a link to a directory.
+					return nil
+				}
+				info = target
+			}
+		}
+		minAge := o.MaxFileAge
+		if len(o.DepthAges) > 0 {
+			if age, ok := o.DepthAges[depth(o.Directory, path)]; ok {
+				minAge = age
+			}
+		}
+		mTime := info.ModTime()
+		if o.MaxFuture > 0 && info.Mode()&os.ModeSymlink == 0 && clock.Age(mTime, now) < -o.MaxFuture {
+			// The file was written by a program with a bad clock, and would
+			// otherwise not be old enough until long after it should be.
+			futureFiles[filename.System(path)] = true
+			mTime = o.Future.firstFound(o.Datatype, filename.System(path), mTime, now)
+		} else if o.BirthTime {
+			var ok bool
+			if mTime, ok = createdAt(path, info); !ok {
+				pusherFinderNoBirthTime.WithLabelValues(o.Datatype).Inc()
+			}
+		}
+		// The age is corrected for steps of the clock, which would otherwise
+		// make files look much older or younger than they are.
+		if clock.Age(mTime, now) > minAge {
 			eligibleFiles[filename.System(path)] = info
 			totalEligibleSize += info.Size()
+		} else if o.Young != nil {
+			youngFiles = append(youngFiles, filename.System(path))
 		}
 		return nil
 	})
 
 	if err != nil {
-		log.Printf("Could not walk %s (err=%s). Proceeding with any discovered files.", directory, err)
+		log.Printf("Could not walk %s (err=%s). Proceeding with any discovered files.", o.Directory, err)
+	} else {
+		// The files which are gone, or no longer in the future, are
+		// forgotten.
+		o.Future.forget(futureFiles)
 	}
 
 	pusherFinderRuns.Inc()
@@ -101,11 +262,21 @@ func findFiles(datatype string, directory filename.System, maxFileAge time.Durat
 		return iInfo.ModTime().Before(jInfo.ModTime())
 	})
 	if len(fileList) > 0 {
-		pusherFinderMtimeLowerBound.WithLabelValues(datatype).Set(float64(eligibleFiles[fileList[0]].ModTime().Unix()))
+		pusherFinderMtimeLowerBound.WithLabelValues(o.Datatype).Set(float64(eligibleFiles[fileList[0]].ModTime().Unix()))
 	} else {
-		pusherFinderMtimeLowerBound.WithLabelValues(datatype).SetToCurrentTime()
+		pusherFinderMtimeLowerBound.WithLabelValues(o.Datatype).SetToCurrentTime()
 	}
-	return fileList
+	return fileList, youngFiles
+}
+
+// depth returns how many directories below the directory the file at the path
+// is: 0 if it is directly in it.
+func depth(directory filename.System, path string) int {
+	rel, err := filepath.Rel(string(directory), path)
+	if err != nil {
+		return 0
+	}
+	return strings.Count(rel, string(filepath.Separator))
 }
 
 // checkDirectory checks to see if a directory is sufficiently old and empty.
@@ -118,8 +289,7 @@ func checkDirectory(datatype string, path string, mTime time.Time) error {
 	}
 	// Do nothing if the directory is less than constant minDirectoryAge.  This
 	// could probably be more aggressive.
-	eligibleTime := time.Now().Add(-minDirectoryAge)
-	if mTime.After(eligibleTime) {
+	if clock.Age(mTime, time.Now()) < minDirectoryAge {
 		return nil
 	}
 	f, err := os.Open(path)
@@ -156,14 +326,84 @@ func checkDirectory(datatype string, path string, mTime time.Time) error {
 // IOPs. We use the memoryless library to ensure that the inter-`find` time is
 // the exponential distribution and that the time-distribution of `find`
 // operations is therefore memoryless.
-func FindForever(ctx context.Context, datatype string, directory filename.System, maxFileAge time.Duration, notificationChannel chan<- filename.System, times memoryless.Config) {
+//
+// Files are found by the first run after they are as old as the options say,
+// so a file may wait up to the time between runs longer than that, however
+// short its MaxFileAge or DepthAges.
+//
+// The files are sent in batches, oldest first.
+func FindForever(ctx context.Context, o Options, notificationChannel chan<- []filename.System, times memoryless.Config) {
+	if o.Future == nil {
+		o.Future = &FutureFiles{}
+	}
 	memoryless.Run(
 		ctx,
 		func() {
-			files := findFiles(datatype, directory, maxFileAge)
-			for _, file := range files {
-				notificationChannel <- file
-			}
+			files, young := findFiles(o)
+			sendBatches(ctx, files, notificationChannel)
+			sendBatches(ctx, young, o.Young)
 		},
 		times)
 }
+
+// FindOnce finds the files which were last modified at least minAge ago, and
+// sends them in batches, oldest first, like a single run of FindForever. It is
+// meant to be run when pusher starts, so that the files which piled up while
+// pusher was down are uploaded at once, instead of when FindForever first
+// runs. minAge replaces the MaxFileAge and DepthAges of the options, and files
+// are judged by their mtimes whatever Options.BirthTime says.
+func FindOnce(ctx context.Context, o Options, minAge time.Duration, notificationChannel chan<- []filename.System) {
+	o.MaxFileAge, o.DepthAges, o.BirthTime = minAge, nil, false
+	files, _ := findFiles(o)
+	pusherFinderStartupFiles.WithLabelValues(o.Datatype).Add(float64(len(files)))
+	log.Printf("Found %d files for %s older than %s on startup\n", len(files), o.Datatype, minAge)
+	sendBatches(ctx, files, notificationChannel)
+}
+
+// sendBatches sends the files in batches of at most batchSize, in order. It
+// gives up on the rest if ctx is done first, as when the TarCache has stopped.
+func sendBatches(ctx context.Context, files []filename.System, notificationChannel chan<- []filename.System) {
+	for len(files) > 0 {
+		n := len(files)
+		if n > batchSize {
+			n = batchSize
+		}
+		select {
+		case notificationChannel <- files[:n:n]:
+		case <-ctx.Done():
+			return
+		}
+		files = files[n:]
+	}
+}
+
+// RecoverForever finds files each time it is signaled, until its context is
+// canceled. It is meant to recover the files of events the listener dropped.
+// Each run waits for the delay, so that the drops of a burst are recovered
+// together, and then finds the files that FindForever would with the same
+// options, except that they are judged by their mtimes whatever
+// Options.BirthTime says, since a file created long ago may have just been
+// written. Files which were closed more recently can't be told apart from
+// files that are still being written, so they are left for the next run of
+// FindForever.
+func RecoverForever(ctx context.Context, o Options, delay time.Duration, notificationChannel chan<- []filename.System, signal <-chan struct{}) {
+	if o.Future == nil {
+		o.Future = &FutureFiles{}
+	}
+	o.BirthTime = false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signal:
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		pusherFinderRecoveryRuns.WithLabelValues(o.Datatype).Inc()
+		files, _ := findFiles(o)
+		sendBatches(ctx, files, notificationChannel)
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"io/fs"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"testing"
 	"time"
 
@@ -43,7 +46,7 @@ func TestFindForever(t *testing.T) {
 	// A new directory.
 	rtx.Must(os.Mkdir(tempdir+"/new_dir", 0750), "Mkdir failed")
 	// Set up the receiver channel.
-	foundFiles := make(chan filename.System)
+	foundFiles := make(chan []filename.System)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	c := memoryless.Config{
@@ -51,15 +54,12 @@ func TestFindForever(t *testing.T) {
 		Expected: time.Microsecond,
 		Max:      time.Microsecond,
 	}
-	go finder.FindForever(ctx, "test", filename.System(tempdir), time.Duration(6)*time.Hour, foundFiles, c)
-	localfiles := []filename.System{
-		<-foundFiles,
-		<-foundFiles,
-		<-foundFiles,
-	}
+	go finder.FindForever(ctx, finder.Options{Datatype: "test", Directory: filename.System(tempdir), MaxFileAge: time.Duration(6) * time.Hour, Symlinks: filename.SymlinksFollow}, foundFiles, c)
+	// The files are found in one batch.
+	localfiles := <-foundFiles
 	// Test files.
 	if len(localfiles) != 3 {
-		t.Errorf("len(localfiles) (%d) != 2", len(localfiles))
+		t.Fatalf("len(localfiles) (%d) != 3", len(localfiles))
 	}
 	if string(localfiles[0]) != tempdir+"/old_not_empty_dir/test_file" {
 		t.Errorf("wrong name[1]: %s", localfiles[0])
@@ -93,7 +93,276 @@ func TestFindForeverNoDirExists(t *testing.T) {
 		Expected: time.Millisecond,
 		Max:      time.Millisecond,
 	}
-	go finder.FindForever(ctx, "dne", "/tmp/dne", time.Duration(time.Millisecond), nil, c)
+	go finder.FindForever(ctx, finder.Options{Datatype: "dne", Directory: "/tmp/dne", MaxFileAge: time.Duration(time.Millisecond), Symlinks: filename.SymlinksFollow}, nil, c)
 	time.Sleep(1 * time.Second)
 	// If the finder doesn't crash on a bad directory, then it's a success.
 }
+
+func TestFindForeverSymlinks(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "find_file_test")
+	rtx.Must(err, "Could not set up temp dir")
+	defer os.RemoveAll(tempdir)
+	rtx.Must(os.Mkdir(tempdir+"/spool", 0750), "Mkdir failed")
+	rtx.Must(os.Mkdir(tempdir+"/dir", 0750), "Mkdir failed")
+	rtx.Must(ioutil.WriteFile(tempdir+"/target", []byte("data\n"), 0644), "WriteFile failed")
+	rtx.Must(ioutil.WriteFile(tempdir+"/spool/regular", []byte("data\n"), 0644), "WriteFile failed")
+	rtx.Must(os.Symlink(tempdir+"/target", tempdir+"/spool/link"), "Symlink failed")
+	rtx.Must(os.Symlink(tempdir+"/nowhere", tempdir+"/spool/dangling"), "Symlink failed")
+	rtx.Must(os.Symlink(tempdir+"/dir", tempdir+"/spool/dirlink"), "Symlink failed")
+	time.Sleep(10 * time.Millisecond)
+
+	tests := []struct {
+		policy filename.SymlinkPolicy
+		want   []string
+	}{
+		{policy: filename.SymlinksIgnore, want: []string{"regular"}},
+		{policy: filename.SymlinksFollow, want: []string{"link", "regular"}},
+		{policy: filename.SymlinksArchiveAsLink, want: []string{"dangling", "dirlink", "link", "regular"}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			foundFiles := make(chan []filename.System)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			c := memoryless.Config{Min: time.Millisecond, Expected: time.Millisecond, Max: time.Millisecond}
+			go finder.FindForever(ctx, finder.Options{Datatype: "spool", Directory: filename.System(tempdir + "/spool"), MaxFileAge: time.Millisecond, Symlinks: tt.policy}, foundFiles, c)
+			found := collect(foundFiles)
+			if !reflect.DeepEqual(found, tt.want) {
+				t.Errorf("Found %v, not %v", found, tt.want)
+			}
+		})
+	}
+}
+
+// collect returns the base names of the files found by a finder that runs
+// repeatedly, finding the same files each time, in sorted order.
+func collect(foundFiles <-chan []filename.System) []string {
+	seen := map[string]bool{}
+	deadline := time.After(200 * time.Millisecond)
+	for collecting := true; collecting; {
+		select {
+		case batch := <-foundFiles:
+			for _, f := range batch {
+				seen[filepath.Base(string(f))] = true
+			}
+		case <-deadline:
+			collecting = false
+		}
+	}
+	found := []string{}
+	for f := range seen {
+		found = append(found, f)
+	}
+	sort.Strings(found)
+	return found
+}
+
+func TestFindForeverSkipsHidden(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "find_file_test")
+	rtx.Must(err, "Could not set up temp dir")
+	defer os.RemoveAll(tempdir)
+	rtx.Must(os.MkdirAll(tempdir+"/.hidden_dir", 0750), "Mkdir failed")
+	rtx.Must(ioutil.WriteFile(tempdir+"/.hidden_dir/in_hidden_dir", []byte("data\n"), 0644), "WriteFile failed")
+	rtx.Must(ioutil.WriteFile(tempdir+"/.hidden_file.swp", []byte("data\n"), 0644), "WriteFile failed")
+	rtx.Must(ioutil.WriteFile(tempdir+"/visible", []byte("data\n"), 0644), "WriteFile failed")
+	// NFS silly renames are skipped whether or not hidden files are.
+	rtx.Must(ioutil.WriteFile(tempdir+"/.nfs000000000123456700000001", []byte("data\n"), 0644), "WriteFile failed")
+	time.Sleep(10 * time.Millisecond)
+
+	for _, skip := range []bool{false, true} {
+		foundFiles := make(chan []filename.System)
+		ctx, cancel := context.WithCancel(context.Background())
+		c := memoryless.Config{Min: time.Millisecond, Expected: time.Millisecond, Max: time.Millisecond}
+		go finder.FindForever(ctx, finder.Options{Datatype: "test", Directory: filename.System(tempdir), MaxFileAge: time.Millisecond, Symlinks: filename.SymlinksFollow, SkipHidden: skip}, foundFiles, c)
+		found := collect(foundFiles)
+		cancel()
+		want := []string{".hidden_file.swp", "in_hidden_dir", "visible"}
+		if skip {
+			want = []string{"visible"}
+		}
+		if !reflect.DeepEqual(found, want) {
+			t.Errorf("With skipHidden=%v, found %v, not %v", skip, found, want)
+		}
+	}
+}
+
+func TestFindForeverDepthAges(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "find_file_test")
+	rtx.Must(err, "Could not set up temp dir")
+	defer os.RemoveAll(tempdir)
+	rtx.Must(os.MkdirAll(tempdir+"/2026/10/16", 0750), "Mkdir failed")
+	// Every file is 20 minutes old.
+	mtime := time.Now().Add(-20 * time.Minute)
+	for _, f := range []string{"straggler", "2026/shallow", "2026/10/16/dated"} {
+		rtx.Must(ioutil.WriteFile(tempdir+"/"+f, []byte("data\n"), 0644), "WriteFile failed")
+		rtx.Must(os.Chtimes(tempdir+"/"+f, mtime, mtime), "Chtimes failed")
+	}
+
+	foundFiles := make(chan []filename.System)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := memoryless.Config{Min: time.Millisecond, Expected: time.Millisecond, Max: time.Millisecond}
+	// Only the files directly in the directory, and three levels down, need
+	// not wait the hour.
+	depthAges := map[int]time.Duration{0: 10 * time.Minute, 3: 15 * time.Minute}
+	go finder.FindForever(ctx, finder.Options{Datatype: "test", Directory: filename.System(tempdir), MaxFileAge: time.Hour, DepthAges: depthAges, Symlinks: filename.SymlinksFollow}, foundFiles, c)
+	found := collect(foundFiles)
+	want := []string{"dated", "straggler"}
+	if !reflect.DeepEqual(found, want) {
+		t.Errorf("Found %v, not %v", found, want)
+	}
+}
+
+func TestRecoverForever(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tempdir, err := ioutil.TempDir("/tmp", "find_file_test")
+	rtx.Must(err, "Could not set up temp dir")
+	defer os.RemoveAll(tempdir)
+	rtx.Must(ioutil.WriteFile(tempdir+"/dropped", []byte("data"), 0666), "Could not write file")
+	oldtime := time.Now().Add(-time.Minute)
+	rtx.Must(os.Chtimes(tempdir+"/dropped", oldtime, oldtime), "Chtimes failed")
+	// A file this young may still be open, and is left for a later run.
+	rtx.Must(ioutil.WriteFile(tempdir+"/young", []byte("data"), 0666), "Could not write file")
+
+	found := make(chan []filename.System)
+	signal := make(chan struct{}, 1)
+	go finder.RecoverForever(ctx, finder.Options{Datatype: "test", Directory: filename.System(tempdir), MaxFileAge: 30 * time.Second, Symlinks: filename.SymlinksFollow}, 50*time.Millisecond, found, signal)
+	select {
+	case batch := <-found:
+		t.Fatalf("%v was found before the finder was signaled", batch)
+	case <-time.After(200 * time.Millisecond):
+	}
+	signal <- struct{}{}
+	select {
+	case batch := <-found:
+		if len(batch) != 1 || string(batch[0]) != tempdir+"/dropped" {
+			t.Errorf("Found %v instead of the dropped file", batch)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("The file of the dropped event was not recovered")
+	}
+}
+
+func TestFindForeverReportsYoungFiles(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "find_file_test")
+	rtx.Must(err, "Could not set up temp dir")
+	defer os.RemoveAll(tempdir)
+	rtx.Must(ioutil.WriteFile(tempdir+"/old", []byte("data"), 0666), "Could not write file")
+	oldtime := time.Now().Add(-time.Minute)
+	rtx.Must(os.Chtimes(tempdir+"/old", oldtime, oldtime), "Chtimes failed")
+	rtx.Must(ioutil.WriteFile(tempdir+"/new", []byte("data"), 0666), "Could not write file")
+
+	found := make(chan []filename.System, 10)
+	young := make(chan []filename.System, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := memoryless.Config{Min: time.Millisecond, Expected: time.Millisecond, Max: time.Millisecond}
+	go finder.FindForever(ctx, finder.Options{Datatype: "test", Directory: filename.System(tempdir), MaxFileAge: 30 * time.Second, Young: young}, found, c)
+	select {
+	case batch := <-young:
+		if len(batch) != 1 || string(batch[0]) != tempdir+"/new" {
+			t.Errorf("Reported %v instead of just the new file", batch)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("The young file was not reported")
+	}
+	if batch := <-found; len(batch) != 1 || string(batch[0]) != tempdir+"/old" {
+		t.Errorf("Found %v instead of just the old file", batch)
+	}
+}
+
+func TestFindOnce(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "find_file_test")
+	rtx.Must(err, "Could not set up temp dir")
+	defer os.RemoveAll(tempdir)
+	rtx.Must(ioutil.WriteFile(tempdir+"/old", []byte("data"), 0666), "Could not write file")
+	oldtime := time.Now().Add(-time.Minute)
+	rtx.Must(os.Chtimes(tempdir+"/old", oldtime, oldtime), "Chtimes failed")
+	rtx.Must(ioutil.WriteFile(tempdir+"/new", []byte("data"), 0666), "Could not write file")
+
+	found := make(chan []filename.System, 1)
+	finder.FindOnce(context.Background(), finder.Options{Datatype: "test", Directory: filename.System(tempdir), Symlinks: filename.SymlinksFollow}, 30*time.Second, found)
+	select {
+	case batch := <-found:
+		if len(batch) != 1 || string(batch[0]) != tempdir+"/old" {
+			t.Errorf("Found %v instead of just the old file", batch)
+		}
+	default:
+		t.Error("FindOnce did not send the old file")
+	}
+}
+
+func TestFindOnceFutureFiles(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "find_file_test")
+	rtx.Must(err, "Could not set up temp dir")
+	defer os.RemoveAll(tempdir)
+	for f, d := range map[string]time.Duration{"far": 2 * time.Hour, "near": time.Minute} {
+		rtx.Must(ioutil.WriteFile(tempdir+"/"+f, []byte("data"), 0666), "Could not write file")
+		mtime := time.Now().Add(d)
+		rtx.Must(os.Chtimes(tempdir+"/"+f, mtime, mtime), "Chtimes failed")
+	}
+
+	// The far file is judged by when it was first found, which is now, so it
+	// isn't yet old enough.
+	o := finder.Options{Datatype: "test", Directory: filename.System(tempdir), MaxFuture: 10 * time.Minute, Future: &finder.FutureFiles{}, Symlinks: filename.SymlinksFollow}
+	found := make(chan []filename.System, 1)
+	finder.FindOnce(context.Background(), o, time.Second, found)
+	select {
+	case batch := <-found:
+		t.Errorf("Found %v, but no file is old enough", batch)
+	default:
+	}
+	// The files are left as they are.
+	info, err := os.Stat(tempdir + "/far")
+	rtx.Must(err, "Could not stat the far file")
+	if !info.ModTime().After(time.Now().Add(time.Hour)) {
+		t.Errorf("The far file's mtime was changed to %s", info.ModTime())
+	}
+
+	// From then on, it ages like any new file.
+	finder.FindOnce(context.Background(), o, 0, found)
+	select {
+	case batch := <-found:
+		if len(batch) != 1 || string(batch[0]) != tempdir+"/far" {
+			t.Errorf("Found %v instead of just the far file", batch)
+		}
+	default:
+		t.Error("FindOnce did not send the far file")
+	}
+}
+
+func TestFindForeverBirthTime(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "find_file_test")
+	rtx.Must(err, "Could not set up temp dir")
+	defer os.RemoveAll(tempdir)
+	// The file was just written, but keeps being touched into the future.
+	rtx.Must(ioutil.WriteFile(tempdir+"/touched", []byte("data"), 0666), "Could not write file")
+	mtime := time.Now().Add(time.Hour)
+	rtx.Must(os.Chtimes(tempdir+"/touched", mtime, mtime), "Chtimes failed")
+	o := finder.Options{Datatype: "test", Directory: filename.System(tempdir), BirthTime: true, Symlinks: filename.SymlinksFollow}
+
+	// FindOnce goes by the mtime whatever the options say.
+	found := make(chan []filename.System, 1)
+	finder.FindOnce(context.Background(), o, 0, found)
+	select {
+	case batch := <-found:
+		t.Errorf("Found %v by birth time, but FindOnce should go by mtime", batch)
+	default:
+	}
+
+	// FindForever goes by its birth time, or else its ctime, which is in the
+	// past.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := memoryless.Config{Min: time.Millisecond, Expected: time.Millisecond, Max: time.Millisecond}
+	go finder.FindForever(ctx, o, found, c)
+	select {
+	case batch := <-found:
+		if len(batch) != 1 || string(batch[0]) != tempdir+"/touched" {
+			t.Errorf("Found %v instead of just the touched file", batch)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("FindForever did not send the touched file")
+	}
+}
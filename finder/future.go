@@ -0,0 +1,63 @@
+package finder
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/m-lab/pusher/filename"
+)
+
+// FutureFiles remembers when the finder first found each file whose mtime was
+// too far in the future (see Options.MaxFuture), so that the file's age can be
+// counted from then instead. The files themselves are left as they are. It is
+// safe for concurrent use, so that the finders of one directory can share it,
+// and the zero FutureFiles is ready to use. A nil *FutureFiles remembers
+// nothing, so that such files are always found to be new.
+type FutureFiles struct {
+	mu    sync.Mutex
+	files map[filename.System]futureFile
+}
+
+// futureFile is the mtime a file had when it was first found, and when that
+// was.
+type futureFile struct {
+	mtime time.Time
+	found time.Time
+}
+
+// firstFound returns when the file, whose mtime is in the future, was first
+// found with that mtime. A file found for the first time, or whose mtime has
+// changed since, was first found now.
+func (f *FutureFiles) firstFound(datatype string, path filename.System, mtime, now time.Time) time.Time {
+	if f == nil {
+		return now
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if file, ok := f.files[path]; ok && file.mtime.Equal(mtime) {
+		return file.found
+	}
+	if f.files == nil {
+		f.files = make(map[filename.System]futureFile)
+	}
+	f.files[path] = futureFile{mtime: mtime, found: now}
+	pusherFinderFutureFiles.WithLabelValues(datatype).Inc()
+	log.Printf("The mtime of %s is %s in the future, so its age is counted from now.", path, mtime.Sub(now))
+	return now
+}
+
+// forget forgets the files which are not in the set, e.g. because a walk of
+// the whole directory did not find them.
+func (f *FutureFiles) forget(keep map[filename.System]bool) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for path := range f.files {
+		if !keep[path] {
+			delete(f.files, path)
+		}
+	}
+}
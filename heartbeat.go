@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/m-lab/go/prometheusx"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/m-lab/pusher/pipeline"
+	"github.com/m-lab/pusher/tarcache"
+	"github.com/m-lab/pusher/tarfile"
+)
+
+var pusherHeartbeats = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pusher_heartbeats_total",
+		Help: "The number of heartbeat objects uploaded, by whether the upload succeeded",
+	},
+	[]string{"result"},
+)
+
+// A heartbeat is the status of a pusher, uploaded regularly with a fixed name
+// (see --heartbeat_interval), so that consumers of the archives can tell from
+// the bucket alone which pushers are alive, e.g. at sites whose metrics can't
+// be scraped.
+type heartbeat struct {
+	Experiment string    `json:"experiment"`
+	NodeName   string    `json:"node_name"`
+	Hostname   string    `json:"hostname"`
+	Version    string    `json:"version"`
+	GitCommit  string    `json:"git_commit"`
+	Started    time.Time `json:"started"`
+	Time       time.Time `json:"time"`
+	// Datatypes holds the status of the experiment's datatypes.
+	Datatypes map[string]datatypeStatus `json:"datatypes"`
+}
+
+// datatypeStatus is the status of one datatype in a heartbeat.
+type datatypeStatus struct {
+	// The tarfiles waiting to be uploaded, and the files and bytes in them.
+	Tarfiles int   `json:"tarfiles"`
+	Files    int   `json:"files"`
+	Bytes    int64 `json:"bytes"`
+	// The seconds since an upload last succeeded and was last attempted,
+	// counted from when pusher started if none has been.
+	SecondsSinceSuccess float64 `json:"seconds_since_success"`
+	SecondsSinceAttempt float64 `json:"seconds_since_upload_attempt"`
+}
+
+// newHeartbeat returns the heartbeat of the tenant, whose datatypes are
+// archived by the pipelines, for a pusher which started at the given time.
+func newHeartbeat(tn tenant, started time.Time, pipelines map[string]*pipeline.Pipeline) heartbeat {
+	hb := heartbeat{
+		Experiment: tn.Experiment,
+		NodeName:   tn.NodeName,
+		Hostname:   hostName(),
+		Version:    buildVersion(),
+		GitCommit:  prometheusx.GitShortCommit,
+		Started:    started,
+		Time:       time.Now().UTC(),
+		Datatypes:  make(map[string]datatypeStatus),
+	}
+	for datatype, p := range pipelines {
+		hb.Datatypes[datatype] = datatypeStatusOf(datatype, p.Snapshot())
+	}
+	return hb
+}
+
+// datatypeStatusOf returns the status of a datatype whose tarfiles are those
+// in the snapshot.
+func datatypeStatusOf(datatype string, snapshot []tarcache.TarfileState) datatypeStatus {
+	status := datatypeStatus{Tarfiles: len(snapshot)}
+	for _, tf := range snapshot {
+		status.Files += tf.Files
+		status.Bytes += int64(tf.Size)
+	}
+	if sinceSuccess, sinceAttempt, ok := tarfile.UploadAges(datatype); ok {
+		status.SecondsSinceSuccess = sinceSuccess.Seconds()
+		status.SecondsSinceAttempt = sinceAttempt.Seconds()
+	}
+	return status
+}
+
+// sendHeartbeats uploads the heartbeat returned by status at once, and then
+// every interval, until ctx is done. Each upload is a single attempt, because
+// the next heartbeat will replace it anyway.
+func sendHeartbeats(ctx context.Context, upload func(ctx context.Context, contents []byte) error, interval time.Duration, status func() heartbeat) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		contents, err := json.Marshal(status())
+		if err == nil {
+			err = upload(ctx, contents)
+		}
+		if err != nil {
+			log.Printf("Could not upload the heartbeat (error: %q)\n", err)
+			pusherHeartbeats.WithLabelValues("error").Inc()
+		} else {
+			pusherHeartbeats.WithLabelValues("ok").Inc()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/m-lab/go/flagx"
+)
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// openArchive opens a local tarfile, or a GCS object named by a gs:// URL. GCS
+// is accessed with the credentials given by the credentials file and service
+// account, as for uploads.
+func openArchive(ctx context.Context, location, credentialsFile, serviceAccount string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(location, "gs://") {
+		return os.Open(location)
+	}
+	object, err := gcsObject(ctx, location, credentialsFile, serviceAccount)
+	if err != nil {
+		return nil, err
+	}
+	return object.NewReader(ctx)
+}
+
+// gcsObject returns a handle on the GCS object named by a gs:// URL, using the
+// given credentials as openArchive does.
+func gcsObject(ctx context.Context, location, credentialsFile, serviceAccount string) (*storage.ObjectHandle, error) {
+	parts := strings.SplitN(strings.TrimPrefix(location, "gs://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("%q is not of the form gs://bucket/object", location)
+	}
+	opts, err := storageOptions(ctx, credentialsFile, serviceAccount, nil)
+	if err != nil {
+		return nil, err
+	}
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return client.Bucket(parts[0]).Object(parts[1]), nil
+}
+
+// describeType returns how a tar entry's type is shown in the manifest.
+func describeType(h *tar.Header) string {
+	switch h.Typeflag {
+	case tar.TypeReg:
+		return "file"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	case tar.TypeDir:
+		return "dir"
+	default:
+		return fmt.Sprintf("type-%c", h.Typeflag)
+	}
+}
+
+// How every gzip file, and every zip archive with at least one member, starts.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zipMagic  = []byte("PK\x03\x04")
+)
+
+// manifestHeader and manifestFormat lay out the manifest.
+const (
+	manifestHeader = "%-8s %-10s %12s %-20s %-64s %s\n"
+	manifestFormat = "%-8s %-10s %12d %-20s %-64s %s\n"
+)
+
+// inspectArchive writes the manifest of a tarfile, with the SHA-256 of every
+// file and the PAX records of its entries, and checks that the gzip and tar
+// layers are intact. A tarfile that does not start like a gzip file is read as
+// a plain, uncompressed one, unless it starts like a zip archive. The manifest
+// is written as the archive is read, so a broken archive still has the entries
+// before the damage listed.
+func inspectArchive(archive io.Reader, out io.Writer) error {
+	counter := &countingReader{r: archive}
+	buffered := bufio.NewReader(counter)
+	var contents io.Reader = buffered
+	layers := "tar layer is"
+	if magic, _ := buffered.Peek(len(zipMagic)); bytes.Equal(magic, zipMagic) {
+		return inspectZip(buffered, out)
+	}
+	if magic, _ := buffered.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return fmt.Errorf("gzip layer is broken: %w", err)
+		}
+		contents = gz
+		layers = "gzip and tar layers are"
+	}
+	tr := tar.NewReader(contents)
+	records := map[string]map[string]bool{}
+	files := 0
+	var size int64
+	fmt.Fprintf(out, manifestHeader, "TYPE", "MODE", "SIZE", "MODIFIED", "SHA256", "NAME")
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("tar layer is broken after %d entries: %w", files, err)
+		}
+		hash := sha256.New()
+		n, err := io.Copy(hash, tr)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %w", h.Name, err)
+		}
+		sum := "-"
+		if h.Typeflag == tar.TypeReg {
+			sum = hex.EncodeToString(hash.Sum(nil))
+		}
+		name := h.Name
+		if h.Linkname != "" {
+			name += " -> " + h.Linkname
+		}
+		fmt.Fprintf(out, manifestFormat, describeType(h), os.FileMode(h.Mode).String(), n, h.ModTime.UTC().Format("2006-01-02T15:04:05Z"), sum, name)
+		for k, v := range h.PAXRecords {
+			if records[k] == nil {
+				records[k] = map[string]bool{}
+			}
+			records[k][v] = true
+		}
+		files++
+		size += n
+	}
+	// Reading to the end checks the gzip checksum.
+	if _, err := io.Copy(ioutil.Discard, contents); err != nil {
+		return fmt.Errorf("%s broken: %w", layers, err)
+	}
+	if len(records) > 0 {
+		fmt.Fprintln(out, "\nPAX records:")
+		keys := make([]string, 0, len(records))
+		for k := range records {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			values := make([]string, 0, len(records[k]))
+			for v := range records[k] {
+				values = append(values, v)
+			}
+			sort.Strings(values)
+			for _, v := range values {
+				fmt.Fprintf(out, "  %s=%s\n", k, v)
+			}
+		}
+	}
+	fmt.Fprintf(out, "\n%d entries, %d bytes in %d archive bytes; %s intact\n", files, size, counter.n, layers)
+	return nil
+}
+
+// inspectZip is inspectArchive for zip archives, which pusher makes with the
+// metadata in the archive comment instead of in PAX records. Zip archives are
+// indexed at the end, so the whole archive is read before anything is written.
+func inspectZip(archive io.Reader, out io.Writer) error {
+	data, err := ioutil.ReadAll(archive)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return fmt.Errorf("zip layer is broken: %w", err)
+	}
+	var size int64
+	fmt.Fprintf(out, manifestHeader, "TYPE", "MODE", "SIZE", "MODIFIED", "SHA256", "NAME")
+	for i, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("zip layer is broken after %d entries: %w", i, err)
+		}
+		hash := sha256.New()
+		target := &bytes.Buffer{}
+		// Reading to the end checks the CRC.
+		n, err := io.Copy(io.MultiWriter(hash, target), r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("could not read %s: %w", f.Name, err)
+		}
+		kind, sum, name := "file", hex.EncodeToString(hash.Sum(nil)), f.Name
+		if f.Mode()&os.ModeSymlink != 0 {
+			kind, sum, name = "symlink", "-", name+" -> "+target.String()
+		}
+		fmt.Fprintf(out, manifestFormat, kind, f.Mode().Perm().String(), n, f.Modified.UTC().Format("2006-01-02T15:04:05Z"), sum, name)
+		size += n
+	}
+	if zr.Comment != "" {
+		fmt.Fprintln(out, "\nArchive comment:")
+		for _, line := range strings.Split(zr.Comment, "\n") {
+			fmt.Fprintf(out, "  %s\n", line)
+		}
+	}
+	fmt.Fprintf(out, "\n%d entries, %d bytes in %d archive bytes; zip layer is intact\n", len(zr.File), size, len(data))
+	return nil
+}
+
+// inspectMain runs `pusher inspect` with the given arguments, which follow the
+// word "inspect" on the command line.
+func inspectMain(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	fs.SetOutput(out)
+	credentials := fs.String("credentials_file", "", "A file of credentials to use for GCS instead of the application default credentials.")
+	serviceAccount := fs.String("impersonate_service_account", "", "The email address of a service account to impersonate for GCS.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s inspect: %s inspect [flags] <file.tgz, file.tar, file.zip or gs://bucket/object>...\n", os.Args[0], os.Args[0])
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), `
+Prints the manifest of each archive, with the SHA-256 of every file and the PAX
+records, and checks that its gzip (if any) and tar layers, or its zip layer,
+are intact. The GCS credentials flags can also be set by environment
+variables, as for uploads.
+`)
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := flagx.ArgsFromEnv(fs); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("no archive to inspect")
+	}
+	broken := 0
+	for i, location := range fs.Args() {
+		if i > 0 {
+			fmt.Fprintln(out)
+		}
+		fmt.Fprintf(out, "%s:\n", location)
+		archive, err := openArchive(ctx, location, *credentials, *serviceAccount)
+		if err == nil {
+			err = inspectArchive(archive, out)
+			archive.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(out, "ERROR: %v\n", err)
+			broken++
+		}
+	}
+	if broken > 0 {
+		return fmt.Errorf("%d of %d archives could not be inspected", broken, fs.NArg())
+	}
+	return nil
+}
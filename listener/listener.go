@@ -7,65 +7,207 @@ import (
 	"context"
 	"log"
 	"os"
+	"time"
 
 	"github.com/m-lab/pusher/filename"
+	"github.com/m-lab/pusher/metrics"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"golang.org/x/sys/unix"
 
 	"github.com/rjeczalik/notify"
 )
 
+var collectors metrics.Collectors
+
+// RegisterMetrics registers the listener's metrics on r, or on
+// prometheus.DefaultRegisterer if r is nil. Create registers them on the
+// registerer it is given, so this need only be called to export them before
+// then.
+func RegisterMetrics(r prometheus.Registerer) {
+	collectors.Register(r)
+}
+
 // Set up prometheus metrics.
 var (
-	pusherFileEventCount = promauto.NewCounterVec(
+	pusherFileEventCount = collectors.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "pusher_file_events_total",
 			Help: "How many file events have we heard.",
 		},
 		[]string{"type"},
 	)
-	pusherFileEventErrorCount = promauto.NewCounterVec(
+	pusherHiddenFilesSkipped = collectors.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pusher_listener_hidden_files_skipped_total",
+			Help: "How many file events we have ignored because the file or a directory it is in is hidden.",
+		},
+	)
+	pusherNFSSillyRenamesSkipped = collectors.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pusher_listener_nfs_silly_renames_skipped_total",
+			Help: "How many file events we have ignored because the file was an NFS silly rename (.nfsXXXX) of a deleted file.",
+		},
+	)
+	pusherEventsDropped = collectors.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pusher_listener_events_dropped_total",
+			Help: "How many file events we have dropped because the event buffer was full.",
+		},
+	)
+	pusherFileEventErrorCount = collectors.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "pusher_file_event_errors_total",
 			Help: "How many file event errors we have encountered.",
 		},
 		[]string{"type"},
 	)
+	pusherEventLag = collectors.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pusher_listener_event_lag_seconds",
+			Help:    "How long after a file was last written the listener dequeued its close event.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		},
+	)
+	pusherEventQueueLength = collectors.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pusher_listener_event_queue_length",
+			Help: "How many file events were waiting to be handled when the listener last dequeued one.",
+		},
+	)
 	// Allow mocking of os.Open to test error cases.
 	osOpen = os.Open
 )
 
+// DefaultEventBuffer is the number of file events buffered when Create is
+// given no buffer size.
+const DefaultEventBuffer = 1000000
+
+// notify drops the events it can't send at once without telling anyone, so it
+// is given a small channel of its own, which is drained immediately into the
+// event buffer, where drops can be counted.
+const notifyBuffer = 1024
+
 // Listener contains all member variables required for the state of a running
 // file listener.
 type Listener struct {
-	events      chan notify.EventInfo
-	fileChannel chan<- filename.System
+	notified chan notify.EventInfo
+	events   chan notify.EventInfo
+	dropped  chan struct{}
+	// The directory itself being removed or moved away is heard of on
+	// removedEvents, and reported by closing removed.
+	removedEvents chan notify.EventInfo
+	removed       chan struct{}
+	stop          chan struct{}
+	fileChannel   chan<- filename.System
+	directory     filename.System
+	symlinks      filename.SymlinkPolicy
+	skipHidden    bool
 }
 
 // Create and set up an inotify watcher on the directory and its
 // subdirectories.  File events will be converted into `tarcache.LocalDataFile`
 // structs and pointers to those structs will sent to the passed-in channel.
-func Create(directory filename.System, fileChannel chan<- filename.System) (*Listener, error) {
+// Symbolic links moved into the directory are dropped if the policy is
+// SymlinksIgnore, and hidden files are dropped if skipHidden is true. At most
+// eventBuffer events (DefaultEventBuffer if it is zero) wait to be handled;
+// more are dropped, and Dropped says so. The listener's metrics are registered
+// on the registerer, or on prometheus.DefaultRegisterer if it is nil.
+func Create(directory filename.System, fileChannel chan<- filename.System, symlinks filename.SymlinkPolicy, skipHidden bool, eventBuffer int, registerer prometheus.Registerer) (*Listener, error) {
+	RegisterMetrics(registerer)
+	if symlinks == "" {
+		symlinks = filename.SymlinksFollow
+	}
+	if eventBuffer <= 0 {
+		eventBuffer = DefaultEventBuffer
+	}
 	listener := &Listener{
-		events:      make(chan notify.EventInfo, 1000000),
-		fileChannel: fileChannel,
+		notified:      make(chan notify.EventInfo, notifyBuffer),
+		events:        make(chan notify.EventInfo, eventBuffer),
+		dropped:       make(chan struct{}, 1),
+		removedEvents: make(chan notify.EventInfo, 1),
+		removed:       make(chan struct{}),
+		stop:          make(chan struct{}),
+		fileChannel:   fileChannel,
+		directory:     directory,
+		symlinks:      symlinks,
+		skipHidden:    skipHidden,
 	}
 	// "..." is the special syntax that means "also watch all subdirectories".
-	if err := notify.Watch(string(directory)+"/...", listener.events, notify.InCloseWrite|notify.InMovedTo); err != nil {
+	if err := notify.Watch(string(directory)+"/...", listener.notified, notify.InCloseWrite|notify.InMovedTo); err != nil {
 		return nil, err
 	}
+	if err := notify.Watch(string(directory), listener.removedEvents, notify.InDeleteSelf|notify.InMoveSelf); err != nil {
+		notify.Stop(listener.notified)
+		return nil, err
+	}
+	go listener.buffer()
 	return listener, nil
 }
 
+// Dropped receives a value after events have been dropped because the event
+// buffer was full. Drops that happen before the value is received are not
+// reported again, so the files of all the events dropped before the value was
+// sent need to be found some other way, e.g. by the finder.
+func (l *Listener) Dropped() <-chan struct{} {
+	return l.dropped
+}
+
+// Removed is closed once the directory itself is removed or moved away, after
+// which the watch hears of nothing written to whatever takes its place.
+func (l *Listener) Removed() <-chan struct{} {
+	return l.removed
+}
+
+// Missed reports that events may have been missed some other way, e.g. while
+// the directory was being watched again after it was replaced, so that Dropped
+// says so.
+func (l *Listener) Missed() {
+	select {
+	case l.dropped <- struct{}{}:
+	default:
+	}
+}
+
+// buffer moves events from notify into the event buffer until ListenForever
+// stops, dropping those that don't fit.
+func (l *Listener) buffer() {
+	removed := false
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-l.removedEvents:
+			if !removed {
+				close(l.removed)
+				removed = true
+			}
+		case ei := <-l.notified:
+			select {
+			case l.events <- ei:
+			default:
+				pusherEventsDropped.Inc()
+				select {
+				case l.dropped <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
 // ListenForever listens for listen for FS events and sends them along the fileChannel until Stop is called.
 func (l *Listener) ListenForever(ctx context.Context) {
+	defer func() {
+		notify.Stop(l.notified)
+		notify.Stop(l.removedEvents)
+		close(l.stop)
+	}()
 	for {
 		select {
 		case <-ctx.Done():
-			notify.Stop(l.events)
 			return
 		case ei := <-l.events:
+			pusherEventQueueLength.Set(float64(len(l.events)))
 			source := "unknown"
 			sysinfo := ei.Sys().(*unix.InotifyEvent)
 			if sysinfo.Mask&unix.IN_CLOSE_WRITE != 0 {
@@ -75,21 +217,55 @@ func (l *Listener) ListenForever(ctx context.Context) {
 				source = "movedto"
 			}
 			pusherFileEventCount.WithLabelValues(source).Inc()
-			if !isOpenable(ei.Path()) {
-				log.Printf("Could not open file for event: %v\n", ei)
+			if filename.System(ei.Path()).IsNFSSillyRename() {
+				pusherNFSSillyRenamesSkipped.Inc()
 				continue
 			}
-			l.fileChannel <- filename.System(ei.Path())
+			if l.skipHidden && filename.System(ei.Path()).Internal(l.directory).IsHidden() {
+				pusherHiddenFilesSkipped.Inc()
+				continue
+			}
+			// A link that is archived as a link need not point anywhere.
+			isLink := l.symlinks != filename.SymlinksFollow && filename.System(ei.Path()).IsSymlink()
+			if isLink && l.symlinks == filename.SymlinksIgnore {
+				continue
+			}
+			if !isLink {
+				mtime, ok := openedModTime(ei.Path())
+				if !ok {
+					log.Printf("Could not open file for event: %v\n", ei)
+					continue
+				}
+				// A file moved into the directory keeps the mtime it had
+				// wherever it was written, so only the close of a write
+				// tells us how long the event waited.
+				if source == "closewrite" && !mtime.IsZero() {
+					pusherEventLag.Observe(time.Since(mtime).Seconds())
+				}
+			}
+			select {
+			case l.fileChannel <- filename.System(ei.Path()):
+			case <-ctx.Done():
+				// Whoever reads the channel may have stopped.
+				return
+			}
 		}
 	}
 
 }
 
-func isOpenable(path string) bool {
-	_, err := osOpen(path)
+// openedModTime returns the modification time of the file, and whether it could
+// be opened.
+func openedModTime(path string) (time.Time, bool) {
+	f, err := osOpen(path)
 	if err != nil {
 		pusherFileEventErrorCount.WithLabelValues("open").Inc()
-		return false
+		return time.Time{}, false
+	}
+	defer f.Close()
+	fstat, err := f.Stat()
+	if err != nil {
+		return time.Time{}, true
 	}
-	return true
+	return fstat.ModTime(), true
 }
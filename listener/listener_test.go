@@ -18,7 +18,7 @@ func TestListenForClose(t *testing.T) {
 	rtx.Must(err, "Could not create tempdir")
 	defer os.RemoveAll(dir)
 	ldfChan := make(chan filename.System)
-	l, err := listener.Create(filename.System(dir), ldfChan)
+	l, err := listener.Create(filename.System(dir), ldfChan, filename.SymlinksFollow, false, 0, nil)
 	rtx.Must(err, "Could not create listener")
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -37,7 +37,7 @@ func TestListenForMove(t *testing.T) {
 	os.Mkdir(dir+"/subdir", 0777)
 	rtx.Must(ioutil.WriteFile(dir+"/testfile", []byte("test"), 0777), "Could not write file")
 	ldfChan := make(chan filename.System)
-	l, err := listener.Create(filename.System(dir+"/subdir"), ldfChan)
+	l, err := listener.Create(filename.System(dir+"/subdir"), ldfChan, filename.SymlinksFollow, false, 0, nil)
 	rtx.Must(err, "Could not create listener")
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -55,7 +55,7 @@ func TestListenInSubdir(t *testing.T) {
 	defer os.RemoveAll(dir)
 	os.Mkdir(dir+"/subdir", 0777)
 	ldfChan := make(chan filename.System)
-	l, err := listener.Create(filename.System(dir+"/subdir"), ldfChan)
+	l, err := listener.Create(filename.System(dir+"/subdir"), ldfChan, filename.SymlinksFollow, false, 0, nil)
 	rtx.Must(err, "Could not create listener")
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -75,7 +75,7 @@ func TestCreateOnBadDir(t *testing.T) {
 	rtx.Must(err, "Could not create tempdir")
 	defer os.RemoveAll(dir)
 	ldfChan := make(chan filename.System)
-	l, err := listener.Create(filename.System(dir+"/doesnotexist"), ldfChan)
+	l, err := listener.Create(filename.System(dir+"/doesnotexist"), ldfChan, filename.SymlinksFollow, false, 0, nil)
 	if l != nil || err == nil {
 		t.Error("Should have had an error")
 	}
@@ -87,7 +87,7 @@ func TestReadCloseWontNotify(t *testing.T) {
 	defer os.RemoveAll(dir)
 	rtx.Must(ioutil.WriteFile(dir+"/testfile", []byte("test"), 0777), "Could not write file")
 	ldfChan := make(chan filename.System)
-	l, err := listener.Create(filename.System(dir), ldfChan)
+	l, err := listener.Create(filename.System(dir), ldfChan, filename.SymlinksFollow, false, 0, nil)
 	rtx.Must(err, "Could not create listener")
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -102,3 +102,113 @@ func TestReadCloseWontNotify(t *testing.T) {
 	case <-time.NewTimer(100 * time.Millisecond).C:
 	}
 }
+
+func TestListenIgnoresSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "TestListenIgnoresSymlinks.")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	os.Mkdir(dir+"/subdir", 0777)
+	rtx.Must(ioutil.WriteFile(dir+"/testfile", []byte("test"), 0777), "Could not write file")
+	rtx.Must(os.Symlink(dir+"/testfile", dir+"/link"), "Could not create link")
+	ldfChan := make(chan filename.System)
+	l, err := listener.Create(filename.System(dir+"/subdir"), ldfChan, filename.SymlinksIgnore, false, 0, nil)
+	rtx.Must(err, "Could not create listener")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.ListenForever(ctx)
+	rtx.Must(os.Rename(dir+"/link", dir+"/subdir/link"), "Could not rename")
+	rtx.Must(os.Rename(dir+"/testfile", dir+"/subdir/testfile"), "Could not rename")
+	if ldf := <-ldfChan; string(ldf) != dir+"/subdir/testfile" {
+		t.Errorf("The link should have been ignored, but got %v", ldf)
+	}
+}
+
+func TestListenSkipsHidden(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "TestListenSkipsHidden.")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	os.MkdirAll(dir+"/.hidden", 0777)
+	ldfChan := make(chan filename.System)
+	l, err := listener.Create(filename.System(dir), ldfChan, filename.SymlinksFollow, true, 0, nil)
+	rtx.Must(err, "Could not create listener")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.ListenForever(ctx)
+	rtx.Must(ioutil.WriteFile(dir+"/.testfile.swp", []byte("test"), 0777), "Could not write file")
+	rtx.Must(ioutil.WriteFile(dir+"/.hidden/testfile", []byte("test"), 0777), "Could not write file")
+	rtx.Must(ioutil.WriteFile(dir+"/testfile", []byte("test"), 0777), "Could not write file")
+	if ldf := <-ldfChan; string(ldf) != dir+"/testfile" {
+		t.Errorf("The hidden files should have been skipped, but got %v", ldf)
+	}
+}
+
+func TestListenSkipsNFSSillyRenames(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "TestListenSkipsNFSSillyRenames.")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	ldfChan := make(chan filename.System)
+	l, err := listener.Create(filename.System(dir), ldfChan, filename.SymlinksFollow, false, 0, nil)
+	rtx.Must(err, "Could not create listener")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.ListenForever(ctx)
+	rtx.Must(ioutil.WriteFile(dir+"/.nfs000000000123456700000001", []byte("test"), 0777), "Could not write file")
+	rtx.Must(ioutil.WriteFile(dir+"/testfile", []byte("test"), 0777), "Could not write file")
+	if ldf := <-ldfChan; string(ldf) != dir+"/testfile" {
+		t.Errorf("The NFS silly rename should have been skipped, but got %v", ldf)
+	}
+}
+
+func TestListenDropsEventsWhenTheBufferIsFull(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "TestListenDropsEventsWhenTheBufferIsFull.")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	ldfChan := make(chan filename.System)
+	l, err := listener.Create(filename.System(dir), ldfChan, filename.SymlinksFollow, false, 1, nil)
+	rtx.Must(err, "Could not create listener")
+	// Nothing handles events yet, so the second one doesn't fit.
+	for _, name := range []string{"first", "second", "third"} {
+		rtx.Must(ioutil.WriteFile(dir+"/"+name, []byte("test"), 0777), "Could not write file")
+	}
+	select {
+	case <-l.Dropped():
+	case <-time.After(5 * time.Second):
+		t.Fatal("The listener should have reported dropped events")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.ListenForever(ctx)
+	// The event that fit is still handled.
+	if ldf := <-ldfChan; !strings.HasPrefix(string(ldf), dir+"/") {
+		t.Errorf("Got %v instead of one of the files", ldf)
+	}
+}
+
+func TestListenReportsRemoval(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "TestListenReportsRemoval.")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	rtx.Must(os.Mkdir(dir+"/subdir", 0777), "Could not create subdir")
+	ldfChan := make(chan filename.System)
+	l, err := listener.Create(filename.System(dir+"/subdir"), ldfChan, filename.SymlinksFollow, false, 0, nil)
+	rtx.Must(err, "Could not create listener")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.ListenForever(ctx)
+
+	// Removing a subdirectory of the watched one is not a removal.
+	rtx.Must(os.Mkdir(dir+"/subdir/2026", 0777), "Could not create a subdirectory")
+	rtx.Must(os.Remove(dir+"/subdir/2026"), "Could not remove a subdirectory")
+	select {
+	case <-l.Removed():
+		t.Fatal("The removal of a subdirectory was reported")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	rtx.Must(os.Remove(dir+"/subdir"), "Could not remove the directory")
+	select {
+	case <-l.Removed():
+	case <-time.After(5 * time.Second):
+		t.Error("The removal of the directory was not reported")
+	}
+}
@@ -21,8 +21,20 @@ func failOnOpen(name string) (*os.File, error) {
 func TestOsOpenFailure(t *testing.T) {
 	osOpen = failOnOpen
 	defer func() { osOpen = os.Open }()
-	if isOpenable("") {
-		t.Error("isOpenable should return false")
+	if _, ok := openedModTime(""); ok {
+		t.Error("openedModTime should return false")
+	}
+}
+
+func TestOpenedModTime(t *testing.T) {
+	f, err := ioutil.TempFile("", "TestOpenedModTime.")
+	rtx.Must(err, "Could not create file")
+	defer os.Remove(f.Name())
+	f.Close()
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	rtx.Must(os.Chtimes(f.Name(), mtime, mtime), "Could not set the mtime")
+	if got, ok := openedModTime(f.Name()); !ok || !got.Equal(mtime) {
+		t.Errorf("openedModTime() = %v, %v, want %v, true", got, ok, mtime)
 	}
 }
 
@@ -45,7 +57,7 @@ func TestBadEvent(t *testing.T) {
 	rtx.Must(err, "Could not create dir")
 	defer os.RemoveAll(dir)
 	ldfChan := make(chan filename.System)
-	l, err := Create(filename.System(dir), ldfChan)
+	l, err := Create(filename.System(dir), ldfChan, filename.SymlinksFollow, false, 0, nil)
 	rtx.Must(err, "Could not create listener")
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collectors holds the Prometheus collectors of a package. Unlike promauto's,
+// they are not registered as the package is imported, but by Register, on the
+// registerer a program chooses, so that programs embedding pusher's packages
+// can keep its metrics in registries of their own. The zero Collectors is
+// ready to use, and is meant to be a package variable from which the package's
+// metrics are made.
+type Collectors struct {
+	mu         sync.Mutex
+	collectors []prometheus.Collector
+	registered map[prometheus.Registerer]bool
+}
+
+// Add adds a collector, which will be registered along with the others.
+func (c *Collectors) Add(collector prometheus.Collector) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.collectors = append(c.collectors, collector)
+}
+
+// NewCounter returns a new counter, which is added to the collectors.
+func (c *Collectors) NewCounter(opts prometheus.CounterOpts) prometheus.Counter {
+	counter := prometheus.NewCounter(opts)
+	c.Add(counter)
+	return counter
+}
+
+// NewCounterVec returns a new counter vector, which is added to the
+// collectors.
+func (c *Collectors) NewCounterVec(opts prometheus.CounterOpts, labels []string) *prometheus.CounterVec {
+	vec := prometheus.NewCounterVec(opts, labels)
+	c.Add(vec)
+	return vec
+}
+
+// NewGauge returns a new gauge, which is added to the collectors.
+func (c *Collectors) NewGauge(opts prometheus.GaugeOpts) prometheus.Gauge {
+	gauge := prometheus.NewGauge(opts)
+	c.Add(gauge)
+	return gauge
+}
+
+// NewGaugeVec returns a new gauge vector, which is added to the collectors.
+func (c *Collectors) NewGaugeVec(opts prometheus.GaugeOpts, labels []string) *prometheus.GaugeVec {
+	vec := prometheus.NewGaugeVec(opts, labels)
+	c.Add(vec)
+	return vec
+}
+
+// NewHistogram returns a new histogram, which is added to the collectors.
+func (c *Collectors) NewHistogram(opts prometheus.HistogramOpts) prometheus.Histogram {
+	histogram := prometheus.NewHistogram(opts)
+	c.Add(histogram)
+	return histogram
+}
+
+// NewHistogramVec returns a new histogram vector, which is added to the
+// collectors.
+func (c *Collectors) NewHistogramVec(opts prometheus.HistogramOpts, labels []string) *prometheus.HistogramVec {
+	vec := prometheus.NewHistogramVec(opts, labels)
+	c.Add(vec)
+	return vec
+}
+
+// Register registers the collectors on the registerer, or on
+// prometheus.DefaultRegisterer if it is nil. Registering them on the same
+// registerer again does nothing, so every constructor of a package may call
+// it. Like promauto, it panics if a collector clashes with another one
+// registered there.
+func (c *Collectors) Register(r prometheus.Registerer) {
+	if r == nil {
+		r = prometheus.DefaultRegisterer
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.registered[r] {
+		return
+	}
+	for _, collector := range c.collectors {
+		if err := r.Register(collector); err != nil {
+			var already prometheus.AlreadyRegisteredError
+			if !errors.As(err, &already) || already.ExistingCollector != collector {
+				panic(err)
+			}
+		}
+	}
+	if c.registered == nil {
+		c.registered = make(map[prometheus.Registerer]bool)
+	}
+	c.registered[r] = true
+}
@@ -0,0 +1,38 @@
+package metrics_test
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/pusher/metrics"
+)
+
+func TestCollectors(t *testing.T) {
+	var collectors metrics.Collectors
+	counter := collectors.NewCounter(prometheus.CounterOpts{Name: "test_collectors_total", Help: "A test counter"})
+	counter.Inc()
+
+	registry := prometheus.NewRegistry()
+	families, err := registry.Gather()
+	if err != nil || len(families) != 0 {
+		t.Fatalf("Gathered %v (error %v) before the collectors were registered", families, err)
+	}
+	collectors.Register(registry)
+	// Registering again does nothing.
+	collectors.Register(registry)
+	families, err = registry.Gather()
+	if err != nil || len(families) != 1 || families[0].GetName() != "test_collectors_total" {
+		t.Fatalf("Gathered %v (error %v) instead of the counter", families, err)
+	}
+
+	// A different collector of the same name clashes with it.
+	var clashing metrics.Collectors
+	clashing.NewCounter(prometheus.CounterOpts{Name: "test_collectors_total", Help: "Another test counter"})
+	defer func() {
+		if recover() == nil {
+			t.Error("Registering a clashing collector did not panic")
+		}
+	}()
+	clashing.Register(registry)
+}
@@ -0,0 +1,29 @@
+// Package metrics holds what pusher's packages share to export their metrics.
+// Their Prometheus metrics are made from Collectors, which are registered on
+// the registry a program chooses rather than on the default one. The most
+// important metrics, those about uploads, may also be sent to a Sink other than
+// Prometheus, such as statsd, for deployments which have no Prometheus to
+// scrape pusher; the sink is given to the tarfiles which make the uploads. The Prometheus metrics are exported whatever the sink.
+package metrics
+
+import "time"
+
+// Tags qualify a metric, like the labels of a Prometheus metric.
+type Tags map[string]string
+
+// A Sink receives metrics. Its methods are called from many goroutines, and
+// must not block.
+type Sink interface {
+	// Count adds the value to the named counter.
+	Count(name string, value int64, tags Tags)
+	// Timing records one duration in the named timer.
+	Timing(name string, value time.Duration, tags Tags)
+}
+
+type nop struct{}
+
+func (nop) Count(string, int64, Tags)          {}
+func (nop) Timing(string, time.Duration, Tags) {}
+
+// Nop is a Sink which throws everything away.
+var Nop Sink = nop{}
@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var collectors Collectors
+
+// RegisterMetrics registers the metrics of the statsd sink, which are
+// exported to Prometheus like the rest, on r, or on
+// prometheus.DefaultRegisterer if r is nil.
+func RegisterMetrics(r prometheus.Registerer) {
+	collectors.Register(r)
+}
+
+var pusherStatsdErrors = collectors.NewCounter(
+	prometheus.CounterOpts{
+		Name: "pusher_statsd_send_errors_total",
+		Help: "The number of metrics which could not be sent to statsd",
+	})
+
+// Flavor is the dialect of the statsd protocol to speak.
+type Flavor string
+
+const (
+	// Statsd is the plain protocol, which has no tags. The values of the
+	// tags are added to the name of the metric instead, in order of their
+	// keys, e.g. pusher.uploads.ndt7.ok.
+	Statsd = Flavor("statsd")
+	// DogStatsD sends the tags as DogStatsD tags, e.g.
+	// pusher.uploads:1|c|#datatype:ndt7,result:ok.
+	DogStatsD = Flavor("dogstatsd")
+)
+
+// Flavors lists every Flavor, e.g. for use in a flagx.Enum.
+var Flavors = []string{string(Statsd), string(DogStatsD)}
+
+// unsafe replaces the characters which would break a statsd line if they were
+// in the value of a tag.
+var unsafe = strings.NewReplacer(":", "_", "|", "_", ",", "_", "#", "_", "@", "_")
+
+// statsd sends each metric to a statsd server in its own UDP packet.
+type statsd struct {
+	conn   net.Conn
+	flavor Flavor
+}
+
+// NewStatsd returns a Sink which sends the metrics to the statsd server at the
+// address, a host:port, over UDP. Metrics which can't be sent are dropped, so
+// that the sink never blocks pusher.
+func NewStatsd(address string, flavor Flavor) (Sink, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &statsd{conn: conn, flavor: flavor}, nil
+}
+
+// Count sends the value as a statsd counter.
+func (s *statsd) Count(name string, value int64, tags Tags) {
+	s.send(name, fmt.Sprint(value), "c", tags)
+}
+
+// Timing sends the duration, in milliseconds, as a statsd timer.
+func (s *statsd) Timing(name string, value time.Duration, tags Tags) {
+	s.send(name, fmt.Sprint(value.Milliseconds()), "ms", tags)
+}
+
+func (s *statsd) send(name, value, kind string, tags Tags) {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var line string
+	if s.flavor == DogStatsD {
+		line = name + ":" + value + "|" + kind
+		if len(keys) > 0 {
+			pairs := make([]string, len(keys))
+			for i, k := range keys {
+				pairs[i] = k + ":" + unsafe.Replace(tags[k])
+			}
+			line += "|#" + strings.Join(pairs, ",")
+		}
+	} else {
+		for _, k := range keys {
+			name += "." + unsafe.Replace(tags[k])
+		}
+		line = name + ":" + value + "|" + kind
+	}
+	if _, err := s.conn.Write([]byte(line)); err != nil {
+		pusherStatsdErrors.Inc()
+	}
+}
@@ -0,0 +1,63 @@
+package metrics_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/pusher/metrics"
+)
+
+func TestStatsd(t *testing.T) {
+	tests := []struct {
+		flavor metrics.Flavor
+		want   []string
+	}{
+		{
+			flavor: metrics.Statsd,
+			want: []string{
+				"pusher.uploads.ndt7.ok:1|c",
+				"pusher.upload_duration.ndt7:1500|ms",
+				"pusher.upload_bytes:10|c",
+			},
+		},
+		{
+			flavor: metrics.DogStatsD,
+			want: []string{
+				"pusher.uploads:1|c|#datatype:ndt7,result:ok",
+				"pusher.upload_duration:1500|ms|#datatype:ndt7",
+				"pusher.upload_bytes:10|c",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.flavor), func(t *testing.T) {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			rtx.Must(err, "Could not listen")
+			defer conn.Close()
+			sink, err := metrics.NewStatsd(conn.LocalAddr().String(), tt.flavor)
+			rtx.Must(err, "Could not make the sink")
+
+			sink.Count("pusher.uploads", 1, metrics.Tags{"result": "ok", "datatype": "ndt7"})
+			sink.Timing("pusher.upload_duration", 1500*time.Millisecond, metrics.Tags{"datatype": "ndt7"})
+			sink.Count("pusher.upload_bytes", 10, nil)
+
+			buf := make([]byte, 1024)
+			for _, want := range tt.want {
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				n, _, err := conn.ReadFrom(buf)
+				rtx.Must(err, "Could not read a metric")
+				if got := string(buf[:n]); got != want {
+					t.Errorf("Sent %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewStatsdBadAddress(t *testing.T) {
+	if _, err := metrics.NewStatsd("not an address", metrics.Statsd); err == nil {
+		t.Error("NewStatsd succeeded with a bad address")
+	}
+}
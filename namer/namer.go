@@ -15,21 +15,65 @@ type Namer interface {
 
 // This is a specific namer used for M-Lab experiments.
 type namer struct {
-	datatype, experiment, node string
+	datatype, experiment, node, extension string
 }
 
-// New creates a new Namer for the given experiment, node, and site.
+// New creates a new Namer for the given experiment, node, and site. Its names
+// end in .tgz.
 func New(datatype, experiment, nodeName string) Namer {
+	return NewWithExtension(datatype, experiment, nodeName, ".tgz")
+}
+
+// NewWithExtension is like New, but its names end in the given extension, e.g.
+// ".tar" for tarfiles that are not compressed.
+func NewWithExtension(datatype, experiment, nodeName, extension string) Namer {
 	return namer{
 		datatype:   datatype,
 		experiment: experiment,
 		node:       nodeName,
+		extension:  extension,
 	}
 }
 
 // ObjectName returns a string (with a leading '/') representing the correct
-// filename for an uploaded tarfile in a bucket.
+// filename for an uploaded tarfile in a bucket. The subdir is used as it is,
+// because the TarCache has already escaped any control characters in it,
+// which GCS object names can't contain.
 func (n namer) ObjectName(subdir filename.System, t time.Time) string {
 	timestring := t.Format("20060102T150405.000000Z")
-	return path.Join(n.experiment, n.datatype, string(subdir), timestring+"-"+n.datatype+"-"+n.node+"-"+n.experiment+".tgz")
+	return path.Join(n.experiment, n.datatype, string(subdir), timestring+"-"+n.datatype+"-"+n.node+"-"+n.experiment+n.extension)
+}
+
+// fixed is a Namer whose names are all the same.
+type fixed string
+
+// Fixed returns a Namer which gives every object the same name, e.g. for an
+// object which is replaced each time it is uploaded.
+func Fixed(name string) Namer {
+	return fixed(name)
+}
+
+// ObjectName returns the fixed name, whatever the subdir and time.
+func (f fixed) ObjectName(filename.System, time.Time) string {
+	return string(f)
+}
+
+// prefixed is a Namer that puts the names of another Namer under a prefix.
+type prefixed struct {
+	prefix string
+	namer  Namer
+}
+
+// WithPrefix returns a Namer whose names are those of the passed-in Namer,
+// under the given prefix. An empty prefix returns the Namer unchanged.
+func WithPrefix(prefix string, n Namer) Namer {
+	if prefix == "" {
+		return n
+	}
+	return prefixed{prefix: prefix, namer: n}
+}
+
+// ObjectName returns the name of the underlying Namer, under the prefix.
+func (p prefixed) ObjectName(subdir filename.System, t time.Time) string {
+	return path.Join(p.prefix, p.namer.ObjectName(subdir, t))
 }
@@ -24,6 +24,12 @@ func TestFilenameGeneration(t *testing.T) {
 			dir:  "2008/01/01",
 			out:  "exp/summary/2008/01/01/20080101T000000.000000Z-summary-mlab6-lga0t-exp.tgz",
 		},
+		{
+			date: time.Date(2008, 1, 1, 0, 0, 0, 0, time.UTC),
+			// An escaped subdir is not escaped again.
+			dir: "2008/01/0%0A1%25",
+			out: "exp/summary/2008/01/0%0A1%25/20080101T000000.000000Z-summary-mlab6-lga0t-exp.tgz",
+		},
 	}
 	namer := namer.New("summary", "exp", "mlab6-lga0t")
 	for _, test := range tests {
@@ -32,3 +38,37 @@ func TestFilenameGeneration(t *testing.T) {
 		}
 	}
 }
+
+func TestNewWithExtension(t *testing.T) {
+	n := namer.NewWithExtension("pcap", "ndt", "mlab6-lga0t", ".tar")
+	out := n.ObjectName("2008/01/01", time.Date(2008, 1, 1, 0, 0, 0, 0, time.UTC))
+	if want := "ndt/pcap/2008/01/01/20080101T000000.000000Z-pcap-mlab6-lga0t-ndt.tar"; out != want {
+		t.Errorf("%q != %q", out, want)
+	}
+}
+
+func TestWithPrefix(t *testing.T) {
+	n := namer.New("summary", "exp", "mlab6-lga0t")
+	date := time.Date(2008, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		prefix string
+		out    string
+	}{
+		{prefix: "", out: "exp/summary/2008/01/01/20080101T000000.000000Z-summary-mlab6-lga0t-exp.tgz"},
+		{prefix: "raw", out: "raw/exp/summary/2008/01/01/20080101T000000.000000Z-summary-mlab6-lga0t-exp.tgz"},
+		{prefix: "a/b/", out: "a/b/exp/summary/2008/01/01/20080101T000000.000000Z-summary-mlab6-lga0t-exp.tgz"},
+	}
+	for _, test := range tests {
+		if out := namer.WithPrefix(test.prefix, n).ObjectName("2008/01/01", date); out != test.out {
+			t.Errorf("%q != %q (prefix: %q)", out, test.out, test.prefix)
+		}
+	}
+}
+
+func TestFixed(t *testing.T) {
+	n := namer.Fixed("_heartbeat/mlab6-lga0t-ndt.json")
+	out := n.ObjectName("2008/01/01", time.Date(2008, 1, 1, 0, 0, 0, 0, time.UTC))
+	if want := "_heartbeat/mlab6-lga0t-ndt.json"; out != want {
+		t.Errorf("%q != %q", out, want)
+	}
+}
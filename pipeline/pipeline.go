@@ -0,0 +1,681 @@
+// Package pipeline wires the listener, finder and TarCache together into the
+// pipeline pusher runs for each datatype, so that other programs can embed it
+// without copying pusher's main.
+//
+// A Pipeline watches one directory. Files written into it are found by the
+// listener as they are closed or moved in, and by the finder once they are
+// old enough, and both hand them to a TarCache, which bundles them into
+// tarfiles and gives those to the Uploader. The Uploader decides where
+// tarfiles go and, with a namer.Namer, what they are called; see the uploader
+// and namer packages.
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/m-lab/go/bytecount"
+	"github.com/m-lab/go/flagx"
+	"github.com/m-lab/go/memoryless"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/pusher/filename"
+	"github.com/m-lab/pusher/finder"
+	"github.com/m-lab/pusher/listener"
+	"github.com/m-lab/pusher/metrics"
+	"github.com/m-lab/pusher/tarcache"
+	"github.com/m-lab/pusher/tarfile"
+	"github.com/m-lab/pusher/uploader"
+)
+
+// Config describes a Pipeline. Directory, Datatype, AgeThreshold,
+// CleanupInterval and Uploader are required.
+type Config struct {
+	// Directory is the directory to archive. The names of files in tarfiles
+	// are relative to it.
+	Directory filename.System
+	// Datatype labels the pipeline's metrics and tarfiles.
+	Datatype string
+	// Ratio is the fraction of files, between 0 and 1, that are put in
+	// tarfiles. The rest are deleted without being uploaded.
+	Ratio float64
+	// Metadata holds PAX records to add to every file in every tarfile. It
+	// may be nil. The values may be templates (see tarcache.MetadataFields).
+	Metadata *flagx.KeyValue
+	// SizeThreshold is the size at which a tarfile is uploaded.
+	SizeThreshold bytecount.ByteCount
+	// AgeThreshold is how long a tarfile may wait to be uploaded, if it does
+	// not reach the SizeThreshold first.
+	AgeThreshold memoryless.Config
+	// MaxFileAge is how old a file must be for the finder to archive it. The
+	// listener archives files as soon as they are written.
+	MaxFileAge time.Duration
+	// DepthFileAges overrides MaxFileAge for the files at the given depths
+	// below the directory: 0 for the files directly in it, 1 for those in its
+	// subdirectories, and so on. It may be nil.
+	DepthFileAges map[int]time.Duration
+	// StartupFileAge, if positive, makes the finder look for the files that
+	// are at least this old once, when Run starts.
+	StartupFileAge time.Duration
+	// MaxFutureMtime, if positive, makes the finder judge the files whose
+	// mtimes are more than this far in the future by when it first found them.
+	MaxFutureMtime time.Duration
+	// UseBirthTime makes the finder's periodic runs judge how old files are
+	// by when they were created instead of by their mtimes.
+	UseBirthTime bool
+	// CleanupInterval is how often the finder looks for files.
+	CleanupInterval memoryless.Config
+	// SkipHidden makes the listener and finder ignore hidden files.
+	SkipHidden bool
+	// EventBuffer is how many file events the listener buffers before it
+	// drops them, or listener.DefaultEventBuffer if it is zero.
+	EventBuffer int
+	// RecoveryDelay is how long after the listener drops events the finder
+	// looks for the files it missed, or DefaultRecoveryDelay if it is zero.
+	RecoveryDelay time.Duration
+	// RestartDelay is how long Run waits before it restarts a pipeline one
+	// of whose parts has failed. The wait doubles after each failure, up to
+	// MaxRestartDelay. Zero means DefaultRestartDelay.
+	RestartDelay time.Duration
+	// DirectoryCheckInterval, if positive, is how often to check that the
+	// directory is still the one being watched, and enables the check. A
+	// directory which was removed, or replaced, e.g. by a remount, no longer
+	// gets any events, so when that happens the pipeline is restarted with a
+	// new watch, as after a failure, and the finder then looks for the files
+	// the listener missed. Removals are noticed as soon as they happen.
+	DirectoryCheckInterval time.Duration
+	// CreateDirectory makes the pipeline create the directory, and any of
+	// its missing parents, whenever it is missing when it is to be watched,
+	// e.g. because pusher started before the program which writes into it.
+	CreateDirectory bool
+	// DirectoryMode is the permissions of the directories the pipeline
+	// creates. Zero means 0755. The umask does not apply.
+	DirectoryMode os.FileMode
+	// DirectoryOwner, if not nil, owns the directories the pipeline creates.
+	DirectoryOwner *tarfile.Owner
+	// WaitForDirectory makes New return the pipeline even if its directory
+	// can't be created or watched yet, e.g. because it does not exist or too
+	// many files are open. Err then says why, and Run keeps trying to set the
+	// pipeline up, with the backoff of a restart, before it archives anything.
+	// NoRestart overrides it.
+	WaitForDirectory bool
+	// NoRestart makes Run return after a failure instead of restarting the
+	// pipeline, and Restart refuse, for programs which can no longer set the
+	// pipeline up once they are running, e.g. after dropping privileges.
+	NoRestart bool
+	// TarCache holds the optional behaviors of the TarCache. Its Symlinks
+	// policy is also used by the listener and finder.
+	TarCache tarcache.Config
+	// Uploader is given every tarfile.
+	Uploader uploader.Uploader
+	// Registerer is where the metrics of the pipeline and all its parts are
+	// registered, unless TarCache.Registerer says otherwise for the TarCache.
+	// Nil means prometheus.DefaultRegisterer.
+	Registerer prometheus.Registerer
+}
+
+const (
+	// DefaultRecoveryDelay is the RecoveryDelay used when none is given.
+	DefaultRecoveryDelay = 10 * time.Second
+	// DefaultRestartDelay is the RestartDelay used when none is given.
+	DefaultRestartDelay = time.Second
+	// MaxRestartDelay is the longest Run waits to restart a pipeline. A
+	// pipeline which ran for longer than this before failing is restarted
+	// after RestartDelay again.
+	MaxRestartDelay = 5 * time.Minute
+)
+
+var collectors metrics.Collectors
+
+// RegisterMetrics registers the pipeline's own metrics on r, or on
+// prometheus.DefaultRegisterer if r is nil. New registers them, and those of
+// every part of the pipeline, on Config.Registerer.
+func RegisterMetrics(r prometheus.Registerer) {
+	collectors.Register(r)
+}
+
+var pusherPipelineFailures = collectors.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pusher_pipeline_failures_total",
+		Help: "The number of times a part of a pipeline panicked or stopped unexpectedly, and the pipeline was restarted",
+	},
+	[]string{"datatype", "component"},
+)
+
+var pusherDirectoryChanges = collectors.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pusher_pipeline_directory_changes_total",
+		Help: "The number of times the directory of a pipeline was found to have been removed or replaced, e.g. by a remount, and the pipeline was restarted to watch it again",
+	},
+	[]string{"datatype", "change"},
+)
+
+// Pipeline archives the files written into a directory.
+type Pipeline struct {
+	config Config
+	// The TarCache and listener are replaced when Run restarts the pipeline.
+	mu       sync.Mutex
+	tarCache *tarcache.TarCache
+	listener *listener.Listener
+	// The directory being watched, to tell whether it has been replaced.
+	watched os.FileInfo
+	// Whether the listener may have missed events because the directory was
+	// replaced, so that the finder should look for their files.
+	missed bool
+	// Whether uploads are paused, which outlives the TarCache.
+	paused bool
+	// Why the pipeline is not running, while Run waits to restart it.
+	err error
+	// When the finder first found the files whose mtimes are too far in the
+	// future, which outlives the finder.
+	future *finder.FutureFiles
+	// The files uploaded but kept, which outlives the TarCache.
+	kept *tarcache.KeptFiles
+	// Each request to restart the pipeline carries a channel for the result.
+	restarts chan chan error
+	// stopped is closed when Run returns.
+	stopped chan struct{}
+}
+
+// New checks the config and sets up a Pipeline. The directory is being
+// watched when New returns, unless Config.WaitForDirectory let New return
+// without it, but nothing is archived until Run is called.
+func New(config Config) (*Pipeline, error) {
+	switch {
+	case config.Directory == "":
+		return nil, errors.New("no directory to archive")
+	case config.Datatype == "":
+		return nil, errors.New("no datatype")
+	case config.Uploader == nil:
+		return nil, errors.New("no uploader")
+	case config.Ratio < 0 || config.Ratio > 1:
+		return nil, fmt.Errorf("ratio %v is not between 0 and 1", config.Ratio)
+	}
+	if err := config.AgeThreshold.Check(); err != nil {
+		return nil, fmt.Errorf("bad age threshold: %w", err)
+	}
+	if err := config.CleanupInterval.Check(); err != nil {
+		return nil, fmt.Errorf("bad cleanup interval: %w", err)
+	}
+	if config.Metadata == nil {
+		config.Metadata = &flagx.KeyValue{}
+	}
+	if err := tarcache.CheckMetadata(config.Metadata.Get()); err != nil {
+		return nil, err
+	}
+	if err := tarcache.CheckMetadata(config.TarCache.Metadata); err != nil {
+		return nil, err
+	}
+	if config.RecoveryDelay <= 0 {
+		config.RecoveryDelay = DefaultRecoveryDelay
+	}
+	if config.RestartDelay <= 0 {
+		config.RestartDelay = DefaultRestartDelay
+	}
+	if config.TarCache.Registerer == nil {
+		config.TarCache.Registerer = config.Registerer
+	}
+	RegisterMetrics(config.Registerer)
+	finder.RegisterMetrics(config.Registerer)
+	p := &Pipeline{config: config, future: &finder.FutureFiles{}, kept: &tarcache.KeptFiles{}, restarts: make(chan chan error), stopped: make(chan struct{})}
+	if err := p.build(); err != nil {
+		var dirErr *DirectoryError
+		if !config.WaitForDirectory || config.NoRestart || !errors.As(err, &dirErr) {
+			return nil, err
+		}
+		log.Printf("Could not set up the pipeline for %s yet (error: %q)\n", config.Datatype, err)
+		p.err = err
+	}
+	return p, nil
+}
+
+// A DirectoryError is returned when the directory can't be created or watched,
+// e.g. because it does not exist yet, which may only be for a while.
+type DirectoryError struct {
+	Op        string
+	Directory filename.System
+	Err       error
+}
+
+func (e *DirectoryError) Error() string {
+	return "could not " + e.Op + " " + string(e.Directory) + ": " + e.Err.Error()
+}
+
+func (e *DirectoryError) Unwrap() error {
+	return e.Err
+}
+
+// build sets up a new TarCache and listener for the pipeline.
+func (p *Pipeline) build() error {
+	c := p.config
+	if c.CreateDirectory {
+		if err := createDirectory(string(c.Directory), c.DirectoryMode, c.DirectoryOwner); err != nil {
+			return &DirectoryError{Op: "create", Directory: c.Directory, Err: err}
+		}
+	}
+	// The directory is looked at before it is watched, so that if it is
+	// replaced in between, the next check notices.
+	watched, err := os.Stat(string(c.Directory))
+	if err != nil {
+		return &DirectoryError{Op: "watch", Directory: c.Directory, Err: err}
+	}
+	c.TarCache.Kept = p.kept
+	tc, files := tarcache.New(c.Directory, c.Datatype, c.Ratio, c.Metadata, c.SizeThreshold, c.AgeThreshold, c.Uploader, c.TarCache)
+	l, err := listener.Create(c.Directory, files, c.TarCache.Symlinks, c.SkipHidden, c.EventBuffer, c.Registerer)
+	if err != nil {
+		return &DirectoryError{Op: "watch", Directory: c.Directory, Err: err}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	tc.SetPaused(p.paused)
+	p.tarCache = tc
+	p.listener = l
+	p.watched = watched
+	if p.missed {
+		l.Missed()
+		p.missed = false
+	}
+	return nil
+}
+
+// createDirectory creates the directory, if it is missing, and its missing
+// parents, with the mode and owner.
+func createDirectory(dir string, mode os.FileMode, owner *tarfile.Owner) error {
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		return err
+	}
+	parent := filepath.Dir(dir)
+	if parent != dir {
+		if err := createDirectory(parent, mode, owner); err != nil {
+			return err
+		}
+	}
+	if mode == 0 {
+		mode = 0755
+	}
+	if err := os.Mkdir(dir, mode); err != nil {
+		// Whatever else creates it meanwhile decides its mode and owner.
+		if os.IsExist(err) {
+			return nil
+		}
+		return err
+	}
+	// The umask applied to Mkdir, but not to Chmod.
+	if err := os.Chmod(dir, mode); err != nil {
+		return err
+	}
+	if owner != nil {
+		if err := os.Chown(dir, owner.UID, owner.GID); err != nil {
+			return err
+		}
+	}
+	log.Printf("Created the directory %s\n", dir)
+	return nil
+}
+
+// Flush makes the TarCache upload every tarfile now (see
+// tarcache.TarCache.Flush).
+func (p *Pipeline) Flush() {
+	if tc := p.TarCache(); tc != nil {
+		tc.Flush()
+	}
+}
+
+// Pause pauses uploads (see tarcache.TarCache.SetPaused) until Resume is
+// called, even if the pipeline is restarted meanwhile.
+func (p *Pipeline) Pause() {
+	p.setPaused(true)
+}
+
+// Resume resumes the uploads paused by Pause.
+func (p *Pipeline) Resume() {
+	p.setPaused(false)
+}
+
+func (p *Pipeline) setPaused(paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = paused
+	if p.tarCache != nil {
+		p.tarCache.SetPaused(paused)
+	}
+}
+
+// Paused returns whether uploads are paused.
+func (p *Pipeline) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+// Snapshot returns the state of the TarCache's tarfiles (see
+// tarcache.TarCache.Snapshot).
+func (p *Pipeline) Snapshot() []tarcache.TarfileState {
+	if tc := p.TarCache(); tc != nil {
+		return tc.Snapshot()
+	}
+	return nil
+}
+
+// TarCache returns the pipeline's TarCache, e.g. to reset it or to take a
+// snapshot of its tarfiles. A restarted pipeline has a new TarCache, so callers
+// should not hold on to the result. It is nil until the pipeline is first set
+// up (see Config.WaitForDirectory).
+func (p *Pipeline) TarCache() *tarcache.TarCache {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.tarCache
+}
+
+// Err returns why the pipeline is not running, while Run waits to restart it
+// after a failure, or after it could not be restarted or set up in the first
+// place, e.g. because its directory can't be watched. It returns nil while the
+// pipeline is running.
+func (p *Pipeline) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (p *Pipeline) setErr(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = err
+}
+
+// ErrNotRunning is returned by Restart when Run has returned, or is about to.
+var ErrNotRunning = errors.New("the pipeline is not running")
+
+// ErrNoRestart is returned by Restart when Config.NoRestart is set.
+var ErrNoRestart = errors.New("the pipeline can't be restarted")
+
+// Restart tears down the pipeline's TarCache, listener and finder, just as Run
+// does when one of them fails, and starts them again at once, with a new watch
+// on the directory. The TarCache uploads what it has first. Restart returns
+// once the new ones are set up, or with an error if they can't be, in which
+// case Run keeps trying after a backoff. A restart requested while Run waits
+// to restart the pipeline after a failure cuts the wait short. Restart gives
+// up if ctx is done first.
+func (p *Pipeline) Restart(ctx context.Context) error {
+	if p.config.NoRestart {
+		return ErrNoRestart
+	}
+	result := make(chan error, 1)
+	select {
+	case p.restarts <- result:
+	case <-p.stopped:
+		return ErrNotRunning
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run archives files until termCtx is canceled, and then uploads the tarfiles
+// in progress, unless killCtx is canceled first. Run returns once the TarCache,
+// the listener and the finder have all stopped, and must be called at most
+// once.
+//
+// If any of them panics or stops while termCtx and killCtx are not done, or
+// the directory is removed or replaced (see Config.DirectoryCheckInterval), the
+// failure is logged and counted, the TarCache uploads what it can, and, after
+// a backoff, Run starts over with a new TarCache and listener. Files the
+// failed TarCache held are left for the finder, unless Config.NoRestart makes
+// Run return instead, leaving the failure to Err. A pipeline New could not set
+// up is set up the same way before Run archives anything.
+func (p *Pipeline) Run(termCtx, killCtx context.Context) {
+	defer close(p.stopped)
+	delay := p.config.RestartDelay
+	startupAge := p.config.StartupFileAge
+	if p.TarCache() == nil && !p.setUp(termCtx, killCtx, nil, &delay) {
+		return
+	}
+	for {
+		start := time.Now()
+		requested, err := p.runOnce(termCtx, killCtx, startupAge)
+		startupAge = 0
+		if requested == nil && err == nil {
+			return
+		}
+		if termCtx.Err() != nil || killCtx.Err() != nil {
+			if requested != nil {
+				requested <- ErrNotRunning
+			}
+			return
+		}
+		if err != nil {
+			p.setErr(err)
+			log.Printf("The pipeline for %s failed (error: %q)\n", p.config.Datatype, err)
+			if p.config.NoRestart {
+				return
+			}
+			if time.Since(start) > MaxRestartDelay {
+				delay = p.config.RestartDelay
+			}
+		}
+		if !p.setUp(termCtx, killCtx, requested, &delay) {
+			return
+		}
+	}
+}
+
+// setUp sets the pipeline up again, for the restart requested, if any, or else
+// after waiting out the backoff, which it doubles. It keeps trying until it
+// succeeds, and then returns true, unless termCtx or killCtx is done first.
+func (p *Pipeline) setUp(termCtx, killCtx context.Context, requested chan error, delay *time.Duration) bool {
+	for {
+		// Wait out the backoff, unless a restart is requested first.
+		if requested == nil {
+			log.Printf("Restarting the pipeline for %s in %s\n", p.config.Datatype, *delay)
+			var ok bool
+			if requested, ok = p.wait(termCtx, killCtx, *delay); !ok {
+				return false
+			}
+			if requested == nil {
+				if *delay *= 2; *delay > MaxRestartDelay {
+					*delay = MaxRestartDelay
+				}
+			}
+		}
+		if requested != nil {
+			log.Printf("Restarting the pipeline for %s on request\n", p.config.Datatype)
+		}
+		err := p.build()
+		p.setErr(err)
+		if requested != nil {
+			requested <- err
+			requested = nil
+		}
+		if err == nil {
+			return true
+		}
+		log.Printf("Could not restart the pipeline for %s (error: %q)\n", p.config.Datatype, err)
+	}
+}
+
+// finderOptions returns the options of the finder for the config, which reports
+// the files it finds too young to the TarCache.
+func (p *Pipeline) finderOptions(tc *tarcache.TarCache) finder.Options {
+	return finder.Options{
+		Datatype:   p.config.Datatype,
+		Directory:  p.config.Directory,
+		MaxFileAge: p.config.MaxFileAge,
+		DepthAges:  p.config.DepthFileAges,
+		MaxFuture:  p.config.MaxFutureMtime,
+		Future:     p.future,
+		BirthTime:  p.config.UseBirthTime,
+		Symlinks:   p.config.TarCache.Symlinks,
+		SkipHidden: p.config.SkipHidden,
+		Young:      tc.YoungChannel(),
+	}
+}
+
+// runOnce runs the TarCache, the listener and the finder until termCtx or
+// killCtx is done, until one of them fails, or until a restart is requested.
+// If startupAge is positive, the finder first looks for the files that old.
+// It returns the request, if any, and the first failure.
+func (p *Pipeline) runOnce(termCtx, killCtx context.Context, startupAge time.Duration) (chan error, error) {
+	p.mu.Lock()
+	tc, l := p.tarCache, p.listener
+	p.mu.Unlock()
+	// A failure or a restart request makes the TarCache upload what it has
+	// and stop. stopCtx is
+	// done once it has been told to stop, or killCtx is done.
+	stopCtx, cancelStop := context.WithCancel(killCtx)
+	defer cancelStop()
+	stop := func() {
+		cancelStop()
+		tc.Stop()
+	}
+	// The listener and finder run until the TarCache stops.
+	ctx, cancel := context.WithCancel(killCtx)
+	defer cancel()
+
+	failures := make(chan error, 5)
+	supervise := func(component string, run func(), stopped func() bool) {
+		err := protect(component, p.config.Datatype, run)
+		if err == nil && !stopped() {
+			err = errors.New("stopped unexpectedly")
+		}
+		if err != nil {
+			pusherPipelineFailures.WithLabelValues(p.config.Datatype, component).Inc()
+			failures <- fmt.Errorf("the %s %w", component, err)
+			stop()
+		}
+	}
+	canceled := func() bool { return ctx.Err() != nil }
+	var requested chan error
+	wg := sync.WaitGroup{}
+	wg.Add(5)
+	go func() {
+		defer wg.Done()
+		if err := p.watchDirectory(ctx, l); err != nil {
+			failures <- err
+			stop()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		select {
+		case requested = <-p.restarts:
+			stop()
+		case <-ctx.Done():
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		supervise("listener", func() { l.ListenForever(ctx) }, canceled)
+	}()
+	go func() {
+		defer wg.Done()
+		supervise("finder", func() {
+			if startupAge > 0 {
+				finder.FindOnce(ctx, p.finderOptions(tc), startupAge, tc.BatchChannel())
+			}
+			finder.FindForever(ctx, p.finderOptions(tc), tc.BatchChannel(), p.config.CleanupInterval)
+		}, canceled)
+	}()
+	go func() {
+		defer wg.Done()
+		supervise("recovery", func() {
+			finder.RecoverForever(ctx, p.finderOptions(tc), p.config.RecoveryDelay, tc.BatchChannel(), l.Dropped())
+		}, canceled)
+	}()
+	supervise("tarcache", func() { tc.ListenForever(termCtx, killCtx) }, func() bool {
+		return stopCtx.Err() != nil
+	})
+	cancel()
+	wg.Wait()
+	select {
+	case err := <-failures:
+		return requested, err
+	default:
+		return requested, nil
+	}
+}
+
+// watchDirectory checks that the directory is still the one being watched
+// until ctx is done, and returns an error if it was removed or replaced. The
+// listener says as soon as the directory is removed, even if another is
+// created in its place at once, perhaps with the same inode number. A
+// directory which is replaced by a mount or unmount is found by looking at it
+// every DirectoryCheckInterval.
+func (p *Pipeline) watchDirectory(ctx context.Context, l *listener.Listener) error {
+	if p.config.DirectoryCheckInterval <= 0 {
+		return nil
+	}
+	p.mu.Lock()
+	watched := p.watched
+	p.mu.Unlock()
+	ticker := time.NewTicker(p.config.DirectoryCheckInterval)
+	defer ticker.Stop()
+	for {
+		removed := false
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-l.Removed():
+			removed = true
+		case <-ticker.C:
+		}
+		current, err := os.Stat(string(p.config.Directory))
+		change := ""
+		switch {
+		case removed || os.IsNotExist(err):
+			change = "removed"
+		case err != nil:
+			// The directory may be there, but can't be looked at for now.
+			log.Printf("Could not check the directory of %s (error: %q)\n", p.config.Datatype, err)
+		case !os.SameFile(watched, current):
+			change = "replaced"
+		}
+		if change != "" {
+			pusherDirectoryChanges.WithLabelValues(p.config.Datatype, change).Inc()
+			p.mu.Lock()
+			p.missed = true
+			p.mu.Unlock()
+			return fmt.Errorf("the directory %s was %s, so it is no longer being watched", p.config.Directory, change)
+		}
+	}
+}
+
+// protect calls run, and returns its panic, if any, as an error.
+func protect(component, datatype string, run func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("The %s for %s panicked: %v\n%s", component, datatype, r, debug.Stack())
+			err = fmt.Errorf("panicked: %v", r)
+		}
+	}()
+	run()
+	return nil
+}
+
+// wait waits for the duration, and returns true, unless termCtx or killCtx is
+// done first, in which case it returns false. A restart requested meanwhile
+// cuts the wait short, and is returned.
+func (p *Pipeline) wait(termCtx, killCtx context.Context, d time.Duration) (chan error, bool) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil, true
+	case requested := <-p.restarts:
+		return requested, true
+	case <-termCtx.Done():
+	case <-killCtx.Done():
+	}
+	return nil, false
+}
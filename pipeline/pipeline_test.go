@@ -0,0 +1,571 @@
+package pipeline_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/flagx"
+	"github.com/m-lab/go/memoryless"
+	"github.com/m-lab/go/rtx"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/pusher/filename"
+	"github.com/m-lab/pusher/pipeline"
+	"github.com/m-lab/pusher/uploader"
+)
+
+type recordingUploader struct {
+	mu      sync.Mutex
+	uploads int
+}
+
+func (r *recordingUploader) Upload(_ context.Context, _ uploader.ID, dir filename.System, contents []byte, _ map[string]string) (uploader.Result, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.uploads++
+	return uploader.Result{Size: int64(len(contents))}, nil
+}
+
+func (r *recordingUploader) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.uploads
+}
+
+func config(dir string, up uploader.Uploader) pipeline.Config {
+	return pipeline.Config{
+		Directory:       filename.System(dir),
+		Datatype:        "test",
+		Ratio:           1,
+		SizeThreshold:   1,
+		AgeThreshold:    memoryless.Config{Expected: time.Hour, Max: time.Hour},
+		MaxFileAge:      time.Hour,
+		CleanupInterval: memoryless.Config{Expected: time.Hour, Max: time.Hour},
+		Uploader:        up,
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline.TestPipeline")
+	rtx.Must(err, "Could not create the temp dir")
+	defer os.RemoveAll(dir)
+	rtx.Must(os.MkdirAll(dir+"/2026/10/16", 0755), "Could not create the subdirectory")
+
+	up := &recordingUploader{}
+	p, err := pipeline.New(config(dir, up))
+	rtx.Must(err, "Could not create the pipeline")
+	if p.TarCache() == nil {
+		t.Error("The pipeline has no TarCache")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx, ctx)
+		close(done)
+	}()
+
+	// The file is bigger than the size threshold, so it is uploaded and
+	// deleted as soon as the listener hears about it.
+	rtx.Must(ioutil.WriteFile(dir+"/2026/10/16/tinyfile", []byte("abcdefghijklmnop"), 0644), "Could not write the file")
+	for i := 0; i < 100 && up.count() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if up.count() != 1 {
+		t.Errorf("%d uploads instead of 1", up.count())
+	}
+	if _, err := os.Stat(dir + "/2026/10/16/tinyfile"); !os.IsNotExist(err) {
+		t.Errorf("The file was not deleted after it was uploaded (%v)", err)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("Run did not return after its contexts were canceled")
+	}
+}
+
+func TestRegisterer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline.TestRegisterer")
+	rtx.Must(err, "Could not create the temp dir")
+	defer os.RemoveAll(dir)
+	rtx.Must(os.MkdirAll(dir+"/2026/10/16", 0755), "Could not create the subdirectory")
+
+	up := &recordingUploader{}
+	c := config(dir, up)
+	registry := prometheus.NewRegistry()
+	c.Registerer = registry
+	p, err := pipeline.New(c)
+	rtx.Must(err, "Could not create the pipeline")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx, ctx)
+
+	rtx.Must(ioutil.WriteFile(dir+"/2026/10/16/tinyfile", []byte("abcdefghijklmnop"), 0644), "Could not write the file")
+	for i := 0; i < 100 && up.count() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	families, err := registry.Gather()
+	rtx.Must(err, "Could not gather the metrics")
+	found := make(map[string]bool)
+	for _, f := range families {
+		found[f.GetName()] = true
+	}
+	// One metric of each of the listener, TarCache and tarfiles.
+	for _, name := range []string{"pusher_file_events_total", "pusher_tarfiles_upload_calls_total", "pusher_tarfiles_created_total"} {
+		if !found[name] {
+			t.Errorf("%s was not registered on the pipeline's registerer", name)
+		}
+	}
+}
+
+// panickingUploader panics the first time it is called, and records the
+// uploads after that.
+type panickingUploader struct {
+	recordingUploader
+	panicked bool
+}
+
+func (r *panickingUploader) Upload(ctx context.Context, id uploader.ID, dir filename.System, contents []byte, _ map[string]string) (uploader.Result, error) {
+	r.mu.Lock()
+	panicked := r.panicked
+	r.panicked = true
+	r.mu.Unlock()
+	if !panicked {
+		panic("the uploader is broken")
+	}
+	return r.recordingUploader.Upload(ctx, id, dir, contents, nil)
+}
+
+func TestPipelineIsRestartedAfterAPanic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline.TestPipelineIsRestartedAfterAPanic")
+	rtx.Must(err, "Could not create the temp dir")
+	defer os.RemoveAll(dir)
+	rtx.Must(os.MkdirAll(dir+"/2026/10/16", 0755), "Could not create the subdirectory")
+
+	up := &panickingUploader{}
+	c := config(dir, up)
+	c.RestartDelay = 10 * time.Millisecond
+	p, err := pipeline.New(c)
+	rtx.Must(err, "Could not create the pipeline")
+	first := p.TarCache()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx, ctx)
+		close(done)
+	}()
+
+	// The first upload panics, which kills the TarCache.
+	rtx.Must(ioutil.WriteFile(dir+"/2026/10/16/first", []byte("abcdefghijklmnop"), 0644), "Could not write the file")
+	for i := 0; i < 100 && p.TarCache() == first; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if p.TarCache() == first {
+		t.Fatal("The pipeline was not restarted")
+	}
+
+	// The restarted pipeline archives new files.
+	rtx.Must(ioutil.WriteFile(dir+"/2026/10/16/second", []byte("abcdefghijklmnop"), 0644), "Could not write the file")
+	for i := 0; i < 100 && up.count() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if up.count() != 1 {
+		t.Errorf("%d uploads instead of 1", up.count())
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("Run did not return after its contexts were canceled")
+	}
+}
+
+func TestRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline.TestRestart")
+	rtx.Must(err, "Could not create the temp dir")
+	defer os.RemoveAll(dir)
+	rtx.Must(os.MkdirAll(dir+"/2026/10/16", 0755), "Could not create the subdirectory")
+
+	up := &recordingUploader{}
+	p, err := pipeline.New(config(dir, up))
+	rtx.Must(err, "Could not create the pipeline")
+	first := p.TarCache()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx, ctx)
+		close(done)
+	}()
+
+	rtx.Must(p.Restart(context.Background()), "Could not restart the pipeline")
+	if p.TarCache() == first {
+		t.Error("The pipeline has the same TarCache after a restart")
+	}
+	// The restarted pipeline archives new files.
+	rtx.Must(ioutil.WriteFile(dir+"/2026/10/16/tinyfile", []byte("abcdefghijklmnop"), 0644), "Could not write the file")
+	for i := 0; i < 100 && up.count() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if up.count() != 1 {
+		t.Errorf("%d uploads instead of 1", up.count())
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after its contexts were canceled")
+	}
+	if err := p.Restart(context.Background()); err != pipeline.ErrNotRunning {
+		t.Errorf("Restart() after Run returned = %v, want %v", err, pipeline.ErrNotRunning)
+	}
+}
+
+func TestKeptFilesOutliveARestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline.TestKeptFilesOutliveARestart")
+	rtx.Must(err, "Could not create the temp dir")
+	defer os.RemoveAll(dir)
+	rtx.Must(os.MkdirAll(dir+"/2026/10/16", 0755), "Could not create the subdirectory")
+
+	up := &recordingUploader{}
+	c := config(dir, up)
+	c.TarCache.Tarfile.KeepFiles = true
+	p, err := pipeline.New(c)
+	rtx.Must(err, "Could not create the pipeline")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx, ctx)
+		close(done)
+	}()
+
+	name := dir + "/2026/10/16/kept"
+	rtx.Must(ioutil.WriteFile(name, []byte("abcdefghijklmnop"), 0644), "Could not write the file")
+	for i := 0; i < 100 && up.count() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if up.count() != 1 {
+		t.Fatalf("%d uploads instead of 1", up.count())
+	}
+	info, err := os.Stat(name)
+	rtx.Must(err, "The kept file was deleted")
+
+	// After a restart, an unchanged copy moved over the kept file is not
+	// uploaded again.
+	rtx.Must(p.Restart(context.Background()), "Could not restart the pipeline")
+	rtx.Must(ioutil.WriteFile(dir+"/copy", []byte("abcdefghijklmnop"), 0644), "Could not write the copy")
+	rtx.Must(os.Chtimes(dir+"/copy", info.ModTime(), info.ModTime()), "Could not set the mtime")
+	rtx.Must(os.Rename(dir+"/copy", name), "Could not move the copy")
+	time.Sleep(200 * time.Millisecond)
+	if up.count() != 1 {
+		t.Errorf("%d uploads after the restart instead of 1", up.count())
+	}
+	cancel()
+	<-done
+}
+
+func TestStartupFileAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline.TestStartupFileAge")
+	rtx.Must(err, "Could not create the temp dir")
+	defer os.RemoveAll(dir)
+	rtx.Must(os.MkdirAll(dir+"/2026/10/16", 0755), "Could not create the subdirectory")
+	// The file was written while the pipeline was not running, so the
+	// listener never hears about it, and it is too new for the finder's
+	// regular runs.
+	rtx.Must(ioutil.WriteFile(dir+"/2026/10/16/backlog", []byte("abcdefghijklmnop"), 0644), "Could not write the file")
+	mtime := time.Now().Add(-time.Minute)
+	rtx.Must(os.Chtimes(dir+"/2026/10/16/backlog", mtime, mtime), "Could not set the mtime")
+
+	up := &recordingUploader{}
+	c := config(dir, up)
+	c.StartupFileAge = 30 * time.Second
+	p, err := pipeline.New(c)
+	rtx.Must(err, "Could not create the pipeline")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx, ctx)
+		close(done)
+	}()
+
+	for i := 0; i < 100 && up.count() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if up.count() != 1 {
+		t.Errorf("%d uploads instead of 1", up.count())
+	}
+
+	// A restart doesn't repeat the startup pass. A hard link makes no event
+	// the listener hears about either.
+	outside, err := ioutil.TempDir("", "pipeline.TestStartupFileAge")
+	rtx.Must(err, "Could not create the temp dir")
+	defer os.RemoveAll(outside)
+	rtx.Must(ioutil.WriteFile(outside+"/later", []byte("abcdefghijklmnop"), 0644), "Could not write the file")
+	rtx.Must(os.Chtimes(outside+"/later", mtime, mtime), "Could not set the mtime")
+	rtx.Must(os.Link(outside+"/later", dir+"/2026/10/16/later"), "Could not link the file")
+	rtx.Must(p.Restart(context.Background()), "Could not restart the pipeline")
+	time.Sleep(200 * time.Millisecond)
+	if up.count() != 1 {
+		t.Errorf("%d uploads after the restart instead of 1", up.count())
+	}
+	cancel()
+	<-done
+}
+
+// directoryChanges returns the number of directory changes counted so far.
+func directoryChanges(registry *prometheus.Registry) float64 {
+	families, err := registry.Gather()
+	rtx.Must(err, "Could not gather the metrics")
+	changes := 0.0
+	for _, f := range families {
+		if f.GetName() == "pusher_pipeline_directory_changes_total" {
+			for _, m := range f.GetMetric() {
+				changes += m.GetCounter().GetValue()
+			}
+		}
+	}
+	return changes
+}
+
+func TestDirectoryReplaced(t *testing.T) {
+	parent, err := ioutil.TempDir("", "pipeline.TestDirectoryReplaced")
+	rtx.Must(err, "Could not create the temp dir")
+	defer os.RemoveAll(parent)
+	dir := parent + "/test"
+	rtx.Must(os.MkdirAll(dir, 0755), "Could not create the directory")
+
+	up := &recordingUploader{}
+	c := config(dir, up)
+	c.DirectoryCheckInterval = 10 * time.Millisecond
+	c.RestartDelay = 200 * time.Millisecond
+	c.RecoveryDelay = 10 * time.Millisecond
+	// Files written while the directory isn't watched are recovered once
+	// they are this old.
+	c.MaxFileAge = 10 * time.Millisecond
+	registry := prometheus.NewRegistry()
+	c.Registerer = registry
+	p, err := pipeline.New(c)
+	rtx.Must(err, "Could not create the pipeline")
+	first := p.TarCache()
+	before := directoryChanges(registry)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx, ctx)
+		close(done)
+	}()
+
+	// The directory is replaced, as by a remount, and a file is written into
+	// the new one before it is watched. Only the finder can find it.
+	rtx.Must(os.RemoveAll(dir), "Could not remove the directory")
+	rtx.Must(os.MkdirAll(dir+"/2026/10/16", 0755), "Could not recreate the directory")
+	rtx.Must(ioutil.WriteFile(dir+"/2026/10/16/tinyfile", []byte("abcdefghijklmnop"), 0644), "Could not write the file")
+	// Until it is restarted, the pipeline says why it is not running.
+	for i := 0; i < 100 && p.Err() == nil; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if p.Err() == nil {
+		t.Error("The pipeline did not say why it was not running")
+	}
+	for i := 0; i < 200 && up.count() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if p.Err() != nil {
+		t.Errorf("The restarted pipeline says it is not running (%v)", p.Err())
+	}
+	if up.count() != 1 {
+		t.Errorf("%d uploads instead of 1", up.count())
+	}
+	if p.TarCache() == first {
+		t.Error("The pipeline was not restarted when its directory was replaced")
+	}
+	if changes := directoryChanges(registry) - before; changes != 1 {
+		t.Errorf("%v directory changes were counted instead of 1", changes)
+	}
+
+	// The restarted pipeline watches the new directory.
+	rtx.Must(ioutil.WriteFile(dir+"/2026/10/16/another", []byte("abcdefghijklmnop"), 0644), "Could not write the file")
+	for i := 0; i < 100 && up.count() == 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if up.count() != 2 {
+		t.Errorf("%d uploads instead of 2", up.count())
+	}
+	cancel()
+	<-done
+}
+
+func TestCreateDirectory(t *testing.T) {
+	parent, err := ioutil.TempDir("", "pipeline.TestCreateDirectory")
+	rtx.Must(err, "Could not create the temp dir")
+	defer os.RemoveAll(parent)
+	dir := parent + "/spool/test"
+
+	up := &recordingUploader{}
+	c := config(dir, up)
+	_, err = pipeline.New(c)
+	var dirErr *pipeline.DirectoryError
+	if !errors.As(err, &dirErr) {
+		t.Fatalf("New() of a missing directory returned %v, not a DirectoryError", err)
+	}
+
+	c.CreateDirectory = true
+	c.DirectoryMode = 0750
+	p, err := pipeline.New(c)
+	rtx.Must(err, "Could not create the pipeline")
+	for _, d := range []string{parent + "/spool", dir} {
+		info, err := os.Stat(d)
+		rtx.Must(err, "The directory %s was not created", d)
+		if info.Mode().Perm() != 0750 {
+			t.Errorf("The directory %s has mode %v, not 0750", d, info.Mode().Perm())
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx, ctx)
+		close(done)
+	}()
+	rtx.Must(ioutil.WriteFile(dir+"/tinyfile", []byte("abcdefghijklmnop"), 0644), "Could not write the file")
+	for i := 0; i < 100 && up.count() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if up.count() != 1 {
+		t.Errorf("%d uploads instead of 1", up.count())
+	}
+	cancel()
+	<-done
+}
+
+func TestWaitForDirectory(t *testing.T) {
+	parent, err := ioutil.TempDir("", "pipeline.TestWaitForDirectory")
+	rtx.Must(err, "Could not create the temp dir")
+	defer os.RemoveAll(parent)
+	dir := parent + "/test"
+
+	up := &recordingUploader{}
+	c := config(dir, up)
+	c.RestartDelay = time.Millisecond
+	c.WaitForDirectory = true
+	p, err := pipeline.New(c)
+	rtx.Must(err, "Could not create the pipeline")
+	var dirErr *pipeline.DirectoryError
+	if !errors.As(p.Err(), &dirErr) {
+		t.Fatalf("Err() of a pipeline whose directory is missing is %v, not a DirectoryError", p.Err())
+	}
+	// It can be controlled before it is set up.
+	p.Pause()
+	p.Resume()
+	p.Flush()
+	if p.Snapshot() != nil {
+		t.Error("A pipeline which is not set up has tarfiles")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx, ctx)
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	rtx.Must(os.Mkdir(dir, 0755), "Could not create the directory")
+	for i := 0; i < 100 && p.Err() != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if p.Err() != nil {
+		t.Fatalf("The pipeline was not set up once its directory was created: %v", p.Err())
+	}
+	rtx.Must(ioutil.WriteFile(dir+"/tinyfile", []byte("abcdefghijklmnop"), 0644), "Could not write the file")
+	for i := 0; i < 100 && up.count() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if up.count() != 1 {
+		t.Errorf("%d uploads instead of 1", up.count())
+	}
+	cancel()
+	<-done
+
+	// Other errors are not waited out.
+	c.Ratio = 2
+	if _, err := pipeline.New(c); err == nil {
+		t.Error("New() of a bad config succeeded")
+	}
+}
+
+func TestNoRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline.TestNoRestart")
+	rtx.Must(err, "Could not create the temp dir")
+	defer os.RemoveAll(dir)
+
+	c := config(dir+"/test", &recordingUploader{})
+	c.NoRestart = true
+	c.WaitForDirectory = true
+	// A missing directory is not waited for.
+	if _, err := pipeline.New(c); err == nil {
+		t.Error("New() of a missing directory succeeded")
+	}
+	rtx.Must(os.Mkdir(dir+"/test", 0755), "Could not create the directory")
+	c.DirectoryCheckInterval = 10 * time.Millisecond
+	p, err := pipeline.New(c)
+	rtx.Must(err, "Could not create the pipeline")
+	if err := p.Restart(context.Background()); !errors.Is(err, pipeline.ErrNoRestart) {
+		t.Errorf("Restart() = %v, not ErrNoRestart", err)
+	}
+
+	// Once its directory is removed, Run returns instead of restarting it.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx, ctx)
+		close(done)
+	}()
+	rtx.Must(os.RemoveAll(dir+"/test"), "Could not remove the directory")
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return once the pipeline failed")
+	}
+	if p.Err() == nil {
+		t.Error("The failed pipeline does not say why it stopped")
+	}
+}
+
+func TestNewRejectsBadConfigs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline.TestNewRejectsBadConfigs")
+	rtx.Must(err, "Could not create the temp dir")
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name   string
+		change func(*pipeline.Config)
+	}{
+		{name: "no-directory", change: func(c *pipeline.Config) { c.Directory = "" }},
+		{name: "missing-directory", change: func(c *pipeline.Config) { c.Directory = filename.System(dir + "/does/not/exist") }},
+		{name: "no-datatype", change: func(c *pipeline.Config) { c.Datatype = "" }},
+		{name: "no-uploader", change: func(c *pipeline.Config) { c.Uploader = nil }},
+		{name: "bad-ratio", change: func(c *pipeline.Config) { c.Ratio = 2 }},
+		{name: "bad-age-threshold", change: func(c *pipeline.Config) { c.AgeThreshold = memoryless.Config{Min: time.Hour, Max: time.Minute} }},
+		{name: "bad-cleanup-interval", change: func(c *pipeline.Config) { c.CleanupInterval = memoryless.Config{Expected: time.Hour, Max: time.Minute} }},
+		{name: "bad-metadata-template", change: func(c *pipeline.Config) {
+			c.Metadata = &flagx.KeyValue{}
+			rtx.Must(c.Metadata.Set("where={{.UploadTime}}"), "Could not set the metadata")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := config(dir, &recordingUploader{})
+			tt.change(&c)
+			if _, err := pipeline.New(c); err == nil {
+				t.Error("New() should have failed")
+			}
+		})
+	}
+}
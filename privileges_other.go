@@ -0,0 +1,20 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// dropPrivileges reports that there are no uids and gids to switch to on
+// systems which are not unix-like.
+func dropPrivileges(uid, gid int) error {
+	return errors.New("running as another user is not supported on this system")
+}
+
+// checkAccess returns an error unless the directory exists.
+func checkAccess(dir string) error {
+	_, err := os.Stat(dir)
+	return err
+}
@@ -0,0 +1,34 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// dropPrivileges makes pusher run as the given uid and gid, with no
+// supplementary groups. Switching away from root also clears every capability
+// the process had. The switch applies to every thread, and can't be undone.
+func dropPrivileges(uid, gid int) error {
+	if err := syscall.Setgroups(nil); err != nil {
+		return fmt.Errorf("Could not drop the supplementary groups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("Could not set the gid to %d: %w", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("Could not set the uid to %d: %w", uid, err)
+	}
+	return nil
+}
+
+// checkAccess returns an error unless pusher, as it is now running, may list,
+// read, and write the directory, as it must to archive and delete its files.
+func checkAccess(dir string) error {
+	const readWriteExecute = 7 // R_OK | W_OK | X_OK
+	if err := syscall.Access(dir, readWriteExecute); err != nil {
+		return fmt.Errorf("Can not read and write %s: %w", dir, err)
+	}
+	return nil
+}
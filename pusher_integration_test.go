@@ -1,14 +1,15 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"errors"
 	"flag"
-	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"sync"
 	"syscall"
 	"testing"
@@ -18,8 +19,10 @@ import (
 	"github.com/m-lab/go/flagx"
 	"github.com/m-lab/go/memoryless"
 	"github.com/m-lab/go/osx"
+	"github.com/m-lab/go/prometheusx"
 	"github.com/m-lab/go/prometheusx/promtest"
 	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/pusher/fakegcs"
 	"github.com/m-lab/pusher/filename"
 	"github.com/m-lab/pusher/listener"
 	"github.com/m-lab/pusher/tarcache"
@@ -57,6 +60,8 @@ func TestMainDoesntCrash(t *testing.T) {
 		return
 	}
 	rtx.Must(os.Mkdir(tempdir+"/testdata", 0777), "Could not create dir.")
+	server := fakegcs.NewServer("archive-mlab-testing")
+	defer server.Close()
 	// Set up the environment variables.
 	type TempEnvVar struct {
 		name, value string
@@ -69,6 +74,7 @@ func TestMainDoesntCrash(t *testing.T) {
 		{"MLAB_NODE_NAME", "mlab5.abc1t.measurement-lab.org"},
 		{"MONITORING_ADDRESS", "localhost:9000"},
 		{"DATATYPE", "testdata=1"},
+		{"STORAGE_EMULATOR_HOST", server.URL()},
 	}
 	for i := range newVars {
 		revert := osx.MustSetenv(newVars[i].name, newVars[i].value)
@@ -93,6 +99,40 @@ func TestMainDoesntCrash(t *testing.T) {
 	main()
 }
 
+func TestMainDoesntNeedCredentialsWithoutGCS(t *testing.T) {
+	ctx, cancelCtx = context.WithCancel(context.Background())
+	defer cancelCtx()
+	tempdir, err := ioutil.TempDir("/tmp", "pusher_main_test.TestMainDoesntNeedCredentialsWithoutGCS")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	rtx.Must(os.Mkdir(tempdir+"/testdata", 0777), "Could not create dir.")
+	oldNoUpload, oldDryRun, oldNodeName := *noUpload, *dryRun, *nodeName
+	oldAddress := *prometheusx.ListenAddress
+	defer func() {
+		*noUpload, *dryRun, *nodeName = oldNoUpload, oldDryRun, oldNodeName
+		*prometheusx.ListenAddress = oldAddress
+	}()
+	// The metric server of the last main() may still hold the default port.
+	*prometheusx.ListenAddress = ":0"
+	// Nothing is uploaded to GCS, so the missing credentials must not matter.
+	for _, v := range [][2]string{
+		{"PROJECT", "mlab-testing"},
+		{"DIRECTORY", tempdir},
+		{"BUCKET", "archive-mlab-testing"},
+		{"EXPERIMENT", "exp"},
+		{"NODE_NAME", "mlab5-abc1t"},
+		{"DATATYPE", "testdata=1"},
+		{"STORAGE_EMULATOR_HOST", ""},
+		{"GOOGLE_APPLICATION_CREDENTIALS", tempdir + "/no-such-credentials.json"},
+		{"NO_UPLOAD", "true"},
+		{"DRY_RUN", "true"},
+	} {
+		revert := osx.MustSetenv(v[0], v[1])
+		defer revert()
+	}
+	main()
+}
+
 func TestLintMetrics(t *testing.T) {
 	promtest.LintMetrics(t)
 }
@@ -106,15 +146,47 @@ func (f fakeNamer) ObjectName(_ filename.System, _ time.Time) string {
 	return f.name
 }
 
+// tarfileContents returns the contents of the named file in the gzipped
+// tarfile the fake GCS server holds.
+func tarfileContents(t *testing.T, server *fakegcs.Server, object, name string) string {
+	obj, ok := server.Object("archive-mlab-testing", object)
+	if !ok {
+		t.Errorf("Object %q was not uploaded", object)
+		return ""
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(obj.Contents))
+	if err != nil {
+		t.Errorf("Object %q is not gzipped: %v", object, err)
+		return ""
+	}
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err != nil {
+			t.Errorf("Could not find %q in %q: %v", name, object, err)
+			return ""
+		}
+		if h.Name == name {
+			contents, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Errorf("Could not read %q from %q: %v", name, object, err)
+			}
+			return string(contents)
+		}
+	}
+}
+
 // Set up the three main components and verify that they all work together correctly.
 func TestListenerTarcacheAndUploader(t *testing.T) {
 	// Set up the Uploader to create an error and then work
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	client, err := storage.NewClient(ctx)
+	server := fakegcs.NewServer("archive-mlab-testing")
+	defer server.Close()
+	client, err := server.Client(ctx)
 	rtx.Must(err, "Could not create cloud storage client")
-	namer := &fakeNamer{fmt.Sprintf("TestListenerTarcacheAndUploader-%d", time.Now().Unix())}
-	up := uploader.Create(ctx, time.Hour, stiface.AdaptClient(client), "archive-mlab-testing", namer)
+	namer := &fakeNamer{"TestListenerTarcacheAndUploader"}
+	up := uploader.Create(time.Hour, stiface.AdaptClient(client), "archive-mlab-testing", namer)
 
 	// Set up the TarCache with the uploader
 	tempdir, err := ioutil.TempDir("/tmp", "pusher_main_test.TestListenerTarcacheAndUploader")
@@ -124,11 +196,11 @@ func TestListenerTarcacheAndUploader(t *testing.T) {
 		return
 	}
 
-	tarCache, pusherChannel := tarcache.New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, 1, memoryless.Config{}, up)
+	tarCache, pusherChannel := tarcache.New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, 1, memoryless.Config{}, up, tarcache.Config{})
 	go tarCache.ListenForever(ctx, ctx)
 
 	// Set up the listener on the temp directory.
-	l, err := listener.Create(filename.System(tempdir), pusherChannel)
+	l, err := listener.Create(filename.System(tempdir), pusherChannel, filename.SymlinksFollow, false, 0, nil)
 	rtx.Must(err, "Could not create listener")
 	go l.ListenForever(ctx)
 
@@ -142,38 +214,9 @@ func TestListenerTarcacheAndUploader(t *testing.T) {
 	// Lose the race condition with the inotify listener and the upload.
 	time.Sleep(1 * time.Second)
 
-	// Verify that the data from the TarCache was successfully uploaded
-	url := "https://storage.googleapis.com/archive-mlab-testing/" + namer.name
-	defer func() {
-		cmd := exec.Command("gsutil", "rm", "-f", "gs://archive-mlab-testing/"+namer.name)
-		cmd.Run()
-	}()
-
-	// Make a place to put the tarfile.
-	tardir, err := ioutil.TempDir("/tmp", "pusher_main_test.TestListenerTarcacheAndUploader.tarfiledir")
-	defer os.RemoveAll(tardir)
-	if err != nil {
-		t.Error(err)
-		return
-	}
-
-	// Download the tarfile and untar it.
-	getter := exec.Command("curl", url, "--output", tardir+"/tarfile.tgz")
-	if err := getter.Run(); err != nil {
-		t.Errorf("curl command failed: %q", err)
-	}
-	untarrer := exec.Command("tar", "xfz", tardir+"/tarfile.tgz", "-C", tardir)
-	if err := untarrer.Run(); err != nil {
-		t.Errorf("tar command failed: %q", err)
-	}
-
 	// Verify that the contents of "tinyfile" from the tarfile match what we wrote the FS in the first place.
-	cloudContents, err := ioutil.ReadFile(tardir + "/tinyfile")
-	if err != nil {
-		t.Errorf("Could not read %s (%v)", tardir+"/tinyfile", err)
-	}
-	if string(cloudContents) != contents {
-		t.Errorf("File contents %q != %q (url: %q)", string(cloudContents), contents, url)
+	if cloudContents := tarfileContents(t, server, namer.name, "tinyfile"); cloudContents != contents {
+		t.Errorf("File contents %q != %q", cloudContents, contents)
 	}
 }
 
@@ -215,6 +258,11 @@ func (f fakeErroringObjectHandle) NewWriter(ctx context.Context) stiface.Writer
 
 type failingWriter struct {
 	stiface.Writer
+	attrs storage.ObjectAttrs
+}
+
+func (f *failingWriter) ObjectAttrs() *storage.ObjectAttrs {
+	return &f.attrs
 }
 
 func (f failingWriter) Write(p []byte) (n int, err error) {
@@ -225,10 +273,12 @@ func TestListenerTarcacheAndUploaderWithOneFailure(t *testing.T) {
 	// Set up the Uploader to create an error and then work
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	client, err := storage.NewClient(ctx)
+	server := fakegcs.NewServer("archive-mlab-testing")
+	defer server.Close()
+	client, err := server.Client(ctx)
 	rtx.Must(err, "Could not create cloud storage client")
-	namer := &fakeNamer{fmt.Sprintf("TestListenerTarcacheAndUploaderWithOneFailure-%d", time.Now().Unix())}
-	up := uploader.Create(ctx, time.Hour, singleErrorClient{realClient: stiface.AdaptClient(client)}, "archive-mlab-testing", namer)
+	namer := &fakeNamer{"TestListenerTarcacheAndUploaderWithOneFailure"}
+	up := uploader.Create(time.Hour, singleErrorClient{realClient: stiface.AdaptClient(client)}, "archive-mlab-testing", namer)
 
 	// Set up the TarCache with the uploader
 	tempdir, err := ioutil.TempDir("/tmp", "pusher_main_test.TestListenerAndUploaderWithOneFailure")
@@ -238,11 +288,11 @@ func TestListenerTarcacheAndUploaderWithOneFailure(t *testing.T) {
 		return
 	}
 
-	tarCache, pusherChannel := tarcache.New(filename.System(tempdir), "testdata", 1, &flagx.KeyValue{}, 1, memoryless.Config{}, up)
+	tarCache, pusherChannel := tarcache.New(filename.System(tempdir), "testdata", 1, &flagx.KeyValue{}, 1, memoryless.Config{}, up, tarcache.Config{})
 	go tarCache.ListenForever(ctx, ctx)
 
 	// Set up the listener on the temp directory.
-	l, err := listener.Create(filename.System(tempdir), pusherChannel)
+	l, err := listener.Create(filename.System(tempdir), pusherChannel, filename.SymlinksFollow, false, 0, nil)
 	rtx.Must(err, "Could not create listener")
 	go l.ListenForever(ctx)
 
@@ -256,38 +306,9 @@ func TestListenerTarcacheAndUploaderWithOneFailure(t *testing.T) {
 	// Lose the race condition with the inotify listener and the upload.
 	time.Sleep(1 * time.Second)
 
-	// Verify that the data from the TarCache was successfully uploaded
-	url := "https://storage.googleapis.com/archive-mlab-testing/" + namer.name
-	defer func() {
-		cmd := exec.Command("gsutil", "rm", "-f", "gs://archive-mlab-testing/"+namer.name)
-		cmd.Run()
-	}()
-
-	// Make a place to put the tarfile.
-	tardir, err := ioutil.TempDir("/tmp", "pusher_main_test.TestListenerTarcacheAndUploadWithOneFailure.tarfiledir")
-	defer os.RemoveAll(tardir)
-	if err != nil {
-		t.Error(err)
-		return
-	}
-
-	// Download the tarfile and untar it.
-	getter := exec.Command("curl", url, "--output", tardir+"/tarfile.tgz")
-	if err := getter.Run(); err != nil {
-		t.Errorf("curl command failed: %q", err)
-	}
-	untarrer := exec.Command("tar", "xfz", tardir+"/tarfile.tgz", "-C", tardir)
-	if err := untarrer.Run(); err != nil {
-		t.Errorf("tar command failed: %q", err)
-	}
-
 	// Verify that the contents of "tinyfile" from the tarfile match what we wrote the FS in the first place.
-	cloudContents, err := ioutil.ReadFile(tardir + "/tinyfile")
-	if err != nil {
-		t.Errorf("Could not read %s (%v)", tardir+"/tinyfile", err)
-	}
-	if string(cloudContents) != contents {
-		t.Errorf("File contents %q != %q (url: %q)", string(cloudContents), contents, url)
+	if cloudContents := tarfileContents(t, server, namer.name, "tinyfile"); cloudContents != contents {
+		t.Errorf("File contents %q != %q", cloudContents, contents)
 	}
 }
 
@@ -314,7 +335,7 @@ func TestSignalHandler(t *testing.T) {
 		cancel2Time = time.Now()
 		wg.Done()
 	}
-	go signalHandler(syscall.SIGUSR2, cancel1, waitTime, cancel2)
+	go signalHandler(syscall.SIGUSR2, cancel1, waitTime, cancel2, nil)
 	time.Sleep(100 * time.Millisecond) // Give the signal handler time to set up
 
 	// Verify that nothing is yet canceled.
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+var (
+	pusherRunSeconds = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pusher_run_seconds",
+			Help: "How long pusher had been running when the metrics were last pushed to the pushgateway",
+		})
+	pusherMetricPushes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_metric_pushes_total",
+			Help: "The number of times the metrics were pushed to the pushgateway, by whether the push succeeded",
+		},
+		[]string{"result"})
+)
+
+// pushTimeout is how long a push to the pushgateway may take.
+const pushTimeout = 30 * time.Second
+
+// newGateway returns a Pusher of every metric to the pushgateway at the URL,
+// grouped by host, so that pushers on different hosts don't replace one
+// another's metrics.
+func newGateway(url string) *push.Pusher {
+	return push.New(url, "pusher").
+		Gatherer(prometheus.DefaultGatherer).
+		Grouping("instance", hostName()).
+		Client(&http.Client{Timeout: pushTimeout})
+}
+
+// pushMetrics pushes every metric to the pushgateway, along with how long
+// pusher has been running.
+func pushMetrics(gateway *push.Pusher, started time.Time) {
+	pusherRunSeconds.Set(time.Since(started).Seconds())
+	if err := gateway.Push(); err != nil {
+		log.Printf("Could not push the metrics to the pushgateway (error: %q)\n", err)
+		pusherMetricPushes.WithLabelValues("error").Inc()
+		return
+	}
+	pusherMetricPushes.WithLabelValues("ok").Inc()
+}
+
+// pushMetricsForever pushes the metrics to the pushgateway every interval,
+// until ctx is done. The last push, once every pipeline is done, is up to the
+// caller.
+func pushMetricsForever(ctx context.Context, gateway *push.Pusher, interval time.Duration, started time.Time) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pushMetrics(gateway, started)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Package ratelog logs repeated messages at most once per interval, so that an
+// outage which makes every retry fail the same way does not bury everything
+// else in the log. Messages are alike if they have the same format and the same
+// arguments but for their durations, such as how long a failed call ran, so
+// that e.g. a 503 and a 403 are not alike. The first of a run of alike messages
+// is logged, and the rest are counted. Once the interval is over, the last of
+// them is logged too, saying how many were suppressed, so that the count is
+// logged even if the messages stop.
+package ratelog
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/pusher/metrics"
+)
+
+var collectors metrics.Collectors
+
+// RegisterMetrics registers the metrics of the suppressed messages on r, or on
+// prometheus.DefaultRegisterer if r is nil. The packages which log through
+// ratelog register them along with their own.
+func RegisterMetrics(r prometheus.Registerer) {
+	collectors.Register(r)
+}
+
+var pusherLogMessagesSuppressed = collectors.NewCounter(
+	prometheus.CounterOpts{
+		Name: "pusher_log_messages_suppressed_total",
+		Help: "The number of log messages not logged because an alike message had been logged less than --log_repeat_interval before",
+	})
+
+// maxEntries is how many kinds of message a Limiter remembers before it forgets
+// those it last logged over an interval ago.
+const maxEntries = 1000
+
+// entry is when a kind of message was last logged, and how many alike
+// messages have been suppressed since.
+type entry struct {
+	logged     time.Time
+	suppressed int
+	// The last message suppressed, and the timer which logs it once the
+	// interval is over.
+	last  string
+	timer *time.Timer
+}
+
+// A Limiter logs alike messages at most once per interval.
+type Limiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	entries  map[string]*entry
+}
+
+// New returns a Limiter which logs alike messages at most once per interval.
+// If the interval is not positive, every message is logged.
+func New(interval time.Duration) *Limiter {
+	return &Limiter{interval: interval, entries: make(map[string]*entry)}
+}
+
+// SetInterval changes the interval, e.g. once it has been read from a flag,
+// and forgets the messages logged so far.
+func (l *Limiter) SetInterval(interval time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, e := range l.entries {
+		if e.timer != nil {
+			e.timer.Stop()
+		}
+	}
+	l.interval = interval
+	l.entries = make(map[string]*entry)
+}
+
+// Printf logs the message, like log.Printf, unless an alike message was logged
+// less than the interval ago.
+func (l *Limiter) Printf(format string, v ...interface{}) {
+	l.printf(3, format, v...)
+}
+
+// printf does the work of Printf. The depth is that of the caller whose file
+// and line should be logged, counted as for log.Output from here.
+func (l *Limiter) printf(depth int, format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	if suppressed, ok := l.allow(keyOf(format, v), msg, time.Now()); !ok {
+		pusherLogMessagesSuppressed.Inc()
+		return
+	} else if suppressed > 0 {
+		msg = withCount(msg, suppressed)
+	}
+	log.Output(depth, msg)
+}
+
+// withCount adds how many alike messages were suppressed to the message.
+func withCount(msg string, suppressed int) string {
+	return fmt.Sprintf("%s (%d alike messages suppressed)", strings.TrimSuffix(msg, "\n"), suppressed)
+}
+
+// keyOf returns what alike messages have in common: their format, and those of
+// their arguments which are not durations.
+func keyOf(format string, v []interface{}) string {
+	var b strings.Builder
+	b.WriteString(format)
+	for _, arg := range v {
+		b.WriteByte(0)
+		if _, ok := arg.(time.Duration); !ok {
+			fmt.Fprint(&b, arg)
+		}
+	}
+	return b.String()
+}
+
+// allow returns whether the message, whose key is given by keyOf, should be
+// logged at the given time and, if so, how many alike messages have been
+// suppressed since one was last logged.
+func (l *Limiter) allow(key, msg string, now time.Time) (int, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.interval <= 0 {
+		return 0, true
+	}
+	e, ok := l.entries[key]
+	if ok && now.Sub(e.logged) < l.interval {
+		e.suppressed++
+		e.last = msg
+		if e.timer == nil {
+			e.timer = time.AfterFunc(e.logged.Add(l.interval).Sub(now), func() { l.flush(e) })
+		}
+		return 0, false
+	}
+	suppressed := 0
+	if ok {
+		suppressed = e.suppressed
+		// The count is logged with this message instead.
+		e.suppressed = 0
+		if e.timer != nil {
+			e.timer.Stop()
+		}
+	}
+	if !ok && len(l.entries) >= maxEntries {
+		for k, old := range l.entries {
+			if now.Sub(old.logged) >= l.interval {
+				delete(l.entries, k)
+			}
+		}
+	}
+	l.entries[key] = &entry{logged: now}
+	return suppressed, true
+}
+
+// flush logs the last of the messages suppressed since the entry was logged,
+// with how many there were, once the interval is over, so that the count is
+// logged even if no alike message follows. Alike messages are then suppressed
+// for another interval.
+func (l *Limiter) flush(e *entry) {
+	l.mu.Lock()
+	e.timer = nil
+	suppressed, last := e.suppressed, e.last
+	e.suppressed = 0
+	e.logged = time.Now()
+	l.mu.Unlock()
+	if suppressed > 0 {
+		log.Output(2, withCount(last, suppressed))
+	}
+}
+
+// std is the Limiter used by the package's functions.
+var std = New(time.Minute)
+
+// SetInterval sets the interval of the package's Limiter, which is a minute
+// until it is set.
+func SetInterval(interval time.Duration) {
+	std.SetInterval(interval)
+}
+
+// Printf logs the message through the package's Limiter.
+func Printf(format string, v ...interface{}) {
+	std.printf(3, format, v...)
+}
@@ -0,0 +1,109 @@
+package ratelog_test
+
+import (
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/logx"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/pusher/ratelog"
+)
+
+func TestLimiter(t *testing.T) {
+	flags := log.Flags()
+	defer log.SetFlags(flags)
+	log.SetFlags(log.Lshortfile)
+
+	l := ratelog.New(100 * time.Millisecond)
+	out, err := logx.CaptureLog(nil, func() {
+		for i := 0; i < 3; i++ {
+			l.Printf("Call to upload failed (error: %q) after running for %s", "unavailable", time.Duration(i)*time.Millisecond)
+		}
+		l.Printf("Call to upload failed (error: %q) after running for %s", "not found", time.Millisecond)
+	})
+	rtx.Must(err, "Could not capture the log")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"unavailable"`) || !strings.Contains(lines[1], `"not found"`) {
+		t.Errorf("Logged %q instead of one message for each error", out)
+	}
+	// The file and line are those of the caller.
+	if !strings.HasPrefix(lines[0], "ratelog_test.go:") {
+		t.Errorf("Logged %q, which is not attributed to the caller", lines[0])
+	}
+
+	// Once the interval is over, the last suppressed message is logged with
+	// the count, even though no alike message follows.
+	out, err = logx.CaptureLog(nil, func() {
+		time.Sleep(150 * time.Millisecond)
+	})
+	rtx.Must(err, "Could not capture the log")
+	if !strings.Contains(out, "running for 2ms (2 alike messages suppressed)") {
+		t.Errorf("Logged %q, which does not count the suppressed messages", out)
+	}
+	// An alike message within the next interval is suppressed and logged
+	// once it is over, so the one after that is logged as it comes.
+	out, err = logx.CaptureLog(nil, func() {
+		l.Printf("Call to upload failed (error: %q) after running for %s", "unavailable", 4*time.Millisecond)
+		time.Sleep(250 * time.Millisecond)
+		l.Printf("Call to upload failed (error: %q) after running for %s", "unavailable", 5*time.Millisecond)
+	})
+	rtx.Must(err, "Could not capture the log")
+	if !strings.Contains(out, "running for 4ms (1 alike messages suppressed)") || !strings.Contains(out, "running for 5ms\n") {
+		t.Errorf("Logged %q instead of the suppressed message and then the next one", out)
+	}
+}
+
+func TestLimiterKeysOnArguments(t *testing.T) {
+	l := ratelog.New(time.Hour)
+	defer l.SetInterval(0)
+	out, err := logx.CaptureLog(nil, func() {
+		for _, status := range []int{503, 403, 503} {
+			l.Printf("Upload failed with status %d after %s", status, time.Duration(status)*time.Millisecond)
+		}
+		l.Printf("Upload of %s failed after %s", "ndt5", time.Second)
+		l.Printf("Upload of %s failed after %s", "ndt7", 2*time.Second)
+		l.Printf("Upload of %s failed after %s", "ndt7", 3*time.Second)
+	})
+	rtx.Must(err, "Could not capture the log")
+	for _, want := range []string{"status 503", "status 403", "ndt5", "ndt7 failed after 2s"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Logged %q, without %q", out, want)
+		}
+	}
+	if n := strings.Count(out, "\n"); n != 4 {
+		t.Errorf("Logged %d messages instead of 4: %q", n, out)
+	}
+}
+
+func TestLimiterDisabled(t *testing.T) {
+	l := ratelog.New(0)
+	out, err := logx.CaptureLog(nil, func() {
+		for i := 0; i < 3; i++ {
+			l.Printf("Attempt %d failed\n", i)
+		}
+	})
+	rtx.Must(err, "Could not capture the log")
+	if n := strings.Count(out, "failed"); n != 3 {
+		t.Errorf("Logged %d of 3 messages: %q", n, out)
+	}
+}
+
+func TestPrintf(t *testing.T) {
+	flags := log.Flags()
+	defer log.SetFlags(flags)
+	log.SetFlags(log.Lshortfile)
+	ratelog.SetInterval(time.Hour)
+	defer ratelog.SetInterval(time.Minute)
+	out, err := logx.CaptureLog(nil, func() {
+		for i := 0; i < 5; i++ {
+			ratelog.Printf("TestPrintf after %s", time.Duration(i)*time.Second)
+		}
+	})
+	rtx.Must(err, "Could not capture the log")
+	if strings.Count(out, "TestPrintf") != 1 || !strings.HasPrefix(out, "ratelog_test.go:") {
+		t.Errorf("Logged %q instead of one message from the caller", out)
+	}
+}
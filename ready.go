@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// erred is the part of a pipeline.Pipeline that readiness needs.
+type erred interface {
+	Err() error
+}
+
+// readiness says whether pusher is ready: whether the pipeline of every
+// datatype is set up and running, so that its directory is being watched. It
+// serves the readiness probe, so that a pusher whose directories can't be
+// watched, e.g. because the inotify watch limit was reached, is reported as
+// such rather than crash-looping.
+type readiness struct {
+	mu        sync.Mutex
+	pipelines map[string]erred
+	// Whether the pipelines have all been started.
+	started bool
+}
+
+func newReadiness() *readiness {
+	return &readiness{pipelines: make(map[string]erred)}
+}
+
+// add records the pipeline of the datatype, which is a problem while Err says
+// it is not running, including while it can't be set up yet.
+func (r *readiness) add(datatype string, p erred) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pipelines[datatype] = p
+}
+
+// start records that every pipeline was started.
+func (r *readiness) start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.started = true
+}
+
+// problems returns what keeps pusher from being ready, one line per problem.
+func (r *readiness) problems() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var problems []string
+	for datatype, p := range r.pipelines {
+		if err := p.Err(); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: not running: %v", datatype, err))
+		}
+	}
+	sort.Strings(problems)
+	if !r.started && len(problems) == 0 {
+		problems = append(problems, "starting")
+	}
+	return problems
+}
+
+// ServeHTTP answers 200 if pusher is ready, and 503, with the reasons why not,
+// if it is not.
+func (r *readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	problems := r.problems()
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, p := range problems {
+			fmt.Fprintln(w, p)
+		}
+		return
+	}
+	fmt.Fprintln(w, "ready")
+}
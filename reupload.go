@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
+	"github.com/m-lab/go/flagx"
+
+	"github.com/m-lab/pusher/filename"
+	"github.com/m-lab/pusher/namer"
+	"github.com/m-lab/pusher/uploader"
+)
+
+// reuploadedFrom is the metadata under which a reuploaded archive records
+// where it was copied from.
+const reuploadedFrom = "pusher-reuploaded-from"
+
+// objectName is what the name of an archive says about it, as made by a
+// namer.
+type objectName struct {
+	experiment, datatype, subdir, node, extension string
+	time                                          time.Time
+}
+
+// parseObjectName recovers the parts of an archive's name, which may be a GCS
+// object name or a local path, that a namer made it from. Anything before the
+// experiment, such as a datatype prefix or a local directory, is ignored.
+func parseObjectName(name string) (objectName, error) {
+	const layout = "20060102T150405.000000Z"
+	dir, base := path.Split(name)
+	extension := path.Ext(base)
+	if extension != ".tgz" && extension != ".tar" && extension != ".zip" {
+		return objectName{}, fmt.Errorf("%q does not end in .tgz, .tar or .zip", name)
+	}
+	stem := strings.TrimSuffix(base, extension)
+	if len(stem) <= len(layout) || stem[len(layout)] != '-' {
+		return objectName{}, fmt.Errorf("%q does not start with a timestamp", base)
+	}
+	t, err := time.Parse(layout, stem[:len(layout)])
+	if err != nil {
+		return objectName{}, fmt.Errorf("%q does not start with a timestamp: %w", base, err)
+	}
+	rest := stem[len(layout)+1:]
+	parts := strings.Split(strings.Trim(dir, "/"), "/")
+	for i := 0; i+1 < len(parts); i++ {
+		experiment, datatype := parts[i], parts[i+1]
+		if len(rest) <= len(datatype)+len(experiment)+2 || !strings.HasPrefix(rest, datatype+"-") || !strings.HasSuffix(rest, "-"+experiment) {
+			continue
+		}
+		o := objectName{
+			experiment: experiment,
+			datatype:   datatype,
+			subdir:     path.Join(parts[i+2:]...),
+			node:       strings.TrimSuffix(strings.TrimPrefix(rest, datatype+"-"), "-"+experiment),
+			extension:  extension,
+			time:       t,
+		}
+		// The namer must be able to make the same name again.
+		if !strings.HasSuffix(name, o.name("")) {
+			continue
+		}
+		return o, nil
+	}
+	return objectName{}, fmt.Errorf("%q is not named like <experiment>/<datatype>/<subdir>/<time>-<datatype>-<node>-<experiment>%s", name, extension)
+}
+
+// name returns the name a namer gives the archive, under the prefix.
+func (o objectName) name(prefix string) string {
+	n := namer.WithPrefix(prefix, namer.NewWithExtension(o.datatype, o.experiment, o.node, o.extension))
+	return n.ObjectName(filename.System(o.subdir), o.time)
+}
+
+// readArchive reads a local archive, or a GCS object named by a gs:// URL, and
+// returns its contents and, for GCS, its custom metadata.
+func readArchive(ctx context.Context, location, credentialsFile, serviceAccount string) ([]byte, map[string]string, error) {
+	if !strings.HasPrefix(location, "gs://") {
+		data, err := ioutil.ReadFile(location)
+		return data, nil, err
+	}
+	object, err := gcsObject(ctx, location, credentialsFile, serviceAccount)
+	if err != nil {
+		return nil, nil, err
+	}
+	attrs, err := object.Attrs(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := object.NewReader(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	return data, attrs.Metadata, err
+}
+
+// reuploadMain runs `pusher reupload` with the given arguments, which follow
+// the word "reupload" on the command line.
+func reuploadMain(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("reupload", flag.ContinueOnError)
+	fs.SetOutput(out)
+	// The flags share their values with pusher's own.
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	validate := fs.Bool("validate", true, "Check that the gzip (if any) and tar layers, or the zip layer, of each archive are intact before uploading it again, as `pusher inspect` does.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s reupload: %s reupload [-validate=false] [pusher's flags] <file.tgz, file.tar, file.zip or gs://bucket/object>...\n", os.Args[0], os.Args[0])
+		fmt.Fprintf(fs.Output(), `
+Uploads archives that pusher made again, e.g. to move them to a new bucket,
+without touching the files on any node. Each archive is first checked as by
+"inspect", unless -validate=false. It keeps its name, but under the
+--datatype_prefix of its datatype instead of any prefix it had, and goes to
+the --datatype_bucket of its datatype, or else to the first --bucket. It keeps
+the custom metadata of its GCS object, and records where it came from as
+`+reuploadedFrom+`. With --no_upload, each archive is read and validated,
+and where it would go is printed, but nothing is uploaded. pusher's flags,
+including the GCS credentials flags, --upload_timeout and
+--upload_verify_attempts, can also be set by environment variables, as for
+pusher itself.
+`)
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := flagx.ArgsFromEnv(fs); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("no archive to reupload")
+	}
+	if len(buckets) == 0 && len(dtBuckets.Get()) == 0 {
+		return errors.New("no --bucket or --datatype_bucket to reupload to")
+	}
+	var client stiface.Client
+	gcs := func() (stiface.Client, error) {
+		if client == nil {
+			opts, err := storageOptions(ctx, *credentialsFile, *impersonateSA, nil)
+			if err != nil {
+				return nil, err
+			}
+			c, err := storage.NewClient(ctx, opts...)
+			if err != nil {
+				return nil, err
+			}
+			client = stiface.AdaptClient(c)
+		}
+		return client, nil
+	}
+	failed := 0
+	for _, location := range fs.Args() {
+		destination, err := reupload(ctx, location, *validate, *noUpload, gcs)
+		if err != nil {
+			fmt.Fprintf(out, "%s: ERROR: %v\n", location, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(out, "%s -> %s\n", location, destination)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d archives could not be reuploaded", failed, fs.NArg())
+	}
+	return nil
+}
+
+// reupload reads the archive at the location, validates it if asked to, and
+// uploads it to where pusher's flags say it belongs, unless this is a dry run.
+// It returns where the archive went, or would have gone.
+func reupload(ctx context.Context, location string, validate, dryRun bool, gcs func() (stiface.Client, error)) (string, error) {
+	source := location
+	if strings.HasPrefix(location, "gs://") {
+		// The name of the object follows the bucket.
+		parts := strings.SplitN(strings.TrimPrefix(location, "gs://"), "/", 2)
+		source = parts[len(parts)-1]
+	}
+	o, err := parseObjectName(source)
+	if err != nil {
+		return "", err
+	}
+	bucket, ok := datatypeValue(dtBuckets.Get(), o.experiment, o.datatype)
+	if !ok {
+		if len(buckets) == 0 {
+			return "", fmt.Errorf("no --bucket or --datatype_bucket for %s", o.datatype)
+		}
+		bucket = buckets[0]
+	}
+	prefix, _ := datatypeValue(dtPrefixes.Get(), o.experiment, o.datatype)
+	name := o.name(prefix)
+	destination := "gs://" + bucket + "/" + name
+	if destination == location {
+		return "", errors.New("the archive is already where it belongs")
+	}
+	data, metadata, err := readArchive(ctx, location, *credentialsFile, *impersonateSA)
+	if err != nil {
+		return "", err
+	}
+	if validate {
+		if err := inspectArchive(bytes.NewReader(data), ioutil.Discard); err != nil {
+			return "", err
+		}
+	}
+	if dryRun {
+		return destination, nil
+	}
+	client, err := gcs()
+	if err != nil {
+		return "", err
+	}
+	copied := map[string]string{}
+	for k, v := range metadata {
+		copied[k] = v
+	}
+	// The upload records its own time and format.
+	delete(copied, "pusher-upload-time")
+	delete(copied, "pusher-archive-format")
+	copied[reuploadedFrom] = location
+	up := uploader.CreateVerified(*uploadTimeout, client, bucket, namer.Fixed(name), *verifyAttempts)
+	result, err := up.Upload(ctx, uploader.NewID(), filename.System(o.subdir), data, copied)
+	return result.Destination, err
+}
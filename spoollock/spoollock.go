@@ -0,0 +1,71 @@
+// Package spoollock keeps two pushers from working on the same spool directory
+// at once, where they would race to upload and delete the same files. Each
+// pusher holds an exclusive flock(2) lock on a file in the root of its
+// directory for as long as it runs. The kernel releases the lock when the
+// process exits, however it exits, so a stale lock file is never a problem.
+package spoollock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Name is the name of the lock file in the spool directory.
+const Name = ".pusher.lock"
+
+// ErrLocked means another process holds the lock.
+var ErrLocked = errors.New("the spool directory is locked by another process")
+
+// A Lock is a held lock on a spool directory.
+type Lock struct {
+	f *os.File
+}
+
+// Acquire locks the directory, without waiting. If another process holds the
+// lock, it returns an error wrapping ErrLocked, which names that process if it
+// can.
+func Acquire(dir string) (*Lock, error) {
+	path := filepath.Join(dir, Name)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open the lock file: %w", err)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		defer f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w: %s is held by %s", ErrLocked, path, holder(f))
+		}
+		return nil, fmt.Errorf("could not lock %s: %w", path, err)
+	}
+	// The file records who holds the lock, for whoever is refused it.
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &Lock{f: f}, nil
+}
+
+// holder returns a description of the process which holds the lock.
+func holder(f *os.File) string {
+	contents := make([]byte, 32)
+	n, _ := f.ReadAt(contents, 0)
+	pid := strings.TrimSpace(string(contents[:n]))
+	if _, err := strconv.Atoi(pid); err != nil {
+		return "an unknown process"
+	}
+	return "pid " + pid
+}
+
+// Release releases the lock. The lock file is left in place, because removing
+// it could let two processes hold locks on different files of the same name.
+func (l *Lock) Release() error {
+	if l == nil {
+		return nil
+	}
+	return l.f.Close()
+}
@@ -0,0 +1,49 @@
+package spoollock_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/pusher/spoollock"
+)
+
+func TestAcquire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spoollock.TestAcquire")
+	rtx.Must(err, "Could not create the temp dir")
+	defer os.RemoveAll(dir)
+	lock, err := spoollock.Acquire(dir)
+	rtx.Must(err, "Could not lock the directory")
+	contents, err := ioutil.ReadFile(filepath.Join(dir, spoollock.Name))
+	rtx.Must(err, "Could not read the lock file")
+	if pid := strings.TrimSpace(string(contents)); pid != strconv.Itoa(os.Getpid()) {
+		t.Errorf("The lock file holds %q, not our pid", pid)
+	}
+
+	// A second lock conflicts, even within one process, because each Acquire
+	// opens the file anew.
+	_, err = spoollock.Acquire(dir)
+	if !errors.Is(err, spoollock.ErrLocked) {
+		t.Fatalf("A second Acquire returned %v, not ErrLocked", err)
+	}
+	if !strings.Contains(err.Error(), "pid "+strconv.Itoa(os.Getpid())) {
+		t.Errorf("The error %q does not name the holder", err)
+	}
+
+	rtx.Must(lock.Release(), "Could not release the lock")
+	lock, err = spoollock.Acquire(dir)
+	rtx.Must(err, "Could not lock the directory again once released")
+	rtx.Must(lock.Release(), "Could not release the lock")
+}
+
+func TestAcquireMissingDirectory(t *testing.T) {
+	_, err := spoollock.Acquire("/nonexistent/spool")
+	if err == nil || errors.Is(err, spoollock.ErrLocked) {
+		t.Errorf("Acquire of a missing directory returned %v", err)
+	}
+}
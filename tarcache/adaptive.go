@@ -0,0 +1,81 @@
+package tarcache
+
+import (
+	"math"
+	"time"
+
+	"github.com/m-lab/go/memoryless"
+)
+
+// arrivalRate estimates how fast data arrives, in bytes per second, as an
+// average which decays exponentially over the horizon. Data that keeps
+// arriving at a steady rate is estimated at that rate.
+type arrivalRate struct {
+	horizon time.Duration
+	rate    float64 // As of last.
+	last    time.Time
+}
+
+// add records that n bytes arrived at the given time.
+func (r *arrivalRate) add(n int64, now time.Time) {
+	if r.horizon <= 0 {
+		return
+	}
+	r.rate = r.at(now) + float64(n)/r.horizon.Seconds()
+	r.last = now
+}
+
+// at returns the estimated rate at the given time.
+func (r *arrivalRate) at(now time.Time) float64 {
+	if r.last.IsZero() {
+		return 0
+	}
+	return r.rate * math.Exp(-now.Sub(r.last).Seconds()/r.horizon.Seconds())
+}
+
+// ageHorizon is the longest a tarfile is usually held for its age threshold.
+func ageHorizon(age memoryless.Config) time.Duration {
+	if age.Max > 0 {
+		return age.Max
+	}
+	return age.Expected
+}
+
+// effectiveAge returns the age threshold for a tarfile started now. Unless the
+// threshold is adaptive, it is the configured one. Otherwise, a datatype whose
+// files arrive fast enough to fill a tarfile to the size threshold within the
+// configured maximum age gets the configured threshold, so that its tarfiles
+// do fill. A slower datatype would only fill its tarfiles after the maximum
+// age anyway, so its threshold is shortened in proportion to how much slower
+// it is, down to the configured minimum, so that its data is not held for
+// hours for nothing.
+func (t *TarCache) effectiveAge(now time.Time) memoryless.Config {
+	age := t.ageThreshold
+	if !t.config.AdaptiveAge {
+		return age
+	}
+	horizon := ageHorizon(age).Seconds()
+	scale := 0.0
+	if rate := t.arrivals.at(now); rate > 0 {
+		scale = math.Min(1, horizon*rate/float64(t.sizeThreshold))
+	}
+	shorten := func(d time.Duration) time.Duration {
+		if scaled := time.Duration(float64(d) * scale); scaled > age.Min {
+			return scaled
+		}
+		return age.Min
+	}
+	effective := memoryless.Config{Min: age.Min, Expected: shorten(age.Expected)}
+	if age.Max > 0 {
+		effective.Max = shorten(age.Max)
+	}
+	t.exportAge(effective)
+	return effective
+}
+
+// exportAge exports the age threshold of the most recently started tarfile.
+func (t *TarCache) exportAge(age memoryless.Config) {
+	pusherAgeThreshold.WithLabelValues(t.datatype, "min").Set(age.Min.Seconds())
+	pusherAgeThreshold.WithLabelValues(t.datatype, "expected").Set(age.Expected.Seconds())
+	pusherAgeThreshold.WithLabelValues(t.datatype, "max").Set(age.Max.Seconds())
+}
@@ -0,0 +1,56 @@
+package tarcache
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/m-lab/pusher/tarfile"
+)
+
+// CheckBoundary returns an error if the boundary, in the sense of
+// Config.Boundary, does not divide a day evenly, so that the boundaries would
+// fall at different times each day.
+func CheckBoundary(boundary time.Duration) error {
+	if boundary > 0 && (24*time.Hour)%boundary != 0 {
+		return fmt.Errorf("boundary %v does not divide a day evenly", boundary)
+	}
+	return nil
+}
+
+// periodStart returns the last boundary, in the sense of Config.Boundary,
+// before the given time.
+func (t *TarCache) periodStart(now time.Time) time.Time {
+	return now.UTC().Truncate(t.config.Boundary)
+}
+
+// untilBoundary returns how long it is from the given time to the next
+// boundary.
+func (t *TarCache) untilBoundary(now time.Time) time.Duration {
+	return t.periodStart(now).Add(t.config.Boundary).Sub(now)
+}
+
+// crossedBoundary returns whether the tarfile was started before the last
+// boundary, and so must be uploaded before any file is added to it.
+func (t *TarCache) crossedBoundary(tf tarfile.Tarfile, now time.Time) bool {
+	if t.config.Boundary <= 0 {
+		return false
+	}
+	first := tf.FirstAdded()
+	return !first.IsZero() && first.Before(t.periodStart(now))
+}
+
+// rotate uploads every tarfile started before the last boundary, oldest first.
+func (t *TarCache) rotate() {
+	now := time.Now()
+	keys := []string{}
+	for key, tf := range t.currentTarfile {
+		if t.crossedBoundary(tf, now) {
+			keys = append(keys, key)
+		}
+	}
+	t.oldestFirst(keys)
+	for _, key := range keys {
+		pusherTarfilesUploadCalls.WithLabelValues(t.datatype, "boundary_crossed").Inc()
+		t.uploadAndDelete(key)
+	}
+}
@@ -0,0 +1,36 @@
+package tarcache
+
+import "sync/atomic"
+
+// Flush queues every tarfile to be uploaded now, as if its age threshold had
+// been met. While uploads are paused or not allowed by the schedule, they wait
+// until they are. Like Reset, Flush must not be called from the goroutine
+// running ListenForever, and is safe to call after it has returned.
+func (t *TarCache) Flush() {
+	select {
+	case t.flushChannel <- struct{}{}:
+	case <-t.done:
+	}
+}
+
+// SetPaused pauses or resumes uploads. While they are paused, the TarCache
+// behaves as it does when its schedule does not allow uploads: nothing is
+// uploaded, and new files are left on disk until uploads are resumed. Everything
+// is still uploaded when the TarCache stops. SetPaused is safe to call from any
+// goroutine, even before ListenForever is called.
+func (t *TarCache) SetPaused(paused bool) {
+	var v int32
+	if paused {
+		v = 1
+	}
+	atomic.StoreInt32(&t.paused, v)
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Paused returns whether uploads are paused by SetPaused.
+func (t *TarCache) Paused() bool {
+	return atomic.LoadInt32(&t.paused) == 1
+}
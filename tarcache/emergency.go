@@ -0,0 +1,141 @@
+package tarcache
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// EmergencyLimiter limits how many tarfiles the TarCaches sharing it upload at
+// once when they upload everything on shutdown, so that a short shutdown
+// window is not split between every tarfile of every datatype. Priority
+// datatypes (see Config.Priority) go first: whenever an upload finishes, a
+// waiting priority upload takes its place before any other. Some of the
+// uploads may also be reserved for priority datatypes, so that they are never
+// stuck waiting behind bulk data.
+type EmergencyLimiter struct {
+	mu       sync.Mutex
+	limit    int
+	reserved int
+	inUse    int
+	// The uploads waiting to start, priority uploads first. Each is started
+	// by closing its channel.
+	waiting [2][]chan struct{}
+}
+
+// NewEmergencyLimiter returns a limiter which allows limit uploads at once, of
+// which reserved may only be used by priority datatypes. The reserved uploads
+// are at most limit-1, so that other datatypes can always upload.
+func NewEmergencyLimiter(limit, reserved int) *EmergencyLimiter {
+	if limit < 1 {
+		limit = 1
+	}
+	if reserved > limit-1 {
+		reserved = limit - 1
+	}
+	if reserved < 0 {
+		reserved = 0
+	}
+	return &EmergencyLimiter{limit: limit, reserved: reserved}
+}
+
+const (
+	priorityQueue = 0
+	normalQueue   = 1
+)
+
+// canStart returns whether an upload may start now. The mutex must be held.
+func (l *EmergencyLimiter) canStart(priority bool) bool {
+	if priority {
+		return l.inUse < l.limit
+	}
+	return len(l.waiting[priorityQueue]) == 0 && l.inUse < l.limit-l.reserved
+}
+
+// acquire waits until an upload may start, and returns whether it may. It
+// returns false if ctx is done first.
+func (l *EmergencyLimiter) acquire(ctx context.Context, priority bool) bool {
+	l.mu.Lock()
+	if len(l.waiting[queueOf(priority)]) == 0 && l.canStart(priority) {
+		l.inUse++
+		l.mu.Unlock()
+		return true
+	}
+	start := make(chan struct{})
+	q := queueOf(priority)
+	l.waiting[q] = append(l.waiting[q], start)
+	l.mu.Unlock()
+
+	select {
+	case <-start:
+		return true
+	case <-ctx.Done():
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, c := range l.waiting[q] {
+		if c == start {
+			l.waiting[q] = append(l.waiting[q][:i], l.waiting[q][i+1:]...)
+			return false
+		}
+	}
+	// The upload was started just as ctx was done, and must make way for
+	// another.
+	l.inUse--
+	l.startWaiting()
+	return false
+}
+
+// release records that an upload has finished, and starts waiting uploads in
+// its place.
+func (l *EmergencyLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inUse--
+	l.startWaiting()
+}
+
+// startWaiting starts as many waiting uploads as are allowed, priority uploads
+// first. The mutex must be held.
+func (l *EmergencyLimiter) startWaiting() {
+	for _, q := range []int{priorityQueue, normalQueue} {
+		for len(l.waiting[q]) > 0 && l.canStart(q == priorityQueue) {
+			close(l.waiting[q][0])
+			l.waiting[q] = l.waiting[q][1:]
+			l.inUse++
+		}
+	}
+}
+
+func queueOf(priority bool) int {
+	if priority {
+		return priorityQueue
+	}
+	return normalQueue
+}
+
+// An EmergencyReport says what became of the tarfiles uploaded on an emergency
+// basis, identified by their subdirectories. The already-compressed files of
+// a subdirectory have a tarfile of their own, whose name ends in "#stored".
+type EmergencyReport struct {
+	// Uploaded are the tarfiles which were uploaded, and their files removed.
+	Uploaded []string
+	// LeftOnDisk are the tarfiles which were not uploaded, every one of whose
+	// files is still on disk to be uploaded by the next run.
+	LeftOnDisk []string
+	// Lost are the tarfiles which were not uploaded, some of whose files had
+	// been removed from the disk and existed only in the tarfile.
+	Lost []string
+}
+
+// reportEmergency logs and exports what became of the tarfiles.
+func (t *TarCache) reportEmergency(r EmergencyReport) {
+	for outcome, keys := range map[string][]string{"uploaded": r.Uploaded, "left_on_disk": r.LeftOnDisk, "lost": r.Lost} {
+		pusherEmergencyUploads.WithLabelValues(t.datatype, outcome).Add(float64(len(keys)))
+	}
+	if len(r.Uploaded)+len(r.LeftOnDisk)+len(r.Lost) == 0 {
+		return
+	}
+	log.Printf("Emergency upload of %s: %d tarfiles uploaded %q, %d left on disk %q, %d lost %q\n",
+		t.datatype, len(r.Uploaded), r.Uploaded, len(r.LeftOnDisk), r.LeftOnDisk, len(r.Lost), r.Lost)
+}
@@ -0,0 +1,90 @@
+package tarcache
+
+import (
+	"os"
+	"sync"
+
+	"github.com/m-lab/pusher/filename"
+)
+
+// minKeptSweep is how many kept files there must be before those which no
+// longer exist are first forgotten.
+const minKeptSweep = 10000
+
+// KeptFiles remembers the files that were uploaded but left in place because of
+// tarfile.Config.KeepFiles, as with --no_delete, so that they are not archived
+// again unless they change. Unlike undeletable files, they are remembered for
+// as long as they exist. It is safe for concurrent use, so that it can outlive
+// a TarCache and be handed to the next one of the directory (see Config.Kept),
+// and the zero KeptFiles is ready to use. A nil *KeptFiles remembers nothing.
+type KeptFiles struct {
+	mu       sync.Mutex
+	versions map[filename.System]fileVersion
+	// Once there are this many files, those which no longer exist are
+	// forgotten.
+	sweepAt int
+}
+
+// add remembers the current versions of the files.
+func (k *KeptFiles) add(names []filename.System) {
+	if k == nil {
+		return
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.versions == nil {
+		k.versions = make(map[filename.System]fileVersion)
+		k.sweepAt = minKeptSweep
+	}
+	for _, name := range names {
+		info, err := os.Stat(string(name))
+		if err != nil {
+			delete(k.versions, name)
+			continue
+		}
+		k.versions[name] = versionOf(info)
+	}
+	if len(k.versions) >= k.sweepAt {
+		k.sweep()
+	}
+}
+
+// contains returns whether the file was kept and has not changed since. A file
+// that has changed is forgotten.
+func (k *KeptFiles) contains(name filename.System, version fileVersion) bool {
+	if k == nil {
+		return false
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	v, ok := k.versions[name]
+	if ok && v != version {
+		delete(k.versions, name)
+		return false
+	}
+	return ok
+}
+
+// len returns how many files are remembered.
+func (k *KeptFiles) len() int {
+	if k == nil {
+		return 0
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.versions)
+}
+
+// sweep forgets the files which no longer exist, and puts off the next sweep
+// until there are twice as many files as are left. k.mu must be held.
+func (k *KeptFiles) sweep() {
+	for name := range k.versions {
+		if _, err := os.Lstat(string(name)); os.IsNotExist(err) {
+			delete(k.versions, name)
+		}
+	}
+	k.sweepAt = 2 * len(k.versions)
+	if k.sweepAt < minKeptSweep {
+		k.sweepAt = minKeptSweep
+	}
+}
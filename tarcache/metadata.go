@@ -0,0 +1,90 @@
+package tarcache
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// MetadataFields are the fields that a metadata value may use as a template,
+// e.g. "{{.Hostname}}/{{.Datatype}}". Templates are expanded for each tarfile
+// when it is started.
+type MetadataFields struct {
+	// Hostname is the name of the host pusher runs on.
+	Hostname string
+	// Datatype is the datatype of the tarfile.
+	Datatype string
+	// Subdir is the subdirectory whose files the tarfile holds.
+	Subdir string
+	// StartTime is when the tarfile was started, in RFC 3339 format, in UTC.
+	// There is no upload time, because the metadata is written into the
+	// header of each file as it is added, long before the upload.
+	StartTime string
+}
+
+// isTemplate returns whether the metadata value needs to be expanded.
+func isTemplate(value string) bool {
+	return strings.Contains(value, "{{")
+}
+
+// expandMetadata returns the value with its template, if any, expanded.
+func expandMetadata(key, value string, fields *MetadataFields) (string, error) {
+	if !isTemplate(value) {
+		return value, nil
+	}
+	tmpl, err := template.New(key).Option("missingkey=error").Parse(value)
+	if err != nil {
+		return "", err
+	}
+	var expanded strings.Builder
+	if err := tmpl.Execute(&expanded, fields); err != nil {
+		return "", err
+	}
+	return expanded.String(), nil
+}
+
+// CheckMetadata returns an error if any of the metadata values is a template
+// that can't be expanded, e.g. because it uses a field MetadataFields lacks.
+func CheckMetadata(metadata map[string]string) error {
+	fields := &MetadataFields{StartTime: time.Now().UTC().Format(time.RFC3339)}
+	for k, v := range metadata {
+		if _, err := expandMetadata(k, v, fields); err != nil {
+			return fmt.Errorf("bad template for metadata %q: %w", k, err)
+		}
+	}
+	return nil
+}
+
+// tarfileMetadata returns the PAX records for a new tarfile of the subdir. Each
+// tarfile gets its own copy, with the templates in the values expanded for it.
+// A value whose template can't be expanded is used as it is.
+func (t *TarCache) tarfileMetadata(subdir string) map[string]string {
+	metadata := make(map[string]string)
+	for k, v := range t.config.Metadata {
+		metadata[k] = v
+	}
+	for k, v := range t.metadata.Get() {
+		metadata[k] = v
+	}
+	datatype := t.datatype
+	if dt, ok := t.config.Metadata["MLAB.datatype"]; ok {
+		datatype = dt
+	}
+	fields := &MetadataFields{
+		Hostname:  t.hostname,
+		Datatype:  datatype,
+		Subdir:    subdir,
+		StartTime: time.Now().UTC().Format(time.RFC3339),
+	}
+	for k, v := range metadata {
+		expanded, err := expandMetadata(k, v, fields)
+		if err != nil {
+			log.Printf("Could not expand the template for metadata %q (error: %q)\n", k, err)
+			continue
+		}
+		metadata[k] = expanded
+	}
+	return metadata
+}
@@ -0,0 +1,74 @@
+package tarcache
+
+import (
+	"log"
+
+	"github.com/m-lab/pusher/filename"
+)
+
+// progress follows the assembly of the tarfiles of large subdirectories, e.g.
+// when the finder hands the TarCache a backlog of tens of thousands of files,
+// so that operators can tell a TarCache working through a backlog from a stuck
+// one. A subdirectory is large while it has at least Config.ProgressFiles
+// files, added to its tarfiles or waiting to be.
+type progress struct {
+	// Files received but not yet added, by subdir.
+	waiting map[string]int
+	// The members of each large subdir when its progress was last logged.
+	logged map[string]int
+}
+
+func newProgress() *progress {
+	return &progress{waiting: make(map[string]int), logged: make(map[string]int)}
+}
+
+// receive records that the files are waiting to be added, and returns the
+// subdir of each, for reportProgress. It returns nil if progress is not
+// followed.
+func (t *TarCache) receive(fnames []filename.System) []string {
+	if t.config.ProgressFiles <= 0 {
+		return nil
+	}
+	subdirs := make([]string, len(fnames))
+	for i, fname := range fnames {
+		subdirs[i] = t.subdir(t.escape(t.internalName(fname)))
+		t.progress.waiting[subdirs[i]]++
+	}
+	return subdirs
+}
+
+// reportProgress records that a file of the subdir is no longer waiting,
+// whether or not it was added. A large subdir's progress is exported, and
+// logged every Config.ProgressFiles members, until no more of its files are
+// waiting.
+func (t *TarCache) reportProgress(subdir string) {
+	p := t.progress
+	p.waiting[subdir]--
+	waiting := p.waiting[subdir]
+	if waiting <= 0 {
+		delete(p.waiting, subdir)
+	}
+	members := 0
+	for _, key := range []string{subdir, storedKey(subdir)} {
+		if tf, ok := t.currentTarfile[key]; ok {
+			members += tf.Count()
+		}
+	}
+	last, large := p.logged[subdir]
+	if !large && members+waiting < t.config.ProgressFiles {
+		return
+	}
+	if !large || waiting <= 0 || members >= last+t.config.ProgressFiles || members < last {
+		// The members drop when a tarfile is uploaded.
+		log.Printf("Archive progress: datatype=%s subdir=%s members=%d pending=%d\n", t.datatype, subdir, members, waiting)
+		p.logged[subdir] = members
+	}
+	if waiting <= 0 {
+		delete(p.logged, subdir)
+		pusherSubdirFiles.DeleteLabelValues(t.datatype, subdir, "added")
+		pusherSubdirFiles.DeleteLabelValues(t.datatype, subdir, "pending")
+		return
+	}
+	pusherSubdirFiles.WithLabelValues(t.datatype, subdir, "added").Set(float64(members))
+	pusherSubdirFiles.WithLabelValues(t.datatype, subdir, "pending").Set(float64(waiting))
+}
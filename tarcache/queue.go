@@ -0,0 +1,99 @@
+package tarcache
+
+import (
+	"container/heap"
+	"log"
+	"sort"
+)
+
+// uploadQueue holds the tarfiles whose age threshold has been met but which
+// have not yet been uploaded, with the tarfile whose first file was added
+// longest ago at the front. Timeouts usually arrive one at a time and are
+// handled immediately, but when uploads are slow (e.g. during a GCS outage)
+// many can arrive while an upload is in progress. The queue ensures that the
+// oldest data is uploaded first, instead of whichever timeout happens to be
+// received first.
+//
+// uploadQueue implements heap.Interface, and should only be modified through
+// the functions of container/heap.
+type uploadQueue []timeout
+
+func (q uploadQueue) Len() int { return len(q) }
+
+func (q uploadQueue) Less(i, j int) bool {
+	return q[i].tf.FirstAdded().Before(q[j].tf.FirstAdded())
+}
+
+func (q uploadQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *uploadQueue) Push(x interface{}) { *q = append(*q, x.(timeout)) }
+
+func (q *uploadQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	x := old[n-1]
+	*q = old[:n-1]
+	return x
+}
+
+// alwaysReady is a closed channel, which can always be received from.
+var alwaysReady = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// enqueue adds a timed-out tarfile to the upload queue, unless it is already
+// queued.
+func (t *TarCache) enqueue(to timeout) {
+	if _, ok := t.queued[to]; ok {
+		return
+	}
+	t.queued[to] = struct{}{}
+	heap.Push(&t.due, to)
+}
+
+// enqueueAll adds every open tarfile to the upload queue. During a blackout
+// nothing is uploaded, so repeated calls leave the queue as it was.
+func (t *TarCache) enqueueAll() {
+	for key, tf := range t.currentTarfile {
+		t.enqueue(timeout{key: key, tf: tf})
+	}
+}
+
+// collectTimeouts adds every timeout that is ready to be received to the
+// upload queue, without blocking.
+func (t *TarCache) collectTimeouts() {
+	for {
+		select {
+		case to := <-t.timeoutChannel:
+			t.enqueue(to)
+		default:
+			return
+		}
+	}
+}
+
+// uploadOldest uploads the oldest tarfile in the upload queue. Tarfiles that
+// were uploaded or abandoned for some other reason after their timer fired are
+// skipped.
+func (t *TarCache) uploadOldest() {
+	to := heap.Pop(&t.due).(timeout)
+	delete(t.queued, to)
+	if t.currentTarfile[to.key] != to.tf {
+		// The timer fired just as its tarfile was uploaded or abandoned for
+		// some other reason.
+		log.Printf("Ignoring a timeout for a tarfile of %q which no longer exists\n", to.key)
+		return
+	}
+	t.uploadAndDelete(to.key)
+	pusherTarfilesUploadCalls.WithLabelValues(t.datatype, "age_threshold_met").Inc()
+}
+
+// oldestFirst sorts the keys so that the tarfile whose first file was added
+// longest ago comes first.
+func (t *TarCache) oldestFirst(keys []string) {
+	sort.SliceStable(keys, func(i, j int) bool {
+		return t.currentTarfile[keys[i]].FirstAdded().Before(t.currentTarfile[keys[j]].FirstAdded())
+	})
+}
@@ -0,0 +1,87 @@
+package tarcache
+
+import (
+	"container/list"
+	"os"
+	"time"
+
+	"github.com/m-lab/pusher/filename"
+)
+
+// fileVersion identifies the contents of a file without reading it.
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+type recentFile struct {
+	name    filename.System
+	version fileVersion
+}
+
+// recentFiles remembers the most recently added files, so that a file which
+// arrives a second time (e.g. from both the listener and the finder) can be
+// ignored without opening it. It forgets the least recently added file once
+// it holds more than its capacity. A nil *recentFiles remembers nothing.
+type recentFiles struct {
+	capacity int
+	order    *list.List // Of recentFile, most recent first.
+	entries  map[filename.System]*list.Element
+}
+
+// newRecentFiles returns a recentFiles of the given capacity, or nil if the
+// capacity is not positive.
+func newRecentFiles(capacity int) *recentFiles {
+	if capacity <= 0 {
+		return nil
+	}
+	return &recentFiles{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[filename.System]*list.Element),
+	}
+}
+
+func versionOf(info os.FileInfo) fileVersion {
+	return fileVersion{modTime: info.ModTime(), size: info.Size()}
+}
+
+// contains returns whether the file was added recently and has not changed
+// since.
+func (r *recentFiles) contains(name filename.System, version fileVersion) bool {
+	if r == nil {
+		return false
+	}
+	e, ok := r.entries[name]
+	return ok && e.Value.(recentFile).version == version
+}
+
+// add remembers that the file was added.
+func (r *recentFiles) add(name filename.System, version fileVersion) {
+	if r == nil {
+		return
+	}
+	if e, ok := r.entries[name]; ok {
+		e.Value = recentFile{name: name, version: version}
+		r.order.MoveToFront(e)
+		return
+	}
+	r.entries[name] = r.order.PushFront(recentFile{name: name, version: version})
+	if r.order.Len() > r.capacity {
+		oldest := r.order.Back()
+		r.order.Remove(oldest)
+		delete(r.entries, oldest.Value.(recentFile).name)
+	}
+}
+
+// remove forgets the file, so that it will be added again the next time it
+// arrives.
+func (r *recentFiles) remove(name filename.System) {
+	if r == nil {
+		return
+	}
+	if e, ok := r.entries[name]; ok {
+		r.order.Remove(e)
+		delete(r.entries, name)
+	}
+}
@@ -0,0 +1,82 @@
+package tarcache
+
+import (
+	"log"
+	"os"
+
+	"github.com/m-lab/pusher/filename"
+)
+
+// maxRefusedFiles is the most refused files that are counted at once. Once
+// there are this many, the files which no longer exist are forgotten, and if
+// that is not enough, new ones are not counted.
+const maxRefusedFiles = 10000
+
+// refusedFiles counts how many times each file was found but not archived for
+// upload, so that the files which will never be uploaded, and are found again
+// by every run of the finder, can be reported. That is every time a file is
+// refused, e.g. because it could not be opened, found again while it waits in
+// a tarfile, put back because its tarfile was abandoned, or found by the
+// finder but too young to archive, as when it is still being written. A file
+// is reported once it has been counted the given number of times, and
+// forgotten once it is uploaded. A nil *refusedFiles counts nothing.
+type refusedFiles struct {
+	datatype string
+	after    int
+	counts   map[filename.System]int
+	// How many of the files have been refused at least after times.
+	reported int
+}
+
+// newRefusedFiles returns a refusedFiles which reports files after they have
+// been refused the given number of times, or nil if it is not positive.
+func newRefusedFiles(datatype string, after int) *refusedFiles {
+	if after <= 0 {
+		return nil
+	}
+	return &refusedFiles{datatype: datatype, after: after, counts: make(map[filename.System]int)}
+}
+
+// add records that the file was found but not archived for the given reason.
+func (r *refusedFiles) add(name filename.System, reason string) {
+	if r == nil {
+		return
+	}
+	if _, ok := r.counts[name]; !ok && len(r.counts) >= maxRefusedFiles {
+		r.sweep()
+		if len(r.counts) >= maxRefusedFiles {
+			return
+		}
+	}
+	r.counts[name]++
+	if r.counts[name] == r.after {
+		r.reported++
+		pusherUnuploadableFiles.WithLabelValues(r.datatype).Set(float64(r.reported))
+		log.Printf("%s has been found %d times but never uploaded (last: %s), and may never be\n", name, r.after, reason)
+	}
+}
+
+// remove forgets the file, because it was uploaded.
+func (r *refusedFiles) remove(name filename.System) {
+	if r == nil {
+		return
+	}
+	n, ok := r.counts[name]
+	if !ok {
+		return
+	}
+	delete(r.counts, name)
+	if n >= r.after {
+		r.reported--
+		pusherUnuploadableFiles.WithLabelValues(r.datatype).Set(float64(r.reported))
+	}
+}
+
+// sweep forgets the files which no longer exist.
+func (r *refusedFiles) sweep() {
+	for name := range r.counts {
+		if _, err := os.Lstat(string(name)); os.IsNotExist(err) {
+			r.remove(name)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package tarcache
+
+import (
+	"context"
+	"sync"
+
+	"github.com/m-lab/pusher/tarfile"
+)
+
+// remover removes the files of uploaded tarfiles on a goroutine of its own, so
+// that the pauses between batches of removals (see
+// tarfile.Config.RemoveBatchPause) don't hold up the TarCache. Tarfiles are
+// handled one at a time, in the order they were uploaded.
+type remover struct {
+	mu      sync.Mutex
+	queued  []tarfile.Tarfile
+	removed []tarfile.Tarfile
+	// queue is sent on when a tarfile is queued, and ready when one has had
+	// its files removed. Neither ever holds more than one value.
+	queue chan struct{}
+	ready chan struct{}
+	// stopped is closed once run returns.
+	stopped chan struct{}
+}
+
+func newRemover() *remover {
+	return &remover{
+		queue:   make(chan struct{}, 1),
+		ready:   make(chan struct{}, 1),
+		stopped: make(chan struct{}),
+	}
+}
+
+// add queues the tarfile, whose removal UploadAndDelete deferred.
+func (r *remover) add(tf tarfile.Tarfile) {
+	r.mu.Lock()
+	r.queued = append(r.queued, tf)
+	r.mu.Unlock()
+	signal(r.queue)
+}
+
+// next returns the next tarfile in the queue, if there is one.
+func (r *remover) next() (tarfile.Tarfile, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.queued) == 0 {
+		return nil, false
+	}
+	tf := r.queued[0]
+	r.queued[0] = nil
+	r.queued = r.queued[1:]
+	return tf, true
+}
+
+// run removes the files of each queued tarfile until the context is done.
+// Then it removes those of the rest of the queue without pausing, and returns.
+func (r *remover) run(ctx context.Context) {
+	defer close(r.stopped)
+	for {
+		tf, ok := r.next()
+		if !ok {
+			select {
+			case <-r.queue:
+				continue
+			case <-ctx.Done():
+			}
+			for tf, ok := r.next(); ok; tf, ok = r.next() {
+				r.remove(ctx, tf)
+			}
+			return
+		}
+		r.remove(ctx, tf)
+	}
+}
+
+// remove removes the files of the tarfile, and makes it ready for takeRemoved.
+func (r *remover) remove(ctx context.Context, tf tarfile.Tarfile) {
+	tf.Remove(ctx)
+	r.mu.Lock()
+	r.removed = append(r.removed, tf)
+	r.mu.Unlock()
+	signal(r.ready)
+}
+
+// takeRemoved returns the tarfiles whose files have been removed since it was
+// last called.
+func (r *remover) takeRemoved() []tarfile.Tarfile {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	removed := r.removed
+	r.removed = nil
+	return removed
+}
+
+// signal sends on a channel with a buffer of one, unless it is already full.
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,89 @@
+package tarcache
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A Window is a period of every day, from Start to End, measured from
+// midnight. A Window whose End is before its Start spans midnight.
+type Window struct {
+	Start, End time.Duration
+}
+
+// ParseWindow parses a window written as "HH:MM-HH:MM", e.g. "22:00-06:00".
+func ParseWindow(s string) (Window, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return Window{}, fmt.Errorf("window %q is not of the form HH:MM-HH:MM", s)
+	}
+	var w Window
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return Window{}, fmt.Errorf("window %q has a bad time: %w", s, err)
+		}
+		offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+		if i == 0 {
+			w.Start = offset
+		} else {
+			w.End = offset
+		}
+	}
+	return w, nil
+}
+
+// contains returns whether the time of day, measured from midnight, is in the
+// window.
+func (w Window) contains(offset time.Duration) bool {
+	if w.Start <= w.End {
+		return w.Start <= offset && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+// A Schedule says when tarfiles may be uploaded, for sites that pay more for
+// bandwidth at some times of day. The zero Schedule allows uploads at all
+// times.
+type Schedule struct {
+	// Windows, if not empty, are the only times uploads are allowed.
+	Windows []Window
+	// Blackouts are times uploads are not allowed, even within a Window.
+	Blackouts []Window
+	// Location is the time zone of the windows. Nil means UTC.
+	Location *time.Location
+}
+
+// IsZero returns whether the schedule always allows uploads.
+func (s Schedule) IsZero() bool {
+	return len(s.Windows) == 0 && len(s.Blackouts) == 0
+}
+
+// Allows returns whether uploads are allowed at the given time.
+func (s Schedule) Allows(t time.Time) bool {
+	if s.IsZero() {
+		return true
+	}
+	loc := s.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	// The windows follow the wall clock, even on days when it jumps.
+	hour, min, sec := t.In(loc).Clock()
+	offset := time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute + time.Duration(sec)*time.Second
+	for _, w := range s.Blackouts {
+		if w.contains(offset) {
+			return false
+		}
+	}
+	if len(s.Windows) == 0 {
+		return true
+	}
+	for _, w := range s.Windows {
+		if w.contains(offset) {
+			return true
+		}
+	}
+	return false
+}
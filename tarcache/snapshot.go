@@ -0,0 +1,87 @@
+package tarcache
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/m-lab/go/bytecount"
+)
+
+// TarfileState describes a tarfile that is being built but has not yet been
+// uploaded.
+type TarfileState struct {
+	// Subdir is the subdirectory whose files the tarfile contains.
+	Subdir string
+	// Stored is true for the tarfile of already-compressed files (see
+	// Config.StoredExtensions).
+	Stored bool
+	// Files is the number of files in the tarfile.
+	Files int
+	// Skipped is the number of files left out of the tarfile by sampling.
+	Skipped int
+	// Size is the current size of the compressed tarfile.
+	Size bytecount.ByteCount
+	// Age is the time since the first file was added to (or skipped by) the
+	// tarfile. It is zero if there are no files.
+	Age time.Duration
+}
+
+// publishedState is a TarfileState as published by ListenForever, with the
+// time its age is counted from instead of the age.
+type publishedState struct {
+	TarfileState
+	firstAdded time.Time
+}
+
+// Snapshot returns the state of every tarfile in the cache, sorted by
+// subdirectory, as of the last time ListenForever handled an event. It never
+// waits for ListenForever, so it is safe to call from any goroutine, even while
+// the TarCache is busy uploading. It returns nil once ListenForever has
+// returned.
+func (t *TarCache) Snapshot() []TarfileState {
+	select {
+	case <-t.done:
+		return nil
+	default:
+	}
+	published, _ := t.published.Load().([]publishedState)
+	now := time.Now()
+	states := make([]TarfileState, len(published))
+	for i, p := range published {
+		states[i] = p.TarfileState
+		if !p.firstAdded.IsZero() {
+			states[i].Age = now.Sub(p.firstAdded)
+		}
+	}
+	return states
+}
+
+// publish records the state of every tarfile for Snapshot. It must only be
+// called by the goroutine running ListenForever.
+func (t *TarCache) publish() {
+	states := make([]publishedState, 0, len(t.currentTarfile))
+	for key, tf := range t.currentTarfile {
+		state := publishedState{
+			TarfileState: TarfileState{
+				Subdir:  key,
+				Files:   tf.Count(),
+				Skipped: tf.SkippedCount(),
+				Size:    tf.Size(),
+			},
+			firstAdded: tf.FirstAdded(),
+		}
+		if subdir := strings.TrimSuffix(key, storedKey("")); subdir != key {
+			state.Subdir = subdir
+			state.Stored = true
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Subdir != states[j].Subdir {
+			return states[i].Subdir < states[j].Subdir
+		}
+		return !states[i].Stored && states[j].Stored
+	})
+	t.published.Store(states)
+}
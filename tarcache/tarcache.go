@@ -1,14 +1,29 @@
 // Package tarcache supports the creation and running of a pipeline that
 // receives files, tars up the contents, and uploads everything when the tarfile
 // is big enough or the contents are old enough.
+//
+// Concurrency model: a TarCache and all of its tarfiles are owned by the
+// goroutine running ListenForever. No other goroutine reads or writes them.
+// Everything else communicates with that goroutine over channels: files arrive
+// on the channel returned by New, age timers (or, with Config.DatatypeTimer,
+// a single ticker) send timeouts, and Reset, ResetAll, and Snapshot send
+// requests. The one exception is uploadAll, which hands each tarfile to its
+// own goroutine for the duration of the upload and waits for all of them
+// before touching the TarCache again.
 package tarcache
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/m-lab/go/flagx"
@@ -16,59 +31,381 @@ import (
 	"github.com/m-lab/go/rtx"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 
 	"github.com/m-lab/go/bytecount"
+	"github.com/m-lab/pusher/decisionlog"
 	"github.com/m-lab/pusher/filename"
+	"github.com/m-lab/pusher/metrics"
+	"github.com/m-lab/pusher/ratelog"
 	"github.com/m-lab/pusher/tarfile"
 	"github.com/m-lab/pusher/uploader"
 )
 
+var collectors metrics.Collectors
+
+// RegisterMetrics registers the TarCache's metrics on r, or on
+// prometheus.DefaultRegisterer if r is nil. New registers them, and those of
+// the tarfiles, on Config.Registerer.
+func RegisterMetrics(r prometheus.Registerer) {
+	collectors.Register(r)
+	ratelog.RegisterMetrics(r)
+}
+
 var (
-	pusherTarfilesUploadCalls = promauto.NewCounterVec(
+	pusherTarfilesUploadCalls = collectors.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "pusher_tarfiles_upload_calls_total",
 			Help: "The number of times upload has been called",
 		},
 		[]string{"datatype", "reason"},
 	)
-	pusherStrangeFilenames = promauto.NewCounterVec(
+	pusherBytesOnlyInMemory = collectors.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pusher_tarcache_bytes_only_in_memory",
+			Help: "The size of the files in tarfiles waiting to be uploaded whose source files no longer exist, as of the last check",
+		},
+		[]string{"datatype"})
+	pusherUploadBlackout = collectors.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pusher_tarcache_upload_blackout",
+			Help: "Whether the upload schedule currently forbids uploads (1) or not (0)",
+		},
+		[]string{"datatype"})
+	pusherFilesDeferred = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_tarcache_files_deferred_total",
+			Help: "The number of files left on disk because they arrived while the upload schedule forbade uploads",
+		},
+		[]string{"datatype"})
+	pusherAgeThreshold = collectors.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pusher_tarcache_age_threshold_seconds",
+			Help: "The bounds of the age threshold given to the most recently started tarfile, which may be shorter than configured when it is adaptive",
+		},
+		[]string{"datatype", "bound"})
+	pusherSubdirFiles = collectors.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pusher_tarcache_large_subdir_files",
+			Help: "The files of each large subdirectory which have been added to its current tarfiles, and which are waiting to be added, while any are waiting",
+		},
+		[]string{"datatype", "subdir", "state"})
+	pusherStrangeFilenames = collectors.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "pusher_strange_filenames_total",
 			Help: "The number of files we have seen with names that looked surprising in some way",
 		},
 		[]string{"datatype"})
-	pusherFileOpenErrors = promauto.NewCounterVec(
+	pusherTarfilesAbandoned = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_tarfiles_abandoned_total",
+			Help: "The number of tarfiles discarded without upload, whose files were queued to be added again",
+		},
+		[]string{"datatype", "reason"})
+	pusherDuplicatesSuppressed = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_duplicate_files_suppressed_total",
+			Help: "The number of files ignored without being opened because they had been added recently",
+		},
+		[]string{"datatype"})
+	pusherUndeletableFiles = collectors.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pusher_undeletable_files",
+			Help: "The number of files which were uploaded but could not be deleted, and are not being uploaded again until their cool-down ends",
+		},
+		[]string{"datatype"})
+	pusherUndeletableFilesSkipped = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_undeletable_files_skipped_total",
+			Help: "The number of times a file which was uploaded but could not be deleted was found again and ignored",
+		},
+		[]string{"datatype"})
+	pusherKeptFilesSkipped = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_kept_files_skipped_total",
+			Help: "The number of times a file which was uploaded but kept, because of --no_delete or --no_upload, was found again unchanged and ignored",
+		},
+		[]string{"datatype"})
+	pusherKeptFiles = collectors.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pusher_kept_files",
+			Help: "The number of files which were uploaded but kept, because of --no_delete or --no_upload, and are remembered so that they are not uploaded again",
+		},
+		[]string{"datatype"})
+	pusherUndeletableLedgerErrors = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_undeletable_ledger_errors_total",
+			Help: "The number of times the ledger of undeletable files could not be loaded or saved",
+		},
+		[]string{"datatype", "operation"})
+	pusherSymlinksIgnored = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_symlinks_ignored_total",
+			Help: "The number of symbolic links that were not archived because of the symlink policy",
+		},
+		[]string{"datatype"})
+	pusherControlCharFilenames = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_control_char_filenames_total",
+			Help: "The number of files whose names contained control characters, by whether they were escaped or rejected",
+		},
+		[]string{"datatype", "action"})
+	pusherUnuploadableFiles = collectors.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pusher_tarcache_unuploadable_files",
+			Help: "The number of files which have been found at least --report_unuploadable_after times without being uploaded, e.g. because they could not be opened or were always too young, and are logged as maybe never being uploaded",
+		},
+		[]string{"datatype"})
+	pusherFileLikeDirectories = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_file_like_directories_total",
+			Help: "The number of directories handed to the TarCache as files, and of files found in directories whose names look like those of files, e.g. 2019/05/01/data.gz/, by the policy they were treated with",
+		},
+		[]string{"datatype", "policy"})
+	pusherFilesOutsideRoot = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_files_outside_root_total",
+			Help: "The number of files which were not archived because, with symbolic links and .. resolved, they are not inside the directory of their datatype",
+		},
+		[]string{"datatype"})
+	pusherFileOpenErrors = collectors.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "pusher_file_open_errors_total",
 			Help: "The number of times we could not open a file that we were trying to add to the tarfile",
 		},
 		[]string{"datatype"})
+	pusherEmergencyUploads = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_emergency_uploads_total",
+			Help: "The number of tarfiles uploaded on an emergency basis on shutdown, by outcome: uploaded, left_on_disk (not uploaded, but every file is still on disk for the next run), or lost (not uploaded, and some files existed only in the tarfile)",
+		},
+		[]string{"datatype", "outcome"})
 )
 
 // TarCache contains everything you need to incrementally create a tarfile.
 // Once enough time has passed since the first file was added OR the resulting
-// tar file has become big enough, it will call the uploadAndDelete() method.
+// tar file has become big enough OR (optionally) it contains enough files, it
+// will call the uploadAndDelete() method.
 // To upload a lot of tarfiles, you should only have to create one TarCache.
 // The TarCache takes care of creating each tarfile and getting it uploaded.
 type TarCache struct {
 	fileChannel    <-chan filename.System
-	timeoutChannel chan string
+	batchChannel   chan []filename.System
+	youngChannel   chan []filename.System
+	timeoutChannel chan timeout
+	resetChannel   chan resetRequest
+	stopChannel    chan struct{}
+	done           chan struct{} // Closed when ListenForever returns.
 	currentTarfile map[string]tarfile.Tarfile
 	sizeThreshold  bytecount.ByteCount
 	ageThreshold   memoryless.Config
 	fileRatio      float64 // Ratio of individual files to be added to the tarcache [0, 1].
 	rootDirectory  filename.System
+	canonicalRoot  filename.System // The rootDirectory, resolved.
 	uploader       uploader.Uploader
 	datatype       string
 	metadata       *flagx.KeyValue
+	hostname       string // For the metadata templates.
+	config         Config
+	// Files from abandoned tarfiles, waiting to be added to new tarfiles.
+	pending []filename.System
+	// Files that arrived while uploads were not allowed, which are left on
+	// disk until they are.
+	deferred map[filename.System]struct{}
+	// Whether uploads were not allowed when the schedule was last checked.
+	blackout bool
+	// Whether uploads were paused by SetPaused, which may be called from any
+	// goroutine, and so is accessed atomically. Setting it sends on wake.
+	paused int32
+	wake   chan struct{}
+	// Requests to upload every tarfile now.
+	flushChannel chan struct{}
+	// The assembly of the tarfiles of large subdirectories.
+	progress *progress
+	// How fast data has been arriving, for the adaptive age threshold.
+	arrivals arrivalRate
+	// Tarfiles whose age threshold has been met, waiting to be uploaded.
+	due uploadQueue
+	// The timeouts in due, so that none is queued twice.
+	queued map[timeout]struct{}
+	// Files added recently, used to ignore files that arrive twice.
+	recent *recentFiles
+	// Files uploaded but not deleted, which are not uploaded again for a while.
+	undeletable *undeletableFiles
+	// Files uploaded but kept, which are not uploaded again unless they change.
+	kept *KeptFiles
+	// Removes the files of uploaded tarfiles, if their removal is paced.
+	remover *remover
+	// The size of the last tarfile uploaded, for Config.Preallocate.
+	lastSize bytecount.ByteCount
+	// Files found but refused, which may never be uploaded.
+	refused *refusedFiles
+	// The []publishedState of the tarfiles, which ListenForever updates each
+	// time it handles an event, for Snapshot to read from any goroutine.
+	published atomic.Value
+	// Every upload is given this context, which ListenForever sets to its
+	// killCtx, so that uploads in progress are canceled when it is done.
+	uploadCtx context.Context
+}
+
+// Config holds the optional behaviors of a TarCache. The zero value is a
+// TarCache that behaves the way it always has.
+type Config struct {
+	// Tarfile is passed along to every tarfile the TarCache creates.
+	Tarfile tarfile.Config
+	// Rewriter, if non-nil, transforms the name of every file before it is
+	// linted, assigned to a subdirectory, and added to a tarfile.
+	Rewriter *filename.Rewriter
+	// StoredExtensions lists the extensions of files that are already
+	// compressed. Such files are put in their own per-subdirectory tarfile
+	// which is not compressed a second time.
+	StoredExtensions []string
+	// Preallocate makes every new tarfile allocate as much memory up front as
+	// the last tarfile uploaded needed, up to maxPreallocation.
+	Preallocate bool
+	// MaxFiles, if positive, is the most files a tarfile may contain. A
+	// tarfile is uploaded as soon as it contains this many files.
+	MaxFiles int
+	// RecentFiles, if positive, is the number of recently added files to
+	// remember. A remembered file which arrives again unchanged is ignored
+	// without being opened.
+	RecentFiles int
+	// ReportRefusedAfter, if positive, is how many times a file may be found
+	// without being uploaded before it is reported as unuploadable.
+	ReportRefusedAfter int
+	// Directories says how to treat directories whose names look like those
+	// of files. The zero value means filename.DirectoriesIgnore.
+	Directories filename.DirectoryPolicy
+	// SubdirDepth is how many levels of directories are kept in the subdir
+	// of a file, which decides which tarfile it goes in and where that
+	// tarfile is uploaded. Files in deeper directories share the tarfile of
+	// their ancestor at that depth. Zero means filename.DefaultSubdirDepth,
+	// and a negative depth keeps every level.
+	SubdirDepth int
+	// DatatypeTimer replaces the age timer of each tarfile with a single
+	// timer for the whole TarCache. Every time it fires, all tarfiles are
+	// uploaded. This keeps the number of timers low when files are written
+	// sparsely to many subdirectories.
+	DatatypeTimer bool
+	// Boundary, if positive, is the period of the wall-clock boundaries,
+	// e.g. 24 hours for every UTC midnight, that no tarfile spans. At each
+	// boundary, the tarfiles started before it are uploaded, and a file
+	// which arrives for one of them before then is put in a new tarfile
+	// instead. It should divide a day evenly.
+	Boundary time.Duration
+	// AdaptiveAge shortens the age threshold of the tarfiles of a datatype
+	// whose files arrive too slowly to fill them to the size threshold
+	// within the maximum age, down to the minimum age. The arrival rate is
+	// that of the sizes of the files, before compression, averaged over
+	// about the maximum age. It does not apply to the DatatypeTimer.
+	AdaptiveAge bool
+	// ProgressFiles, if positive, makes a subdirectory with at least this
+	// many files, added to its tarfiles or waiting to be, report its
+	// progress: it is logged every ProgressFiles files, and exported, until
+	// none of its files are waiting.
+	ProgressFiles int
+	// Emergency, if not nil, limits how many tarfiles are uploaded at once
+	// when everything is uploaded on shutdown. It may be shared by the
+	// TarCaches of several datatypes. If nil, every tarfile is uploaded at
+	// once.
+	Emergency *EmergencyLimiter
+	// Priority makes the tarfiles of the datatype go before those of other
+	// datatypes sharing the Emergency limiter, and lets them use the
+	// uploads it reserves.
+	Priority bool
+	// EmergencyDeadline, if positive, is how long everything may take to
+	// upload on shutdown. The uploads still running then are given up on, so
+	// that what was and wasn't uploaded can be reported before pusher is
+	// killed.
+	EmergencyDeadline time.Duration
+	// UndeletableCooldown, if positive, is how long to wait before uploading
+	// a file again when it was uploaded but could not be deleted, e.g.
+	// because the filesystem is read-only. A file that changes is uploaded
+	// again without waiting.
+	UndeletableCooldown time.Duration
+	// UndeletableLedger, if not empty, is the file in which the files that are
+	// cooling down are recorded, so that the cool-down survives a restart. It
+	// must not be inside the directory being archived.
+	UndeletableLedger string
+	// Kept remembers the files kept by tarfile.Config.KeepFiles. Handing the
+	// same one to the next TarCache of the directory keeps them from being
+	// uploaded again after a restart. If it is nil, the TarCache keeps its
+	// own.
+	Kept *KeptFiles
+	// Symlinks is how symbolic links are treated. The zero value means
+	// filename.SymlinksFollow.
+	Symlinks filename.SymlinkPolicy
+	// ControlChars is how files whose names contain control characters are
+	// treated. The zero value means filename.ControlCharsEscape, in which
+	// case the percent signs of every name are escaped too. It is passed
+	// along to every tarfile, for the targets of symbolic links.
+	ControlChars filename.ControlCharPolicy
+	// Schedule says when tarfiles may be uploaded. While they may not, files
+	// are left on disk, and only their names are kept, to be added once
+	// uploads are allowed again. Tarfiles that reach their age threshold
+	// wait too. The tarfiles uploaded at shutdown are uploaded regardless.
+	Schedule Schedule
+	// MissingCheckInterval, if positive, is how often to check for files
+	// whose only copy is in a tarfile waiting to be uploaded, because their
+	// source files were removed, and to export their total size. Each check
+	// stats every file in every tarfile.
+	MissingCheckInterval time.Duration
+	// Metadata holds PAX records to add to every tarfile, in addition to
+	// those given to New. Those given to New take precedence. The values of
+	// both may be templates (see MetadataFields). An MLAB.datatype record
+	// replaces the datatype given to New, both in the tarfiles and in the
+	// templates, e.g. when that is qualified by the experiment.
+	Metadata map[string]string
+	// Decisions, if not nil, records every file the TarCache refuses or
+	// quarantines, and, unless Tarfile.Decisions is set, what its tarfiles do
+	// with every other file.
+	Decisions *decisionlog.Log
+	// Registerer is where the metrics of the TarCache are registered, and
+	// those of its tarfiles unless Tarfile.Registerer is set. Nil means
+	// prometheus.DefaultRegisterer.
+	Registerer prometheus.Registerer
+}
+
+// storedKey is the key in currentTarfile for the tarfile that holds the
+// already-compressed files of a subdirectory. The '#' can not appear in a
+// subdirectory name that passes Lint().
+func storedKey(subdir string) string {
+	return subdir + "#stored"
+}
+
+// isCompressed returns whether the name has one of the extensions of files
+// that are already compressed, and so needs a tarfile of its own kind. When
+// tarfiles are not compressed at all, or are zip archives, which choose how to
+// compress each member, none does.
+func (t *TarCache) isCompressed(name filename.Internal) bool {
+	if t.config.Tarfile.Uncompressed || t.config.Tarfile.Format == tarfile.Zip {
+		return false
+	}
+	for _, ext := range t.config.StoredExtensions {
+		if strings.HasSuffix(string(name), ext) {
+			return true
+		}
+	}
+	return false
 }
 
 // New creates a new TarCache object and returns a pointer to it and the
 // channel used to send data to the TarCache.
-func New(rootDirectory filename.System, datatype string, ratio float64, metadata *flagx.KeyValue, sizeThreshold bytecount.ByteCount, ageThreshold memoryless.Config, uploader uploader.Uploader) (*TarCache, chan<- filename.System) {
+func New(rootDirectory filename.System, datatype string, ratio float64, metadata *flagx.KeyValue, sizeThreshold bytecount.ByteCount, ageThreshold memoryless.Config, uploader uploader.Uploader, config Config) (*TarCache, chan<- filename.System) {
 	rtx.Must(ageThreshold.Check(), "Bad config for the ageThreshold")
-	if !strings.HasSuffix(string(rootDirectory), "/") {
+	if config.Tarfile.Registerer == nil {
+		config.Tarfile.Registerer = config.Registerer
+	}
+	if config.Tarfile.Decisions == nil {
+		config.Tarfile.Decisions = config.Decisions
+	}
+	config.Tarfile.ControlChars = config.ControlChars
+	// Paced removals are left to a goroutine of their own.
+	config.Tarfile.DeferRemoval = config.Tarfile.RemoveBatchPause > 0
+	RegisterMetrics(config.Registerer)
+	tarfile.RegisterMetrics(config.Tarfile.Registerer)
+	// The upload ages count from when the datatype was first set up.
+	tarfile.ExportUploadAges(datatype)
+	if !strings.HasSuffix(filepath.ToSlash(string(rootDirectory)), "/") {
 		rootDirectory = filename.System(string(rootDirectory) + "/")
 	}
 	// By giving the channel a large buffer, we attempt to decouple file
@@ -76,7 +413,14 @@ func New(rootDirectory filename.System, datatype string, ratio float64, metadata
 	fileChannel := make(chan filename.System, 1000000)
 	tarCache := &TarCache{
 		fileChannel:    fileChannel,
-		timeoutChannel: make(chan string),
+		batchChannel:   make(chan []filename.System, 100),
+		youngChannel:   make(chan []filename.System, 100),
+		timeoutChannel: make(chan timeout),
+		resetChannel:   make(chan resetRequest),
+		stopChannel:    make(chan struct{}),
+		flushChannel:   make(chan struct{}),
+		wake:           make(chan struct{}, 1),
+		done:           make(chan struct{}),
 		rootDirectory:  rootDirectory,
 		currentTarfile: make(map[string]tarfile.Tarfile),
 		sizeThreshold:  sizeThreshold,
@@ -85,26 +429,146 @@ func New(rootDirectory filename.System, datatype string, ratio float64, metadata
 		uploader:       uploader,
 		datatype:       datatype,
 		metadata:       metadata,
+		config:         config,
+		recent:         newRecentFiles(config.RecentFiles),
+		refused:        newRefusedFiles(datatype, config.ReportRefusedAfter),
+		deferred:       make(map[filename.System]struct{}),
+		queued:         make(map[timeout]struct{}),
+		progress:       newProgress(),
+		arrivals:       arrivalRate{horizon: ageHorizon(ageThreshold)},
+		uploadCtx:      context.Background(),
 	}
+	if config.Tarfile.DeferRemoval {
+		tarCache.remover = newRemover()
+	}
+	if config.Tarfile.KeepFiles {
+		tarCache.kept = config.Kept
+		if tarCache.kept == nil {
+			tarCache.kept = &KeptFiles{}
+		}
+	}
+	var err error
+	if tarCache.canonicalRoot, err = rootDirectory.Canonical(true); err != nil {
+		// The directory may not exist yet, in which case it can't be
+		// reached through symbolic links either.
+		abs, _ := filepath.Abs(string(rootDirectory))
+		tarCache.canonicalRoot = filename.System(abs)
+	}
+	if tarCache.hostname, err = os.Hostname(); err != nil {
+		tarCache.hostname = "unknown"
+	}
+	tarCache.undeletable, err = newUndeletableFiles(config.UndeletableCooldown, config.UndeletableLedger)
+	if err != nil {
+		log.Printf("Could not load the ledger of undeletable files %s (error: %q)\n", config.UndeletableLedger, err)
+		pusherUndeletableLedgerErrors.WithLabelValues(datatype, "load").Inc()
+	}
+	pusherUndeletableFiles.WithLabelValues(datatype).Set(float64(tarCache.undeletable.len()))
+	tarCache.exportAge(ageThreshold)
 	return tarCache, fileChannel
 }
 
 // ListenForever waits for new files and then uploads them. Using this approach
 // allows us to ensure that all file processing happens in this single thread,
 // no matter whether the processing is happening due to age thresholds or size
-// thresholds.
+// thresholds. When termCtx is done, every tarfile is uploaded. Uploads are
+// canceled when killCtx is done, and their files are left for a later run.
+// ListenForever must be called at most once.
 func (t *TarCache) ListenForever(termCtx context.Context, killCtx context.Context) {
+	defer close(t.done)
+	t.uploadCtx = killCtx
+	// Once ListenForever is done, the removals still queued are finished
+	// without pausing.
+	var removed <-chan struct{}
+	if t.remover != nil {
+		removerCtx, stopRemover := context.WithCancel(killCtx)
+		go t.remover.run(removerCtx)
+		defer func() {
+			stopRemover()
+			<-t.remover.stopped
+			t.handleRemoved()
+		}()
+		removed = t.remover.ready
+	}
+	// With a per-datatype timer, every tarfile is uploaded on every tick.
+	// Otherwise, tick stays nil and never fires.
+	var tick <-chan time.Time
+	if t.config.DatatypeTimer {
+		ticker, err := memoryless.NewTicker(killCtx, t.ageThreshold)
+		rtx.Must(err, "This config is supposed to be fine - we already checked it in New - this should never happen")
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	// The schedule is checked every minute, to notice when uploads are
+	// allowed again.
+	var scheduleCheck <-chan time.Time
+	if !t.config.Schedule.IsZero() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		scheduleCheck = ticker.C
+		t.checkSchedule()
+	}
+	// Tarfiles are uploaded at every boundary, unless uploads are not
+	// allowed, in which case no files were added since.
+	var boundary <-chan time.Time
+	var boundaryTimer *time.Timer
+	if t.config.Boundary > 0 {
+		boundaryTimer = time.NewTimer(t.untilBoundary(time.Now()))
+		defer boundaryTimer.Stop()
+		boundary = boundaryTimer.C
+	}
+	var missingCheck <-chan time.Time
+	if t.config.MissingCheckInterval > 0 {
+		ticker := time.NewTicker(t.config.MissingCheckInterval)
+		defer ticker.Stop()
+		missingCheck = ticker.C
+	}
 	for {
+		t.addPending()
+		t.publish()
+		// Uploads from the queue happen one per iteration, so that new files
+		// and cancellations are not ignored while a long queue drains.
+		var due <-chan struct{}
+		if t.due.Len() > 0 && !t.blackout {
+			due = alwaysReady
+		}
 		select {
-		case subdir := <-t.timeoutChannel:
-			t.uploadAndDelete(subdir)
-			pusherTarfilesUploadCalls.WithLabelValues(t.datatype, "age_threshold_met").Inc()
+		case to := <-t.timeoutChannel:
+			t.enqueue(to)
+		case <-tick:
+			t.enqueueAll()
+		case <-due:
+			t.collectTimeouts()
+			t.uploadOldest()
+		case <-scheduleCheck:
+			t.checkSchedule()
+		case <-t.wake:
+			t.checkSchedule()
+		case <-t.flushChannel:
+			t.enqueueAll()
+		case <-boundary:
+			if !t.blackout {
+				t.rotate()
+			}
+			boundaryTimer.Reset(t.untilBoundary(time.Now()))
+		case <-missingCheck:
+			t.checkMissing()
+		case <-removed:
+			t.handleRemoved()
+		case r := <-t.resetChannel:
+			t.reset(r)
 		case dataFile, channelOpen := <-t.fileChannel:
 			if channelOpen {
 				t.add(dataFile)
 			} else {
 				return
 			}
+		case batch := <-t.batchChannel:
+			t.addAll(batch)
+		case young := <-t.youngChannel:
+			t.countYoung(young)
+		case <-t.stopChannel:
+			t.uploadAll()
+			return
 		case <-termCtx.Done():
 			t.uploadAll()
 		case <-killCtx.Done():
@@ -114,78 +578,607 @@ func (t *TarCache) ListenForever(termCtx context.Context, killCtx context.Contex
 	}
 }
 
-func (t *TarCache) uploadAll() {
-	// Upload everything in parallel on an emergency basis.
+// BatchChannel returns the channel on which to send many files at once, such as
+// those found by the finder. A batch is added in one go, rather than one file
+// per pass through ListenForever's loop. Unlike the channel returned by New,
+// it is never closed.
+func (t *TarCache) BatchChannel() chan<- []filename.System {
+	return t.batchChannel
+}
+
+// YoungChannel returns the channel on which the finder reports the files it
+// found too young to archive, which are counted towards
+// Config.ReportRefusedAfter like refused files, so that files which never get
+// old enough, such as logs that are never closed, are reported too. It is
+// never closed.
+func (t *TarCache) YoungChannel() chan<- []filename.System {
+	return t.youngChannel
+}
+
+// countYoung counts the files, which the finder found too young to archive,
+// as not archived.
+func (t *TarCache) countYoung(files []filename.System) {
+	for _, f := range files {
+		t.refused.add(f, "too young to archive")
+	}
+}
+
+// checkSchedule records whether the schedule currently forbids uploads, or they
+// are paused, and returns it. When uploads are allowed again, the deferred
+// files are queued to be added.
+func (t *TarCache) checkSchedule() bool {
+	blackout := t.Paused() || !t.config.Schedule.Allows(time.Now())
+	if blackout == t.blackout {
+		return blackout
+	}
+	t.blackout = blackout
+	if blackout {
+		pusherUploadBlackout.WithLabelValues(t.datatype).Set(1)
+		log.Printf("Uploads of %s are not allowed now. Leaving new files on disk until they are.\n", t.datatype)
+		return true
+	}
+	pusherUploadBlackout.WithLabelValues(t.datatype).Set(0)
+	files := make([]filename.System, 0, len(t.deferred))
+	for f := range t.deferred {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i] < files[j] })
+	log.Printf("Uploads of %s are allowed again. Queueing the %d files that arrived meanwhile.\n", t.datatype, len(files))
+	t.pending = append(t.pending, files...)
+	t.deferred = make(map[filename.System]struct{})
+	return false
+}
+
+// checkMissing exports the total size of the files whose only copy is in a
+// tarfile, because their source files were removed before it was uploaded. If
+// pusher were to crash, they would be lost.
+func (t *TarCache) checkMissing() {
+	missing := bytecount.ByteCount(0)
+	for _, tf := range t.currentTarfile {
+		missing += tf.MissingBytes()
+	}
+	pusherBytesOnlyInMemory.WithLabelValues(t.datatype).Set(float64(missing))
+}
+
+// uploadAll uploads every tarfile at once on an emergency basis, and reports
+// what became of each of them.
+func (t *TarCache) uploadAll() EmergencyReport {
+	ctx := t.uploadCtx
+	if t.config.EmergencyDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.config.EmergencyDeadline)
+		defer cancel()
+	}
 	wg := sync.WaitGroup{}
 
 	// Make a copy of the list of subdirectories because uploadAndDelete modifies
-	// the t.currentTarfile map.
+	// the t.currentTarfile map, and because the goroutines below must not read
+	// the map.
 	currentTarfiles := []string{}
 	for subdir := range t.currentTarfile {
 		currentTarfiles = append(currentTarfiles, subdir)
 	}
+	// Start the oldest uploads first.
+	t.oldestFirst(currentTarfiles)
 
-	// We can't use tarcache.UploadAndDelete in this loop without adding mutexes to
-	// all accesses and modifications of t.currentTarfile or uploading all these
-	// tarfiles in series rather than in parallel. Adding mutexes to all accesses
-	// seems like overkill because everything else in a tarcache is
-	// single-threaded; Uploading tarfiles in series seems contrary to the idea
-	// that uploadAll is called on an emergency basis.
-	for _, subdirTarfile := range t.currentTarfile {
+	// We can't use tarcache.UploadAndDelete in this loop, because it modifies
+	// t.currentTarfile, which only this goroutine may touch. Instead, each
+	// goroutine gets exclusive use of a single tarfile, and reports failure
+	// through its own element of failed. Nothing else can run until wg.Wait()
+	// returns, because this is the ListenForever goroutine.
+	failed := make([]error, len(currentTarfiles))
+	for i, key := range currentTarfiles {
 		wg.Add(1)
-		go func(tf tarfile.Tarfile) {
+		go func(i int, tf tarfile.Tarfile) {
+			defer wg.Done()
+			if limiter := t.config.Emergency; limiter != nil {
+				if !limiter.acquire(ctx, t.config.Priority) {
+					log.Printf("Gave up waiting to upload the tarfile for %q: %v", currentTarfiles[i], ctx.Err())
+					failed[i] = ctx.Err()
+					return
+				}
+				defer limiter.release()
+			}
 			pusherTarfilesUploadCalls.WithLabelValues(t.datatype, "emergency_upload").Inc()
-			tf.UploadAndDelete(t.uploader)
-			wg.Done()
-		}(subdirTarfile)
+			if err := tf.UploadAndDelete(ctx, t.uploader); err != nil {
+				log.Printf("Could not finish the tarfile for %q: %v", currentTarfiles[i], err)
+				failed[i] = err
+			}
+		}(i, t.currentTarfile[key])
 	}
 	wg.Wait()
+	var report EmergencyReport
+	for i, key := range currentTarfiles {
+		switch {
+		case failed[i] == nil:
+			report.Uploaded = append(report.Uploaded, key)
+			t.uploaded(t.currentTarfile[key])
+		case t.currentTarfile[key].MissingBytes() > 0:
+			report.Lost = append(report.Lost, key)
+		default:
+			report.LeftOnDisk = append(report.LeftOnDisk, key)
+		}
+		if failed[i] != nil {
+			t.abandon(key, failureReason(failed[i]))
+		}
+	}
+	t.reportEmergency(report)
 
 	// After uploading everything, clear the cache.
 	t.currentTarfile = make(map[string]tarfile.Tarfile)
+	return report
 }
 
-func (t *TarCache) makeTimer(subdir string) *time.Timer {
-	log.Println("Starting timer for " + t.datatype + "/" + subdir)
-	timer, err := memoryless.AfterFunc(t.ageThreshold, func() {
-		t.timeoutChannel <- subdir
+// timeout is sent by the age timer of a tarfile. It identifies the tarfile as
+// well as its key, because by the time the timeout is received the tarfile may
+// have been replaced by a newer one.
+type timeout struct {
+	key string
+	tf  tarfile.Tarfile
+}
+
+func (t *TarCache) makeTimer(key string, tf tarfile.Tarfile) *time.Timer {
+	log.Println("Starting timer for " + t.datatype + "/" + key)
+	timer, err := memoryless.AfterFunc(t.effectiveAge(time.Now()), func() {
+		select {
+		case t.timeoutChannel <- timeout{key: key, tf: tf}:
+		case <-t.done:
+		}
 	})
 	rtx.Must(err, "This config is supposed to be fine - we already checked it in NewTarCache - this should never happen")
 	return timer
 }
 
-// Add adds the contents of a file to the underlying tarfile.  It possibly
+// add adds the contents of a file to the underlying tarfile.  It possibly
 // calls uploadAndDelete() afterwards.
 func (t *TarCache) add(fname filename.System) {
-	internalName := fname.Internal(t.rootDirectory)
+	t.addAll([]filename.System{fname})
+}
+
+// addAll adds many files, such as a batch from the finder, to their tarfiles.
+// While uploads are not allowed, the files are deferred instead.
+func (t *TarCache) addAll(fnames []filename.System) {
+	if t.checkSchedule() {
+		for _, fname := range fnames {
+			if _, ok := t.deferred[fname]; !ok {
+				t.deferred[fname] = struct{}{}
+				pusherFilesDeferred.WithLabelValues(t.datatype).Inc()
+			}
+		}
+		return
+	}
+	subdirs := t.receive(fnames)
+	for i, fname := range fnames {
+		if key, ok := t.addFile(fname); ok {
+			t.checkThresholds(key)
+		}
+		if subdirs != nil {
+			t.reportProgress(subdirs[i])
+		}
+	}
+	t.expireUndeletable()
+}
+
+// addFile adds a file to its tarfile. It returns the key of the tarfile, unless
+// the file was ignored before it reached the tarfile, or the tarfile was
+// abandoned.
+func (t *TarCache) addFile(fname filename.System) (string, bool) {
+	// Files often arrive twice, from both the listener and the finder. A
+	// file that was added recently and has not changed since is ignored
+	// without being opened.
+	stat := os.Stat
+	isLink := t.config.Symlinks != "" && t.config.Symlinks != filename.SymlinksFollow && fname.IsSymlink()
+	if isLink {
+		if t.config.Symlinks == filename.SymlinksIgnore {
+			pusherSymlinksIgnored.WithLabelValues(t.datatype).Inc()
+			t.config.Decisions.Record(t.datatype, decisionlog.Refused, string(fname), "", "an ignored symbolic link")
+			return "", false
+		}
+		stat = os.Lstat
+	}
+	if !t.isWithinRoot(fname, !isLink) {
+		t.refuse(fname, decisionlog.Refused, "outside the root directory or unresolvable")
+		return "", false
+	}
+	var version fileVersion
+	if info, err := stat(string(fname)); err == nil {
+		version = versionOf(info)
+		if t.undeletable.cooling(fname, version, time.Now()) {
+			pusherUndeletableFilesSkipped.WithLabelValues(t.datatype).Inc()
+			return "", false
+		}
+		if t.kept.contains(fname, version) {
+			pusherKeptFilesSkipped.WithLabelValues(t.datatype).Inc()
+			return "", false
+		}
+		if t.recent.contains(fname, version) {
+			pusherDuplicatesSuppressed.WithLabelValues(t.datatype).Inc()
+			t.refused.add(fname, "found again before its tarfile was uploaded")
+			return "", false
+		}
+		if info.IsDir() {
+			// A directory moved into place, or a followed link to one, is
+			// never archived.
+			t.fileLikeDir(fname, fname)
+			return "", false
+		}
+	}
+	if dir, ok := fname.Internal(t.rootDirectory).FileLikeDir(); ok {
+		if !t.fileLikeDir(fname, t.rootDirectory+filename.System(dir)) {
+			t.refuse(fname, decisionlog.Quarantined, "in a quarantined directory")
+			return "", false
+		}
+	}
+	internalName := t.internalName(fname)
+	if internalName.HasControlChars() {
+		if t.config.ControlChars == filename.ControlCharsReject {
+			pusherControlCharFilenames.WithLabelValues(t.datatype, "rejected").Inc()
+			log.Printf("Not archiving %q, whose name contains control characters\n", fname)
+			t.refuse(fname, decisionlog.Refused, "control characters in the name")
+			return "", false
+		}
+		pusherControlCharFilenames.WithLabelValues(t.datatype, "escaped").Inc()
+	}
+	internalName = t.escape(internalName)
 	if warning := internalName.Lint(); warning != nil {
 		log.Println("Strange filename encountered:", warning)
 		pusherStrangeFilenames.WithLabelValues(t.datatype).Inc()
 	}
-	file, err := os.Open(string(fname))
+	var file interface {
+		io.ReadCloser
+		Stat() (os.FileInfo, error)
+		Name() string
+	}
+	var err error
+	if isLink {
+		file, err = tarfile.OpenSymlink(string(fname))
+	} else {
+		file, err = os.Open(string(fname))
+	}
 	if err != nil {
 		pusherFileOpenErrors.WithLabelValues(t.datatype).Inc()
 		log.Printf("Could not open %s (error: %q)\n", fname, err)
+		t.refuse(fname, decisionlog.Refused, "could not be opened")
+		return "", false
+	}
+	defer file.Close()
+	subdir := t.subdir(internalName)
+	key := subdir
+	tfConfig := t.config.Tarfile
+	tfConfig.StoredExtensions = t.config.StoredExtensions
+	if t.config.Preallocate {
+		tfConfig.InitialSize = t.preallocation()
+	}
+	if t.isCompressed(internalName) {
+		key = storedKey(subdir)
+		tfConfig.Stored = true
+	}
+	if tf, ok := t.currentTarfile[key]; ok && t.crossedBoundary(tf, time.Now()) {
+		pusherTarfilesUploadCalls.WithLabelValues(t.datatype, "boundary_crossed").Inc()
+		t.uploadAndDelete(key)
+	}
+	if _, ok := t.currentTarfile[key]; !ok {
+		t.currentTarfile[key] = tarfile.New(filename.System(subdir), t.datatype, t.fileRatio, t.tarfileMetadata(subdir), tfConfig)
+	}
+	tf := t.currentTarfile[key]
+	before := tf.Count() + tf.SkippedCount()
+	// The arrival is recorded first, so that the age threshold of a new
+	// tarfile accounts for its first file.
+	t.arrivals.add(version.size, time.Now())
+	// The timer must fire for the key, which is not always the subdir.
+	timerFactory := func(string) *time.Timer { return t.makeTimer(key, tf) }
+	if t.config.DatatypeTimer {
+		timerFactory = func(string) *time.Timer { return nil }
+	}
+	if err := tf.Add(internalName, file, timerFactory); err != nil {
+		log.Printf("Could not add %s to the tarfile: %v", fname, err)
+		t.abandon(key, failureReason(err))
+		t.refuse(fname, decisionlog.Refused, "could not be added to a tarfile")
+		return "", false
+	}
+	if tf.Count()+tf.SkippedCount() > before {
+		// The file was either added or skipped by sampling. Either way, it
+		// will be deleted once the tarfile is uploaded.
+		t.recent.add(fname, version)
+	} else {
+		// It was already in the tarfile, or could not be read.
+		t.refused.add(fname, "not added to its tarfile")
+	}
+	return key, true
+}
+
+// refuse records that the file was not archived, and why.
+func (t *TarCache) refuse(fname filename.System, action decisionlog.Action, reason string) {
+	t.config.Decisions.Record(t.datatype, action, string(fname), "", reason)
+	t.refused.add(fname, reason)
+}
+
+// fileLikeDir counts and, if the policy says so, logs that the file is in dir,
+// a directory whose name looks like that of a file, or that it is itself a
+// directory, if dir is fname. It returns whether the file may be archived.
+func (t *TarCache) fileLikeDir(fname, dir filename.System) bool {
+	policy := t.config.Directories
+	if policy == "" {
+		policy = filename.DirectoriesIgnore
+	}
+	pusherFileLikeDirectories.WithLabelValues(t.datatype, string(policy)).Inc()
+	where := fmt.Sprintf("in %s, a directory named like a file", dir)
+	if dir == fname {
+		where = "a directory where a file was expected"
+	}
+	switch policy {
+	case filename.DirectoriesWarn:
+		log.Printf("Found %s, %s\n", fname, where)
+	case filename.DirectoriesQuarantine:
+		log.Printf("Not archiving %s, %s\n", fname, where)
+		return false
+	}
+	return true
+}
+
+// isWithinRoot returns whether the file, or the file a symbolic link points to
+// if the link is followed, is inside the root directory once symbolic links and
+// .. are resolved. A file outside it is refused, so that an experiment can't
+// make pusher archive, and then delete, arbitrary files of the host.
+func (t *TarCache) isWithinRoot(fname filename.System, followLink bool) bool {
+	canonical, err := fname.Canonical(followLink)
+	if err != nil {
+		pusherFileOpenErrors.WithLabelValues(t.datatype).Inc()
+		log.Printf("Could not resolve %s (error: %q)\n", fname, err)
+		return false
+	}
+	if !canonical.IsWithin(t.canonicalRoot) {
+		pusherFilesOutsideRoot.WithLabelValues(t.datatype).Inc()
+		log.Printf("Not archiving %s, which is %s, outside %s\n", fname, canonical, t.canonicalRoot)
+		return false
+	}
+	return true
+}
+
+// escape returns the name the file is archived under, which is escaped (see
+// filename.Internal.Escape) unless names with control characters are rejected
+// instead. Every name is escaped exactly once, here.
+func (t *TarCache) escape(name filename.Internal) filename.Internal {
+	if t.config.ControlChars == filename.ControlCharsReject {
+		return name
+	}
+	return name.Escape()
+}
+
+// internalName returns the name of the file in its tarfile.
+func (t *TarCache) internalName(fname filename.System) filename.Internal {
+	internalName := fname.Internal(t.rootDirectory)
+	if t.config.Rewriter != nil {
+		internalName = t.config.Rewriter.Rewrite(internalName)
+	}
+	return internalName
+}
+
+// subdir returns the subdir of the file, to Config.SubdirDepth levels.
+func (t *TarCache) subdir(name filename.Internal) string {
+	if t.config.SubdirDepth == 0 {
+		return name.Subdir()
+	}
+	return name.SubdirDepth(t.config.SubdirDepth)
+}
+
+// checkThresholds uploads a tarfile if it has reached a threshold. Its size is
+// only known once it is flushed, so it is flushed first if its estimated size,
+// which errs high, has reached the size threshold. Tarfiles are therefore only
+// flushed as they near the threshold.
+func (t *TarCache) checkThresholds(key string) {
+	tf, ok := t.currentTarfile[key]
+	if !ok {
 		return
 	}
-	subdir := internalName.Subdir()
-	if _, ok := t.currentTarfile[subdir]; !ok {
-		t.currentTarfile[subdir] = tarfile.New(filename.System(subdir), t.datatype, t.fileRatio, t.metadata.Get())
+	if tf.EstimatedSize() > t.sizeThreshold {
+		if err := tf.Flush(); err != nil {
+			log.Printf("Could not flush the tarfile for %q: %v", key, err)
+			t.abandon(key, "write_error")
+			return
+		}
 	}
-	tf := t.currentTarfile[subdir]
-	tf.Add(internalName, file, t.makeTimer)
 	if tf.Size() > t.sizeThreshold {
 		pusherTarfilesUploadCalls.WithLabelValues(t.datatype, "size_threshold_met").Inc()
-		t.uploadAndDelete(subdir)
+		t.uploadAndDelete(key)
+	} else if t.config.MaxFiles > 0 && tf.Count() >= t.config.MaxFiles {
+		pusherTarfilesUploadCalls.WithLabelValues(t.datatype, "file_count_threshold_met").Inc()
+		t.uploadAndDelete(key)
 	}
 }
 
-// Upload the buffer, delete the component files, start a new buffer.
-func (t *TarCache) uploadAndDelete(subdir string) {
-	if tf, ok := t.currentTarfile[subdir]; ok {
-		tf.UploadAndDelete(t.uploader)
-		delete(t.currentTarfile, subdir)
+// Upload the buffer, delete the component files, start a new buffer. The key
+// is usually the subdirectory, but see storedKey.
+func (t *TarCache) uploadAndDelete(key string) {
+	if tf, ok := t.currentTarfile[key]; ok {
+		size := tf.Size()
+		if err := tf.UploadAndDelete(t.uploadCtx, t.uploader); err != nil {
+			log.Printf("Could not finish the tarfile for %q: %v", key, err)
+			t.abandon(key, failureReason(err))
+			return
+		}
+		delete(t.currentTarfile, key)
+		t.lastSize = size
+		t.uploaded(tf)
 	} else {
-		log.Printf("Upload called for nonexistent tarfile for directory %q\n", subdir)
+		log.Printf("Upload called for nonexistent tarfile for directory %q\n", key)
+	}
+}
+
+// maxPreallocation is the most memory a new tarfile allocates up front (see
+// Config.Preallocate), so that the many tarfiles of many subdirectories, most
+// of which stay small, don't hold much more memory than their contents need.
+const maxPreallocation = bytecount.ByteCount(1 << 20)
+
+// preallocation returns how much memory a new tarfile should allocate up
+// front: as much as the last tarfile uploaded needed, up to maxPreallocation
+// and the size threshold.
+func (t *TarCache) preallocation() bytecount.ByteCount {
+	size := t.lastSize
+	if size > maxPreallocation {
+		size = maxPreallocation
+	}
+	if size > t.sizeThreshold {
+		size = t.sizeThreshold
+	}
+	return size
+}
+
+// uploaded hands a tarfile that was uploaded to the remover, if the removal of
+// its files is paced, or else takes note of the files it kept or could not
+// remove.
+func (t *TarCache) uploaded(tf tarfile.Tarfile) {
+	if t.refused != nil {
+		for _, f := range tf.Files() {
+			t.refused.remove(f)
+		}
+	}
+	if t.remover != nil {
+		t.remover.add(tf)
+		return
+	}
+	t.noteRemaining(tf)
+}
+
+// handleRemoved takes note of the files the remover kept or could not remove.
+func (t *TarCache) handleRemoved() {
+	for _, tf := range t.remover.takeRemoved() {
+		t.noteRemaining(tf)
+	}
+}
+
+// noteRemaining remembers the files of an uploaded tarfile that were kept or
+// could not be removed.
+func (t *TarCache) noteRemaining(tf tarfile.Tarfile) {
+	if t.kept != nil {
+		t.kept.add(tf.Kept())
+		pusherKeptFiles.WithLabelValues(t.datatype).Set(float64(t.kept.len()))
+	}
+	if t.undeletable == nil {
+		return
+	}
+	// The cool-down, rather than the recent files, decides when files that
+	// could not be deleted are uploaded again.
+	undeletable := tf.Undeletable()
+	for _, f := range undeletable {
+		t.recent.remove(f)
+	}
+	t.undeletable.add(undeletable, tf.Uploaded().Destination, time.Now())
+	t.expireUndeletable()
+}
+
+// expireUndeletable forgets the undeletable files whose cool-down has ended,
+// saves their ledger if they changed, and exports how many are left.
+func (t *TarCache) expireUndeletable() {
+	if t.undeletable == nil {
+		return
+	}
+	if err := t.undeletable.expire(time.Now()); err != nil {
+		ratelog.Printf("Could not save the ledger of undeletable files %s (error: %q)\n", t.config.UndeletableLedger, err)
+		pusherUndeletableLedgerErrors.WithLabelValues(t.datatype, "save").Inc()
+	}
+	pusherUndeletableFiles.WithLabelValues(t.datatype).Set(float64(t.undeletable.len()))
+}
+
+// failureReason returns the reason, for the pusher_tarfiles_abandoned_total
+// metric, that a tarfile which UploadAndDelete failed to upload is abandoned.
+func failureReason(err error) string {
+	if errors.Is(err, tarfile.ErrUploadGaveUp) {
+		return "upload_gave_up"
+	}
+	if errors.Is(err, tarfile.ErrCorrupt) {
+		return "corrupt"
+	}
+	if errors.Is(err, tarfile.ErrShortRead) {
+		return "short_read"
+	}
+	return "write_error"
+}
+
+// abandon discards a tarfile without uploading it, and queues all of its files
+// to be added again.
+func (t *TarCache) abandon(key string, reason string) {
+	tf, ok := t.currentTarfile[key]
+	if !ok {
+		return
+	}
+	delete(t.currentTarfile, key)
+	files := tf.Abandon()
+	for _, f := range files {
+		t.recent.remove(f)
+		t.refused.add(f, "its tarfile was abandoned")
+	}
+	pusherTarfilesAbandoned.WithLabelValues(t.datatype, reason).Inc()
+	log.Printf("Abandoned the tarfile for %q (%s). Queueing its %d files to be added again.", key, reason, len(files))
+	t.pending = append(t.pending, files...)
+}
+
+// send delivers a reset request to ListenForever. Requests sent after
+// ListenForever has returned are dropped.
+func (t *TarCache) send(r resetRequest) {
+	select {
+	case t.resetChannel <- r:
+	case <-t.done:
+	}
+}
+
+// resetRequest asks ListenForever to abandon either every tarfile or the
+// tarfiles of a single subdirectory.
+type resetRequest struct {
+	all    bool
+	subdir string
+	reason string
+}
+
+// Reset discards the tarfiles for the subdirectory without uploading them and
+// queues their files to be added to new tarfiles. The reason is recorded in
+// the pusher_tarfiles_abandoned_total metric. Reset blocks until ListenForever
+// receives the request, so it must not be called from the goroutine running
+// ListenForever. It is safe to call from any other goroutine, even after
+// ListenForever has returned.
+func (t *TarCache) Reset(subdir string, reason string) {
+	t.send(resetRequest{subdir: subdir, reason: reason})
+}
+
+// ResetAll is like Reset, but for every tarfile in the cache.
+func (t *TarCache) ResetAll(reason string) {
+	t.send(resetRequest{all: true, reason: reason})
+}
+
+// Stop makes ListenForever upload every tarfile, as it does when its termCtx is
+// canceled, and then return, as it does when its killCtx is. Stop returns once
+// ListenForever has returned. Like Reset, it must not be called from the
+// goroutine running ListenForever, and is safe to call after it has returned.
+func (t *TarCache) Stop() {
+	select {
+	case t.stopChannel <- struct{}{}:
+	case <-t.done:
+	}
+	<-t.done
+}
+
+func (t *TarCache) reset(r resetRequest) {
+	if !r.all {
+		t.abandon(r.subdir, r.reason)
+		t.abandon(storedKey(r.subdir), r.reason)
+		return
+	}
+	keys := []string{}
+	for key := range t.currentTarfile {
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		t.abandon(key, r.reason)
+	}
+}
+
+// addPending adds the files from abandoned tarfiles to new tarfiles. Files
+// that get queued again while this runs wait for the next call, so a
+// persistent failure can not cause an infinite loop.
+func (t *TarCache) addPending() {
+	pending := t.pending
+	t.pending = nil
+	if len(pending) > 0 {
+		t.addAll(pending)
 	}
 }
@@ -3,6 +3,7 @@ package tarcache_test
 import (
 	"context"
 	"crypto/rand"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"sync"
@@ -17,6 +18,8 @@ import (
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/pusher/filename"
 	"github.com/m-lab/pusher/tarcache"
+	"github.com/m-lab/pusher/tarfile"
+	"github.com/m-lab/pusher/uploader"
 )
 
 type fakeUploader struct {
@@ -24,11 +27,11 @@ type fakeUploader struct {
 	mutex sync.Mutex
 }
 
-func (f *fakeUploader) Upload(_ filename.System, _ []byte) error {
+func (f *fakeUploader) Upload(_ context.Context, _ uploader.ID, _ filename.System, _ []byte, _ map[string]string) (uploader.Result, error) {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 	f.calls++
-	return nil
+	return uploader.Result{}, nil
 }
 
 func (f *fakeUploader) Calls() int {
@@ -63,7 +66,7 @@ func TestTimer(t *testing.T) {
 		Expected: 100 * time.Millisecond,
 		Max:      100 * time.Millisecond,
 	}
-	tarCache, channel := tarcache.New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Kilobyte), config, uploader)
+	tarCache, channel := tarcache.New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Kilobyte), config, uploader, tarcache.Config{})
 	// Add the small file, which should not trigger an upload.
 	tinyFile := filename.System("a/b/tinyfile")
 	otherTinyFile := filename.System("c/d/tinyfile")
@@ -98,7 +101,7 @@ func TestTimer(t *testing.T) {
 	// Wait for the timer to fire.
 	time.Sleep(time.Duration(250 * time.Millisecond))
 	if uploader.Calls() != 1 {
-		t.Error("uploader.calls should be one ", uploader.calls)
+		t.Error("uploader.calls should be one ", uploader.Calls())
 	}
 }
 
@@ -119,7 +122,7 @@ func TestContextCancellation(t *testing.T) {
 		Expected: 100 * time.Hour,
 		Max:      100 * time.Hour,
 	}
-	tarCache, fileChan := tarcache.New(filename.System("/tmp"), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Gigabyte), config, &uploader)
+	tarCache, fileChan := tarcache.New(filename.System("/tmp"), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Gigabyte), config, &uploader, tarcache.Config{})
 	killCtx, killCancel := context.WithCancel(context.Background())
 	termCtx, termCancel := context.WithCancel(killCtx)
 
@@ -146,8 +149,8 @@ func TestContextCancellation(t *testing.T) {
 	time.Sleep(10 * time.Millisecond)
 
 	// Verify that nothing has been uploaded.
-	if uploader.calls != 0 {
-		t.Errorf("Should have uploaded 0 times, not %d", uploader.calls)
+	if uploader.Calls() != 0 {
+		t.Errorf("Should have uploaded 0 times, not %d", uploader.Calls())
 	}
 
 	// Cancel things with the first context to cause an upload and then wait for the cancellation to take effect.
@@ -156,7 +159,7 @@ func TestContextCancellation(t *testing.T) {
 
 	// Verify that something has been uploaded in each of the subdirectories
 	if uploader.Calls() != 2 {
-		t.Errorf("Should have uploaded 2 times, not %d", uploader.calls)
+		t.Errorf("Should have uploaded 2 times, not %d", uploader.Calls())
 	}
 
 	// Add another file.
@@ -175,7 +178,7 @@ func TestContextCancellation(t *testing.T) {
 
 	// Verify that one more upload happened.
 	if uploader.Calls() != 3 {
-		t.Errorf("Should have uploaded 3 times in all, not %d", uploader.calls)
+		t.Errorf("Should have uploaded 3 times in all, not %d", uploader.Calls())
 	}
 }
 
@@ -186,7 +189,7 @@ func TestChannelCloseCancellation(t *testing.T) {
 		Expected: 100 * time.Millisecond,
 		Max:      100 * time.Millisecond,
 	}
-	tarCache, inputChannel := tarcache.New(filename.System("/tmp"), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Kilobyte), config, &uploader)
+	tarCache, inputChannel := tarcache.New(filename.System("/tmp"), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Kilobyte), config, &uploader, tarcache.Config{})
 	ctx := context.Background()
 	go func() {
 		time.Sleep(100 * time.Millisecond)
@@ -195,3 +198,399 @@ func TestChannelCloseCancellation(t *testing.T) {
 	// If this doesn't actually listen forever, then this test is a success.
 	tarCache.ListenForever(ctx, ctx)
 }
+
+// TestConcurrentUse exercises every way that other goroutines interact with a
+// TarCache at once. It is most useful when run with -race.
+func TestConcurrentUse(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestConcurrentUse")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+
+	uploader := fakeUploader{}
+	// Timers fire constantly, the size threshold is met every few files, and
+	// tarfiles are reset while all that happens.
+	config := memoryless.Config{
+		Min:      1 * time.Millisecond,
+		Expected: 2 * time.Millisecond,
+		Max:      5 * time.Millisecond,
+	}
+	tarCache, fileChan := tarcache.New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(100*bytecount.Byte), config, &uploader, tarcache.Config{Tarfile: tarfile.Config{CompressionCores: 2}})
+	killCtx, killCancel := context.WithCancel(context.Background())
+	termCtx, termCancel := context.WithCancel(killCtx)
+	done := make(chan struct{})
+	go func() {
+		tarCache.ListenForever(termCtx, killCtx)
+		close(done)
+	}()
+
+	subdirs := []string{"2019/05/01", "2019/05/02", "2019/05/03"}
+	files := []string{}
+	for _, subdir := range subdirs {
+		rtx.Must(os.MkdirAll(tempdir+"/"+subdir, 0777), "Could not make directories")
+		for i := 0; i < 50; i++ {
+			name := fmt.Sprintf("%s/%s/file%d", tempdir, subdir, i)
+			rtx.Must(ioutil.WriteFile(name, []byte("abcdefgh"), 0666), "Could not write test data")
+			files = append(files, name)
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		for _, f := range files {
+			fileChan <- filename.System(f)
+		}
+		wg.Done()
+	}()
+	go func() {
+		for i := 0; i < 20; i++ {
+			tarCache.Reset(subdirs[i%len(subdirs)], "test")
+			if i%5 == 0 {
+				tarCache.ResetAll("test")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		wg.Done()
+	}()
+	wg.Wait()
+
+	// Let the timers upload everything, then shut down.
+	remaining := func() []string {
+		r := []string{}
+		for _, f := range files {
+			if _, err := os.Stat(f); err == nil {
+				r = append(r, f)
+			}
+		}
+		return r
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for len(remaining()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	termCancel()
+	killCancel()
+	<-done
+
+	if r := remaining(); len(r) > 0 {
+		t.Errorf("%d files should have been uploaded and deleted: %v", len(r), r)
+	}
+	if uploader.Calls() == 0 {
+		t.Error("Nothing was uploaded")
+	}
+
+	// Resetting a TarCache that is no longer listening should not block.
+	tarCache.Reset(subdirs[0], "test")
+	tarCache.ResetAll("test")
+}
+
+func TestSnapshot(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestSnapshot")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+
+	uploader := fakeUploader{}
+	config := memoryless.Config{
+		Min:      1 * time.Hour,
+		Expected: 1 * time.Hour,
+		Max:      1 * time.Hour,
+	}
+	tarCache, fileChan := tarcache.New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Megabyte), config, &uploader, tarcache.Config{StoredExtensions: []string{".gz"}})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		tarCache.ListenForever(ctx, ctx)
+		close(done)
+	}()
+
+	if s := tarCache.Snapshot(); len(s) != 0 {
+		t.Errorf("An empty cache should have an empty snapshot, not %v", s)
+	}
+	for _, name := range []string{"2019/05/02/a", "2019/05/02/b", "2019/05/02/c.gz", "2019/05/01/a"} {
+		rtx.Must(os.MkdirAll(tempdir+"/"+name[:10], 0777), "Could not make directories")
+		rtx.Must(ioutil.WriteFile(tempdir+"/"+name, []byte("abcdefgh"), 0666), "Could not write test data")
+		fileChan <- filename.System(tempdir + "/" + name)
+	}
+	var s []tarcache.TarfileState
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if s = tarCache.Snapshot(); len(s) == 3 && s[1].Files == 2 {
+			break
+		}
+	}
+	want := []struct {
+		subdir string
+		stored bool
+		files  int
+	}{
+		{"2019/05/01", false, 1},
+		{"2019/05/02", false, 2},
+		{"2019/05/02", true, 1},
+	}
+	if len(s) != len(want) {
+		t.Fatalf("Wanted %d tarfiles, got %v", len(want), s)
+	}
+	for i, w := range want {
+		if s[i].Subdir != w.subdir || s[i].Stored != w.stored || s[i].Files != w.files || s[i].Skipped != 0 || s[i].Size == 0 || s[i].Age <= 0 {
+			t.Errorf("Tarfile %d was %+v, wanted %+v", i, s[i], w)
+		}
+	}
+
+	cancel()
+	<-done
+	if s := tarCache.Snapshot(); s != nil {
+		t.Errorf("Snapshot should return nil after ListenForever returns, not %v", s)
+	}
+}
+
+// blockingUploader blocks every upload until release is closed.
+type blockingUploader struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingUploader) Upload(ctx context.Context, _ uploader.ID, _ filename.System, _ []byte, _ map[string]string) (uploader.Result, error) {
+	select {
+	case b.started <- struct{}{}:
+	default:
+	}
+	<-b.release
+	return uploader.Result{}, nil
+}
+
+func TestSnapshotDoesNotWaitForUploads(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestSnapshotDoesNotWaitForUploads")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+
+	up := &blockingUploader{started: make(chan struct{}, 1), release: make(chan struct{})}
+	config := memoryless.Config{Expected: time.Hour, Max: time.Hour}
+	tarCache, fileChan := tarcache.New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, 1, config, up, tarcache.Config{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		tarCache.ListenForever(ctx, ctx)
+		close(done)
+	}()
+
+	rtx.Must(os.MkdirAll(tempdir+"/2019/05/01", 0777), "Could not make directories")
+	rtx.Must(ioutil.WriteFile(tempdir+"/2019/05/01/a", []byte("abcdefgh"), 0666), "Could not write test data")
+	fileChan <- filename.System(tempdir + "/2019/05/01/a")
+	<-up.started
+
+	// ListenForever is stuck in the upload, but the snapshot is still there.
+	got := make(chan []tarcache.TarfileState)
+	go func() { got <- tarCache.Snapshot() }()
+	select {
+	case s := <-got:
+		if s == nil {
+			t.Error("Snapshot returned nil while ListenForever was running")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Snapshot waited for the upload")
+	}
+	close(up.release)
+	cancel()
+	<-done
+}
+
+func TestStop(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestStop")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+
+	uploader := fakeUploader{}
+	config := memoryless.Config{
+		Min:      1 * time.Hour,
+		Expected: 1 * time.Hour,
+		Max:      1 * time.Hour,
+	}
+	tarCache, fileChan := tarcache.New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Megabyte), config, &uploader, tarcache.Config{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		tarCache.ListenForever(ctx, ctx)
+		close(done)
+	}()
+
+	rtx.Must(os.MkdirAll(tempdir+"/2019/05/02", 0777), "Could not make directories")
+	rtx.Must(ioutil.WriteFile(tempdir+"/2019/05/02/a", []byte("abcdefgh"), 0666), "Could not write test data")
+	fileChan <- filename.System(tempdir + "/2019/05/02/a")
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if len(tarCache.Snapshot()) == 1 {
+			break
+		}
+	}
+
+	tarCache.Stop()
+	select {
+	case <-done:
+	default:
+		t.Error("ListenForever had not returned when Stop did")
+	}
+	if uploader.Calls() != 1 {
+		t.Errorf("Stop should have uploaded the tarfile, but there were %d uploads", uploader.Calls())
+	}
+	// Stopping a stopped TarCache does nothing.
+	tarCache.Stop()
+}
+
+func TestSkippedFilesAreDeletedOnTimeout(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestSkippedFilesAreDeletedOnTimeout")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+
+	uploader := fakeUploader{}
+	config := memoryless.Config{
+		Min:      10 * time.Millisecond,
+		Expected: 10 * time.Millisecond,
+		Max:      10 * time.Millisecond,
+	}
+	// A ratio of 0 skips every file.
+	tarCache, fileChan := tarcache.New(filename.System(tempdir), "test", 0, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Megabyte), config, &uploader, tarcache.Config{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		tarCache.ListenForever(ctx, ctx)
+		close(done)
+	}()
+	rtx.Must(os.MkdirAll(tempdir+"/2019/05/01", 0777), "Could not make directories")
+	rtx.Must(ioutil.WriteFile(tempdir+"/2019/05/01/a", []byte("abcdefgh"), 0666), "Could not write test data")
+	fileChan <- filename.System(tempdir + "/2019/05/01/a")
+
+	// The timer of the tarfile of skipped files should upload it, which
+	// deletes the skipped file and removes the tarfile from the cache.
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(tempdir + "/2019/05/01/a"); err != nil && len(tarCache.Snapshot()) == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := os.Stat(tempdir + "/2019/05/01/a"); err == nil {
+		t.Error("The skipped file should have been deleted")
+	}
+	if s := tarCache.Snapshot(); len(s) != 0 {
+		t.Errorf("The tarfile should be gone, not %v", s)
+	}
+	if uploader.Calls() != 0 {
+		t.Errorf("Nothing should have been uploaded, not %d tarfiles", uploader.Calls())
+	}
+	cancel()
+	<-done
+}
+
+func TestDatatypeTimer(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestDatatypeTimer")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+
+	uploader := fakeUploader{}
+	config := memoryless.Config{
+		Min:      50 * time.Millisecond,
+		Expected: 50 * time.Millisecond,
+		Max:      50 * time.Millisecond,
+	}
+	tarCache, fileChan := tarcache.New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Megabyte), config, &uploader, tarcache.Config{DatatypeTimer: true})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		tarCache.ListenForever(ctx, ctx)
+		close(done)
+	}()
+	for _, subdir := range []string{"2019/05/01", "2019/05/02", "2019/05/03"} {
+		rtx.Must(os.MkdirAll(tempdir+"/"+subdir, 0777), "Could not make directories")
+		rtx.Must(ioutil.WriteFile(tempdir+"/"+subdir+"/a", []byte("abcdefgh"), 0666), "Could not write test data")
+		fileChan <- filename.System(tempdir + "/" + subdir + "/a")
+	}
+	for deadline := time.Now().Add(10 * time.Second); uploader.Calls() < 3 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if uploader.Calls() != 3 {
+		t.Errorf("Every tarfile should have been uploaded by the ticker, not %d", uploader.Calls())
+	}
+	if s := tarCache.Snapshot(); len(s) != 0 {
+		t.Errorf("Every tarfile should have been uploaded, not %v", s)
+	}
+	cancel()
+	<-done
+}
+
+func TestPacedRemovalDoesNotHoldUpTheTarCache(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestPacedRemovalDoesNotHoldUpTheTarCache")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	rtx.Must(os.MkdirAll(tempdir+"/2019/05/01", 0777), "Could not make directories")
+	rtx.Must(os.MkdirAll(tempdir+"/2019/05/02", 0777), "Could not make directories")
+
+	uploader := &fakeUploader{}
+	config := memoryless.Config{
+		Min:      100 * time.Hour,
+		Expected: 100 * time.Hour,
+		Max:      100 * time.Hour,
+	}
+	tarCache, fileChan := tarcache.New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Gigabyte), config, uploader, tarcache.Config{
+		Tarfile: tarfile.Config{
+			RemoveBatchSize:  1,
+			RemoveBatchPause: time.Hour,
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		tarCache.ListenForever(ctx, ctx)
+		close(done)
+	}()
+	// Files sent on the channel may otherwise arrive after the flush.
+	flush := func(files int) {
+		for i := 0; i < 500; i++ {
+			added := 0
+			for _, state := range tarCache.Snapshot() {
+				added += state.Files
+			}
+			if added == files {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		tarCache.Flush()
+	}
+	waitForUploads := func(n int) {
+		for i := 0; i < 500 && uploader.Calls() < n; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if uploader.Calls() != n {
+			t.Fatalf("%d uploads instead of %d", uploader.Calls(), n)
+		}
+	}
+	names := []string{"2019/05/01/a", "2019/05/01/b", "2019/05/02/c"}
+	for _, name := range names[:2] {
+		rtx.Must(ioutil.WriteFile(tempdir+"/"+name, []byte("abcdefgh"), 0666), "Could not write %s", name)
+		fileChan <- filename.System(tempdir + "/" + name)
+	}
+	flush(2)
+	waitForUploads(1)
+
+	// The removal of the first tarfile's files is waiting for an hour, but
+	// the next tarfile is still uploaded.
+	rtx.Must(ioutil.WriteFile(tempdir+"/"+names[2], []byte("abcdefgh"), 0666), "Could not write %s", names[2])
+	fileChan <- filename.System(tempdir + "/" + names[2])
+	flush(1)
+	waitForUploads(2)
+	if _, err := os.Stat(tempdir + "/" + names[1]); err != nil {
+		t.Errorf("The second batch of removals should still be waiting (%v)", err)
+	}
+
+	// Once the TarCache stops, the rest are removed without waiting.
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The TarCache waited for the paced removals to stop")
+	}
+	for _, name := range names {
+		if _, err := os.Stat(tempdir + "/" + name); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed (%v)", name, err)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package tarcache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/m-lab/pusher/filename"
+)
+
+type undeletableFile struct {
+	version fileVersion
+	until   time.Time
+	// Where the tarfile holding the file was uploaded to.
+	object string
+}
+
+// ledgerEntry is how an undeletable file is recorded in the ledger file.
+type ledgerEntry struct {
+	Path     string
+	Size     int64
+	ModTime  time.Time
+	Uploaded time.Time
+	Until    time.Time
+	Object   string
+}
+
+// removeFailuresBeforeCooldown is how many uploads in a row of the same version
+// of a file must fail to delete it before it cools down. A single failure may
+// be a fluke, after which the file is uploaded, and removed, again.
+const removeFailuresBeforeCooldown = 2
+
+// removeFailures counts the uploads in a row that failed to delete a file.
+type removeFailures struct {
+	version fileVersion
+	count   int
+	last    time.Time
+}
+
+// undeletableFiles remembers files that were uploaded but could not be deleted,
+// e.g. because the filesystem was remounted read-only. Once removing the same
+// version of a file has failed removeFailuresBeforeCooldown times, it is not
+// uploaded again until its cool-down ends, unless it changes. If it has a
+// ledger file, it survives restarts. A nil *undeletableFiles remembers nothing.
+type undeletableFiles struct {
+	cooldown time.Duration
+	ledger   string
+	entries  map[filename.System]undeletableFile
+	failures map[filename.System]removeFailures
+	// Whether entries changed since the ledger was last saved.
+	changed bool
+}
+
+// newUndeletableFiles returns an undeletableFiles with the given cool-down, or
+// nil if the cool-down is not positive. If the ledger is not empty, it is the
+// name of the file that the undeletable files are saved to, and they are
+// loaded from it. A ledger that can not be read is returned as an error, along
+// with an empty but usable undeletableFiles.
+func newUndeletableFiles(cooldown time.Duration, ledger string) (*undeletableFiles, error) {
+	if cooldown <= 0 {
+		return nil, nil
+	}
+	u := &undeletableFiles{
+		cooldown: cooldown,
+		ledger:   ledger,
+		entries:  make(map[filename.System]undeletableFile),
+		failures: make(map[filename.System]removeFailures),
+	}
+	if ledger == "" {
+		return u, nil
+	}
+	contents, err := ioutil.ReadFile(ledger)
+	if os.IsNotExist(err) {
+		return u, nil
+	}
+	if err != nil {
+		return u, err
+	}
+	var entries []ledgerEntry
+	if err := json.Unmarshal(contents, &entries); err != nil {
+		return u, err
+	}
+	now := time.Now()
+	for _, e := range entries {
+		if now.After(e.Until) {
+			u.changed = true
+			continue
+		}
+		u.entries[filename.System(e.Path)] = undeletableFile{
+			version: fileVersion{modTime: e.ModTime, size: e.Size},
+			until:   e.Until,
+			object:  e.Object,
+		}
+	}
+	return u, nil
+}
+
+// add records that the files, which have just been uploaded in the given
+// object, could not be deleted. Files that no longer exist are ignored. A file
+// only starts its cool-down once removing it failed often enough.
+func (u *undeletableFiles) add(names []filename.System, object string, now time.Time) {
+	if u == nil {
+		return
+	}
+	for _, name := range names {
+		info, err := os.Stat(string(name))
+		if err != nil {
+			delete(u.failures, name)
+			continue
+		}
+		version := versionOf(info)
+		f := u.failures[name]
+		if f.count == 0 || !f.version.modTime.Equal(version.modTime) || f.version.size != version.size {
+			f = removeFailures{version: version}
+		}
+		f.count++
+		f.last = now
+		if f.count < removeFailuresBeforeCooldown {
+			u.failures[name] = f
+			continue
+		}
+		delete(u.failures, name)
+		u.entries[name] = undeletableFile{version: version, until: now.Add(u.cooldown), object: object}
+		u.changed = true
+	}
+}
+
+// expire forgets the files whose cool-down has ended, and the failures to
+// remove files that are too old to be in a row with the next one. If anything
+// was forgotten, or remembered since, the ledger is saved, and any error is
+// from saving it.
+func (u *undeletableFiles) expire(now time.Time) error {
+	if u == nil {
+		return nil
+	}
+	for name, f := range u.entries {
+		if now.After(f.until) {
+			delete(u.entries, name)
+			u.changed = true
+		}
+	}
+	for name, f := range u.failures {
+		if now.After(f.last.Add(u.cooldown)) {
+			delete(u.failures, name)
+		}
+	}
+	if !u.changed {
+		return nil
+	}
+	if err := u.save(); err != nil {
+		return err
+	}
+	u.changed = false
+	return nil
+}
+
+// save writes every file to the ledger, if there is one. The ledger is
+// replaced atomically, so that a crash can not leave it half written.
+func (u *undeletableFiles) save() error {
+	if u.ledger == "" {
+		return nil
+	}
+	entries := make([]ledgerEntry, 0, len(u.entries))
+	for name, f := range u.entries {
+		entries = append(entries, ledgerEntry{
+			Path:     string(name),
+			Size:     f.version.size,
+			ModTime:  f.version.modTime,
+			Uploaded: f.until.Add(-u.cooldown),
+			Until:    f.until,
+			Object:   f.object,
+		})
+	}
+	contents, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(u.ledger), filepath.Base(u.ledger)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), u.ledger)
+}
+
+// cooling returns whether the file was uploaded but not deleted, has not
+// changed since, and is still in its cool-down. A file whose cool-down has
+// ended is forgotten, which the ledger records the next time it is saved.
+func (u *undeletableFiles) cooling(name filename.System, version fileVersion, now time.Time) bool {
+	if u == nil {
+		return false
+	}
+	f, ok := u.entries[name]
+	if !ok {
+		return false
+	}
+	if now.After(f.until) || !f.version.modTime.Equal(version.modTime) || f.version.size != version.size {
+		delete(u.entries, name)
+		u.changed = true
+		return false
+	}
+	return true
+}
+
+// len returns the number of files remembered.
+func (u *undeletableFiles) len() int {
+	if u == nil {
+		return 0
+	}
+	return len(u.entries)
+}
@@ -4,6 +4,7 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/rand"
 	"errors"
 	"fmt"
@@ -13,6 +14,7 @@ import (
 	"os/exec"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -24,6 +26,8 @@ import (
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/pusher/filename"
 	"github.com/m-lab/pusher/tarfile"
+	"github.com/m-lab/pusher/uploader"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 // verifyTarfileContents checks that the referenced tarfile actually contains
@@ -81,22 +85,24 @@ func verifyTarfileContents(t *testing.T, tarfile string, contents []FileInTarfil
 
 type fakeUploader struct {
 	contents         []byte
+	dirs             []string
 	calls            int
 	requestedRetries int
 	expectedDir      string
 }
 
-func (f *fakeUploader) Upload(dir filename.System, contents []byte) error {
+func (f *fakeUploader) Upload(_ context.Context, _ uploader.ID, dir filename.System, contents []byte, _ map[string]string) (uploader.Result, error) {
 	if f.expectedDir != "" && string(dir) != f.expectedDir {
 		log.Fatalf("Upload to unexpected directory: %v != %v\n", dir, f.expectedDir)
 	}
 	f.contents = contents
+	f.dirs = append(f.dirs, string(dir))
 	f.calls++
 	if f.requestedRetries > 0 {
 		f.requestedRetries--
-		return errors.New("A fake error to trigger retry logic")
+		return uploader.Result{}, errors.New("A fake error to trigger retry logic")
 	}
-	return nil
+	return uploader.Result{Destination: "fake://" + string(dir), Size: int64(len(contents))}, nil
 }
 
 type FileInTarfile struct {
@@ -118,8 +124,8 @@ func TestEmptyUpload(t *testing.T) {
 		Expected: 1 * time.Hour,
 		Max:      1 * time.Hour,
 	}
-	tarCache, _ := New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Kilobyte), config, &uploader)
-	tarCache.currentTarfile[tempdir] = tarfile.New(filename.System(tempdir), "", 1, make(map[string]string))
+	tarCache, _ := New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Kilobyte), config, &uploader, Config{})
+	tarCache.currentTarfile[tempdir] = tarfile.New(filename.System(tempdir), "", 1, make(map[string]string), tarfile.Config{})
 	tarCache.uploadAndDelete("this does not exist")
 	tarCache.uploadAndDelete(tempdir)
 	if uploader.calls != 0 {
@@ -152,7 +158,7 @@ func TestSkipFile(t *testing.T) {
 		Max:      1 * time.Hour,
 	}
 	// File ratio = 0 means all files should be skipped.
-	tarCache, _ := New(filename.System(tempdir), "test", 0, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Kilobyte), config, &uploader)
+	tarCache, _ := New(filename.System(tempdir), "test", 0, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Kilobyte), config, &uploader, Config{})
 
 	ioutil.WriteFile(tempdir+"/skipfile", []byte("abcdefgh"), os.FileMode(0666))
 	tarCache.add(filename.System(tempdir + "/skipfile"))
@@ -175,7 +181,7 @@ func TestUnreadableFile(t *testing.T) {
 		Expected: 1 * time.Hour,
 		Max:      1 * time.Hour,
 	}
-	tarCache, _ := New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Kilobyte), config, &uploader)
+	tarCache, _ := New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Kilobyte), config, &uploader, Config{})
 	// This should not crash, even though the file does not exist.
 	tarCache.add(filename.System(tempdir + "/dne"))
 	if tf, ok := tarCache.currentTarfile[tempdir]; ok && tf.Size() != 0 {
@@ -215,7 +221,7 @@ func TestAdd(t *testing.T) {
 		Expected: 1 * time.Hour,
 		Max:      1 * time.Hour,
 	}
-	tarCache, _ := New(filename.System(tempdir), "testdata", 1, kv, bytecount.ByteCount(1*bytecount.Kilobyte), config, &uploader)
+	tarCache, _ := New(filename.System(tempdir), "testdata", 1, kv, bytecount.ByteCount(1*bytecount.Kilobyte), config, &uploader, Config{})
 	if len(tarCache.currentTarfile) != 0 {
 		t.Errorf("The file list should be of zero length and is not (%d != 0)", len(tarCache.currentTarfile))
 	}
@@ -263,3 +269,1399 @@ func TestAdd(t *testing.T) {
 		t.Error("Failed to add the new file after upload")
 	}
 }
+
+func TestAddWithRewriter(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestAddWithRewriter")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	rtx.Must(os.MkdirAll(tempdir+"/legacy/20190501", 0777), "Could not create dirs")
+	rtx.Must(ioutil.WriteFile(tempdir+"/legacy/20190501/data.txt", []byte("abcdefgh"), 0666), "Could not write file")
+
+	rewriter, err := filename.NewRewriter(`^legacy/([0-9]{4})([0-9]{2})([0-9]{2})/=>$1/$2/$3/`)
+	rtx.Must(err, "Could not create rewriter")
+	config := memoryless.Config{
+		Min:      1 * time.Hour,
+		Expected: 1 * time.Hour,
+		Max:      1 * time.Hour,
+	}
+	uploader := fakeUploader{}
+	tarCache, _ := New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Kilobyte), config, &uploader, Config{Rewriter: rewriter})
+	tarCache.add(filename.System(tempdir + "/legacy/20190501/data.txt"))
+	if _, ok := tarCache.currentTarfile["2019/05/01"]; !ok || len(tarCache.currentTarfile) != 1 {
+		t.Errorf("The file should have been added to the 2019/05/01 tarfile: %v", tarCache.currentTarfile)
+	}
+	tarCache.uploadAndDelete("2019/05/01")
+	ioutil.WriteFile(tempdir+"/tarfile.tgz", uploader.contents, 0666)
+	verifyTarfileContents(t, tempdir+"/tarfile.tgz",
+		[]FileInTarfile{{name: "2019/05/01/data.txt", size: 8}},
+		map[string]string{"MLAB.datatype": "test"})
+}
+
+func TestAddWithControlChars(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestAddWithControlChars")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	rtx.Must(os.MkdirAll(tempdir+"/2019/05/01", 0777), "Could not create dirs")
+	adversarial := tempdir + "/2019/05/01/a\nb%\x1b"
+	config := memoryless.Config{
+		Min:      1 * time.Hour,
+		Expected: 1 * time.Hour,
+		Max:      1 * time.Hour,
+	}
+
+	// By default, the name is escaped.
+	rtx.Must(ioutil.WriteFile(adversarial, []byte("abcdefgh"), 0666), "Could not write file")
+	uploader := fakeUploader{}
+	tarCache, _ := New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Kilobyte), config, &uploader, Config{})
+	tarCache.add(filename.System(adversarial))
+	tarCache.uploadAndDelete("2019/05/01")
+	ioutil.WriteFile(tempdir+"/tarfile.tgz", uploader.contents, 0666)
+	verifyTarfileContents(t, tempdir+"/tarfile.tgz",
+		[]FileInTarfile{{name: "2019/05/01/a%0Ab%25%1B", size: 8}},
+		map[string]string{"MLAB.datatype": "test"})
+	if _, err := os.Stat(adversarial); !os.IsNotExist(err) {
+		t.Errorf("The file should have been deleted: %v", err)
+	}
+
+	// Rejected files are left alone.
+	rtx.Must(ioutil.WriteFile(adversarial, []byte("abcdefgh"), 0666), "Could not write file")
+	tarCache, _ = New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Kilobyte), config, &uploader, Config{ControlChars: filename.ControlCharsReject})
+	tarCache.add(filename.System(adversarial))
+	if len(tarCache.currentTarfile) != 0 {
+		t.Errorf("The file should have been rejected: %v", tarCache.currentTarfile)
+	}
+	if _, err := os.Stat(adversarial); err != nil {
+		t.Errorf("The rejected file should still exist: %v", err)
+	}
+	rtx.Must(os.Remove(adversarial), "Could not remove file")
+
+	// Percent signs are escaped in every name, unless names are not escaped
+	// at all.
+	percent := tempdir + "/2019/05/01/100%"
+	for policy, want := range map[filename.ControlCharPolicy]string{
+		filename.ControlCharsEscape: "2019/05/01/100%25",
+		filename.ControlCharsReject: "2019/05/01/100%",
+	} {
+		rtx.Must(ioutil.WriteFile(percent, []byte("abcdefgh"), 0666), "Could not write file")
+		tarCache, _ = New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Kilobyte), config, &uploader, Config{ControlChars: policy})
+		tarCache.add(filename.System(percent))
+		tarCache.uploadAndDelete("2019/05/01")
+		ioutil.WriteFile(tempdir+"/tarfile.tgz", uploader.contents, 0666)
+		verifyTarfileContents(t, tempdir+"/tarfile.tgz",
+			[]FileInTarfile{{name: want, size: 8}},
+			map[string]string{"MLAB.datatype": "test"})
+	}
+}
+
+func TestAddCompressedFilesAreStoredSeparately(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestAddCompressedFilesAreStoredSeparately")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	rtx.Must(os.MkdirAll(tempdir+"/2019/05/01", 0777), "Could not create dirs")
+	rtx.Must(ioutil.WriteFile(tempdir+"/2019/05/01/data.txt", []byte("abcdefgh"), 0666), "Could not write file")
+	rtx.Must(ioutil.WriteFile(tempdir+"/2019/05/01/data.gz", []byte("abcdefgh"), 0666), "Could not write file")
+
+	config := memoryless.Config{
+		Min:      1 * time.Hour,
+		Expected: 1 * time.Hour,
+		Max:      1 * time.Hour,
+	}
+	uploader := fakeUploader{expectedDir: "2019/05/01"}
+	tarCache, _ := New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Megabyte), config, &uploader, Config{StoredExtensions: []string{".gz", ".zst"}})
+	tarCache.add(filename.System(tempdir + "/2019/05/01/data.txt"))
+	tarCache.add(filename.System(tempdir + "/2019/05/01/data.gz"))
+	if len(tarCache.currentTarfile) != 2 {
+		t.Fatalf("There should be two tarfiles, not %d", len(tarCache.currentTarfile))
+	}
+	tarCache.uploadAndDelete(storedKey("2019/05/01"))
+	ioutil.WriteFile(tempdir+"/stored.tgz", uploader.contents, 0666)
+	verifyTarfileContents(t, tempdir+"/stored.tgz",
+		[]FileInTarfile{{name: "2019/05/01/data.gz", size: 8}},
+		map[string]string{"MLAB.datatype": "test"})
+	tarCache.uploadAndDelete("2019/05/01")
+	ioutil.WriteFile(tempdir+"/compressed.tgz", uploader.contents, 0666)
+	verifyTarfileContents(t, tempdir+"/compressed.tgz",
+		[]FileInTarfile{{name: "2019/05/01/data.txt", size: 8}},
+		map[string]string{"MLAB.datatype": "test"})
+	if len(tarCache.currentTarfile) != 0 {
+		t.Errorf("Both tarfiles should have been uploaded: %v", tarCache.currentTarfile)
+	}
+}
+
+func TestUncompressedAndZipTarfilesAreNotSplit(t *testing.T) {
+	tests := []struct {
+		name   string
+		config tarfile.Config
+	}{
+		{name: "uncompressed", config: tarfile.Config{Uncompressed: true}},
+		{name: "zip", config: tarfile.Config{Format: tarfile.Zip}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestUncompressedAndZipTarfilesAreNotSplit")
+			rtx.Must(err, "Could not create tempdir")
+			defer os.RemoveAll(tempdir)
+			rtx.Must(os.MkdirAll(tempdir+"/2019/05/01", 0777), "Could not create dirs")
+			rtx.Must(ioutil.WriteFile(tempdir+"/2019/05/01/data.txt", []byte("abcdefgh"), 0666), "Could not write file")
+			rtx.Must(ioutil.WriteFile(tempdir+"/2019/05/01/data.gz", []byte("abcdefgh"), 0666), "Could not write file")
+
+			config := memoryless.Config{
+				Min:      1 * time.Hour,
+				Expected: 1 * time.Hour,
+				Max:      1 * time.Hour,
+			}
+			uploader := fakeUploader{expectedDir: "2019/05/01"}
+			tarCache, _ := New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Megabyte), config, &uploader, Config{
+				StoredExtensions: []string{".gz"},
+				Tarfile:          tt.config,
+			})
+			tarCache.add(filename.System(tempdir + "/2019/05/01/data.txt"))
+			tarCache.add(filename.System(tempdir + "/2019/05/01/data.gz"))
+			if tf, ok := tarCache.currentTarfile["2019/05/01"]; len(tarCache.currentTarfile) != 1 || !ok || tf.Count() != 2 {
+				t.Errorf("Both files should be in one tarfile, not %v", tarCache.currentTarfile)
+			}
+		})
+	}
+}
+
+// brokenTarfile is a tarfile that can't be written to.
+type brokenTarfile struct {
+	tarfile.Tarfile
+	files     []filename.System
+	abandoned bool
+}
+
+func (b *brokenTarfile) UploadAndDelete(context.Context, uploader.Uploader) error {
+	return errors.New("the tarfile is broken")
+}
+
+func (b *brokenTarfile) FirstAdded() time.Time {
+	return time.Time{}
+}
+
+func (b *brokenTarfile) Count() int {
+	return len(b.files)
+}
+
+func (b *brokenTarfile) SkippedCount() int {
+	return 0
+}
+
+func (b *brokenTarfile) Size() bytecount.ByteCount {
+	return 0
+}
+
+func (b *brokenTarfile) Abandon() []filename.System {
+	b.abandoned = true
+	return b.files
+}
+
+func (b *brokenTarfile) MissingBytes() bytecount.ByteCount {
+	return 0
+}
+
+func TestBrokenTarfilesAreAbandoned(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestBrokenTarfilesAreAbandoned")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	rtx.Must(os.MkdirAll(tempdir+"/2019/05/01", 0777), "Could not create dirs")
+	for _, name := range []string{"a", "b"} {
+		rtx.Must(ioutil.WriteFile(tempdir+"/2019/05/01/"+name, []byte("abcdefgh"), 0666), "Could not write file")
+	}
+	config := memoryless.Config{
+		Min:      1 * time.Hour,
+		Expected: 1 * time.Hour,
+		Max:      1 * time.Hour,
+	}
+	uploader := fakeUploader{}
+	tarCache, _ := New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Megabyte), config, &uploader, Config{})
+
+	// A failed upload abandons the tarfile and queues its files.
+	broken := &brokenTarfile{files: []filename.System{filename.System(tempdir + "/2019/05/01/a")}}
+	tarCache.currentTarfile["2019/05/01"] = broken
+	tarCache.uploadAndDelete("2019/05/01")
+	if !broken.abandoned || len(tarCache.currentTarfile) != 0 || len(tarCache.pending) != 1 {
+		t.Fatalf("The tarfile should have been abandoned: %v %v %v", broken.abandoned, tarCache.currentTarfile, tarCache.pending)
+	}
+
+	// So does a failure during uploadAll.
+	broken = &brokenTarfile{files: []filename.System{filename.System(tempdir + "/2019/05/01/b")}}
+	tarCache.currentTarfile["2019/05/01"] = broken
+	tarCache.uploadAll()
+	if !broken.abandoned || len(tarCache.currentTarfile) != 0 || len(tarCache.pending) != 2 {
+		t.Fatalf("The tarfile should have been abandoned: %v %v %v", broken.abandoned, tarCache.currentTarfile, tarCache.pending)
+	}
+
+	// The queued files end up in a new, working tarfile.
+	tarCache.addPending()
+	if len(tarCache.pending) != 0 {
+		t.Errorf("Pending files should have been added: %v", tarCache.pending)
+	}
+	tarCache.uploadAndDelete("2019/05/01")
+	ioutil.WriteFile(tempdir+"/tarfile.tgz", uploader.contents, 0666)
+	verifyTarfileContents(t, tempdir+"/tarfile.tgz",
+		[]FileInTarfile{{name: "2019/05/01/a", size: 8}, {name: "2019/05/01/b", size: 8}},
+		map[string]string{"MLAB.datatype": "test"})
+}
+
+// stuckTarfile is a tarfile whose upload never finishes, some of whose files
+// may have been removed from the disk.
+type stuckTarfile struct {
+	brokenTarfile
+	missing bytecount.ByteCount
+}
+
+func (s *stuckTarfile) UploadAndDelete(ctx context.Context, _ uploader.Uploader) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (s *stuckTarfile) MissingBytes() bytecount.ByteCount {
+	return s.missing
+}
+
+// uploadedTarfile is a tarfile whose upload succeeds.
+type uploadedTarfile struct {
+	brokenTarfile
+}
+
+func (u *uploadedTarfile) UploadAndDelete(context.Context, uploader.Uploader) error {
+	return nil
+}
+
+func TestEmergencyDeadline(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestEmergencyDeadline")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	config := memoryless.Config{
+		Min:      1 * time.Hour,
+		Expected: 1 * time.Hour,
+		Max:      1 * time.Hour,
+	}
+	tarCache, _ := New(filename.System(tempdir), "emergency", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Megabyte), config, &fakeUploader{}, Config{EmergencyDeadline: 50 * time.Millisecond})
+	tarCache.currentTarfile["2019/05/01"] = &uploadedTarfile{}
+	tarCache.currentTarfile["2019/05/02"] = &stuckTarfile{}
+	tarCache.currentTarfile["2019/05/03"] = &stuckTarfile{missing: 8}
+
+	start := time.Now()
+	report := tarCache.uploadAll()
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("The emergency upload took %v despite its deadline", took)
+	}
+	want := EmergencyReport{Uploaded: []string{"2019/05/01"}, LeftOnDisk: []string{"2019/05/02"}, Lost: []string{"2019/05/03"}}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("uploadAll() = %+v, want %+v", report, want)
+	}
+	for outcome, want := range map[string]float64{"uploaded": 1, "left_on_disk": 1, "lost": 1} {
+		if got := testutil.ToFloat64(pusherEmergencyUploads.WithLabelValues("emergency", outcome)); got != want {
+			t.Errorf("pusher_emergency_uploads_total{outcome=%q} = %v, want %v", outcome, got, want)
+		}
+	}
+	if len(tarCache.currentTarfile) != 0 {
+		t.Errorf("The tarfiles should all be gone: %v", tarCache.currentTarfile)
+	}
+}
+
+func TestReset(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestReset")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	rtx.Must(os.MkdirAll(tempdir+"/2019/05/01", 0777), "Could not create dirs")
+	rtx.Must(ioutil.WriteFile(tempdir+"/2019/05/01/a", []byte("abcdefgh"), 0666), "Could not write file")
+	config := memoryless.Config{
+		Min:      1 * time.Hour,
+		Expected: 1 * time.Hour,
+		Max:      1 * time.Hour,
+	}
+	uploader := fakeUploader{}
+	tarCache, _ := New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Megabyte), config, &uploader, Config{})
+	// A tarfile that can't be uploaded, so the only way its file can get
+	// uploaded is by being reset into a new tarfile.
+	broken := &brokenTarfile{files: []filename.System{filename.System(tempdir + "/2019/05/01/a")}}
+	tarCache.currentTarfile["2019/05/01"] = broken
+
+	termCtx, termCancel := context.WithCancel(context.Background())
+	defer termCancel()
+	killCtx, killCancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		tarCache.ListenForever(termCtx, killCtx)
+		close(done)
+	}()
+	tarCache.Reset("2019/05/01", "test")
+	// ListenForever can not receive this until it has handled the Reset and
+	// re-added the file.
+	tarCache.ResetAll("test")
+	killCancel()
+	<-done
+
+	if !broken.abandoned {
+		t.Error("The tarfile should have been abandoned")
+	}
+	if uploader.calls != 1 {
+		t.Fatalf("The reset file should have been uploaded once, not %d times", uploader.calls)
+	}
+	ioutil.WriteFile(tempdir+"/tarfile.tgz", uploader.contents, 0666)
+	verifyTarfileContents(t, tempdir+"/tarfile.tgz",
+		[]FileInTarfile{{name: "2019/05/01/a", size: 8}},
+		map[string]string{"MLAB.datatype": "test"})
+}
+
+func TestAddWithMaxFiles(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestAddWithMaxFiles")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	rtx.Must(os.MkdirAll(tempdir+"/2019/05/01", 0777), "Could not create dirs")
+	for _, name := range []string{"a", "b", "c"} {
+		rtx.Must(ioutil.WriteFile(tempdir+"/2019/05/01/"+name, []byte("abcdefgh"), 0666), "Could not write file")
+	}
+	config := memoryless.Config{
+		Min:      1 * time.Hour,
+		Expected: 1 * time.Hour,
+		Max:      1 * time.Hour,
+	}
+	uploader := fakeUploader{}
+	tarCache, _ := New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Megabyte), config, &uploader, Config{MaxFiles: 2})
+	tarCache.add(filename.System(tempdir + "/2019/05/01/a"))
+	if uploader.calls != 0 {
+		t.Fatal("One file should not have triggered an upload")
+	}
+	tarCache.add(filename.System(tempdir + "/2019/05/01/b"))
+	if uploader.calls != 1 {
+		t.Fatal("Two files should have triggered an upload")
+	}
+	ioutil.WriteFile(tempdir+"/tarfile.tgz", uploader.contents, 0666)
+	verifyTarfileContents(t, tempdir+"/tarfile.tgz",
+		[]FileInTarfile{{name: "2019/05/01/a", size: 8}, {name: "2019/05/01/b", size: 8}},
+		map[string]string{"MLAB.datatype": "test"})
+	tarCache.add(filename.System(tempdir + "/2019/05/01/c"))
+	if uploader.calls != 1 || tarCache.currentTarfile["2019/05/01"].Count() != 1 {
+		t.Error("The third file should have started a new tarfile")
+	}
+}
+
+func TestAddAll(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestAddAll")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	rtx.Must(os.MkdirAll(tempdir+"/2019/05/01", 0777), "Could not create dirs")
+	rtx.Must(os.MkdirAll(tempdir+"/2019/05/02", 0777), "Could not create dirs")
+	random := make([]byte, 1000)
+	var batch []filename.System
+	for _, name := range []string{"2019/05/01/a", "2019/05/02/b", "2019/05/01/c", "2019/05/01/d"} {
+		// Random data does not compress, so each file is 1000 bytes in the tarfile.
+		rand.Read(random)
+		rtx.Must(ioutil.WriteFile(tempdir+"/"+name, random, 0666), "Could not write file")
+		batch = append(batch, filename.System(tempdir+"/"+name))
+	}
+	config := memoryless.Config{
+		Min:      1 * time.Hour,
+		Expected: 1 * time.Hour,
+		Max:      1 * time.Hour,
+	}
+
+	// Below the threshold, the files end up in one tarfile per subdir.
+	uploader := fakeUploader{}
+	tarCache, _ := New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Megabyte), config, &uploader, Config{})
+	tarCache.addAll(batch)
+	if uploader.calls != 0 || len(tarCache.currentTarfile) != 2 || tarCache.currentTarfile["2019/05/01"].Count() != 3 {
+		t.Fatalf("The batch should have filled two tarfiles: %d uploads, %v", uploader.calls, tarCache.currentTarfile)
+	}
+
+	// A tarfile which reaches the threshold is uploaded in the middle of the
+	// batch, rather than growing past it.
+	for _, f := range batch {
+		rand.Read(random)
+		rtx.Must(ioutil.WriteFile(string(f), random, 0666), "Could not write file")
+	}
+	uploader = fakeUploader{}
+	tarCache, _ = New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1500), config, &uploader, Config{})
+	tarCache.addAll(batch)
+	if uploader.calls != 1 || tarCache.currentTarfile["2019/05/01"].Count() != 1 || tarCache.currentTarfile["2019/05/02"].Count() != 1 {
+		t.Errorf("The tarfile should have been uploaded after two files: %d uploads, %d and %d files", uploader.calls, tarCache.currentTarfile["2019/05/01"].Count(), tarCache.currentTarfile["2019/05/02"].Count())
+	}
+}
+
+func TestGivingUpOnAnUploadAbandonsTheTarfile(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestGivingUpOnAnUploadAbandonsTheTarfile")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	rtx.Must(os.MkdirAll(tempdir+"/2019/05/01", 0777), "Could not create dirs")
+	rtx.Must(ioutil.WriteFile(tempdir+"/2019/05/01/a", []byte("abcdefgh"), 0666), "Could not write file")
+	config := memoryless.Config{
+		Min:      1 * time.Hour,
+		Expected: 1 * time.Hour,
+		Max:      1 * time.Hour,
+	}
+	uploader := fakeUploader{requestedRetries: 2}
+	tcConfig := Config{
+		Tarfile:  tarfile.Config{MaxUploadAttempts: 2},
+		MaxFiles: 1,
+	}
+	tarCache, _ := New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Megabyte), config, &uploader, tcConfig)
+	tarCache.add(filename.System(tempdir + "/2019/05/01/a"))
+	if uploader.calls != 2 {
+		t.Errorf("The upload should have been tried twice, not %d times", uploader.calls)
+	}
+	if len(tarCache.currentTarfile) != 0 || len(tarCache.pending) != 1 {
+		t.Fatalf("The tarfile should have been abandoned and its file queued: %v, %v", tarCache.currentTarfile, tarCache.pending)
+	}
+	if _, err := os.Stat(tempdir + "/2019/05/01/a"); err != nil {
+		t.Error("A file that was not uploaded should not be deleted")
+	}
+	// The next time around, the upload succeeds.
+	tarCache.addPending()
+	if uploader.calls != 3 {
+		t.Errorf("The file should have been uploaded again, but there were %d calls", uploader.calls)
+	}
+	if _, err := os.Stat(tempdir + "/2019/05/01/a"); !os.IsNotExist(err) {
+		t.Error("The uploaded file should have been deleted")
+	}
+}
+
+func TestOldestTarfilesAreUploadedFirst(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestOldestTarfilesAreUploadedFirst")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	config := memoryless.Config{
+		Min:      1 * time.Hour,
+		Expected: 1 * time.Hour,
+		Max:      1 * time.Hour,
+	}
+	uploader := fakeUploader{}
+	tarCache, _ := New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Megabyte), config, &uploader, Config{})
+	// Oldest first.
+	subdirs := []string{"2019/05/02", "2019/05/03", "2019/05/01"}
+	for _, subdir := range subdirs {
+		rtx.Must(os.MkdirAll(tempdir+"/"+subdir, 0777), "Could not create dirs")
+		rtx.Must(ioutil.WriteFile(tempdir+"/"+subdir+"/data", []byte("abcdefgh"), 0666), "Could not write file")
+		tarCache.add(filename.System(tempdir + "/" + subdir + "/data"))
+		time.Sleep(time.Millisecond)
+	}
+
+	keys := []string{"2019/05/01", "2019/05/03", "2019/05/02"}
+	tarCache.oldestFirst(keys)
+	if !reflect.DeepEqual(keys, subdirs) {
+		t.Errorf("oldestFirst sorted to %v, not %v", keys, subdirs)
+	}
+
+	// Timeouts that arrive in the wrong order are uploaded in the right one.
+	for i := len(subdirs) - 1; i >= 0; i-- {
+		tarCache.enqueue(timeout{key: subdirs[i], tf: tarCache.currentTarfile[subdirs[i]]})
+	}
+	// A stale timeout for a tarfile that is gone should be ignored, even
+	// though it sorts first.
+	stale := &brokenTarfile{}
+	tarCache.enqueue(timeout{key: "2019/05/04", tf: stale})
+	for tarCache.due.Len() > 0 {
+		tarCache.uploadOldest()
+	}
+	if !reflect.DeepEqual(uploader.dirs, subdirs) {
+		t.Errorf("Uploaded in the order %v, not %v", uploader.dirs, subdirs)
+	}
+}
+
+func TestRecentFiles(t *testing.T) {
+	v1 := fileVersion{modTime: time.Unix(1, 0), size: 1}
+	v2 := fileVersion{modTime: time.Unix(2, 0), size: 1}
+	r := newRecentFiles(2)
+	r.add("a", v1)
+	r.add("b", v1)
+	if !r.contains("a", v1) || !r.contains("b", v1) {
+		t.Error("Both files should be remembered")
+	}
+	if r.contains("a", v2) {
+		t.Error("A changed file should not be remembered")
+	}
+	r.add("a", v2) // Now a is more recent than b.
+	r.add("c", v1)
+	if r.contains("b", v1) || !r.contains("a", v2) || !r.contains("c", v1) {
+		t.Error("The least recently added file should have been forgotten")
+	}
+	r.remove("a")
+	if r.contains("a", v2) {
+		t.Error("a should have been forgotten")
+	}
+
+	// A nil recentFiles remembers nothing.
+	var none *recentFiles
+	if newRecentFiles(0) != nil {
+		t.Error("A zero capacity should produce nil")
+	}
+	none.add("a", v1)
+	none.remove("a")
+	if none.contains("a", v1) {
+		t.Error("nil should remember nothing")
+	}
+}
+
+func TestDuplicatesAreSuppressed(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestDuplicatesAreSuppressed")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	rtx.Must(os.MkdirAll(tempdir+"/2019/05/01", 0777), "Could not create dirs")
+	name := filename.System(tempdir + "/2019/05/01/a")
+	rtx.Must(ioutil.WriteFile(string(name), []byte("abcdefgh"), 0666), "Could not write file")
+	config := memoryless.Config{
+		Min:      1 * time.Hour,
+		Expected: 1 * time.Hour,
+		Max:      1 * time.Hour,
+	}
+	uploader := fakeUploader{}
+	tarCache, _ := New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Megabyte), config, &uploader, Config{RecentFiles: 10})
+	tarCache.add(name)
+	info, err := os.Stat(string(name))
+	rtx.Must(err, "Could not stat")
+	if !tarCache.recent.contains(name, versionOf(info)) {
+		t.Fatal("The added file should be remembered")
+	}
+	tarCache.add(name)
+	if tarCache.currentTarfile["2019/05/01"].Count() != 1 {
+		t.Error("The file should be in the tarfile once")
+	}
+	// Abandoned files must be added again, not suppressed.
+	tarCache.abandon("2019/05/01", "test")
+	if tarCache.recent.contains(name, versionOf(info)) {
+		t.Fatal("An abandoned file should be forgotten")
+	}
+	tarCache.addPending()
+	if tf, ok := tarCache.currentTarfile["2019/05/01"]; !ok || tf.Count() != 1 {
+		t.Error("The abandoned file should have been added again")
+	}
+}
+
+// undeletableTarfile is a tarfile whose files can't be deleted after upload.
+type undeletableTarfile struct {
+	tarfile.Tarfile
+	files []filename.System
+}
+
+func (u *undeletableTarfile) UploadAndDelete(context.Context, uploader.Uploader) error {
+	return nil
+}
+
+func (u *undeletableTarfile) Size() bytecount.ByteCount {
+	return 0
+}
+
+func (u *undeletableTarfile) Undeletable() []filename.System {
+	return u.files
+}
+
+func (u *undeletableTarfile) Uploaded() uploader.Result {
+	return uploader.Result{Destination: "gs://bucket/2019/05/01/a.tgz"}
+}
+
+func TestUndeletableFiles(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestUndeletableFiles")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	rtx.Must(os.MkdirAll(tempdir+"/2019/05/01", 0777), "Could not create dirs")
+	a := filename.System(tempdir + "/2019/05/01/a")
+	rtx.Must(ioutil.WriteFile(string(a), []byte("abcdefgh"), 0666), "Could not write file")
+	config := memoryless.Config{
+		Min:      1 * time.Hour,
+		Expected: 1 * time.Hour,
+		Max:      1 * time.Hour,
+	}
+	uploader := fakeUploader{}
+	tarCache, _ := New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Megabyte), config, &uploader, Config{UndeletableCooldown: time.Hour})
+	tarCache.currentTarfile["2019/05/01"] = &undeletableTarfile{files: []filename.System{a}}
+	tarCache.uploadAndDelete("2019/05/01")
+	if tarCache.undeletable.len() != 0 {
+		t.Error("A single failure to delete a file should not start its cool-down")
+	}
+	// The file is uploaded again, and still can't be deleted.
+	tarCache.add(a)
+	if tf, ok := tarCache.currentTarfile["2019/05/01"]; !ok || tf.Count() != 1 {
+		t.Fatal("A file that could not be deleted once should be added again")
+	}
+	tarCache.currentTarfile["2019/05/01"] = &undeletableTarfile{files: []filename.System{a}}
+	tarCache.uploadAndDelete("2019/05/01")
+	if f := tarCache.undeletable.entries[a]; f.object != "gs://bucket/2019/05/01/a.tgz" {
+		t.Errorf("The undeletable file should be recorded with its object, not %q", f.object)
+	}
+	if got := testutil.ToFloat64(pusherUndeletableFiles.WithLabelValues("test")); got != 1 {
+		t.Errorf("There should be 1 undeletable file, not %v", got)
+	}
+
+	// The file is still there, but it was just uploaded.
+	tarCache.add(a)
+	if len(tarCache.currentTarfile) != 0 {
+		t.Fatal("An undeletable file should not be added again during its cool-down")
+	}
+	// Once it changes, it is new data.
+	rtx.Must(ioutil.WriteFile(string(a), []byte("abcdefghijkl"), 0666), "Could not write file")
+	tarCache.add(a)
+	if tf, ok := tarCache.currentTarfile["2019/05/01"]; !ok || tf.Count() != 1 {
+		t.Error("A changed file should be added again")
+	}
+	if got := testutil.ToFloat64(pusherUndeletableFiles.WithLabelValues("test")); got != 0 {
+		t.Errorf("A forgotten file should no longer be counted as undeletable, not %v", got)
+	}
+}
+
+func TestUndeletableFilesCooldown(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestUndeletableFilesCooldown")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	a := filename.System(tempdir + "/a")
+	rtx.Must(ioutil.WriteFile(string(a), []byte("abcdefgh"), 0666), "Could not write file")
+	info, err := os.Stat(string(a))
+	rtx.Must(err, "Could not stat file")
+
+	now := time.Now()
+	u, err := newUndeletableFiles(time.Minute, "")
+	rtx.Must(err, "Could not create undeletableFiles")
+	missing := filename.System(tempdir + "/does-not-exist")
+	u.add([]filename.System{a, missing}, "", now)
+	if u.len() != 0 {
+		t.Error("A single failure should not start the cool-down")
+	}
+	u.add([]filename.System{a, missing}, "", now)
+	if u.len() != 1 {
+		t.Errorf("Only files that exist should be remembered, not %d", u.len())
+	}
+	if !u.cooling(a, versionOf(info), now.Add(30*time.Second)) {
+		t.Error("The file should still be cooling down")
+	}
+	if u.cooling(a, versionOf(info), now.Add(2*time.Minute)) || u.len() != 0 {
+		t.Error("The file should have been forgotten after its cool-down")
+	}
+
+	// Failures in a row are only counted for the same version of the file.
+	u.add([]filename.System{a}, "", now)
+	rtx.Must(ioutil.WriteFile(string(a), []byte("abcdefghijkl"), 0666), "Could not write file")
+	u.add([]filename.System{a}, "", now)
+	if u.len() != 0 {
+		t.Error("A changed file should start counting its failures again")
+	}
+	// And they are forgotten once they are too old.
+	rtx.Must(u.expire(now.Add(2*time.Minute)), "Could not expire")
+	u.add([]filename.System{a}, "", now.Add(2*time.Minute))
+	if u.len() != 0 {
+		t.Error("An old failure should not count")
+	}
+	u.add([]filename.System{a}, "", now.Add(2*time.Minute))
+	if u.len() != 1 {
+		t.Error("Failures in a row should start the cool-down")
+	}
+	rtx.Must(u.expire(now.Add(4*time.Minute)), "Could not expire")
+	if u.len() != 0 {
+		t.Error("Expired files should be forgotten")
+	}
+	disabled, err := newUndeletableFiles(0, "")
+	rtx.Must(err, "Could not create undeletableFiles")
+	disabled.add([]filename.System{a}, "", now)
+	disabled.add([]filename.System{a}, "", now)
+	if disabled.cooling(a, versionOf(info), now) {
+		t.Error("A disabled undeletableFiles should remember nothing")
+	}
+}
+
+func TestUndeletableFilesLedger(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestUndeletableFilesLedger")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	a := filename.System(tempdir + "/a")
+	rtx.Must(ioutil.WriteFile(string(a), []byte("abcdefgh"), 0666), "Could not write file")
+	info, err := os.Stat(string(a))
+	rtx.Must(err, "Could not stat file")
+	ledger := tempdir + "/ledger.json"
+
+	u, err := newUndeletableFiles(time.Hour, ledger)
+	if err != nil || u.len() != 0 {
+		t.Fatalf("A missing ledger should be an empty one (error: %v)", err)
+	}
+	u.add([]filename.System{a}, "gs://bucket/a.tgz", time.Now())
+	u.add([]filename.System{a}, "gs://bucket/a.tgz", time.Now())
+	rtx.Must(u.expire(time.Now()), "Could not save the ledger")
+
+	// After a restart, the file is still cooling down.
+	restarted, err := newUndeletableFiles(time.Hour, ledger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.cooling(a, versionOf(info), time.Now()) {
+		t.Error("The ledger should have kept the file cooling down across the restart")
+	}
+	if f := restarted.entries[a]; f.object != "gs://bucket/a.tgz" {
+		t.Errorf("The ledger should have kept the file's object, not %q", f.object)
+	}
+
+	// A file that changed is forgotten, and so is saved to the ledger.
+	rtx.Must(ioutil.WriteFile(string(a), []byte("abcdefghijkl"), 0666), "Could not write file")
+	changed, err := os.Stat(string(a))
+	rtx.Must(err, "Could not stat file")
+	if restarted.cooling(a, versionOf(changed), time.Now()) {
+		t.Error("A changed file should not be cooling down")
+	}
+	rtx.Must(restarted.expire(time.Now()), "Could not save the ledger")
+	if forgotten, err := newUndeletableFiles(time.Hour, ledger); err != nil || forgotten.len() != 0 {
+		t.Errorf("A forgotten file should not be in the ledger (error: %v)", err)
+	}
+
+	// Expiry is saved to the ledger.
+	u.add([]filename.System{a}, "gs://bucket/a.tgz", time.Now())
+	u.add([]filename.System{a}, "gs://bucket/a.tgz", time.Now())
+	rtx.Must(u.expire(time.Now()), "Could not save the ledger")
+	rtx.Must(u.expire(time.Now().Add(2*time.Hour)), "Could not save the ledger")
+	if expired, err := newUndeletableFiles(time.Hour, ledger); err != nil || expired.len() != 0 {
+		t.Errorf("Expired entries should not be loaded (error: %v)", err)
+	}
+
+	// A corrupt ledger is an error, but still gives a usable, empty result.
+	rtx.Must(ioutil.WriteFile(ledger, []byte("not json"), 0666), "Could not write file")
+	if corrupt, err := newUndeletableFiles(time.Hour, ledger); err == nil || corrupt == nil || corrupt.len() != 0 {
+		t.Error("A corrupt ledger should be an error and be ignored")
+	}
+}
+
+func TestTarfileMetadata(t *testing.T) {
+	metadata := flagx.KeyValue{}
+	rtx.Must(metadata.Set("MLAB.pusher.hostname=override,extra=1"), "Could not set metadata")
+	config := memoryless.Config{
+		Min:      1 * time.Hour,
+		Expected: 1 * time.Hour,
+		Max:      1 * time.Hour,
+	}
+	tarCache, _ := New("/tmp", "test", 1, &metadata, bytecount.ByteCount(1*bytecount.Megabyte), config, &fakeUploader{}, Config{
+		Metadata: map[string]string{"MLAB.pusher.hostname": "host", "MLAB.pusher.version": "v1"},
+	})
+	got := tarCache.tarfileMetadata("2026/10/16")
+	want := map[string]string{"MLAB.pusher.hostname": "override", "MLAB.pusher.version": "v1", "extra": "1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tarfileMetadata() = %v, want %v", got, want)
+	}
+	got["MLAB.datatype"] = "test"
+	if _, ok := tarCache.tarfileMetadata("2026/10/16")["MLAB.datatype"]; ok {
+		t.Error("Each tarfile should get its own copy of the metadata")
+	}
+}
+
+func TestTarfileMetadataTemplates(t *testing.T) {
+	metadata := flagx.KeyValue{}
+	rtx.Must(metadata.Set("where={{.Hostname}}/{{.Datatype}}/{{.Subdir}}"), "Could not set metadata")
+	rtx.Must(metadata.Set("bad={{.Hostname 1}}"), "Could not set metadata")
+	config := memoryless.Config{
+		Min:      1 * time.Hour,
+		Expected: 1 * time.Hour,
+		Max:      1 * time.Hour,
+	}
+	tarCache, _ := New("/tmp", "test", 1, &metadata, bytecount.ByteCount(1*bytecount.Megabyte), config, &fakeUploader{}, Config{
+		Metadata: map[string]string{"started": "{{.StartTime}}", "plain": "{{not a template"},
+	})
+	tarCache.hostname = "mlab1"
+	before := time.Now().Add(-time.Second)
+	got := tarCache.tarfileMetadata("2026/10/16")
+	if got["where"] != "mlab1/test/2026/10/16" {
+		t.Errorf("where = %q, want %q", got["where"], "mlab1/test/2026/10/16")
+	}
+	if started, err := time.Parse(time.RFC3339, got["started"]); err != nil || started.Before(before) {
+		t.Errorf("started = %q is not the start time of the tarfile (%v)", got["started"], err)
+	}
+	// Templates which can't be expanded are left as they are.
+	if got["bad"] != "{{.Hostname 1}}" || got["plain"] != "{{not a template" {
+		t.Errorf("Bad templates were changed: %v", got)
+	}
+}
+
+func TestCheckMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{name: "plain", value: "v1"},
+		{name: "template", value: "{{.Hostname}}-{{.StartTime}}"},
+		{name: "unparseable", value: "{{.Hostname", wantErr: true},
+		{name: "unknown-field", value: "{{.UploadTime}}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckMetadata(map[string]string{"key": tt.value}); (err != nil) != tt.wantErr {
+				t.Errorf("CheckMetadata() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	at := func(hhmm string) time.Time {
+		tm, err := time.Parse("15:04", hhmm)
+		rtx.Must(err, "Bad time")
+		return time.Date(2019, 5, 1, tm.Hour(), tm.Minute(), 0, 0, time.UTC)
+	}
+	window := func(s string) Window {
+		w, err := ParseWindow(s)
+		rtx.Must(err, "Bad window")
+		return w
+	}
+	tests := []struct {
+		name     string
+		schedule Schedule
+		time     string
+		want     bool
+	}{
+		{name: "zero", schedule: Schedule{}, time: "12:00", want: true},
+		{name: "in-window", schedule: Schedule{Windows: []Window{window("01:00-05:00")}}, time: "01:00", want: true},
+		{name: "after-window", schedule: Schedule{Windows: []Window{window("01:00-05:00")}}, time: "05:00", want: false},
+		{name: "window-past-midnight", schedule: Schedule{Windows: []Window{window("22:00-06:00")}}, time: "23:30", want: true},
+		{name: "window-after-midnight", schedule: Schedule{Windows: []Window{window("22:00-06:00")}}, time: "03:00", want: true},
+		{name: "outside-midnight-window", schedule: Schedule{Windows: []Window{window("22:00-06:00")}}, time: "12:00", want: false},
+		{name: "second-window", schedule: Schedule{Windows: []Window{window("01:00-02:00"), window("13:00-14:00")}}, time: "13:30", want: true},
+		{name: "blackout", schedule: Schedule{Blackouts: []Window{window("09:00-17:00")}}, time: "12:00", want: false},
+		{name: "outside-blackout", schedule: Schedule{Blackouts: []Window{window("09:00-17:00")}}, time: "17:00", want: true},
+		{name: "blackout-in-window", schedule: Schedule{Windows: []Window{window("00:00-12:00")}, Blackouts: []Window{window("06:00-07:00")}}, time: "06:30", want: false},
+		{name: "time-zone", schedule: Schedule{Windows: []Window{window("01:00-02:00")}, Location: time.FixedZone("UTC+10", 10*60*60)}, time: "15:30", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.schedule.Allows(at(tt.time)); got != tt.want {
+				t.Errorf("Allows(%s) = %v, want %v", tt.time, got, tt.want)
+			}
+		})
+	}
+	for _, bad := range []string{"", "01:00", "01:00-02:00-03:00", "1am-2am", "25:00-01:00"} {
+		if _, err := ParseWindow(bad); err == nil {
+			t.Errorf("ParseWindow(%q) should have failed", bad)
+		}
+	}
+}
+
+func TestFilesAreDeferredDuringABlackout(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestFilesAreDeferredDuringABlackout")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	rtx.Must(os.MkdirAll(tempdir+"/2019/05/01", 0777), "Could not create dirs")
+	var batch []filename.System
+	for _, name := range []string{"b", "a"} {
+		rtx.Must(ioutil.WriteFile(tempdir+"/2019/05/01/"+name, []byte(name), 0666), "Could not write file")
+		batch = append(batch, filename.System(tempdir+"/2019/05/01/"+name))
+	}
+	config := memoryless.Config{
+		Min:      1 * time.Hour,
+		Expected: 1 * time.Hour,
+		Max:      1 * time.Hour,
+	}
+	uploader := fakeUploader{}
+	allDay := Schedule{Blackouts: []Window{{Start: 0, End: 24 * time.Hour}}}
+	tarCache, _ := New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Megabyte), config, &uploader, Config{Schedule: allDay})
+
+	// The files are left on disk, and only their names are kept.
+	tarCache.addAll(batch)
+	tarCache.add(batch[0])
+	if len(tarCache.currentTarfile) != 0 || len(tarCache.deferred) != 2 || !tarCache.blackout {
+		t.Fatalf("The files should have been deferred: %v, %v", tarCache.currentTarfile, tarCache.deferred)
+	}
+
+	// Once uploads are allowed, the files are added in order.
+	tarCache.config.Schedule = Schedule{}
+	if tarCache.checkSchedule() {
+		t.Error("Uploads should be allowed")
+	}
+	if len(tarCache.deferred) != 0 || len(tarCache.pending) != 2 || tarCache.pending[0] != batch[1] {
+		t.Fatalf("The deferred files should be pending, in order: %v", tarCache.pending)
+	}
+	tarCache.addPending()
+	if tarCache.currentTarfile["2019/05/01"].Count() != 2 {
+		t.Errorf("The deferred files were not added: %v", tarCache.currentTarfile)
+	}
+}
+
+func TestEffectiveAge(t *testing.T) {
+	age := memoryless.Config{Min: 10 * time.Minute, Expected: time.Hour, Max: 2 * time.Hour}
+	now := time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		adaptive bool
+		bytes    int64 // Arriving every second for an hour.
+		want     memoryless.Config
+	}{
+		{name: "not-adaptive", bytes: 0, want: age},
+		{name: "nothing-arrives", adaptive: true, bytes: 0, want: memoryless.Config{Min: age.Min, Expected: age.Min, Max: age.Min}},
+		{name: "fills-in-time", adaptive: true, bytes: 1000, want: age},
+		// 250 bytes a second fills 7200000 bytes in 8 hours, 4 times slower
+		// than the 2 hours needed.
+		{name: "slow", adaptive: true, bytes: 250, want: memoryless.Config{Min: age.Min, Expected: 15 * time.Minute, Max: 30 * time.Minute}},
+		{name: "slower", adaptive: true, bytes: 10, want: memoryless.Config{Min: age.Min, Expected: age.Min, Max: age.Min}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tarCache, _ := New("/tmp", "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(7200000), age, &fakeUploader{}, Config{AdaptiveAge: tt.adaptive})
+			// Arrivals are recorded over a long time so that the estimate
+			// settles at the steady rate.
+			for i := 0; i < 24*3600; i++ {
+				tarCache.arrivals.add(tt.bytes, now.Add(time.Duration(i)*time.Second))
+			}
+			got := tarCache.effectiveAge(now.Add(24 * time.Hour))
+			if got.Min != tt.want.Min || got.Expected.Round(time.Minute) != tt.want.Expected || got.Max.Round(time.Minute) != tt.want.Max {
+				t.Errorf("effectiveAge() = %+v, want %+v", got, tt.want)
+			}
+			if got.Check() != nil {
+				t.Errorf("effectiveAge() = %+v is not a valid config", got)
+			}
+		})
+	}
+}
+
+func TestEmergencyLimiter(t *testing.T) {
+	l := NewEmergencyLimiter(2, 1)
+	ctx := context.Background()
+	if !l.acquire(ctx, false) {
+		t.Fatal("The first upload should start")
+	}
+	// The other upload is reserved for priority datatypes.
+	started := make(chan string, 3)
+	waitFor := func(q, n int) {
+		for {
+			l.mu.Lock()
+			waiting := len(l.waiting[q])
+			l.mu.Unlock()
+			if waiting == n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	go func() {
+		l.acquire(ctx, false)
+		started <- "normal"
+	}()
+	waitFor(normalQueue, 1)
+	if !l.acquire(ctx, true) {
+		t.Fatal("A priority upload should use the reserved upload")
+	}
+	go func() {
+		l.acquire(ctx, true)
+		started <- "priority"
+	}()
+	waitFor(priorityQueue, 1)
+
+	// A waiting priority upload goes first, and the other upload then has to
+	// wait for both a free upload and one that is not reserved.
+	l.release()
+	if s := <-started; s != "priority" {
+		t.Errorf("The %s upload started first", s)
+	}
+	l.release()
+	select {
+	case s := <-started:
+		t.Errorf("The %s upload started while only the reserved upload was free", s)
+	case <-time.After(10 * time.Millisecond):
+	}
+	l.release()
+	if s := <-started; s != "normal" {
+		t.Errorf("The %s upload started last", s)
+	}
+
+	// An upload which is canceled while waiting gives up its place.
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if l.acquire(canceled, false) {
+		t.Error("The canceled upload should not have started")
+	}
+	if len(l.waiting[normalQueue]) != 0 || l.inUse != 1 {
+		t.Errorf("The canceled upload was not forgotten: %d waiting, %d in use", len(l.waiting[normalQueue]), l.inUse)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestProgress")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	rtx.Must(os.MkdirAll(tempdir+"/2019/05/01", 0777), "Could not create dirs")
+	rtx.Must(os.MkdirAll(tempdir+"/2019/05/02", 0777), "Could not create dirs")
+	var batch []filename.System
+	for _, name := range []string{"2019/05/01/a", "2019/05/01/b", "2019/05/02/c", "2019/05/01/d", "2019/05/01/e", "2019/05/01/f"} {
+		rtx.Must(ioutil.WriteFile(tempdir+"/"+name, []byte(name), 0666), "Could not write file")
+		batch = append(batch, filename.System(tempdir+"/"+name))
+	}
+	config := memoryless.Config{
+		Min:      1 * time.Hour,
+		Expected: 1 * time.Hour,
+		Max:      1 * time.Hour,
+	}
+	tarCache, _ := New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Megabyte), config, &fakeUploader{}, Config{ProgressFiles: 2})
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	tarCache.addAll(batch)
+
+	// The large subdir is logged when it is first seen, every two members,
+	// and when it is done. The small one is not logged at all.
+	var lines []string
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if i := strings.Index(line, "Archive progress: "); i >= 0 {
+			lines = append(lines, line[i:])
+		}
+	}
+	want := []string{
+		"Archive progress: datatype=test subdir=2019/05/01 members=1 pending=4",
+		"Archive progress: datatype=test subdir=2019/05/01 members=3 pending=2",
+		"Archive progress: datatype=test subdir=2019/05/01 members=5 pending=0",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("Logged %q, want %q", lines, want)
+	}
+	if len(tarCache.progress.waiting) != 0 || len(tarCache.progress.logged) != 0 {
+		t.Errorf("Progress should be forgotten once nothing is waiting: %v %v", tarCache.progress.waiting, tarCache.progress.logged)
+	}
+}
+
+func TestFilesOutsideTheRootAreRefused(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestFilesOutsideTheRootAreRefused")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	rtx.Must(os.MkdirAll(tempdir+"/root/2019/05/01", 0777), "Could not create dirs")
+	rtx.Must(ioutil.WriteFile(tempdir+"/secret", []byte("secret"), 0666), "Could not write file")
+	rtx.Must(os.Symlink(tempdir+"/secret", tempdir+"/root/2019/05/01/link"), "Could not create link")
+	config := memoryless.Config{
+		Min:      1 * time.Hour,
+		Expected: 1 * time.Hour,
+		Max:      1 * time.Hour,
+	}
+	root := filename.System(tempdir + "/root")
+
+	// Neither a followed link nor .. may reach outside the root.
+	tarCache, _ := New(root, "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Megabyte), config, &fakeUploader{}, Config{})
+	tarCache.add(root + "/2019/05/01/link")
+	tarCache.add(root + "/2019/05/01/../../../../secret")
+	if len(tarCache.currentTarfile) != 0 {
+		t.Errorf("No file should have been added: %v", tarCache.currentTarfile)
+	}
+
+	// A link archived as a link is inside the root.
+	tarCache, _ = New(root, "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Megabyte), config, &fakeUploader{}, Config{Symlinks: filename.SymlinksArchiveAsLink})
+	tarCache.add(root + "/2019/05/01/link")
+	if tf, ok := tarCache.currentTarfile["2019/05/01"]; !ok || tf.Count() != 1 {
+		t.Errorf("The link should have been added: %v", tarCache.currentTarfile)
+	}
+	if _, err := os.Stat(tempdir + "/secret"); err != nil {
+		t.Errorf("The file outside the root should be untouched: %v", err)
+	}
+}
+
+func TestRefusedFiles(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestRefusedFiles")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	rtx.Must(os.MkdirAll(tempdir+"/root/2019/05/01", 0777), "Could not create dirs")
+	rtx.Must(ioutil.WriteFile(tempdir+"/secret", []byte("secret"), 0666), "Could not write file")
+	rtx.Must(os.Symlink(tempdir+"/secret", tempdir+"/root/2019/05/01/link"), "Could not create link")
+	config := memoryless.Config{
+		Min:      1 * time.Hour,
+		Expected: 1 * time.Hour,
+		Max:      1 * time.Hour,
+	}
+	root := filename.System(tempdir + "/root")
+	link := root + "/2019/05/01/link"
+
+	tarCache, _ := New(root, "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Megabyte), config, &fakeUploader{}, Config{ReportRefusedAfter: 3})
+	for i := 1; i <= 4; i++ {
+		tarCache.add(link)
+		if tarCache.refused.counts[link] != i {
+			t.Errorf("The link was refused %d times, not %d", tarCache.refused.counts[link], i)
+		}
+		if want := map[bool]int{false: 0, true: 1}[i >= 3]; tarCache.refused.reported != want {
+			t.Errorf("After %d refusals, %d files were reported instead of %d", i, tarCache.refused.reported, want)
+		}
+	}
+
+	// A file that no longer exists is forgotten by a sweep.
+	rtx.Must(os.Remove(string(link)), "Could not remove the link")
+	tarCache.refused.sweep()
+	if len(tarCache.refused.counts) != 0 || tarCache.refused.reported != 0 {
+		t.Errorf("The removed link was not forgotten: %v", tarCache.refused.counts)
+	}
+
+	// A file is counted until it is uploaded, not just added: when it is
+	// found again while it waits in its tarfile, and when it is put back by
+	// an abandoned tarfile.
+	rtx.Must(ioutil.WriteFile(string(link), []byte("data"), 0666), "Could not write file")
+	tarCache.add(link)
+	tarCache.add(link)
+	if tarCache.refused.counts[link] != 1 {
+		t.Errorf("The file found again was counted %d times, not 1", tarCache.refused.counts[link])
+	}
+	tarCache.abandon("2019/05/01", "test")
+	if tarCache.refused.counts[link] != 2 {
+		t.Errorf("The file of the abandoned tarfile was counted %d times, not 2", tarCache.refused.counts[link])
+	}
+	tarCache.addPending()
+	tarCache.uploadAndDelete("2019/05/01")
+	if len(tarCache.refused.counts) != 0 {
+		t.Errorf("The uploaded file was not forgotten: %v", tarCache.refused.counts)
+	}
+}
+
+func TestYoungFilesAreCounted(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestYoungFilesAreCounted")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	config := memoryless.Config{Expected: time.Hour, Max: time.Hour}
+	tarCache, _ := New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Megabyte), config, &fakeUploader{}, Config{ReportRefusedAfter: 2})
+	log := filename.System(tempdir + "/2019/05/01/log")
+	tarCache.countYoung([]filename.System{log})
+	tarCache.countYoung([]filename.System{log})
+	if tarCache.refused.counts[log] != 2 || tarCache.refused.reported != 1 {
+		t.Errorf("The young file was counted %d times and %d files reported, not 2 and 1", tarCache.refused.counts[log], tarCache.refused.reported)
+	}
+}
+
+func TestFileLikeDirectories(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestFileLikeDirectories")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	root := filename.System(tempdir)
+	rtx.Must(os.MkdirAll(tempdir+"/2019/05/01/trace.json", 0777), "Could not create dirs")
+	rtx.Must(ioutil.WriteFile(tempdir+"/2019/05/01/trace.json/data", []byte("data"), 0666), "Could not write file")
+	config := memoryless.Config{
+		Min:      1 * time.Hour,
+		Expected: 1 * time.Hour,
+		Max:      1 * time.Hour,
+	}
+	for _, tt := range []struct {
+		policy filename.DirectoryPolicy
+		fname  filename.System
+		added  bool
+	}{
+		{policy: "", fname: root + "/2019/05/01/trace.json/data", added: true},
+		{policy: filename.DirectoriesIgnore, fname: root + "/2019/05/01/trace.json/data", added: true},
+		{policy: filename.DirectoriesWarn, fname: root + "/2019/05/01/trace.json/data", added: true},
+		{policy: filename.DirectoriesQuarantine, fname: root + "/2019/05/01/trace.json/data", added: false},
+		{policy: filename.DirectoriesIgnore, fname: root + "/2019/05/01/trace.json", added: false},
+		{policy: filename.DirectoriesWarn, fname: root + "/2019/05/01/trace.json", added: false},
+	} {
+		t.Run(string(tt.policy)+" "+string(tt.fname), func(t *testing.T) {
+			tarCache, _ := New(root, "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Megabyte), config, &fakeUploader{}, Config{Directories: tt.policy})
+			tarCache.add(tt.fname)
+			added := 0
+			for _, tf := range tarCache.currentTarfile {
+				added += tf.Count()
+			}
+			if (added == 1) != tt.added {
+				t.Errorf("%d files were added, but added should be %v", added, tt.added)
+			}
+		})
+	}
+}
+
+func TestSubdirDepth(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestSubdirDepth")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	root := filename.System(tempdir)
+	for _, run := range []string{"run1", "run2"} {
+		rtx.Must(os.MkdirAll(tempdir+"/2019/05/01/05/"+run, 0777), "Could not create dirs")
+		rtx.Must(ioutil.WriteFile(tempdir+"/2019/05/01/05/"+run+"/data", []byte("data"), 0666), "Could not write file")
+	}
+	config := memoryless.Config{
+		Min:      1 * time.Hour,
+		Expected: 1 * time.Hour,
+		Max:      1 * time.Hour,
+	}
+	for _, tt := range []struct {
+		depth   int
+		subdirs []string
+	}{
+		{depth: 0, subdirs: []string{"2019/05/01"}},
+		{depth: 4, subdirs: []string{"2019/05/01/05"}},
+		{depth: 5, subdirs: []string{"2019/05/01/05/run1", "2019/05/01/05/run2"}},
+		{depth: -1, subdirs: []string{"2019/05/01/05/run1", "2019/05/01/05/run2"}},
+	} {
+		tarCache, _ := New(root, "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Megabyte), config, &fakeUploader{}, Config{SubdirDepth: tt.depth})
+		tarCache.add(root + "/2019/05/01/05/run1/data")
+		tarCache.add(root + "/2019/05/01/05/run2/data")
+		subdirs := []string{}
+		for subdir := range tarCache.currentTarfile {
+			subdirs = append(subdirs, subdir)
+		}
+		sort.Strings(subdirs)
+		if !reflect.DeepEqual(subdirs, tt.subdirs) {
+			t.Errorf("At depth %d, the tarfiles were %v, not %v", tt.depth, subdirs, tt.subdirs)
+		}
+	}
+}
+
+func TestBoundary(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestBoundary")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	root := filename.System(tempdir)
+	rtx.Must(os.MkdirAll(tempdir+"/2019/05/01", 0777), "Could not create dirs")
+	for _, f := range []string{"a", "b", "c"} {
+		rtx.Must(ioutil.WriteFile(tempdir+"/2019/05/01/"+f, []byte("data"), 0666), "Could not write file")
+	}
+	config := memoryless.Config{
+		Min:      1 * time.Hour,
+		Expected: 1 * time.Hour,
+		Max:      1 * time.Hour,
+	}
+	boundary := 200 * time.Millisecond
+	untilBoundary := func() time.Duration {
+		now := time.Now()
+		return now.UTC().Truncate(boundary).Add(boundary).Sub(now)
+	}
+	up := &fakeUploader{}
+	tarCache, _ := New(root, "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Megabyte), config, up, Config{Boundary: boundary})
+
+	// Leave time for two files to be added before the boundary.
+	if untilBoundary() < boundary/2 {
+		time.Sleep(untilBoundary())
+	}
+	tarCache.add(root + "/2019/05/01/a")
+	tarCache.add(root + "/2019/05/01/b")
+	tarCache.rotate()
+	if up.calls != 0 {
+		t.Errorf("A tarfile was uploaded before the boundary")
+	}
+
+	// A file which arrives after the boundary goes in a new tarfile.
+	time.Sleep(untilBoundary())
+	tarCache.add(root + "/2019/05/01/c")
+	if up.calls != 1 {
+		t.Fatalf("The tarfile was uploaded %d times, not once, when a file arrived after the boundary", up.calls)
+	}
+	if tf := tarCache.currentTarfile["2019/05/01"]; tf == nil || tf.Count() != 1 {
+		t.Errorf("The file which arrived after the boundary was not put in a new tarfile")
+	}
+
+	// At the next boundary, the new tarfile is uploaded.
+	time.Sleep(untilBoundary())
+	tarCache.rotate()
+	if up.calls != 2 || len(tarCache.currentTarfile) != 0 {
+		t.Errorf("The tarfile was not uploaded after the boundary: %d uploads, %d tarfiles left", up.calls, len(tarCache.currentTarfile))
+	}
+}
+
+func TestCheckBoundary(t *testing.T) {
+	for _, tt := range []struct {
+		boundary time.Duration
+		ok       bool
+	}{
+		{boundary: 0, ok: true},
+		{boundary: time.Hour, ok: true},
+		{boundary: 24 * time.Hour, ok: true},
+		{boundary: 15 * time.Minute, ok: true},
+		{boundary: 7 * time.Hour, ok: false},
+		{boundary: 48 * time.Hour, ok: false},
+	} {
+		if err := CheckBoundary(tt.boundary); (err == nil) != tt.ok {
+			t.Errorf("CheckBoundary(%v) = %v, but ok should be %v", tt.boundary, err, tt.ok)
+		}
+	}
+}
+
+func TestKeptFilesAreNotUploadedAgain(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestKeptFilesAreNotUploadedAgain")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	rtx.Must(os.MkdirAll(tempdir+"/2019/05/01", 0777), "Could not create dirs")
+	name := filename.System(tempdir + "/2019/05/01/a")
+	rtx.Must(ioutil.WriteFile(string(name), []byte("abcdefgh"), 0666), "Could not write file")
+	config := memoryless.Config{Expected: time.Hour, Max: time.Hour}
+	up := &fakeUploader{}
+	// Even with a cool-down, kept files are not treated as undeletable.
+	tarCache, _ := New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Megabyte), config, up, Config{
+		Tarfile:             tarfile.Config{KeepFiles: true},
+		UndeletableCooldown: time.Millisecond,
+	})
+
+	tarCache.add(name)
+	tarCache.uploadAndDelete("2019/05/01")
+	if up.calls != 1 || tarCache.kept.len() != 1 || tarCache.undeletable.len() != 0 {
+		t.Fatalf("After the upload: %d uploads, %d kept and %d undeletable files, want 1, 1 and 0", up.calls, tarCache.kept.len(), tarCache.undeletable.len())
+	}
+	if got := testutil.ToFloat64(pusherKeptFiles.WithLabelValues("test")); got != 1 {
+		t.Errorf("pusher_kept_files = %v, want 1", got)
+	}
+
+	// The kept file is not archived again, however long after.
+	time.Sleep(10 * time.Millisecond)
+	tarCache.add(name)
+	if len(tarCache.currentTarfile) != 0 {
+		t.Errorf("The kept file was archived again: %v", tarCache.currentTarfile)
+	}
+
+	// Unless it changes.
+	rtx.Must(ioutil.WriteFile(string(name), []byte("abcdefghij"), 0666), "Could not write file")
+	tarCache.add(name)
+	if len(tarCache.currentTarfile) != 1 {
+		t.Error("The changed file was not archived again")
+	}
+}
+
+func TestPreallocationIsBounded(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestPreallocationIsBounded")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	config := memoryless.Config{Expected: time.Hour, Max: time.Hour}
+	tarCache, _ := New(filename.System(tempdir), "test", 1000, &flagx.KeyValue{}, bytecount.ByteCount(20*bytecount.Megabyte), config, &fakeUploader{}, Config{
+		Preallocate: true,
+	})
+
+	// Nothing has been uploaded yet, so nothing is preallocated.
+	if got := tarCache.preallocation(); got != 0 {
+		t.Errorf("preallocation() = %v before any upload, want 0", got)
+	}
+
+	// However big the last tarfile, hundreds of subdirectories preallocate
+	// no more than maxPreallocation each.
+	var total bytecount.ByteCount
+	for i := 0; i < 300; i++ {
+		dir := fmt.Sprintf("%s/2019/%02d/%02d", tempdir, i/25+1, i%25+1)
+		rtx.Must(os.MkdirAll(dir, 0777), "Could not create dirs")
+		name := filename.System(dir + "/a")
+		rtx.Must(ioutil.WriteFile(string(name), bytes.Repeat([]byte("a"), 4096), 0666), "Could not write file")
+		tarCache.lastSize = bytecount.ByteCount(20 * bytecount.Megabyte)
+		total += tarCache.preallocation()
+		tarCache.add(name)
+	}
+	if len(tarCache.currentTarfile) != 300 {
+		t.Fatalf("%d tarfiles, want 300", len(tarCache.currentTarfile))
+	}
+	if max := 300 * maxPreallocation; total > max {
+		t.Errorf("300 tarfiles preallocated %v, want at most %v", total, max)
+	}
+
+	// A small last tarfile makes the next preallocation small too.
+	tarCache.uploadAndDelete("2019/01/01")
+	if got := tarCache.preallocation(); got == 0 || got >= maxPreallocation {
+		t.Errorf("preallocation() = %v after a small upload, want between 0 and %v", got, maxPreallocation)
+	}
+}
+
+func TestQueueIsBoundedDuringABlackout(t *testing.T) {
+	tempdir, err := ioutil.TempDir("/tmp", "tarcache.TestQueueIsBoundedDuringABlackout")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tempdir)
+	config := memoryless.Config{Expected: time.Hour, Max: time.Hour}
+	up := &fakeUploader{}
+	tarCache, _ := New(filename.System(tempdir), "test", 1, &flagx.KeyValue{}, bytecount.ByteCount(1*bytecount.Megabyte), config, up, Config{})
+	for _, day := range []string{"01", "02", "03"} {
+		rtx.Must(os.MkdirAll(tempdir+"/2019/05/"+day, 0777), "Could not create dirs")
+		name := filename.System(tempdir + "/2019/05/" + day + "/a")
+		rtx.Must(ioutil.WriteFile(string(name), []byte("abcdefgh"), 0666), "Could not write file")
+		tarCache.add(name)
+	}
+
+	// Every tick and flush of a blackout queues the same open tarfiles.
+	tarCache.blackout = true
+	for i := 0; i < 1000; i++ {
+		tarCache.enqueueAll()
+	}
+	if tarCache.due.Len() != 3 || len(tarCache.queued) != 3 {
+		t.Fatalf("The queue holds %d tarfiles after 1000 ticks, want 3", tarCache.due.Len())
+	}
+
+	// Once the blackout ends, each tarfile is uploaded once.
+	tarCache.blackout = false
+	for tarCache.due.Len() > 0 {
+		tarCache.uploadOldest()
+	}
+	if up.calls != 3 || len(tarCache.queued) != 0 {
+		t.Errorf("%d uploads and %d queued tarfiles, want 3 and 0", up.calls, len(tarCache.queued))
+	}
+}
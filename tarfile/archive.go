@@ -0,0 +1,262 @@
+package tarfile
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Format is the kind of archive a tarfile produces.
+type Format string
+
+const (
+	// Tar archives are gzipped tarfiles, or plain ones if Config.Uncompressed
+	// is set. The zero Format is Tar.
+	Tar = Format("tar")
+	// Zip archives are .zip files, for consumers whose tools can't read tar
+	// streams. Each member is deflated, unless it is already compressed (see
+	// Config.StoredExtensions), in which case it is stored. Zip archives can't
+	// record owners or hard links, so the owner options are ignored, and so is
+	// Deduplicate. The metadata is recorded in the archive comment, and the
+	// metadata of each file in its member's comment.
+	Zip = Format("zip")
+)
+
+// archiveWriter writes the entries of an archive in one format. A tarfile
+// drives every format through the same lifecycle: WriteHeader for each entry,
+// followed by exactly the header's Size bytes of contents and a Flush, and
+// finally Close.
+type archiveWriter interface {
+	// WriteHeader starts a new entry. Entries are described by tar headers
+	// whatever the format. Formats which can't represent some of the fields
+	// ignore them.
+	WriteHeader(*tar.Header) error
+	// Write writes the contents of the current entry.
+	io.Writer
+	// Flush pushes everything written so far into the tarfile's buffer, so
+	// that its size is accurate.
+	Flush() error
+	// Pending is about how many bytes have been written since the last
+	// Flush, before compression, including the headers.
+	Pending() int64
+	// Close finishes the archive.
+	Close() error
+}
+
+// tarArchive writes a tarfile through a compressor. If that compressor is a
+// memberGzipWriter, each entry is compressed as its own gzip member, and
+// indexed.
+type tarArchive struct {
+	*tar.Writer
+	compressor compressor
+	pending    *pendingCounter
+	members    *memberGzipWriter
+	index      []IndexEntry
+	// The entry being written, until its member ends.
+	current *IndexEntry
+}
+
+// pendingCounter counts the bytes written to a compressor since it was last
+// flushed.
+type pendingCounter struct {
+	io.Writer
+	n int64
+}
+
+func (p *pendingCounter) Write(b []byte) (int, error) {
+	n, err := p.Writer.Write(b)
+	p.n += int64(n)
+	return n, err
+}
+
+func newTarArchive(c compressor) *tarArchive {
+	pending := &pendingCounter{Writer: c}
+	members, _ := c.(*memberGzipWriter)
+	return &tarArchive{Writer: tar.NewWriter(pending), compressor: c, pending: pending, members: members}
+}
+
+// WriteHeader starts a new entry, in a new gzip member if the archive is
+// seekable.
+func (a *tarArchive) WriteHeader(h *tar.Header) error {
+	if a.members != nil {
+		if err := a.endEntry(); err != nil {
+			return err
+		}
+		a.current = &IndexEntry{Name: h.Name, Offset: a.members.offset()}
+		if h.Typeflag == tar.TypeLink {
+			a.current.Link = h.Linkname
+		}
+	}
+	return a.Writer.WriteHeader(h)
+}
+
+// endEntry ends the gzip member of the current entry, padding included, and
+// indexes the entry.
+func (a *tarArchive) endEntry() error {
+	if a.current == nil {
+		return nil
+	}
+	if err := a.Writer.Flush(); err != nil {
+		return fmt.Errorf("Could not flush the tarWriter: %w", err)
+	}
+	if err := a.members.endMember(); err != nil {
+		return fmt.Errorf("Could not end the gzip member: %w", err)
+	}
+	a.current.Size = a.members.offset() - a.current.Offset
+	a.index = append(a.index, *a.current)
+	a.current = nil
+	return nil
+}
+
+func (a *tarArchive) Flush() error {
+	if err := a.Writer.Flush(); err != nil {
+		return fmt.Errorf("Could not flush the tarWriter: %w", err)
+	}
+	if err := a.compressor.Flush(); err != nil {
+		return fmt.Errorf("Could not flush the gzipWriter: %w", err)
+	}
+	a.pending.n = 0
+	return nil
+}
+
+func (a *tarArchive) Pending() int64 {
+	return a.pending.n
+}
+
+func (a *tarArchive) Close() error {
+	a.pending.n = 0
+	if a.members != nil {
+		// The end-of-archive marker gets a member of its own.
+		if err := a.endEntry(); err != nil {
+			return err
+		}
+	}
+	if err := a.Writer.Close(); err != nil {
+		return fmt.Errorf("Could not close the tarWriter: %w", err)
+	}
+	if err := a.compressor.Close(); err != nil {
+		return fmt.Errorf("Could not close the gzipWriter: %w", err)
+	}
+	return nil
+}
+
+var errNoZipEntry = errors.New("write to a zip archive before its first header")
+
+// zipArchive writes a .zip file.
+type zipArchive struct {
+	w *zip.Writer
+	// stored returns whether the member with the given name is stored rather
+	// than deflated.
+	stored func(name string) bool
+	// The writer for the contents of the current entry, and its deflater if
+	// it is deflated. Zip's own Flush does not reach the deflater, which
+	// would otherwise hold the data back until the entry ends.
+	entry    io.Writer
+	deflater *flate.Writer
+	// The metadata of the whole archive, for the archive comment.
+	records map[string]string
+	pending int64
+}
+
+// zipHeaderSize is more than the size of the headers of a zip entry, apart from
+// its name and comment.
+const zipHeaderSize = 128
+
+func newZipArchive(w io.Writer, records map[string]string, stored func(name string) bool) *zipArchive {
+	a := &zipArchive{w: zip.NewWriter(w), records: records, stored: stored}
+	a.w.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		d, err := flate.NewWriter(out, flate.DefaultCompression)
+		a.deflater = d
+		return d, err
+	})
+	return a
+}
+
+func (a *zipArchive) WriteHeader(h *tar.Header) error {
+	fh := &zip.FileHeader{
+		Name:     h.Name,
+		Modified: h.ModTime,
+		Method:   zip.Deflate,
+	}
+	// Records which are not the archive's own belong to this file alone.
+	var own []string
+	for k, v := range h.PAXRecords {
+		if archived, ok := a.records[k]; !ok || archived != v {
+			own = append(own, k+"="+v)
+		}
+	}
+	sort.Strings(own)
+	fh.Comment = strings.Join(own, "\n")
+	a.pending += zipHeaderSize + int64(len(fh.Name)+len(fh.Comment)+len(h.Linkname))
+	mode := os.FileMode(h.Mode).Perm()
+	if h.Typeflag == tar.TypeSymlink {
+		// By convention, the contents of a symlink entry are its target.
+		mode |= os.ModeSymlink
+	}
+	fh.SetMode(mode)
+	if h.Typeflag == tar.TypeSymlink || a.stored(h.Name) {
+		fh.Method = zip.Store
+	}
+	a.deflater = nil
+	entry, err := a.w.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	a.entry = entry
+	if h.Typeflag == tar.TypeSymlink {
+		_, err = io.WriteString(entry, h.Linkname)
+	}
+	return err
+}
+
+func (a *zipArchive) Write(p []byte) (int, error) {
+	if a.entry == nil {
+		return 0, errNoZipEntry
+	}
+	n, err := a.entry.Write(p)
+	a.pending += int64(n)
+	return n, err
+}
+
+func (a *zipArchive) Flush() error {
+	if a.deflater != nil {
+		if err := a.deflater.Flush(); err != nil {
+			return fmt.Errorf("Could not flush the deflater: %w", err)
+		}
+	}
+	if err := a.w.Flush(); err != nil {
+		return fmt.Errorf("Could not flush the zipWriter: %w", err)
+	}
+	a.pending = 0
+	return nil
+}
+
+func (a *zipArchive) Pending() int64 {
+	return a.pending
+}
+
+// Close writes the metadata that a tarfile keeps in its PAX records into the
+// archive comment, one key=value pair per line, and finishes the archive.
+func (a *zipArchive) Close() error {
+	a.pending = 0
+	if len(a.records) > 0 {
+		lines := make([]string, 0, len(a.records))
+		for k, v := range a.records {
+			lines = append(lines, k+"="+v)
+		}
+		sort.Strings(lines)
+		if err := a.w.SetComment(strings.Join(lines, "\n")); err != nil {
+			return fmt.Errorf("Could not record the metadata: %w", err)
+		}
+	}
+	if err := a.w.Close(); err != nil {
+		return fmt.Errorf("Could not close the zipWriter: %w", err)
+	}
+	return nil
+}
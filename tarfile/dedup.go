@@ -0,0 +1,53 @@
+package tarfile
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+)
+
+// maxBufferedFileSize is the size of the largest file whose contents are kept
+// in memory after they are hashed for Config.Deduplicate. Larger files are
+// hashed as they are read, and then read again to be added.
+const maxBufferedFileSize = 1 << 20
+
+// hashForDeduplication reads the size bytes of the file to hash them. It
+// returns their SHA-256 and a reader of the same bytes to add to the tarfile.
+// If the file is read twice, stored returns the SHA-256 of the bytes the
+// reader returned, in case the file changed in between; otherwise it is nil.
+// Files which can't be read twice are kept in memory whatever their size.
+func hashForDeduplication(file osFile, reader *bufio.Reader, size int64) (body io.Reader, sum [sha256.Size]byte, stored func() [sha256.Size]byte, err error) {
+	seeker, seekable := file.(io.Seeker)
+	if size <= maxBufferedFileSize || !seekable {
+		data, err := ioutil.ReadAll(io.LimitReader(reader, size))
+		if err == nil && int64(len(data)) < size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, sum, nil, err
+		}
+		return bytes.NewReader(data), sha256.Sum256(data), nil, nil
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, io.LimitReader(reader, size))
+	if err == nil && n < size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, sum, nil, err
+	}
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return nil, sum, nil, err
+	}
+	copy(sum[:], h.Sum(nil))
+	reader.Reset(file)
+	h = sha256.New()
+	stored = func() [sha256.Size]byte {
+		var sum [sha256.Size]byte
+		copy(sum[:], h.Sum(nil))
+		return sum
+	}
+	return io.TeeReader(reader, h), sum, stored, nil
+}
@@ -0,0 +1,67 @@
+package tarfile
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sort"
+)
+
+// DigestMetadata is the key under which the digest of a tarfile (see
+// Config.Digest) is recorded in the metadata of the uploaded object.
+const DigestMetadata = "pusher-digest"
+
+// hashContents returns the reader through which the contents of a member
+// should be copied into the tarfile, and a function which returns their
+// SHA-256 once they have been. If the contents were already hashed, e.g. to
+// deduplicate them, known points at the hash, which is returned instead.
+// Symbolic links are hashed as their targets.
+func (t *tarfile) hashContents(body io.Reader, header *tar.Header, known *[sha256.Size]byte) (io.Reader, func() [sha256.Size]byte) {
+	if known != nil {
+		return body, func() [sha256.Size]byte { return *known }
+	}
+	if !t.config.Digest {
+		return body, func() [sha256.Size]byte { return [sha256.Size]byte{} }
+	}
+	h := sha256.New()
+	if header.Typeflag == tar.TypeSymlink {
+		io.WriteString(h, header.Linkname)
+	} else {
+		body = io.TeeReader(body, h)
+	}
+	return body, func() [sha256.Size]byte {
+		var sum [sha256.Size]byte
+		copy(sum[:], h.Sum(nil))
+		return sum
+	}
+}
+
+// Digest returns the digest of the files in the tarfile, as "sha256:" and the
+// hex SHA-256 of the sorted hex SHA-256es of their contents, one per line. A
+// loader which computes the same digest from the archive it read knows it got
+// every file pusher shipped. It is empty unless Config.Digest is set.
+func (t *tarfile) Digest() string {
+	if !t.config.Digest {
+		return ""
+	}
+	lines := make([]string, 0, len(t.digests))
+	for _, sum := range t.digests {
+		lines = append(lines, hex.EncodeToString(sum[:]))
+	}
+	sort.Strings(lines)
+	h := sha256.New()
+	for _, line := range lines {
+		io.WriteString(h, line+"\n")
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// uploadMetadata returns the metadata to upload the tarfile with, which records
+// the digest if there is one.
+func (t *tarfile) uploadMetadata() map[string]string {
+	if !t.config.Digest {
+		return nil
+	}
+	return map[string]string{DigestMetadata: t.Digest()}
+}
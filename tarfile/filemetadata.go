@@ -0,0 +1,41 @@
+package tarfile
+
+import (
+	"github.com/m-lab/pusher/filename"
+)
+
+// A MetadataExtractor finds metadata describing a single file, e.g. the UUID
+// of the measurement it holds, so that it can be recorded in that file's PAX
+// records and downstream consumers need not parse the file to recover it.
+type MetadataExtractor interface {
+	// Extract returns the records for the named file, given the first bytes
+	// of its contents (up to 32KiB, or the whole file if it is smaller). A
+	// file for which it returns an error is added without them.
+	Extract(name filename.Internal, head []byte) (map[string]string, error)
+}
+
+// MetadataExtractorFunc adapts a function to a MetadataExtractor.
+type MetadataExtractorFunc func(name filename.Internal, head []byte) (map[string]string, error)
+
+// Extract calls f(name, head).
+func (f MetadataExtractorFunc) Extract(name filename.Internal, head []byte) (map[string]string, error) {
+	return f(name, head)
+}
+
+// fileRecords returns the PAX records of a member: the tarfile's metadata,
+// plus those the extractor found for the file. The tarfile's metadata takes
+// precedence, so that an extractor can't relabel the datatype. The tarfile's
+// own map is returned when there is nothing to add.
+func fileRecords(metadata, extracted map[string]string) map[string]string {
+	if len(extracted) == 0 {
+		return metadata
+	}
+	records := make(map[string]string, len(metadata)+len(extracted))
+	for k, v := range extracted {
+		records[k] = v
+	}
+	for k, v := range metadata {
+		records[k] = v
+	}
+	return records
+}
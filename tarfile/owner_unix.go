@@ -0,0 +1,17 @@
+//go:build unix
+
+package tarfile
+
+import (
+	"os"
+	"syscall"
+)
+
+// ownerOf returns the uid and gid of the file described by fstat.
+func ownerOf(fstat os.FileInfo) (int, int, bool) {
+	st, ok := fstat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
@@ -0,0 +1,180 @@
+package tarfile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+)
+
+// compressor is the part of gzip.Writer used by the tarfile. It exists so that
+// the tarfile can use a parallel implementation when one is configured.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// nopCompressor is a compressor that passes its input through unchanged, for
+// tarfiles that are not compressed at all.
+type nopCompressor struct {
+	io.Writer
+}
+
+func (nopCompressor) Flush() error { return nil }
+func (nopCompressor) Close() error { return nil }
+
+// The amount of uncompressed data handed to each compression goroutine.
+const parallelGzipBlockSize = 1 << 20
+
+var errWriterClosed = errors.New("write to a closed parallelGzipWriter")
+
+// compressedBlock is the output of a single compression goroutine.
+type compressedBlock struct {
+	data []byte
+	err  error
+}
+
+// parallelGzipWriter compresses its input in fixed-size blocks, each of which
+// is compressed by its own goroutine into an independent gzip member. Members
+// are written to the underlying writer in the order their input arrived. A
+// sequence of gzip members is itself a valid gzip file (RFC 1952, section
+// 2.2), which gzip, tar, and Go's gzip.Reader all read without complaint. The
+// price is a slightly worse compression ratio, because blocks do not share a
+// dictionary.
+//
+// All writes to the underlying writer happen in the goroutine calling Write,
+// Flush, or Close, so the underlying writer need not be thread-safe.
+type parallelGzipWriter struct {
+	w         io.Writer
+	level     int
+	blockSize int
+	block     []byte
+	pending   []chan compressedBlock
+	sem       chan struct{}
+	written   bool
+	closed    bool
+	err       error
+}
+
+// newParallelGzipWriter returns a compressor that uses up to `cores` goroutines
+// to compress data at the given gzip level.
+func newParallelGzipWriter(w io.Writer, level, cores, blockSize int) *parallelGzipWriter {
+	return &parallelGzipWriter{
+		w:         w,
+		level:     level,
+		blockSize: blockSize,
+		block:     make([]byte, 0, blockSize),
+		sem:       make(chan struct{}, cores),
+	}
+}
+
+// Write buffers the data and starts compressing every block that fills up.
+func (p *parallelGzipWriter) Write(b []byte) (int, error) {
+	if p.closed {
+		return 0, errWriterClosed
+	}
+	if p.err != nil {
+		return 0, p.err
+	}
+	n := 0
+	for len(b) > 0 {
+		space := p.blockSize - len(p.block)
+		if space > len(b) {
+			space = len(b)
+		}
+		p.block = append(p.block, b[:space]...)
+		b = b[space:]
+		n += space
+		if len(p.block) == p.blockSize {
+			p.startBlock()
+			// Bound the memory held by finished-but-unwritten blocks.
+			if err := p.writeFinished(len(p.pending) > 2*cap(p.sem)); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// startBlock hands the current block to a compression goroutine, waiting for a
+// free core if all of them are busy.
+func (p *parallelGzipWriter) startBlock() {
+	block := p.block
+	p.block = make([]byte, 0, p.blockSize)
+	result := make(chan compressedBlock, 1)
+	p.pending = append(p.pending, result)
+	p.sem <- struct{}{}
+	go func() {
+		defer func() { <-p.sem }()
+		buf := &bytes.Buffer{}
+		// NewWriterLevel only returns an error for invalid levels.
+		gz, _ := gzip.NewWriterLevel(buf, p.level)
+		_, err := gz.Write(block)
+		if err == nil {
+			err = gz.Close()
+		}
+		result <- compressedBlock{data: buf.Bytes(), err: err}
+	}()
+}
+
+// writeFinished writes compressed blocks to the underlying writer in order. If
+// wait is false, it stops at the first block that is not yet compressed. If
+// wait is true, it writes every pending block.
+func (p *parallelGzipWriter) writeFinished(wait bool) error {
+	for len(p.pending) > 0 {
+		var r compressedBlock
+		if wait {
+			r = <-p.pending[0]
+		} else {
+			select {
+			case r = <-p.pending[0]:
+			default:
+				return nil
+			}
+		}
+		p.pending = p.pending[1:]
+		if p.err != nil {
+			// Keep draining so that no goroutine is left behind, but report
+			// only the first error.
+			continue
+		}
+		if r.err != nil {
+			p.err = r.err
+			continue
+		}
+		if _, err := p.w.Write(r.data); err != nil {
+			p.err = err
+			continue
+		}
+		p.written = true
+	}
+	return p.err
+}
+
+// Flush compresses any buffered data and writes all compressed data to the
+// underlying writer.
+func (p *parallelGzipWriter) Flush() error {
+	if p.closed {
+		return errWriterClosed
+	}
+	if len(p.block) > 0 {
+		p.startBlock()
+	}
+	return p.writeFinished(true)
+}
+
+// Close flushes the writer. It does not close the underlying writer.
+func (p *parallelGzipWriter) Close() error {
+	if p.closed {
+		return p.err
+	}
+	err := p.Flush()
+	p.closed = true
+	if err != nil || p.written {
+		return err
+	}
+	// Nothing was ever written. An empty gzip member keeps the output valid.
+	gz, _ := gzip.NewWriterLevel(p.w, p.level)
+	p.err = gz.Close()
+	return p.err
+}
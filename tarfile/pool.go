@@ -0,0 +1,57 @@
+package tarfile
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Buffers are recycled between tarfiles, and between the reads of individual
+// files, to reduce allocation churn on datatypes with high file rates.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return &bytes.Buffer{} },
+}
+
+// maxPooledBufferSize bounds the size of the buffers kept in the pool, so that
+// one unusually large file does not pin a huge buffer in memory.
+const maxPooledBufferSize = 64 << 20
+
+// getBuffer returns an empty buffer with room for at least size bytes.
+func getBuffer(size int) *bytes.Buffer {
+	b := bufferPool.Get().(*bytes.Buffer)
+	b.Reset()
+	if size > 0 {
+		b.Grow(size)
+	}
+	return b
+}
+
+// putBuffer returns a buffer to the pool. The buffer must not be used after it
+// is returned.
+func putBuffer(b *bytes.Buffer) {
+	if b == nil || b.Cap() > maxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(b)
+}
+
+// The size of the read buffer used when streaming a file into the tarfile.
+const readerBufferSize = 32 * 1024
+
+var readerPool = sync.Pool{
+	New: func() interface{} { return bufio.NewReaderSize(nil, readerBufferSize) },
+}
+
+// getReader returns a buffered reader for the file.
+func getReader(r io.Reader) *bufio.Reader {
+	b := readerPool.Get().(*bufio.Reader)
+	b.Reset(r)
+	return b
+}
+
+// putReader returns a buffered reader to the pool.
+func putReader(b *bufio.Reader) {
+	b.Reset(nil)
+	readerPool.Put(b)
+}
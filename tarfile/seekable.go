@@ -0,0 +1,88 @@
+package tarfile
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+// IndexSuffix is added to the name of a seekable tarfile to name its index.
+const IndexSuffix = ".index.json"
+
+// An IndexEntry says where a member of a seekable tarfile is. Its tar headers,
+// contents, and padding are the gzip member Size bytes long starting Offset
+// bytes into the tarfile, which can be fetched with a range request and
+// gunzipped on its own. Deduplicated files are hard links (see
+// Config.Deduplicate), whose entries have no contents, and name the member
+// holding them as their Link.
+type IndexEntry struct {
+	Name   string `json:"name"`
+	Link   string `json:"link,omitempty"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+// memberGzipWriter is a compressor which starts a new gzip member whenever
+// endMember is called, so that each member can be decompressed on its own. A
+// sequence of gzip members is itself a valid gzip file, as for the
+// parallelGzipWriter.
+type memberGzipWriter struct {
+	w    *offsetWriter
+	gz   *gzip.Writer
+	open bool
+}
+
+// offsetWriter counts the bytes written through it.
+type offsetWriter struct {
+	io.Writer
+	n int64
+}
+
+func (o *offsetWriter) Write(b []byte) (int, error) {
+	n, err := o.Writer.Write(b)
+	o.n += int64(n)
+	return n, err
+}
+
+func newMemberGzipWriter(w io.Writer, level int) *memberGzipWriter {
+	ow := &offsetWriter{Writer: w}
+	// NewWriterLevel only returns an error for invalid levels.
+	gz, _ := gzip.NewWriterLevel(ow, level)
+	return &memberGzipWriter{w: ow, gz: gz}
+}
+
+// Write starts a new member if the last one has ended.
+func (m *memberGzipWriter) Write(b []byte) (int, error) {
+	if !m.open {
+		m.gz.Reset(m.w)
+		m.open = true
+	}
+	return m.gz.Write(b)
+}
+
+// Flush pushes the data written so far into the current member, without
+// ending it.
+func (m *memberGzipWriter) Flush() error {
+	if !m.open {
+		return nil
+	}
+	return m.gz.Flush()
+}
+
+// endMember ends the current member, if any.
+func (m *memberGzipWriter) endMember() error {
+	if !m.open {
+		return nil
+	}
+	m.open = false
+	return m.gz.Close()
+}
+
+func (m *memberGzipWriter) Close() error {
+	return m.endMember()
+}
+
+// offset returns the offset at which the next member will start, if the
+// current one has ended.
+func (m *memberGzipWriter) offset() int64 {
+	return m.w.n
+}
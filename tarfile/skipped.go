@@ -0,0 +1,57 @@
+package tarfile
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/m-lab/pusher/filename"
+)
+
+// SkippedSuffix is added to the name of a tarfile to name its skipped
+// manifest.
+const SkippedSuffix = ".skipped.json"
+
+// A SkippedEntry describes a file that was skipped by sampling, in the skipped
+// manifest of its tarfile (see Config.SkippedManifest). The size and
+// modification time are zero if the file could not be stat'ed.
+type SkippedEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// recordSkipped records the size and modification time of the skipped file,
+// before it is deleted.
+func (t *tarfile) recordSkipped(name filename.Internal, file osFile) {
+	entry := SkippedEntry{Name: string(name)}
+	if fstat, err := file.Stat(); err == nil {
+		entry.Size = fstat.Size()
+		entry.ModTime = fstat.ModTime().UTC()
+	}
+	if t.skippedInfo == nil {
+		t.skippedInfo = make(map[filename.Internal]SkippedEntry)
+	}
+	t.skippedInfo[name] = entry
+}
+
+// skippedManifest returns the skipped files, in order of name.
+func (t *tarfile) skippedManifest() []SkippedEntry {
+	manifest := make([]SkippedEntry, 0, len(t.skippedInfo))
+	for _, entry := range t.skippedInfo {
+		manifest = append(manifest, entry)
+	}
+	sort.Slice(manifest, func(i, j int) bool { return manifest[i].Name < manifest[j].Name })
+	return manifest
+}
+
+// logSkipped logs the skipped manifest as JSON, for when it can't be uploaded.
+func (t *tarfile) logSkipped() {
+	data, err := json.Marshal(t.skippedManifest())
+	if err != nil {
+		log.Printf("Could not encode the skipped manifest of %s (error: %q)\n", t.subdir, err)
+		return
+	}
+	log.Printf("Skipped files of %s/%s: %s\n", t.datatype, t.subdir, data)
+}
@@ -0,0 +1,62 @@
+package tarfile
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// The kinds of StuckEvent.
+const (
+	// UploadStuck is reported once Config.StuckAttempts attempts to upload a
+	// tarfile have failed.
+	UploadStuck = "upload_stuck"
+	// UploadRecovered is reported when a tarfile that was reported stuck is
+	// uploaded after all.
+	UploadRecovered = "upload_recovered"
+)
+
+// A StuckEvent describes a tarfile whose upload keeps failing, or which was
+// finally uploaded after being reported stuck (see Config.StuckAttempts). It
+// is logged as JSON, and given to Config.OnStuck, so that someone can be
+// alerted to stuck uploads before the success timestamps go stale.
+type StuckEvent struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Datatype string    `json:"datatype"`
+	Subdir   string    `json:"subdir"`
+	Files    int       `json:"files"`
+	Bytes    int       `json:"bytes"`
+	Attempts int       `json:"attempts"`
+	// Since is when the first attempt to upload the tarfile started.
+	Since time.Time `json:"since"`
+	// LastError is the error of the last failed attempt.
+	LastError string `json:"last_error,omitempty"`
+	// Destination is where the tarfile was uploaded, once it recovered.
+	Destination string `json:"destination,omitempty"`
+}
+
+// reportStuck counts and logs the event, and passes it to Config.OnStuck.
+func (t *tarfile) reportStuck(event string, attempts int, since time.Time, err error) {
+	e := StuckEvent{
+		Event:       event,
+		Time:        time.Now().UTC(),
+		Datatype:    t.datatype,
+		Subdir:      string(t.subdir),
+		Files:       len(t.members),
+		Bytes:       t.contents.Len(),
+		Attempts:    attempts,
+		Since:       since.UTC(),
+		Destination: t.uploaded.Destination,
+	}
+	if err != nil {
+		e.LastError = err.Error()
+	}
+	pusherStuckEvents.WithLabelValues(t.datatype, event).Inc()
+	if data, err := json.Marshal(e); err == nil {
+		log.Printf("Upload event: %s\n", data)
+	}
+	if t.config.OnStuck != nil {
+		t.config.OnStuck(e)
+	}
+}
@@ -0,0 +1,48 @@
+package tarfile
+
+import (
+	"io"
+	"os"
+)
+
+// Symlink is a symbolic link, opened so that it can be added to a tarfile as a
+// link rather than as the file it points to. It reads as empty.
+type Symlink struct {
+	name   string
+	info   os.FileInfo
+	target string
+}
+
+// OpenSymlink returns the symbolic link with the given name. It is an error if
+// the file is not a symbolic link.
+func OpenSymlink(name string) (*Symlink, error) {
+	info, err := os.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	target, err := os.Readlink(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Symlink{name: name, info: info, target: target}, nil
+}
+
+// Read always returns io.EOF, because a link has no contents of its own.
+func (s *Symlink) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+// Close does nothing.
+func (s *Symlink) Close() error {
+	return nil
+}
+
+// Stat returns the FileInfo of the link itself.
+func (s *Symlink) Stat() (os.FileInfo, error) {
+	return s.info, nil
+}
+
+// Name returns the name the link was opened with.
+func (s *Symlink) Name() string {
+	return s.name
+}
@@ -4,20 +4,29 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/m-lab/go/bytecount"
 
-	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/pusher/backoff"
+	"github.com/m-lab/pusher/bytesize"
+	"github.com/m-lab/pusher/decisionlog"
 	"github.com/m-lab/pusher/filename"
+	"github.com/m-lab/pusher/metrics"
 	"github.com/m-lab/pusher/uploader"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 const (
@@ -25,83 +34,165 @@ const (
 	skipFile = "skip_file"
 )
 
+var collectors metrics.Collectors
+
+// RegisterMetrics registers the tarfiles' metrics on r, or on
+// prometheus.DefaultRegisterer if r is nil. New registers them, along with
+// those of the backoff and uploader packages which tarfiles use, on
+// Config.Registerer.
+func RegisterMetrics(r prometheus.Registerer) {
+	collectors.Register(r)
+}
+
 var (
-	pusherTarfilesCreated = promauto.NewCounterVec(
+	pusherTarfilesCreated = collectors.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "pusher_tarfiles_created_total",
 			Help: "The number of tarfiles the pusher has created",
 		},
 		[]string{"datatype"})
-	pusherTarfilesUploaded = promauto.NewCounterVec(
+	pusherTarfilesUploaded = collectors.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "pusher_tarfiles_successful_uploads_total",
 			Help: "The number of tarfiles the pusher has uploaded",
 		},
 		[]string{"datatype"})
-	pusherFilesPerTarfile = promauto.NewHistogramVec(
+	pusherFilesPerTarfile = collectors.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "pusher_files_per_tarfile",
 			Help:    "The number of files in each tarfile the pusher has uploaded",
 			Buckets: []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000},
 		},
 		[]string{"datatype"})
-	pusherBytesPerTarfile = promauto.NewHistogramVec(
+	pusherBytesPerTarfile = collectors.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "pusher_bytes_per_tarfile",
 			Help:    "The number of bytes in each tarfile the pusher has uploaded",
 			Buckets: []float64{1e3, 1e4, 1e5, 1e6, 1e7, 1e8, 1e9},
 		},
 		[]string{"datatype"})
-	pusherBytesPerFile = promauto.NewHistogramVec(
+	pusherBytesPerFile = collectors.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "pusher_bytes_per_file",
 			Help:    "The number of bytes in each file the pusher has uploaded",
 			Buckets: []float64{1e1, 1e2, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8, 1e9},
 		},
 		[]string{"datatype"})
-	pusherTarfileDuplicateFiles = promauto.NewCounterVec(
+	pusherTarfileDuplicateFiles = collectors.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "pusher_tarfiles_duplicates_total",
 			Help: "The number of times we attempted to add a file twice to the same tarfile",
 		},
 		[]string{"datatype", "condition"})
-	pusherFileReadErrors = promauto.NewCounterVec(
+	pusherFileReadErrors = collectors.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "pusher_file_read_errors_total",
 			Help: "The number of times we could not read or stat a file that we were trying to add to the tarfile",
 		},
 		[]string{"datatype"})
-	pusherFilesAdded = promauto.NewCounterVec(
+	pusherFilesAdded = collectors.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "pusher_files_added_total",
 			Help: "The number of files we have added to a tarfile",
 		},
 		[]string{"datatype"})
-	pusherFilesSkipped = promauto.NewCounterVec(
+	pusherFilesSkipped = collectors.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "pusher_files_skipped_total",
 			Help: "The number of files we have skipped in the tarfile",
 		},
 		[]string{"datatype"})
-	pusherFilesRemoved = promauto.NewCounterVec(
+	pusherFilesRemoved = collectors.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "pusher_files_removed_total",
 			Help: "The number of files we have removed from the disk after upload",
 		},
 		[]string{"datatype", "condition"})
-	pusherFileRemoveErrors = promauto.NewCounterVec(
+	pusherBytesRemoved = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_file_bytes_removed_total",
+			Help: "The total size of the files counted by pusher_files_removed_total, which were removed from the disk after upload. Compare the add_file bytes with pusher_tarfile_bytes_uploaded_total to find how well the files compress, and to check that nothing is removed without being uploaded",
+		},
+		[]string{"datatype", "condition"})
+	pusherBytesUploaded = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_tarfile_bytes_uploaded_total",
+			Help: "The total size of the tarfiles the pusher has uploaded, after compression",
+		},
+		[]string{"datatype"})
+	pusherFilesKept = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_files_kept_total",
+			Help: "The number of files which would have been removed from the disk after upload, but were kept because of --no_delete or --no_upload",
+		},
+		[]string{"datatype", "condition"})
+	pusherFileRemoveErrors = collectors.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "pusher_file_remove_errors_total",
 			Help: "The number of times the os.Remove call failed",
 		},
 		[]string{"datatype", "condition"})
-	pusherEmptyUploads = promauto.NewCounterVec(
+	pusherFilesDeduplicated = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_tarfile_deduplicated_files_total",
+			Help: "The number of files stored as a link to an identical file already in the tarfile",
+		},
+		[]string{"datatype"})
+	pusherDirectorySyncErrors = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_directory_sync_errors_total",
+			Help: "The number of times a directory could not be synced after files were removed from it",
+		},
+		[]string{"datatype"})
+	pusherFileMetadataErrors = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_file_metadata_errors_total",
+			Help: "The number of files added without their own metadata because the metadata extractor failed",
+		},
+		[]string{"datatype"})
+	pusherTarfileWriteErrors = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_tarfile_write_errors_total",
+			Help: "The number of times writing to an in-memory tarfile failed, which causes the tarfile to be abandoned",
+		},
+		[]string{"datatype"})
+	pusherUploadDeadlinesExceeded = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_tarfile_upload_deadlines_exceeded_total",
+			Help: "The number of tarfiles given up on because all the attempts to upload them took longer than the upload deadline",
+		},
+		[]string{"datatype"})
+	pusherUploadRetryDelay = collectors.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pusher_upload_retry_delay_seconds",
+			Help: "How long the current failing upload is waiting before its next attempt, or zero if no upload is failing",
+		},
+		[]string{"datatype"})
+	pusherEmptyUploads = collectors.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "pusher_empty_uploads_total",
-			Help: "The number of times we tried to upload a tarfile with nothing in it",
+			Help: "The number of tarfiles not uploaded because nothing was added to them, e.g. because every file was skipped",
 		},
 		[]string{"datatype"})
-	pusherSuccessTimestamp = promauto.NewGaugeVec(
+	pusherSideUploads = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_tarfile_side_uploads_total",
+			Help: "The number of attempts to upload a side file, such as the index of a seekable tarfile, next to its tarfile, by kind and result",
+		},
+		[]string{"datatype", "kind", "result"})
+	pusherTarfilesCorrupt = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_tarfile_verify_failures_total",
+			Help: "The number of finished tarfiles that could not be read back, and so were abandoned instead of uploaded, by whether they were spooled to disk",
+		},
+		[]string{"datatype", "spooled"})
+	pusherStuckEvents = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_tarfile_stuck_upload_events_total",
+			Help: "The number of tarfiles reported stuck after failing to upload Config.StuckAttempts times (event upload_stuck), and of stuck tarfiles uploaded after all (event upload_recovered)",
+		},
+		[]string{"datatype", "event"})
+	pusherSuccessTimestamp = collectors.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "pusher_success_timestamp",
 			Help: "The unix timestamp of the most recent pusher success",
@@ -112,43 +203,272 @@ var (
 // A tarfile represents a single tar file containing data for upload
 type tarfile struct {
 	timeout    *time.Timer
+	firstAdded time.Time
 	members    map[filename.Internal]filename.System
+	sizes      map[filename.Internal]int64 // The size of each member's file.
 	skipped    map[filename.Internal]filename.System
 	contents   *bytes.Buffer
-	tarWriter  *tar.Writer
-	gzipWriter *gzip.Writer
+	archive    archiveWriter
 	subdir     filename.System
 	datatype   string
 	fileRatio  float64
 	metadata   map[string]string
+	config     Config
+	// The first member added with each content hash, when deduplicating.
+	hashes map[[sha256.Size]byte]filename.Internal
+	// The first error encountered while writing the tarfile. Once a write has
+	// failed, the tarfile is corrupt and can only be abandoned.
+	writeErr error
+	// The files that were uploaded but could not be removed afterwards.
+	undeletable []filename.System
+	// The files that were uploaded but kept, because of Config.KeepFiles.
+	kept []filename.System
+	// Whether UploadAndDelete left files for Remove, and whether those
+	// include the members or only the skipped files.
+	removalDeferred bool
+	removeMembers   bool
+	// Identifies the tarfile to the uploader in each attempt to upload it.
+	uploadID uploader.ID
+	// Where the tarfile was uploaded to, once UploadAndDelete has succeeded.
+	uploaded uploader.Result
+	// The size and modification time of each skipped file, if
+	// Config.SkippedManifest is set.
+	skippedInfo map[filename.Internal]SkippedEntry
+	// The SHA-256 of the contents of each member, if Config.Digest is set.
+	digests map[filename.Internal][sha256.Size]byte
+}
+
+// Owner is a uid/gid pair to be recorded in the tar headers of member files.
+type Owner struct {
+	UID, GID int
+}
+
+// Config holds the optional behaviors of a tarfile. The zero value produces
+// the same archives that pusher has always produced: every member has mode
+// 0666 and no ownership information.
+type Config struct {
+	// PreserveMode copies the permission bits of each file into its header.
+	PreserveMode bool
+	// PreserveOwner copies the uid and gid of each file into its header.
+	PreserveOwner bool
+	// Owner, if non-nil, is recorded as the owner of every file. It takes
+	// precedence over PreserveOwner.
+	Owner *Owner
+	// Stored makes the gzip layer store data without compressing it. This is
+	// for archives of files that are already compressed. The result is still a
+	// valid .tgz file.
+	Stored bool
+	// Uncompressed leaves out the gzip layer altogether, so that the result
+	// is a plain .tar file. This is for datatypes whose files are all already
+	// compressed. It takes precedence over Stored and CompressionCores. In a
+	// Zip archive, it and Stored make every member stored.
+	Uncompressed bool
+	// Format is the kind of archive to produce. The zero value is Tar.
+	Format Format
+	// StoredExtensions lists the extensions of files that are already
+	// compressed, which a Zip archive stores instead of deflating. (Tar
+	// archives compress every member alike, so the TarCache gives such files
+	// a separate tarfile with Stored set instead.)
+	StoredExtensions []string
+	// Seekable compresses each entry of the tarfile, with its headers, as a
+	// separate gzip member, so that a single file can be extracted without
+	// decompressing the rest. An index of the members (see IndexEntry) is
+	// uploaded next to the tarfile, named like it plus IndexSuffix, if the
+	// uploader can put it there. It only applies to gzipped Tar archives,
+	// and takes precedence over CompressionCores. Small files compress less
+	// well, because no two share a dictionary.
+	Seekable bool
+	// CompressionCores is the number of goroutines used to compress the
+	// tarfile. Values greater than one cause the tarfile to be compressed in
+	// parallel, one 1MiB block at a time, which helps most when member files
+	// are large.
+	CompressionCores int
+	// InitialSize is the number of bytes preallocated for the compressed
+	// tarfile. Setting it near the size threshold avoids repeatedly growing
+	// the buffer as files are added.
+	InitialSize bytecount.ByteCount
+	// Deduplicate stores the contents of identical files only once per
+	// tarfile. Every later file with the same contents is stored as a hard
+	// link to the first one. Each file is hashed before it is added, which
+	// reads files larger than 1MiB twice. It is ignored by Zip and Seekable
+	// archives, whose members must each be readable on their own.
+	Deduplicate bool
+	// MaxUploadAttempts is the number of times an upload is tried before
+	// UploadAndDelete gives up and returns ErrUploadGaveUp. Zero means the
+	// upload is retried until it succeeds.
+	MaxUploadAttempts int
+	// UploadDeadline is the total time allowed for all the attempts to upload
+	// the tarfile, after which UploadAndDelete gives up and returns
+	// ErrUploadGaveUp. An attempt still in progress at the deadline is
+	// canceled. Zero means no limit.
+	UploadDeadline time.Duration
+	// StuckAttempts is the number of failed attempts to upload a tarfile after
+	// which it is reported stuck, once, as a StuckEvent. If it is then
+	// uploaded after all, that is reported too. Zero means uploads are never
+	// reported stuck.
+	StuckAttempts int
+	// OnStuck, if not nil, is given every StuckEvent, e.g. to send it to an
+	// alerting system. It is called by UploadAndDelete, which waits for it.
+	OnStuck func(StuckEvent)
+	// UploadBackoff is how to choose the wait between attempts to upload the
+	// tarfile. The zero value is backoff.Capped.
+	UploadBackoff backoff.Strategy
+	// RemoveBatchSize is how many files are removed at a time after an
+	// upload. Zero means they are all removed in one batch.
+	RemoveBatchSize int
+	// RemoveBatchPause is how long to wait between batches of removals, so
+	// that removing the files of a big tarfile does not starve the processes
+	// writing new files on slow disks. The pauses are skipped once the
+	// context given to UploadAndDelete, or Remove, is canceled.
+	RemoveBatchPause time.Duration
+	// DeferRemoval makes UploadAndDelete leave the files in place, for Remove
+	// to remove later, as on another goroutine, so that the pauses between
+	// batches of removals don't hold up the caller.
+	DeferRemoval bool
+	// Digest hashes the contents of each file as it is added, and records a
+	// digest of those hashes (see the Digest method) in the metadata of the
+	// uploaded object, under DigestMetadata, so that loaders can check that
+	// they processed exactly what was shipped.
+	Digest bool
+	// SkippedManifest records the name, size, and modification time of each
+	// file skipped by sampling, so that the bias of the sampling can be
+	// measured. The manifest (see SkippedEntry) is uploaded next to the
+	// tarfile, named like it plus SkippedSuffix, if the uploader can put it
+	// there. Otherwise, as when every file was skipped and there is no
+	// tarfile, it is logged as JSON.
+	SkippedManifest bool
+	// KeepFiles leaves every file in place once the tarfile is uploaded, and
+	// returns them from Kept instead.
+	KeepFiles bool
+	// SyncRemovedDirs syncs each directory after a batch of files has been
+	// removed from it, so that the removals are durable.
+	SyncRemovedDirs bool
+	// Verify reads each tarfile back before it is uploaded, decompressing it
+	// and checking its checksums, so that an archive corrupted in memory, as
+	// by bad RAM on flaky hardware, is not uploaded in place of its files.
+	// UploadAndDelete returns ErrCorrupt for such a tarfile, which is
+	// abandoned so that its files are archived again. An Uncompressed tarfile
+	// has checksums only in its headers, so only they can be checked.
+	Verify bool
+	// VerifySpoolDir, if not empty, is a directory in which to save each
+	// tarfile that fails verification, so that it can be examined later.
+	VerifySpoolDir string
+	// FileMetadata, if non-nil, finds metadata for each file, which is added
+	// to that file's PAX records. In a Zip archive, it is recorded in the
+	// member's comment instead.
+	FileMetadata MetadataExtractor
+	// Decisions, if not nil, records every file that is added, skipped,
+	// uploaded, deleted or kept.
+	Decisions *decisionlog.Log
+	// Registerer is where the metrics of tarfiles, and of the uploads and
+	// retries they make, are registered. Nil means
+	// prometheus.DefaultRegisterer.
+	Registerer prometheus.Registerer
+	// Sink, if not nil, is sent the metrics of the uploads as well, such as
+	// to statsd.
+	Sink metrics.Sink
+	// ControlChars is how the targets of symbolic links are archived. Unless
+	// it is filename.ControlCharsReject, they are escaped, like the names
+	// the TarCache gives the tarfile (see filename.Internal.Escape). Names
+	// are not escaped by the tarfile.
+	ControlChars filename.ControlCharPolicy
 }
 
-// Tarfile represents all the capabilities of a tarfile.  You can add files to it, upload it, and check its size.
+// ErrUploadGaveUp is returned (wrapped) by UploadAndDelete when the upload
+// failed Config.MaxUploadAttempts times or for longer than
+// Config.UploadDeadline, or its context was canceled.
+var ErrUploadGaveUp = errors.New("gave up uploading the tarfile")
+
+// ErrShortRead is returned (wrapped) by Add when a file could not be read to
+// the end after its header was written. The tarfile can't be used after that.
+var ErrShortRead = errors.New("the file could not be read to the end")
+
+// Tarfile represents all the capabilities of a tarfile.  You can add files to it, upload it, and check its size and member count.
+//
+// Add and UploadAndDelete return an error only when the tarfile itself can no
+// longer be written. Such a tarfile should be abandoned with Abandon, which
+// returns the files that had been added to it so that they may be added to a
+// new tarfile.
 type Tarfile interface {
-	Add(filename.Internal, osFile, func(string) *time.Timer)
-	UploadAndDelete(uploader uploader.Uploader)
+	Add(filename.Internal, osFile, func(string) *time.Timer) error
+	Flush() error
+	UploadAndDelete(ctx context.Context, uploader uploader.Uploader) error
+	Abandon() []filename.System
+	Files() []filename.System
 	Size() bytecount.ByteCount
+	EstimatedSize() bytecount.ByteCount
+	Count() int
+	FirstAdded() time.Time
 	SkippedCount() int
+	Remove(ctx context.Context)
+	Undeletable() []filename.System
+	Kept() []filename.System
+	Uploaded() uploader.Result
+	MissingBytes() bytecount.ByteCount
+	Digest() string
 }
 
 // New creates a new tarfile to hold the contents of a particular subdirectory.
-func New(subdir filename.System, datatype string, ratio float64, metadata map[string]string) Tarfile {
+// Unless the metadata has an MLAB.datatype record, one is added for the
+// datatype.
+func New(subdir filename.System, datatype string, ratio float64, metadata map[string]string, config Config) Tarfile {
+	RegisterMetrics(config.Registerer)
+	backoff.RegisterMetrics(config.Registerer)
+	uploader.RegisterMetrics(config.Registerer)
 	pusherTarfilesCreated.WithLabelValues(datatype).Inc()
-	// TODO: profile and determine if preallocation is a good idea.
-	buffer := &bytes.Buffer{}
-	gzipWriter := gzip.NewWriter(buffer)
-	tarWriter := tar.NewWriter(gzipWriter)
-	metadata["MLAB.datatype"] = datatype
+	if config.Sink == nil {
+		config.Sink = metrics.Nop
+	}
+	buffer := getBuffer(int(config.InitialSize))
+	if _, ok := metadata["MLAB.datatype"]; !ok {
+		metadata["MLAB.datatype"] = datatype
+	}
+	var archive archiveWriter
+	if config.Format == Zip {
+		archive = newZipArchive(buffer, metadata, func(name string) bool {
+			if config.Stored || config.Uncompressed {
+				return true
+			}
+			for _, ext := range config.StoredExtensions {
+				if strings.HasSuffix(name, ext) {
+					return true
+				}
+			}
+			return false
+		})
+		config.Deduplicate = false
+	} else {
+		level := gzip.DefaultCompression
+		if config.Stored {
+			level = gzip.NoCompression
+		}
+		var gzipWriter compressor
+		if config.Uncompressed {
+			gzipWriter = nopCompressor{buffer}
+		} else if config.Seekable {
+			gzipWriter = newMemberGzipWriter(buffer, level)
+			config.Deduplicate = false
+		} else if config.CompressionCores > 1 {
+			gzipWriter = newParallelGzipWriter(buffer, level, config.CompressionCores, parallelGzipBlockSize)
+		} else {
+			// NewWriterLevel only returns an error for invalid levels.
+			gzipWriter, _ = gzip.NewWriterLevel(buffer, level)
+		}
+		archive = newTarArchive(gzipWriter)
+	}
 	return &tarfile{
-		contents:   buffer,
-		tarWriter:  tarWriter,
-		gzipWriter: gzipWriter,
-		members:    make(map[filename.Internal]filename.System),
-		skipped:    make(map[filename.Internal]filename.System),
-		subdir:     subdir,
-		datatype:   datatype,
-		fileRatio:  ratio,
-		metadata:   metadata,
+		contents:  buffer,
+		archive:   archive,
+		members:   make(map[filename.Internal]filename.System),
+		sizes:     make(map[filename.Internal]int64),
+		skipped:   make(map[filename.Internal]filename.System),
+		hashes:    make(map[[sha256.Size]byte]filename.Internal),
+		subdir:    subdir,
+		datatype:  datatype,
+		fileRatio: ratio,
+		metadata:  metadata,
+		config:    config,
+		uploadID:  uploader.NewID(),
 	}
 }
 
@@ -161,27 +481,43 @@ type osFile interface {
 }
 
 // Add adds a single file to the tarfile, and starts a timer if the file is the
-// first file added.
-func (t *tarfile) Add(cleanedFilename filename.Internal, file osFile, timerFactory func(string) *time.Timer) {
+// first file added or skipped. Files which can't be read are logged and ignored. An error
+// is returned only if writing to the tarfile failed, or if the file stopped
+// being readable partway through (ErrShortRead). A *Symlink is added as a
+// symbolic link. Control characters in the names are escaped (see
+// filename.Internal.Escape), although the TarCache normally escapes them first.
+//
+// The file is left in the compressor, which compresses small files much better
+// than flushing it after every file, so Size is only an estimate until Flush is
+// called.
+func (t *tarfile) Add(cleanedFilename filename.Internal, file osFile, timerFactory func(string) *time.Timer) error {
+	if t.writeErr != nil {
+		return t.writeErr
+	}
 	// Check if file has already been skipped.
 	if _, present := t.skipped[cleanedFilename]; present {
 		pusherTarfileDuplicateFiles.WithLabelValues(t.datatype, skipFile).Inc()
 		log.Printf("Not adding %q to the skipped files a second time.\n", cleanedFilename)
-		return
+		return nil
 	}
 
 	// Check if file has already been added.
 	if _, present := t.members[cleanedFilename]; present {
 		pusherTarfileDuplicateFiles.WithLabelValues(t.datatype, addFile).Inc()
 		log.Printf("Not adding %q to the tarfile a second time.\n", cleanedFilename)
-		return
+		return nil
 	}
 
 	// Check if file should be skipped.
 	if rand.Float64() >= t.fileRatio {
+		t.startTimer(timerFactory)
 		t.skipped[cleanedFilename] = filename.System(file.Name())
+		if t.config.SkippedManifest {
+			t.recordSkipped(cleanedFilename, file)
+		}
 		pusherFilesSkipped.WithLabelValues(t.datatype).Inc()
-		return
+		t.config.Decisions.Record(t.datatype, decisionlog.Skipped, file.Name(), "", "")
+		return nil
 	}
 
 	// Add file.
@@ -189,112 +525,578 @@ func (t *tarfile) Add(cleanedFilename filename.Internal, file osFile, timerFacto
 	if err != nil {
 		pusherFileReadErrors.WithLabelValues(t.datatype).Inc()
 		log.Printf("Could not stat %s (error: %q)\n", cleanedFilename, err)
-		return
+		return nil
 	}
 	size := fstat.Size()
+	link, isLink := file.(*Symlink)
+	if isLink {
+		size = 0
+	}
 	pusherBytesPerFile.WithLabelValues(t.datatype).Observe(float64(size))
-	// We read the file into memory instead of using io.Copy directly into the
-	// tarfile because if the use of io.Copy goes wrong, then we have to make
-	// the error fatal (because the already-written tarfile headers are now
-	// wrong), while the reading of disk into RAM, if it goes wrong, simply
-	// causes us to ignore the file and return.
-	//
-	// As things stand we have to choose between mitigating the risk of too-large
-	// files or mitigating the risk of unreadable files. The code below mitigates
-	// the risk of unreadable files. If too-large files become a problem, delete
-	// everything up to the declaration of the header and then replace the
-	// `io.Copy(t.tarWriter, contents)` line with `io.Copy(tarWriter, file)`.
-	contents := &bytes.Buffer{}
-	_, err = io.Copy(contents, file)
+	// We stream the file directly into the tarfile instead of reading it into
+	// RAM first. Before writing the header, we read the first block of the file
+	// so that a file which can't be read at all is skipped without touching the
+	// tarfile.
+	reader := getReader(file)
+	defer putReader(reader)
+	peek := size
+	if peek > readerBufferSize {
+		peek = readerBufferSize
+	}
+	head, err := reader.Peek(int(peek))
 	if err != nil {
 		pusherFileReadErrors.WithLabelValues(t.datatype).Inc()
 		log.Printf("Could not read %s (error: %q)\n", cleanedFilename, err)
-		return
+		return nil
+	}
+	var extracted map[string]string
+	if t.config.FileMetadata != nil && !isLink {
+		extracted, err = t.config.FileMetadata.Extract(cleanedFilename, head)
+		if err != nil {
+			pusherFileMetadataErrors.WithLabelValues(t.datatype).Inc()
+			log.Printf("Could not extract the metadata of %s (error: %q)\n", cleanedFilename, err)
+			extracted = nil
+		}
 	}
 	header := &tar.Header{
 		Name:       string(cleanedFilename),
 		Mode:       0666,
 		Size:       size,
 		ModTime:    fstat.ModTime(),
-		PAXRecords: t.metadata,
+		PAXRecords: fileRecords(t.metadata, extracted),
 	}
+	if isLink {
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = link.target
+		if t.config.ControlChars != filename.ControlCharsReject {
+			header.Linkname = string(filename.Internal(link.target).Escape())
+		}
+	}
+	t.setPermissions(header, fstat)
+	var body io.Reader = reader
+	var hash [sha256.Size]byte
+	var stored func() [sha256.Size]byte
+	deduplicate := t.config.Deduplicate && size > 0
+	if deduplicate {
+		body, hash, stored, err = hashForDeduplication(file, reader, size)
+		if err != nil {
+			pusherFileReadErrors.WithLabelValues(t.datatype).Inc()
+			log.Printf("Could not read %s (error: %q)\n", cleanedFilename, err)
+			return nil
+		}
+		if original, ok := t.hashes[hash]; ok {
+			header.Typeflag = tar.TypeLink
+			header.Linkname = string(original)
+			header.Size = 0
+			pusherFilesDeduplicated.WithLabelValues(t.datatype).Inc()
+		}
+	}
+	var known *[sha256.Size]byte
+	if deduplicate {
+		known = &hash
+	}
+	body, contentsHash := t.hashContents(body, header, known)
 
-	// It's not at all clear how any of the below errors might be recovered from,
-	// so we treat them as unrecoverable using Must, and hope that the errors
-	// are transient and will not re-occur when the container is restarted.
-	rtx.Must(t.tarWriter.WriteHeader(header), "Could not write the tarfile header for %v", cleanedFilename)
-	_, err = io.Copy(t.tarWriter, contents)
-	rtx.Must(err, "Could not write the tarfile contents for %v", cleanedFilename)
-
-	// Flush the data so that our in-memory filesize is accurate.
-	rtx.Must(t.tarWriter.Flush(), "Could not flush the tarWriter")
-	rtx.Must(t.gzipWriter.Flush(), "Could not flush the gzipWriter")
+	// None of the below errors can be recovered from, because the tarfile has
+	// been partially written. They are returned so that the caller can abandon
+	// this tarfile without affecting any other.
+	if err = t.archive.WriteHeader(header); err != nil {
+		return t.failed(fmt.Errorf("Could not write the tarfile header for %v: %w", cleanedFilename, err))
+	}
+	size = header.Size
+	recorder := &readErrorRecorder{r: body}
+	n, err := io.CopyN(t.archive, recorder, size)
+	if err != nil && err != io.EOF && recorder.err == nil {
+		return t.failed(fmt.Errorf("Could not write the tarfile contents for %v: %w", cleanedFilename, err))
+	}
+	if n < size {
+		// The file could not be read to the end, or it shrank after we called
+		// Stat(). The header promised size bytes, and padding the entry would
+		// upload a corrupt copy of the file under its real name, so the
+		// tarfile is given up on instead. The file is not added to the
+		// members, so it will not be deleted, and the finder will eventually
+		// hand it to us again.
+		pusherFileReadErrors.WithLabelValues(t.datatype).Inc()
+		if err == nil || err == io.EOF {
+			err = recorder.err
+		}
+		return t.failed(fmt.Errorf("%w: could only read %d of %d bytes of %v (error: %v)", ErrShortRead, n, size, cleanedFilename, err))
+	}
 
-	if len(t.members) == 0 {
-		t.timeout = timerFactory(string(t.subdir))
+	if stored != nil && header.Typeflag != tar.TypeLink {
+		// The file was read twice, and what was stored is what counts.
+		hash = stored()
 	}
+
+	t.startTimer(timerFactory)
 	pusherFilesAdded.WithLabelValues(t.datatype).Inc()
+	t.config.Decisions.Record(t.datatype, decisionlog.Added, file.Name(), "", "")
 	t.members[cleanedFilename] = filename.System(file.Name())
+	t.sizes[cleanedFilename] = fstat.Size()
+	if t.config.Deduplicate && header.Typeflag != tar.TypeLink && size > 0 {
+		t.hashes[hash] = cleanedFilename
+	}
+	if t.config.Digest {
+		if t.digests == nil {
+			t.digests = make(map[filename.Internal][sha256.Size]byte)
+		}
+		t.digests[cleanedFilename] = contentsHash()
+	}
+	return nil
 }
 
-// Upload the contents of the tarfile and then delete the component files. This
-// function will never return unsuccessfully. If there are files to upload, this
-// method will keep trying until the upload succeeds.
-func (t *tarfile) UploadAndDelete(uploader uploader.Uploader) {
-	// Delete skipped files.
-	for _, filename := range t.skipped {
-		t.removeFile(filename, skipFile)
+// Flush pushes the files added so far through the compressor into the tarfile,
+// so that Size is accurate. Like Add, it returns an error only if writing to
+// the tarfile failed.
+func (t *tarfile) Flush() error {
+	if t.writeErr != nil {
+		return t.writeErr
+	}
+	if err := t.archive.Flush(); err != nil {
+		return t.failed(err)
 	}
+	return nil
+}
+
+// failed records the first write error and returns it.
+func (t *tarfile) failed(err error) error {
+	if t.writeErr == nil {
+		t.writeErr = err
+	}
+	pusherTarfileWriteErrors.WithLabelValues(t.datatype).Inc()
+	return t.writeErr
+}
+
+// readErrorRecorder remembers the error returned by the reader it wraps, which
+// allows read errors to be told apart from write errors after an io.Copy.
+type readErrorRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrorRecorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// Upload the contents of the tarfile and then delete the component files. If
+// there are files to upload, this method will keep trying until the upload
+// succeeds, the context is canceled, or the Config's limits make it give up.
+// Every attempt is given the context. It returns an error only if the tarfile
+// could not be finished or uploaded, in which case nothing is deleted and the
+// tarfile should be abandoned. Otherwise, the tarfile must not be used after
+// this method returns, because its buffer is recycled.
+func (t *tarfile) UploadAndDelete(ctx context.Context, uploader uploader.Uploader) error {
+	if t.writeErr != nil {
+		return t.writeErr
+	}
+	if len(t.members) > 0 {
+		if err := t.archive.Close(); err != nil {
+			return t.failed(err)
+		}
+	}
+	// The timer must be stopped even if every file was skipped, or it would
+	// fire for a tarfile that no longer exists.
+	t.stopTimer()
 
 	if len(t.members) == 0 {
+		if t.config.SkippedManifest && len(t.skipped) > 0 {
+			// There is no tarfile for the manifest to go next to.
+			t.logSkipped()
+		}
+		// Nothing is uploaded, so neither the time of the last successful
+		// upload nor the upload ages change.
+		t.remove(ctx, false)
+		t.release()
 		pusherEmptyUploads.WithLabelValues(t.datatype).Inc()
-		pusherSuccessTimestamp.WithLabelValues(t.datatype).SetToCurrentTime()
-		log.Println("uploadAndDelete called on an empty tarfile.")
-		return
+		log.Printf("Not uploading an empty tarfile, whose %d files were all skipped.\n", len(t.skipped))
+		return nil
 	}
-	if t.timeout != nil {
-		t.timeout.Stop()
+	if t.config.Verify {
+		if err := t.verify(); err != nil {
+			return t.corrupt(err)
+		}
 	}
-	t.tarWriter.Close()
-	t.gzipWriter.Close()
 	pusherFilesPerTarfile.WithLabelValues(t.datatype).Observe(float64(len(t.members)))
 	pusherBytesPerTarfile.WithLabelValues(t.datatype).Observe(float64(t.contents.Len()))
 	bytes := t.contents.Bytes()
-	// Try to upload until the upload succeeds.
-	backoff.Retry(
+	metadata := t.uploadMetadata()
+	// Try to upload until the upload succeeds or we give up.
+	start := time.Now()
+	attempts := 0
+	// The context is canceled once the upload is over, to tell the uploader
+	// that it will not be retried.
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if t.config.UploadDeadline > 0 {
+		uploadCtx, cancel = context.WithTimeout(uploadCtx, t.config.UploadDeadline)
+		defer cancel()
+	}
+	err := backoff.RetryBudget(
 		func() error {
-			return uploader.Upload(t.subdir, bytes)
+			attempts++
+			var err error
+			t.uploaded, err = uploader.Upload(uploadCtx, t.uploadID, t.subdir, bytes, metadata)
+			ages.attempted(t.datatype, err == nil, time.Now())
+			t.config.Sink.Count("pusher.upload_attempts", 1, metrics.Tags{"datatype": t.datatype, "result": resultOf(err)})
+			return err
 		},
 		time.Duration(100)*time.Millisecond,
 		time.Duration(5)*time.Minute,
+		t.config.UploadBackoff,
+		backoff.Budget{
+			Attempts: t.config.MaxUploadAttempts,
+			Duration: t.config.UploadDeadline,
+			OnRetry: func(attempt int, err error, next time.Duration) bool {
+				pusherUploadRetryDelay.WithLabelValues(t.datatype).Set(next.Seconds())
+				if attempt == t.config.StuckAttempts {
+					t.reportStuck(UploadStuck, attempt, start, err)
+				}
+				return true
+			},
+			Context: uploadCtx,
+		},
 		"upload",
 	)
+	pusherUploadRetryDelay.WithLabelValues(t.datatype).Set(0)
+	t.config.Sink.Count("pusher.uploads", 1, metrics.Tags{"datatype": t.datatype, "result": resultOf(err)})
+	if err != nil {
+		if attempts == t.config.MaxUploadAttempts {
+			return fmt.Errorf("%w after %d attempts: %v", ErrUploadGaveUp, attempts, err)
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w because it was canceled after %d attempts: %v", ErrUploadGaveUp, attempts, err)
+		}
+		pusherUploadDeadlinesExceeded.WithLabelValues(t.datatype).Inc()
+		return fmt.Errorf("%w after %s (the upload deadline): %v", ErrUploadGaveUp, time.Since(start), err)
+	}
+	log.Printf("Uploaded %d files from %s to %s (%s in %s)\n", len(t.members), t.subdir, t.uploaded.Destination, bytesize.Format(t.uploaded.Size), t.uploaded.Duration)
+	if t.config.StuckAttempts > 0 && attempts > t.config.StuckAttempts {
+		t.reportStuck(UploadRecovered, attempts, start, nil)
+	}
+	pusherBytesUploaded.WithLabelValues(t.datatype).Add(float64(t.uploaded.Size))
+	t.config.Sink.Count("pusher.upload_bytes", t.uploaded.Size, metrics.Tags{"datatype": t.datatype})
+	t.config.Sink.Timing("pusher.upload_duration", t.uploaded.Duration, metrics.Tags{"datatype": t.datatype})
+	for _, f := range t.members {
+		t.config.Decisions.Record(t.datatype, decisionlog.Uploaded, string(f), t.uploaded.Destination, "")
+	}
+	if t.config.Digest {
+		log.Printf("The digest of %s is %s\n", t.uploaded.Destination, t.Digest())
+	}
+	if a, ok := t.archive.(*tarArchive); ok && a.members != nil {
+		t.uploadSide(ctx, "index", IndexSuffix, a.index)
+	}
+	if t.config.SkippedManifest && len(t.skipped) > 0 {
+		if !t.uploadSide(ctx, "skipped_manifest", SkippedSuffix, t.skippedManifest()) {
+			t.logSkipped()
+		}
+	}
+	t.release()
 	pusherTarfilesUploaded.WithLabelValues(t.datatype).Inc()
 	pusherSuccessTimestamp.WithLabelValues(t.datatype).SetToCurrentTime()
-	for _, filename := range t.members {
-		t.removeFile(filename, addFile)
+	t.remove(ctx, true)
+	return nil
+}
+
+// corrupt counts and logs a tarfile that failed verification, spools it if
+// Config.VerifySpoolDir is set, and returns the error for UploadAndDelete.
+func (t *tarfile) corrupt(err error) error {
+	spooled := "false"
+	if t.config.VerifySpoolDir != "" {
+		if name, spoolErr := t.spoolCorrupt(); spoolErr != nil {
+			log.Printf("Could not spool the corrupt tarfile for %s (error: %q)\n", t.subdir, spoolErr)
+		} else {
+			spooled = "true"
+			log.Printf("Spooled the corrupt tarfile for %s to %s\n", t.subdir, name)
+		}
+	}
+	pusherTarfilesCorrupt.WithLabelValues(t.datatype, spooled).Inc()
+	return fmt.Errorf("%w: %v", ErrCorrupt, err)
+}
+
+// uploadSide makes one attempt to upload a side file of the tarfile, holding v
+// as JSON, next to it, and returns whether it succeeded. The files are deleted
+// whether or not it does: a seekable tarfile is still seekable, and its index
+// can be rebuilt by reading the size of each gzip member. The kind labels the
+// metrics, so it is in snake case.
+func (t *tarfile) uploadSide(ctx context.Context, kind, suffix string, v interface{}) bool {
+	name := strings.ReplaceAll(kind, "_", " ")
+	if t.uploaded.Side == nil {
+		pusherSideUploads.WithLabelValues(t.datatype, kind, "unsupported").Inc()
+		log.Printf("Could not upload the %s of %s, because the uploader can't put files next to it\n", name, t.uploaded.Destination)
+		return false
+	}
+	data, err := json.Marshal(v)
+	if err == nil {
+		err = t.uploaded.Side(ctx, suffix, data)
+	}
+	if err != nil {
+		pusherSideUploads.WithLabelValues(t.datatype, kind, "error").Inc()
+		log.Printf("Could not upload the %s of %s (error: %q)\n", name, t.uploaded.Destination, err)
+		return false
+	}
+	pusherSideUploads.WithLabelValues(t.datatype, kind, "ok").Inc()
+	return true
+}
+
+// resultOf describes the outcome of an upload for the metrics.
+func resultOf(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// removal is a file to remove, and why it is being removed.
+type removal struct {
+	name      filename.System
+	condition string
+}
+
+// remove removes the files like removeAll, unless Config.DeferRemoval is set,
+// in which case they are left for Remove.
+func (t *tarfile) remove(ctx context.Context, members bool) {
+	if t.config.DeferRemoval {
+		t.removalDeferred = true
+		t.removeMembers = members
+		return
+	}
+	t.removeAll(ctx, members)
+}
+
+// Remove removes the files that UploadAndDelete left in place because
+// Config.DeferRemoval is set. Otherwise, or if it was already called, it does
+// nothing. The files that could not be removed are then returned by
+// Undeletable.
+func (t *tarfile) Remove(ctx context.Context) {
+	if !t.removalDeferred {
+		return
+	}
+	t.removalDeferred = false
+	t.removeAll(ctx, t.removeMembers)
+}
+
+// removeAll removes the files that were skipped rather than added, and the
+// members too if members is true. They are removed in order, so that the files
+// of each directory are removed together, in batches of Config.RemoveBatchSize.
+func (t *tarfile) removeAll(ctx context.Context, members bool) {
+	removals := make([]removal, 0, len(t.skipped)+len(t.members))
+	for _, f := range t.skipped {
+		removals = append(removals, removal{f, skipFile})
+	}
+	if members {
+		for _, f := range t.members {
+			removals = append(removals, removal{f, addFile})
+		}
+	}
+	sort.Slice(removals, func(i, j int) bool { return removals[i].name < removals[j].name })
+	if t.config.KeepFiles {
+		for _, r := range removals {
+			pusherFilesKept.WithLabelValues(t.datatype, r.condition).Inc()
+			t.config.Decisions.Record(t.datatype, decisionlog.Kept, string(r.name), "", r.condition)
+			t.kept = append(t.kept, r.name)
+		}
+		if len(removals) > 0 {
+			log.Printf("Kept the %d files of %s, which would have been removed (uploaded to %q)\n", len(removals), t.subdir, t.uploaded.Destination)
+		}
+		return
+	}
+	batchSize := t.config.RemoveBatchSize
+	if batchSize <= 0 {
+		batchSize = len(removals)
+	}
+	for start := 0; start < len(removals); start += batchSize {
+		end := start + batchSize
+		if end > len(removals) {
+			end = len(removals)
+		}
+		dirs := make(map[string]struct{})
+		for _, r := range removals[start:end] {
+			t.removeFile(r.name, r.condition)
+			dirs[filepath.Dir(string(r.name))] = struct{}{}
+		}
+		if t.config.SyncRemovedDirs {
+			for dir := range dirs {
+				t.syncDir(dir)
+			}
+		}
+		if end < len(removals) && t.config.RemoveBatchPause > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(t.config.RemoveBatchPause):
+			}
+		}
+	}
+}
+
+// syncDir syncs a directory, so that the removal of its files is durable.
+func (t *tarfile) syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err == nil {
+		err = d.Sync()
+		d.Close()
+	}
+	if err != nil {
+		pusherDirectorySyncErrors.WithLabelValues(t.datatype).Inc()
+		log.Printf("Could not sync the directory %s (error: %q)\n", dir, err)
+	}
+}
+
+// Abandon discards the tarfile without uploading or deleting anything, and
+// returns the names of all the files that were added to it, including the
+// skipped ones.
+func (t *tarfile) Abandon() []filename.System {
+	t.stopTimer()
+	t.release()
+	return t.Files()
+}
+
+// Files returns the files that were added to the tarfile or skipped by it.
+func (t *tarfile) Files() []filename.System {
+	files := make([]filename.System, 0, len(t.members)+len(t.skipped))
+	for _, f := range t.members {
+		files = append(files, f)
+	}
+	for _, f := range t.skipped {
+		files = append(files, f)
+	}
+	return files
+}
+
+// startTimer starts the age timer, unless it has already been started.
+func (t *tarfile) startTimer(timerFactory func(string) *time.Timer) {
+	if t.firstAdded.IsZero() {
+		t.timeout = timerFactory(string(t.subdir))
+		t.firstAdded = time.Now()
+	}
+}
+
+// stopTimer stops the age timer, if it was started.
+func (t *tarfile) stopTimer() {
+	if t.timeout != nil {
+		t.timeout.Stop()
+		t.timeout = nil
+	}
+}
+
+// setPermissions fills in the mode and ownership fields of the header according
+// to the tarfile's config.
+func (t *tarfile) setPermissions(header *tar.Header, fstat os.FileInfo) {
+	if t.config.PreserveMode {
+		header.Mode = int64(fstat.Mode().Perm())
+	}
+	if t.config.Owner != nil {
+		header.Uid = t.config.Owner.UID
+		header.Gid = t.config.Owner.GID
+	} else if t.config.PreserveOwner {
+		if uid, gid, ok := ownerOf(fstat); ok {
+			header.Uid = uid
+			header.Gid = gid
+		}
 	}
 }
 
+// release returns the tarfile's buffer to the pool.
+func (t *tarfile) release() {
+	putBuffer(t.contents)
+	t.contents = nil
+}
+
+// Size returns the compressed size of the tarfile so far. Files added since
+// the last Flush may not be counted yet.
 func (t tarfile) Size() bytecount.ByteCount {
+	if t.contents == nil {
+		return 0
+	}
 	return bytecount.ByteCount(t.contents.Len())
 }
 
+// EstimatedSize returns the size the tarfile would have if it were flushed.
+// Files added since the last Flush are counted at their uncompressed size, so
+// the estimate is usually too big, and is exact right after a Flush.
+func (t tarfile) EstimatedSize() bytecount.ByteCount {
+	if t.contents == nil {
+		return 0
+	}
+	return bytecount.ByteCount(int64(t.contents.Len()) + t.archive.Pending())
+}
+
+// Count returns the number of files in the tarfile.
+func (t tarfile) Count() int {
+	return len(t.members)
+}
+
+// FirstAdded returns the time the first file was added to or skipped by the
+// tarfile, which is when its age timer started. It is the zero time if the
+// tarfile is empty.
+func (t tarfile) FirstAdded() time.Time {
+	return t.firstAdded
+}
+
 // SkippedCount returns the number of files skipped in the tarfile given
 // the datatype's file upload ratio.
 func (t tarfile) SkippedCount() int {
 	return len(t.skipped)
 }
 
-func (t tarfile) removeFile(filename filename.System, condition string) {
+func (t *tarfile) removeFile(filename filename.System, condition string) {
 	// If the file can't be removed, then it either was already removed or the
 	// remove call failed for some unknown reason (permissions, maybe?). If the
 	// file still exists after this attempted remove, then it should eventually
-	// get picked up by the finder.
+	// get picked up by the finder. The file is stat'ed first, so that the
+	// bytes removed can be counted.
+	var size int64
+	if info, err := os.Lstat(string(filename)); err == nil {
+		size = info.Size()
+	}
 	if err := os.Remove(string(filename)); err == nil {
 		pusherFilesRemoved.WithLabelValues(t.datatype, condition).Inc()
+		pusherBytesRemoved.WithLabelValues(t.datatype, condition).Add(float64(size))
+		t.config.Decisions.Record(t.datatype, decisionlog.Deleted, string(filename), "", condition)
 	} else {
 		pusherFileRemoveErrors.WithLabelValues(t.datatype, condition).Inc()
 		log.Printf("Failed to remove %s file %v (error: %q)\n", condition, filename, err)
+		if !os.IsNotExist(err) {
+			t.undeletable = append(t.undeletable, filename)
+		}
+	}
+}
+
+// Undeletable returns the files that UploadAndDelete uploaded (or skipped) but
+// could not delete, e.g. because the filesystem is read-only.
+func (t *tarfile) Undeletable() []filename.System {
+	return t.undeletable
+}
+
+// Kept returns the files that UploadAndDelete, or Remove, left in place because
+// of Config.KeepFiles.
+func (t *tarfile) Kept() []filename.System {
+	return t.kept
+}
+
+// Uploaded returns where UploadAndDelete uploaded the tarfile. It is the zero
+// Result if the tarfile was empty or has not been uploaded.
+func (t *tarfile) Uploaded() uploader.Result {
+	return t.uploaded
+}
+
+// MissingBytes returns the total size of the members whose files no longer
+// exist, e.g. because something else removed them after they were added. The
+// tarfile holds the only copy of their contents until it is uploaded. It stats
+// every member, so it should not be called often.
+func (t *tarfile) MissingBytes() bytecount.ByteCount {
+	if t.contents == nil {
+		// The tarfile has been uploaded or abandoned.
+		return 0
+	}
+	missing := int64(0)
+	for name, f := range t.members {
+		if _, err := os.Lstat(string(f)); os.IsNotExist(err) {
+			missing += t.sizes[name]
+		}
 	}
+	return bytecount.ByteCount(missing)
 }
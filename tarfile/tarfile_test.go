@@ -1,18 +1,36 @@
 package tarfile_test
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/go/testingx"
+	"github.com/m-lab/pusher/decisionlog"
 	"github.com/m-lab/pusher/filename"
+	"github.com/m-lab/pusher/namer"
 	"github.com/m-lab/pusher/tarfile"
+	"github.com/m-lab/pusher/uploader"
 )
 
 var timerFactoryCalls = 0
@@ -38,6 +56,62 @@ func (_ unreadableioFile) Read(_ []byte) (int, error) {
 	return 0, errors.New("This can't be read")
 }
 
+// failsPartwayFile returns an error once it has read more than limit bytes.
+type failsPartwayFile struct {
+	*os.File
+	limit int
+	read  int
+}
+
+func (f *failsPartwayFile) Read(p []byte) (int, error) {
+	if f.read >= f.limit {
+		return 0, errors.New("This can't be read any further")
+	}
+	n, err := f.File.Read(p)
+	f.read += n
+	return n, err
+}
+
+func TestAddShortRead(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tarfile.TestAddShortRead")
+	rtx.Must(err, "Could not create temp dir")
+	defer os.RemoveAll(tmp)
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(tmp), "Could not chdir to the tempdir")
+	defer os.Chdir(oldDir)
+
+	big := make([]byte, 200000)
+	rtx.Must(ioutil.WriteFile("bigfile", big, 0666), "Could not write bigfile")
+	rtx.Must(ioutil.WriteFile("tinyfile", []byte("abcdefgh"), 0666), "Could not write tinyfile")
+	bigf, err := os.Open("bigfile")
+	rtx.Must(err, "Could not open bigfile")
+	tinyf, err := os.Open("tinyfile")
+	rtx.Must(err, "Could not open tinyfile")
+
+	tf := tarfile.New("test", "", 1, map[string]string{}, tarfile.Config{})
+	timerFactory := func(string) *time.Timer { return time.NewTimer(time.Hour) }
+	rtx.Must(tf.Add("tinyfile", tinyf, timerFactory), "Could not add tinyfile")
+	// A truncated copy of the file must never be uploaded, so the tarfile
+	// can't be used any more.
+	if err := tf.Add("bigfile", &failsPartwayFile{File: bigf, limit: 100000}, timerFactory); !errors.Is(err, tarfile.ErrShortRead) {
+		t.Errorf("Add() = %v, want ErrShortRead", err)
+	}
+	if err := tf.UploadAndDelete(context.Background(), &uploaderThatSavesLocallyInstead{"file.tgz"}); err == nil {
+		t.Error("The tarfile should not have been uploaded")
+	}
+	// Abandoning it hands back the files that were added whole, to be added
+	// to another tarfile, and leaves every file in place.
+	if files := tf.Abandon(); len(files) != 1 || files[0] != "tinyfile" {
+		t.Errorf("Abandon() = %v, want just tinyfile", files)
+	}
+	for _, f := range []string{"bigfile", "tinyfile"} {
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("%s should not have been deleted: %v", f, err)
+		}
+	}
+}
+
 func TestAdd(t *testing.T) {
 	tmp, err := ioutil.TempDir("", "tarfile.TestAdd")
 	rtx.Must(err, "Could not create temp dir")
@@ -47,7 +121,7 @@ func TestAdd(t *testing.T) {
 	rtx.Must(os.Chdir(tmp), "Could not chdir to the tempdir")
 	defer os.Chdir(oldDir)
 	timerFactoryCalls = 0
-	tf := tarfile.New("test", "", 1, map[string]string{})
+	tf := tarfile.New("test", "", 1, map[string]string{}, tarfile.Config{})
 	ioutil.WriteFile("tinyfile", []byte("abcdefgh"), os.FileMode(0666))
 	if tf.Size() != 0 {
 		t.Errorf("Tarfile size is nonzero before anything is added to it")
@@ -70,6 +144,38 @@ func TestAdd(t *testing.T) {
 	}
 }
 
+func TestAddDoesNotFlush(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tarfile.TestAddDoesNotFlush")
+	rtx.Must(err, "Could not create temp dir")
+	defer os.RemoveAll(tmp)
+	tf := tarfile.New("test", "", 1, map[string]string{}, tarfile.Config{})
+	for _, name := range []string{"a", "b"} {
+		rtx.Must(ioutil.WriteFile(tmp+"/"+name, []byte(strings.Repeat(name, 1000)), 0666), "Could not write %s", name)
+		f, err := os.Open(tmp + "/" + name)
+		rtx.Must(err, "Could not open %s", name)
+		rtx.Must(tf.Add(filename.Internal(name), f, nilTimerFactory), "Could not add %s", name)
+		f.Close()
+	}
+	// Until the tarfile is flushed, the files are estimated at their
+	// uncompressed size, plus their headers, but the size is what has been
+	// compressed so far.
+	estimate := tf.EstimatedSize()
+	if tf.Count() != 2 || estimate < 2*(512+1000) {
+		t.Errorf("%d files were added, and the estimate %d does not count them", tf.Count(), estimate)
+	}
+	if size := tf.Size(); size >= estimate {
+		t.Errorf("Before flushing, the size %d should be less than the estimate %d", size, estimate)
+	}
+	rtx.Must(tf.Flush(), "Could not flush")
+	if size := tf.Size(); size >= estimate || size == 0 || tf.EstimatedSize() != size {
+		t.Errorf("After flushing, the size %d should be less than the estimate %d, which should now be exact", size, estimate)
+	}
+	rtx.Must(tf.UploadAndDelete(context.Background(), &uploaderThatSavesLocallyInstead{tmp + "/archive.tgz"}), "Could not upload")
+	if headers := readHeaders(t, tmp+"/archive.tgz"); len(headers) != 2 || headers[0].Name != "a" || headers[1].Name != "b" {
+		t.Errorf("Bad headers %v", headers)
+	}
+}
+
 func TestAddSkipped(t *testing.T) {
 	tmp, err := ioutil.TempDir("", "tarfile.TestAdd")
 	testingx.Must(t, err, "Could not create temp dir")
@@ -80,7 +186,7 @@ func TestAddSkipped(t *testing.T) {
 	defer os.Chdir(oldDir)
 
 	// File ratio = 0 means all files should be skipped.
-	tf := tarfile.New("test", "", 0, map[string]string{})
+	tf := tarfile.New("test", "", 0, map[string]string{}, tarfile.Config{})
 	ioutil.WriteFile("tinyfile", []byte("abcdefgh"), os.FileMode(0666))
 	f, err := os.Open("tinyfile")
 	testingx.Must(t, err, "Could not open tinyfile")
@@ -100,9 +206,51 @@ func TestAddSkipped(t *testing.T) {
 		t.Errorf("Skipped count should still be 1")
 	}
 }
+
+func TestSkippedFilesStartAndStopTheTimer(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tarfile.TestSkippedFilesStartAndStopTheTimer")
+	testingx.Must(t, err, "Could not create temp dir")
+	defer os.RemoveAll(tmp)
+	oldDir, err := os.Getwd()
+	testingx.Must(t, err, "Could not get working directory")
+	testingx.Must(t, os.Chdir(tmp), "Could not chdir to the tempdir")
+	defer os.Chdir(oldDir)
+
+	// File ratio = 0 means all files should be skipped.
+	tf := tarfile.New("test", "", 0, map[string]string{}, tarfile.Config{})
+	fired := make(chan struct{})
+	timers := 0
+	timerFactory := func(string) *time.Timer {
+		timers++
+		return time.AfterFunc(50*time.Millisecond, func() { close(fired) })
+	}
+	for _, name := range []string{"file1", "file2"} {
+		ioutil.WriteFile(name, []byte("abcdefgh"), os.FileMode(0666))
+		f, err := os.Open(name)
+		testingx.Must(t, err, "Could not open %s", name)
+		tf.Add(filename.Internal(name), f, timerFactory)
+	}
+	if timers != 1 {
+		t.Errorf("Exactly one timer should have been started, not %d", timers)
+	}
+	if tf.FirstAdded().IsZero() {
+		t.Error("FirstAdded should be set by a skipped file")
+	}
+	// The upload of a tarfile of only skipped files must stop the timer.
+	testingx.Must(t, tf.UploadAndDelete(context.Background(), nil), "Could not upload")
+	select {
+	case <-fired:
+		t.Error("The timer fired after the tarfile was uploaded")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := os.Stat("file1"); err == nil {
+		t.Error("Skipped files should be deleted")
+	}
+}
+
 func TestUploadAndDeleteOnEmpty(t *testing.T) {
-	tf := tarfile.New("test", "", 1, map[string]string{})
-	tf.UploadAndDelete(nil) // If this doesn't crash, then the test passes.
+	tf := tarfile.New("test", "", 1, map[string]string{}, tarfile.Config{})
+	tf.UploadAndDelete(context.Background(), nil) // If this doesn't crash, then the test passes.
 }
 
 type fakeUploader struct {
@@ -112,7 +260,7 @@ type fakeUploader struct {
 	expectedDir      string
 }
 
-func (f *fakeUploader) Upload(dir filename.System, contents []byte) error {
+func (f *fakeUploader) Upload(_ context.Context, _ uploader.ID, dir filename.System, contents []byte, _ map[string]string) (uploader.Result, error) {
 	if f.expectedDir != "" && string(dir) != f.expectedDir {
 		log.Fatalf("Upload to unexpected directory: %v != %v\n", dir, f.expectedDir)
 	}
@@ -120,9 +268,9 @@ func (f *fakeUploader) Upload(dir filename.System, contents []byte) error {
 	f.calls++
 	if f.requestedRetries > 0 {
 		f.requestedRetries--
-		return errors.New("A fake error to trigger retry logic")
+		return uploader.Result{}, errors.New("A fake error to trigger retry logic")
 	}
-	return nil
+	return uploader.Result{Destination: "fake://" + string(dir), Size: int64(len(contents))}, nil
 }
 
 func TestUploadAndDelete(t *testing.T) {
@@ -143,11 +291,288 @@ func TestUploadAndDelete(t *testing.T) {
 	f2, err := os.Open("disappearing")
 	rtx.Must(err, "Could not open file we just wrote")
 	rtx.Must(os.Remove("disappearing"), "Could not delete file")
-	tf := tarfile.New("test", "", 1, map[string]string{})
+	tf := tarfile.New("test", "", 1, map[string]string{}, tarfile.Config{})
 	timerFactory := func(string) *time.Timer { return time.NewTimer(time.Hour) }
 	tf.Add("tinyfile", f, timerFactory)
 	tf.Add("disappearing", f2, timerFactory)
-	tf.UploadAndDelete(&fakeUploader{})
+	tf.UploadAndDelete(context.Background(), &fakeUploader{})
+	if files := tf.Undeletable(); len(files) != 0 {
+		t.Errorf("Files that are already gone are not undeletable: %v", files)
+	}
+	if r := tf.Uploaded(); r.Destination != "fake://test" || r.Size == 0 {
+		t.Errorf("Uploaded() should say where the tarfile went, not %+v", r)
+	}
+}
+
+func TestDecisions(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tarfile.TestDecisions")
+	rtx.Must(err, "Could not create temp dir")
+	defer os.RemoveAll(tmp)
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(tmp), "Could not chdir to the tempdir")
+	defer os.Chdir(oldDir)
+	rtx.Must(os.Mkdir("log", 0777), "Could not create the log dir")
+	decisions, err := decisionlog.Open("log", 0, 0)
+	rtx.Must(err, "Could not open the decision log")
+	rtx.Must(ioutil.WriteFile("tinyfile", []byte("abcdefgh"), 0666), "Could not write tinyfile")
+	f, err := os.Open("tinyfile")
+	rtx.Must(err, "Could not open file we just wrote")
+	tf := tarfile.New("test", "test", 1, map[string]string{}, tarfile.Config{Decisions: decisions})
+	tf.Add("tinyfile", f, func(string) *time.Timer { return time.NewTimer(time.Hour) })
+	rtx.Must(tf.UploadAndDelete(context.Background(), &fakeUploader{}), "Could not upload")
+	rtx.Must(decisions.Close(), "Could not close the decision log")
+
+	names, err := filepath.Glob("log/decisions-*.jsonl")
+	rtx.Must(err, "Could not list the decision log")
+	if len(names) != 1 {
+		t.Fatalf("Found %v instead of one day's decision log", names)
+	}
+	contents, err := ioutil.ReadFile(names[0])
+	rtx.Must(err, "Could not read the decision log")
+	var actions []decisionlog.Action
+	for _, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+		var e decisionlog.Entry
+		rtx.Must(json.Unmarshal([]byte(line), &e), "Could not parse %q", line)
+		if e.File != "tinyfile" || e.Datatype != "test" {
+			t.Errorf("Logged %+v", e)
+		}
+		actions = append(actions, e.Action)
+	}
+	if want := []decisionlog.Action{decisionlog.Added, decisionlog.Uploaded, decisionlog.Deleted}; !reflect.DeepEqual(actions, want) {
+		t.Errorf("Logged %v, want %v", actions, want)
+	}
+}
+
+func TestKeepFiles(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tarfile.TestKeepFiles")
+	rtx.Must(err, "Could not create temp dir")
+	defer os.RemoveAll(tmp)
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(tmp), "Could not chdir to the tempdir")
+	defer os.Chdir(oldDir)
+	rtx.Must(ioutil.WriteFile("tinyfile", []byte("abcdefgh"), 0666), "Could not write tinyfile")
+	f, err := os.Open("tinyfile")
+	rtx.Must(err, "Could not open file we just wrote")
+	tf := tarfile.New("test", "", 1, map[string]string{}, tarfile.Config{KeepFiles: true})
+	tf.Add("tinyfile", f, func(string) *time.Timer { return time.NewTimer(time.Hour) })
+	rtx.Must(tf.UploadAndDelete(context.Background(), &fakeUploader{}), "Could not upload")
+	if _, err := os.Stat("tinyfile"); err != nil {
+		t.Errorf("The file should have been kept: %v", err)
+	}
+	if files := tf.Kept(); !reflect.DeepEqual(files, []filename.System{"tinyfile"}) {
+		t.Errorf("The kept files should be [tinyfile], not %v", files)
+	}
+	if files := tf.Undeletable(); len(files) != 0 {
+		t.Errorf("The kept file should not be undeletable: %v", files)
+	}
+}
+
+func TestUploadAndDeleteRemovesInBatches(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tarfile.TestUploadAndDeleteRemovesInBatches")
+	rtx.Must(err, "Could not create temp dir")
+	defer os.RemoveAll(tmp)
+	tf := tarfile.New("test", "", 1, map[string]string{}, tarfile.Config{
+		RemoveBatchSize:  2,
+		RemoveBatchPause: 50 * time.Millisecond,
+		SyncRemovedDirs:  true,
+	})
+	names := []string{"a", "b", "c", "d", "e"}
+	for _, name := range names {
+		rtx.Must(ioutil.WriteFile(tmp+"/"+name, []byte("abcdefgh"), 0666), "Could not write %s", name)
+		f, err := os.Open(tmp + "/" + name)
+		rtx.Must(err, "Could not open %s", name)
+		rtx.Must(tf.Add(filename.Internal(name), f, nilTimerFactory), "Could not add %s", name)
+		f.Close()
+	}
+	start := time.Now()
+	rtx.Must(tf.UploadAndDelete(context.Background(), &fakeUploader{}), "Could not upload")
+	// Three batches, with a pause between each.
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Removing the files took %v, which is too short for two pauses", elapsed)
+	}
+	for _, name := range names {
+		if _, err := os.Stat(tmp + "/" + name); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed (%v)", name, err)
+		}
+	}
+}
+
+func TestUploadAndDeleteDefersRemoval(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tarfile.TestUploadAndDeleteDefersRemoval")
+	rtx.Must(err, "Could not create temp dir")
+	defer os.RemoveAll(tmp)
+	tf := tarfile.New("test", "", 1, map[string]string{}, tarfile.Config{DeferRemoval: true})
+	rtx.Must(ioutil.WriteFile(tmp+"/a", []byte("abcdefgh"), 0666), "Could not write a")
+	f, err := os.Open(tmp + "/a")
+	rtx.Must(err, "Could not open a")
+	rtx.Must(tf.Add("a", f, nilTimerFactory), "Could not add a")
+	f.Close()
+	rtx.Must(tf.UploadAndDelete(context.Background(), &fakeUploader{}), "Could not upload")
+	if _, err := os.Stat(tmp + "/a"); err != nil {
+		t.Errorf("The file should be left for Remove (%v)", err)
+	}
+	tf.Remove(context.Background())
+	if _, err := os.Stat(tmp + "/a"); !os.IsNotExist(err) {
+		t.Errorf("Remove should have removed the file (%v)", err)
+	}
+}
+
+func TestMissingBytes(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tarfile.TestMissingBytes")
+	rtx.Must(err, "Could not create temp dir")
+	defer os.RemoveAll(tmp)
+	tf := tarfile.New("test", "", 1, map[string]string{}, tarfile.Config{})
+	for name, size := range map[string]int{"kept": 10, "removed": 100} {
+		rtx.Must(ioutil.WriteFile(tmp+"/"+name, make([]byte, size), 0666), "Could not write %s", name)
+		f, err := os.Open(tmp + "/" + name)
+		rtx.Must(err, "Could not open %s", name)
+		rtx.Must(tf.Add(filename.Internal(name), f, nilTimerFactory), "Could not add %s", name)
+		f.Close()
+	}
+	if missing := tf.MissingBytes(); missing != 0 {
+		t.Errorf("MissingBytes() = %d before any file was removed", missing)
+	}
+	rtx.Must(os.Remove(tmp+"/removed"), "Could not remove the file")
+	if missing := tf.MissingBytes(); missing != 100 {
+		t.Errorf("MissingBytes() = %d, want 100", missing)
+	}
+	rtx.Must(tf.UploadAndDelete(context.Background(), &fakeUploader{}), "Could not upload")
+	if missing := tf.MissingBytes(); missing != 0 {
+		t.Errorf("MissingBytes() = %d after the upload", missing)
+	}
+}
+
+func TestUploadAndDeleteGivesUp(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tarfile.TestUploadAndDeleteGivesUp")
+	rtx.Must(err, "Could not create temp dir")
+	defer os.RemoveAll(tmp)
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(tmp), "Could not chdir to the tempdir")
+	defer os.Chdir(oldDir)
+	ioutil.WriteFile("tinyfile", []byte("abcdefgh"), os.FileMode(0666))
+	f, err := os.Open("tinyfile")
+	rtx.Must(err, "Could not open file we just wrote")
+
+	tf := tarfile.New("test", "", 1, map[string]string{}, tarfile.Config{MaxUploadAttempts: 3})
+	tf.Add("tinyfile", f, func(string) *time.Timer { return time.NewTimer(time.Hour) })
+	up := &fakeUploader{requestedRetries: 5}
+	if err := tf.UploadAndDelete(context.Background(), up); !errors.Is(err, tarfile.ErrUploadGaveUp) {
+		t.Errorf("UploadAndDelete should have given up, not returned %v", err)
+	}
+	if up.calls != 3 {
+		t.Errorf("The upload was tried %d times instead of 3", up.calls)
+	}
+	if _, err = os.Stat("tinyfile"); err != nil {
+		t.Error("A file that was not uploaded should not be removed")
+	}
+	if files := tf.Abandon(); len(files) != 1 {
+		t.Errorf("Abandon should return the file that was not uploaded, not %v", files)
+	}
+}
+
+func TestStuckUploadsAreReported(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tarfile.TestStuckUploadsAreReported")
+	rtx.Must(err, "Could not create temp dir")
+	defer os.RemoveAll(tmp)
+	rtx.Must(ioutil.WriteFile(tmp+"/tinyfile", []byte("abcdefgh"), 0666), "Could not write the file")
+	f, err := os.Open(tmp + "/tinyfile")
+	rtx.Must(err, "Could not open file we just wrote")
+
+	var events []tarfile.StuckEvent
+	tf := tarfile.New("2026/10/16", "ndt7", 1, map[string]string{}, tarfile.Config{
+		StuckAttempts: 2,
+		OnStuck:       func(e tarfile.StuckEvent) { events = append(events, e) },
+	})
+	tf.Add("tinyfile", f, func(string) *time.Timer { return time.NewTimer(time.Hour) })
+	up := &fakeUploader{requestedRetries: 3}
+	rtx.Must(tf.UploadAndDelete(context.Background(), up), "Could not upload the tarfile")
+	if len(events) != 2 {
+		t.Fatalf("Got %d events instead of 2: %+v", len(events), events)
+	}
+	stuck, recovered := events[0], events[1]
+	if stuck.Event != tarfile.UploadStuck || stuck.Attempts != 2 || stuck.Datatype != "ndt7" || stuck.Subdir != "2026/10/16" ||
+		stuck.Files != 1 || stuck.Bytes != len(up.contents) || stuck.LastError == "" || stuck.Destination != "" {
+		t.Errorf("Bad stuck event %+v", stuck)
+	}
+	if recovered.Event != tarfile.UploadRecovered || recovered.Attempts != 4 || recovered.Since != stuck.Since || recovered.Destination != "fake://2026/10/16" {
+		t.Errorf("Bad recovered event %+v", recovered)
+	}
+
+	// An upload that succeeds soon enough is not reported.
+	events = nil
+	rtx.Must(ioutil.WriteFile(tmp+"/tinyfile", []byte("abcdefgh"), 0666), "Could not write the file")
+	f, err = os.Open(tmp + "/tinyfile")
+	rtx.Must(err, "Could not open the file")
+	tf = tarfile.New("2026/10/16", "ndt7", 1, map[string]string{}, tarfile.Config{
+		StuckAttempts: 2,
+		OnStuck:       func(e tarfile.StuckEvent) { events = append(events, e) },
+	})
+	tf.Add("tinyfile", f, func(string) *time.Timer { return time.NewTimer(time.Hour) })
+	rtx.Must(tf.UploadAndDelete(context.Background(), &fakeUploader{requestedRetries: 1}), "Could not upload the tarfile")
+	if len(events) != 0 {
+		t.Errorf("An upload that failed once was reported: %+v", events)
+	}
+}
+
+func TestUploadAndDeleteGivesUpAfterTheDeadline(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tarfile.TestUploadAndDeleteGivesUpAfterTheDeadline")
+	rtx.Must(err, "Could not create temp dir")
+	defer os.RemoveAll(tmp)
+	rtx.Must(ioutil.WriteFile(tmp+"/tinyfile", []byte("abcdefgh"), os.FileMode(0666)), "Could not write file")
+	f, err := os.Open(tmp + "/tinyfile")
+	rtx.Must(err, "Could not open file we just wrote")
+
+	tf := tarfile.New("test", "", 1, map[string]string{}, tarfile.Config{UploadDeadline: time.Second})
+	tf.Add("tinyfile", f, func(string) *time.Timer { return time.NewTimer(time.Hour) })
+	up := &fakeUploader{requestedRetries: 1000}
+	start := time.Now()
+	if err := tf.UploadAndDelete(context.Background(), up); !errors.Is(err, tarfile.ErrUploadGaveUp) {
+		t.Errorf("UploadAndDelete should have given up, not returned %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("UploadAndDelete kept trying for %s, past its deadline", d)
+	}
+	if up.calls < 2 {
+		t.Errorf("The upload should have been retried before the deadline, but was tried %d times", up.calls)
+	}
+}
+
+// blockingUploader's uploads never finish until their context is done.
+type blockingUploader struct {
+	calls int
+}
+
+func (b *blockingUploader) Upload(ctx context.Context, _ uploader.ID, _ filename.System, _ []byte, _ map[string]string) (uploader.Result, error) {
+	b.calls++
+	<-ctx.Done()
+	return uploader.Result{}, ctx.Err()
+}
+
+func TestUploadAndDeleteGivesUpWhenCanceled(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tarfile.TestUploadAndDeleteGivesUpWhenCanceled")
+	rtx.Must(err, "Could not create temp dir")
+	defer os.RemoveAll(tmp)
+	rtx.Must(ioutil.WriteFile(tmp+"/tinyfile", []byte("abcdefgh"), os.FileMode(0666)), "Could not write file")
+	f, err := os.Open(tmp + "/tinyfile")
+	rtx.Must(err, "Could not open file we just wrote")
+
+	tf := tarfile.New("test", "", 1, map[string]string{}, tarfile.Config{})
+	tf.Add("tinyfile", f, func(string) *time.Timer { return time.NewTimer(time.Hour) })
+	up := &blockingUploader{}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := tf.UploadAndDelete(ctx, up); !errors.Is(err, tarfile.ErrUploadGaveUp) {
+		t.Errorf("UploadAndDelete should have given up, not returned %v", err)
+	}
+	if up.calls != 1 {
+		t.Errorf("The upload was tried %d times instead of once", up.calls)
+	}
+	if _, err = os.Stat(tmp + "/tinyfile"); err != nil {
+		t.Error("A file that was not uploaded should not be removed")
+	}
 }
 
 func TestUploadAndDeleteSkipped(t *testing.T) {
@@ -163,10 +588,10 @@ func TestUploadAndDeleteSkipped(t *testing.T) {
 	rtx.Must(err, "Could not open file we just wrote")
 
 	// File ratio = 0 means all files should be skipped.
-	tf := tarfile.New("test", "", 0, map[string]string{})
+	tf := tarfile.New("test", "", 0, map[string]string{}, tarfile.Config{})
 	timerFactory := func(string) *time.Timer { return time.NewTimer(time.Hour) }
 	tf.Add("tinyfile", f, timerFactory)
-	tf.UploadAndDelete(&fakeUploader{})
+	tf.UploadAndDelete(context.Background(), &fakeUploader{})
 	if _, err = os.Open("tinyfile"); err == nil {
 		t.Errorf("File should have been removed and unable to open")
 	}
@@ -176,8 +601,8 @@ type uploaderThatSavesLocallyInstead struct {
 	localfilename string
 }
 
-func (u *uploaderThatSavesLocallyInstead) Upload(_ filename.System, contents []byte) error {
-	return ioutil.WriteFile(u.localfilename, contents, 0666)
+func (u *uploaderThatSavesLocallyInstead) Upload(_ context.Context, _ uploader.ID, _ filename.System, contents []byte, _ map[string]string) (uploader.Result, error) {
+	return uploader.Result{Destination: u.localfilename}, ioutil.WriteFile(u.localfilename, contents, 0666)
 }
 
 func TestTimestampsArePreserved(t *testing.T) {
@@ -192,12 +617,12 @@ func TestTimestampsArePreserved(t *testing.T) {
 	ioutil.WriteFile("tinyfile", []byte("abcdefgh"), os.FileMode(0666))
 	f, err := os.Open("tinyfile")
 	rtx.Must(err, "Could not open file we just wrote")
-	tf := tarfile.New("test", "", 1, map[string]string{})
+	tf := tarfile.New("test", "", 1, map[string]string{}, tarfile.Config{})
 	timerFactory := func(string) *time.Timer { return time.NewTimer(time.Hour) }
 	tf.Add("tinyfile", f, timerFactory)
 
 	u := &uploaderThatSavesLocallyInstead{"file.tgz"}
-	tf.UploadAndDelete(u)
+	tf.UploadAndDelete(context.Background(), u)
 
 	if _, err := os.Stat("tinyfile"); err == nil {
 		t.Error("Stat of tinyfile should fail because it should be deleted")
@@ -220,3 +645,499 @@ func TestTimestampsArePreserved(t *testing.T) {
 		t.Error("ModTime was not preserved")
 	}
 }
+
+// readHeaders returns all the headers in the passed-in .tgz file.
+func readHeaders(t *testing.T, tgz string) []*tar.Header {
+	f, err := os.Open(tgz)
+	rtx.Must(err, "Could not open %s", tgz)
+	defer f.Close()
+	g, err := gzip.NewReader(f)
+	rtx.Must(err, "Could not create gzip reader for %s", tgz)
+	r := tar.NewReader(g)
+	headers := []*tar.Header{}
+	for h, err := r.Next(); err == nil; h, err = r.Next() {
+		headers = append(headers, h)
+	}
+	return headers
+}
+
+func TestPermissionsArePreserved(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tarfile.TestPermissionsArePreserved")
+	rtx.Must(err, "Could not create temp dir")
+	defer os.RemoveAll(tmp)
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(tmp), "Could not chdir to the tempdir")
+	defer os.Chdir(oldDir)
+
+	tests := []struct {
+		name     string
+		config   tarfile.Config
+		mode     int64
+		uid, gid int
+	}{
+		{name: "default", config: tarfile.Config{}, mode: 0666},
+		{name: "mode", config: tarfile.Config{PreserveMode: true}, mode: 0640},
+		{name: "owner", config: tarfile.Config{PreserveOwner: true}, mode: 0666, uid: os.Getuid(), gid: os.Getgid()},
+		{
+			name:   "override",
+			config: tarfile.Config{PreserveOwner: true, Owner: &tarfile.Owner{UID: 1234, GID: 5678}},
+			mode:   0666,
+			uid:    1234,
+			gid:    5678,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rtx.Must(ioutil.WriteFile("tinyfile", []byte("abcdefgh"), 0640), "Could not write tinyfile")
+			rtx.Must(os.Chmod("tinyfile", 0640), "Could not chmod tinyfile")
+			f, err := os.Open("tinyfile")
+			rtx.Must(err, "Could not open file we just wrote")
+			tf := tarfile.New("test", "", 1, map[string]string{}, tt.config)
+			tf.Add("tinyfile", f, func(string) *time.Timer { return time.NewTimer(time.Hour) })
+			tf.UploadAndDelete(context.Background(), &uploaderThatSavesLocallyInstead{"file.tgz"})
+
+			headers := readHeaders(t, "file.tgz")
+			if len(headers) != 1 {
+				t.Fatalf("Wanted 1 header, got %d", len(headers))
+			}
+			h := headers[0]
+			if h.Mode != tt.mode {
+				t.Errorf("Mode %o != %o", h.Mode, tt.mode)
+			}
+			if h.Uid != tt.uid || h.Gid != tt.gid {
+				t.Errorf("Owner %d:%d != %d:%d", h.Uid, h.Gid, tt.uid, tt.gid)
+			}
+		})
+	}
+}
+
+func TestParallelCompressionProducesValidTarfile(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tarfile.TestParallelCompressionProducesValidTarfile")
+	rtx.Must(err, "Could not create temp dir")
+	defer os.RemoveAll(tmp)
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(tmp), "Could not chdir to the tempdir")
+	defer os.Chdir(oldDir)
+
+	tf := tarfile.New("test", "", 1, map[string]string{}, tarfile.Config{CompressionCores: 4})
+	timerFactory := func(string) *time.Timer { return time.NewTimer(time.Hour) }
+	for _, name := range []string{"file1", "file2", "file3"} {
+		rtx.Must(ioutil.WriteFile(name, []byte("abcdefgh"), 0666), "Could not write %s", name)
+		f, err := os.Open(name)
+		rtx.Must(err, "Could not open %s", name)
+		tf.Add(filename.Internal(name), f, timerFactory)
+	}
+	tf.UploadAndDelete(context.Background(), &uploaderThatSavesLocallyInstead{"file.tgz"})
+	if headers := readHeaders(t, "file.tgz"); len(headers) != 3 {
+		t.Errorf("Wanted 3 files in the tarfile, got %d", len(headers))
+	}
+}
+
+func TestUncompressedProducesPlainTarfile(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tarfile.TestUncompressedProducesPlainTarfile")
+	rtx.Must(err, "Could not create temp dir")
+	defer os.RemoveAll(tmp)
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(tmp), "Could not chdir to the tempdir")
+	defer os.Chdir(oldDir)
+
+	tf := tarfile.New("test", "", 1, map[string]string{}, tarfile.Config{Uncompressed: true, Stored: true, CompressionCores: 4})
+	rtx.Must(ioutil.WriteFile("file1.gz", []byte("abcdefgh"), 0666), "Could not write file1.gz")
+	f, err := os.Open("file1.gz")
+	rtx.Must(err, "Could not open file1.gz")
+	tf.Add("file1.gz", f, func(string) *time.Timer { return time.NewTimer(time.Hour) })
+	rtx.Must(tf.UploadAndDelete(context.Background(), &uploaderThatSavesLocallyInstead{"file.tar"}), "Could not upload")
+
+	archive, err := os.Open("file.tar")
+	rtx.Must(err, "Could not open file.tar")
+	defer archive.Close()
+	tr := tar.NewReader(archive)
+	h, err := tr.Next()
+	if err != nil || h.Name != "file1.gz" {
+		t.Fatalf("The archive should be a plain tarfile holding file1.gz, not %v (%v)", h, err)
+	}
+	contents, err := ioutil.ReadAll(tr)
+	if err != nil || string(contents) != "abcdefgh" {
+		t.Errorf("Bad contents %q (%v)", contents, err)
+	}
+}
+
+func TestSeekableArchives(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tarfile.TestSeekableArchives")
+	rtx.Must(err, "Could not create temp dir")
+	defer os.RemoveAll(tmp)
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(tmp), "Could not chdir to the tempdir")
+	defer os.Chdir(oldDir)
+
+	tf := tarfile.New("test", "", 1, map[string]string{}, tarfile.Config{Seekable: true, Deduplicate: true})
+	timerFactory := func(string) *time.Timer { return time.NewTimer(time.Hour) }
+	contents := map[string]string{
+		"file1": "abcdefgh",
+		"file2": strings.Repeat("ijklmnop", 1000),
+		"file3": "abcdefgh",
+	}
+	for _, name := range []string{"file1", "file2", "file3"} {
+		rtx.Must(ioutil.WriteFile(name, []byte(contents[name]), 0666), "Could not write %s", name)
+		f, err := os.Open(name)
+		rtx.Must(err, "Could not open %s", name)
+		rtx.Must(tf.Add(filename.Internal(name), f, timerFactory), "Could not add %s", name)
+		// Flushing does not split an entry's member.
+		rtx.Must(tf.Flush(), "Could not flush")
+	}
+	rtx.Must(tf.UploadAndDelete(context.Background(), uploader.NewLocal("out", namer.Fixed("file.tgz"))), "Could not upload")
+
+	// The whole tarfile is still readable.
+	if headers := readHeaders(t, "out/file.tgz"); len(headers) != 3 {
+		t.Errorf("Wanted 3 files in the tarfile, got %d", len(headers))
+	}
+	data, err := ioutil.ReadFile("out/file.tgz" + tarfile.IndexSuffix)
+	rtx.Must(err, "Could not read the index")
+	var index []tarfile.IndexEntry
+	rtx.Must(json.Unmarshal(data, &index), "Could not parse the index %q", data)
+	archive, err := ioutil.ReadFile("out/file.tgz")
+	rtx.Must(err, "Could not read the tarfile")
+	// Deduplication is off, so that every member holds its own contents.
+	if len(index) != 3 || index[2].Link != "" {
+		t.Fatalf("Bad index %+v", index)
+	}
+	// Each member can be read on its own.
+	for _, entry := range index {
+		gz, err := gzip.NewReader(bytes.NewReader(archive[entry.Offset : entry.Offset+entry.Size]))
+		rtx.Must(err, "Could not read the member of %s", entry.Name)
+		gz.Multistream(false)
+		tr := tar.NewReader(gz)
+		h, err := tr.Next()
+		if err != nil || h.Name != entry.Name {
+			t.Errorf("The member at %d should hold %s, not %v (%v)", entry.Offset, entry.Name, h, err)
+			continue
+		}
+		b, err := ioutil.ReadAll(tr)
+		if entry.Link != "" {
+			if h.Typeflag != tar.TypeLink || len(b) != 0 {
+				t.Errorf("%s should be a link to %s, not %v", entry.Name, entry.Link, h)
+			}
+		} else if err != nil || string(b) != contents[entry.Name] {
+			t.Errorf("Bad contents of %s: %q (%v)", entry.Name, b, err)
+		}
+	}
+}
+
+func TestSkippedManifest(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tarfile.TestSkippedManifest")
+	rtx.Must(err, "Could not create temp dir")
+	defer os.RemoveAll(tmp)
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(tmp), "Could not chdir to the tempdir")
+	defer os.Chdir(oldDir)
+
+	// About half of the files are skipped.
+	tf := tarfile.New("test", "", 0.5, map[string]string{}, tarfile.Config{SkippedManifest: true})
+	timerFactory := func(string) *time.Timer { return time.NewTimer(time.Hour) }
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("file%02d", i)
+		rtx.Must(ioutil.WriteFile(name, []byte(strings.Repeat("a", i)), 0666), "Could not write %s", name)
+		f, err := os.Open(name)
+		rtx.Must(err, "Could not open %s", name)
+		rtx.Must(tf.Add(filename.Internal(name), f, timerFactory), "Could not add %s", name)
+	}
+	if tf.Count() == 0 || tf.SkippedCount() == 0 {
+		t.Fatalf("%d files were added and %d skipped; the test needs both", tf.Count(), tf.SkippedCount())
+	}
+	rtx.Must(tf.UploadAndDelete(context.Background(), uploader.NewLocal("out", namer.Fixed("file.tgz"))), "Could not upload")
+
+	archived := map[string]bool{}
+	for _, h := range readHeaders(t, "out/file.tgz") {
+		archived[h.Name] = true
+	}
+	data, err := ioutil.ReadFile("out/file.tgz" + tarfile.SkippedSuffix)
+	rtx.Must(err, "Could not read the skipped manifest")
+	var manifest []tarfile.SkippedEntry
+	rtx.Must(json.Unmarshal(data, &manifest), "Could not parse the manifest %q", data)
+	if len(manifest)+len(archived) != 20 {
+		t.Errorf("The manifest has %d files, and the tarfile %d, of 20", len(manifest), len(archived))
+	}
+	for _, entry := range manifest {
+		var i int64
+		fmt.Sscanf(entry.Name, "file%02d", &i)
+		if archived[entry.Name] || entry.Size != i || entry.ModTime.IsZero() {
+			t.Errorf("Bad entry %+v in the manifest", entry)
+		}
+	}
+}
+
+func TestDigest(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tarfile.TestDigest")
+	rtx.Must(err, "Could not create temp dir")
+	defer os.RemoveAll(tmp)
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(tmp), "Could not chdir to the tempdir")
+	defer os.Chdir(oldDir)
+
+	contents := map[string]string{"file1": "abcdefgh", "file2": "ijklmnop", "file3": "abcdefgh"}
+	sums := []string{}
+	for _, c := range contents {
+		sum := sha256.Sum256([]byte(c))
+		sums = append(sums, hex.EncodeToString(sum[:])+"\n")
+	}
+	sort.Strings(sums)
+	sum := sha256.Sum256([]byte(strings.Join(sums, "")))
+	want := "sha256:" + hex.EncodeToString(sum[:])
+
+	var header string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("X-" + tarfile.DigestMetadata)
+	}))
+	defer server.Close()
+	// Deduplicated files have the same digest.
+	for _, dedup := range []bool{false, true} {
+		tf := tarfile.New("test", "", 1, map[string]string{}, tarfile.Config{Digest: true, Deduplicate: dedup})
+		for name, c := range contents {
+			rtx.Must(ioutil.WriteFile(name, []byte(c), 0666), "Could not write %s", name)
+			f, err := os.Open(name)
+			rtx.Must(err, "Could not open %s", name)
+			rtx.Must(tf.Add(filename.Internal(name), f, func(string) *time.Timer { return time.NewTimer(time.Hour) }), "Could not add %s", name)
+		}
+		if got := tf.Digest(); got != want {
+			t.Errorf("With deduplication %v, the digest is %q, not %q", dedup, got, want)
+		}
+		rtx.Must(tf.UploadAndDelete(context.Background(), uploader.NewHTTP(time.Minute, server.Client(), server.URL+"/{name}", "", namer.Fixed("file.tgz"))), "Could not upload")
+		if header != want {
+			t.Errorf("The digest was uploaded as %q, not %q", header, want)
+		}
+	}
+	if got := tarfile.New("test", "", 1, map[string]string{}, tarfile.Config{}).Digest(); got != "" {
+		t.Errorf("Without Config.Digest, the digest should be empty, not %q", got)
+	}
+}
+
+func TestDeduplicate(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tarfile.TestDeduplicate")
+	rtx.Must(err, "Could not create temp dir")
+	defer os.RemoveAll(tmp)
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(tmp), "Could not chdir to the tempdir")
+	defer os.Chdir(oldDir)
+
+	tf := tarfile.New("test", "", 1, map[string]string{}, tarfile.Config{Deduplicate: true})
+	timerFactory := func(string) *time.Timer { return time.NewTimer(time.Hour) }
+	// The big files are too large to keep in memory, so they are read twice.
+	big := strings.Repeat("qrstuvwx", 256*1024)
+	contents := map[string]string{
+		"file1": "abcdefgh",
+		"file2": "ijklmnop",
+		"file3": "abcdefgh",
+		"empty": "",
+		"file4": "abcdefgh",
+		"big1":  big,
+		"big2":  big,
+	}
+	for _, name := range []string{"file1", "file2", "file3", "empty", "file4", "big1", "big2"} {
+		rtx.Must(ioutil.WriteFile(name, []byte(contents[name]), 0666), "Could not write %s", name)
+		f, err := os.Open(name)
+		rtx.Must(err, "Could not open %s", name)
+		rtx.Must(tf.Add(filename.Internal(name), f, timerFactory), "Could not add %s", name)
+	}
+	if tf.Count() != 7 {
+		t.Errorf("All 7 files should be members, not %d", tf.Count())
+	}
+	tf.UploadAndDelete(context.Background(), &uploaderThatSavesLocallyInstead{"file.tgz"})
+
+	want := []struct {
+		name     string
+		typeflag byte
+		linkname string
+		size     int64
+	}{
+		{"file1", tar.TypeReg, "", 8},
+		{"file2", tar.TypeReg, "", 8},
+		{"file3", tar.TypeLink, "file1", 0},
+		{"empty", tar.TypeReg, "", 0},
+		{"file4", tar.TypeLink, "file1", 0},
+		{"big1", tar.TypeReg, "", int64(len(big))},
+		{"big2", tar.TypeLink, "big1", 0},
+	}
+	headers := readHeaders(t, "file.tgz")
+	if len(headers) != len(want) {
+		t.Fatalf("Wanted %d files in the tarfile, got %d", len(want), len(headers))
+	}
+	for i, w := range want {
+		h := headers[i]
+		if h.Name != w.name || h.Typeflag != w.typeflag || h.Linkname != w.linkname || h.Size != w.size {
+			t.Errorf("Header %d was %q %c %q %d, wanted %v", i, h.Name, h.Typeflag, h.Linkname, h.Size, w)
+		}
+	}
+	// Every file, linked or not, was uploaded and should have been deleted.
+	for name := range contents {
+		if _, err := os.Stat(name); err == nil {
+			t.Errorf("%s should have been deleted", name)
+		}
+	}
+}
+
+func TestSymlinksAreArchivedAsLinks(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tarfile.TestSymlinksAreArchivedAsLinks")
+	rtx.Must(err, "Could not create temp dir")
+	defer os.RemoveAll(tmp)
+	rtx.Must(ioutil.WriteFile(tmp+"/target", []byte("abcdefgh"), 0666), "Could not write file")
+	rtx.Must(os.Symlink("target", tmp+"/link"), "Could not create link")
+	rtx.Must(os.Symlink("nowhere", tmp+"/dangling"), "Could not create link")
+	if _, err := tarfile.OpenSymlink(tmp + "/target"); err == nil {
+		t.Error("A regular file should not open as a symlink")
+	}
+
+	tf := tarfile.New("test", "", 1, map[string]string{}, tarfile.Config{})
+	timerFactory := func(string) *time.Timer { return time.NewTimer(time.Hour) }
+	for _, name := range []string{"link", "dangling"} {
+		link, err := tarfile.OpenSymlink(tmp + "/" + name)
+		rtx.Must(err, "Could not open %s", name)
+		rtx.Must(tf.Add(filename.Internal(name), link, timerFactory), "Could not add %s", name)
+	}
+	rtx.Must(tf.UploadAndDelete(context.Background(), &uploaderThatSavesLocallyInstead{tmp + "/file.tgz"}), "Could not upload")
+
+	headers := readHeaders(t, tmp+"/file.tgz")
+	if len(headers) != 2 {
+		t.Fatalf("Wanted 2 headers, got %d", len(headers))
+	}
+	for i, linkname := range []string{"target", "nowhere"} {
+		if h := headers[i]; h.Typeflag != tar.TypeSymlink || h.Linkname != linkname || h.Size != 0 {
+			t.Errorf("Bad header for a symlink: %+v", h)
+		}
+	}
+	// The links are deleted, but not what they point to.
+	if _, err := os.Lstat(tmp + "/link"); !os.IsNotExist(err) {
+		t.Error("The link should have been deleted")
+	}
+	if _, err := os.Stat(tmp + "/target"); err != nil {
+		t.Error("The target of the link should not have been deleted")
+	}
+}
+
+func TestZipArchives(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tarfile.TestZipArchives")
+	rtx.Must(err, "Could not create temp dir")
+	defer os.RemoveAll(tmp)
+	contents := map[string]string{
+		"data.txt": "abcdefghabcdefghabcdefghabcdefgh",
+		"data.gz":  "abcdefghabcdefghabcdefghabcdefgh",
+		"copy.txt": "abcdefghabcdefghabcdefghabcdefgh",
+	}
+	for name, c := range contents {
+		rtx.Must(ioutil.WriteFile(tmp+"/"+name, []byte(c), 0666), "Could not write %s", name)
+	}
+	rtx.Must(os.Symlink("data.txt", tmp+"/link"), "Could not create link")
+
+	tf := tarfile.New("test", "zipped", 1, map[string]string{"MLAB.pusher.version": "v1.2.3"}, tarfile.Config{
+		Format:           tarfile.Zip,
+		StoredExtensions: []string{".gz"},
+		// Zip archives have no hard links, so nothing is deduplicated.
+		Deduplicate: true,
+	})
+	timerFactory := func(string) *time.Timer { return time.NewTimer(time.Hour) }
+	for _, name := range []string{"data.txt", "data.gz", "copy.txt"} {
+		f, err := os.Open(tmp + "/" + name)
+		rtx.Must(err, "Could not open %s", name)
+		rtx.Must(tf.Add(filename.Internal(name), f, timerFactory), "Could not add %s", name)
+		// Flushing pushes the deflated data into the buffer, so the size
+		// counts more than the 47 bytes of the first header.
+		if name == "data.txt" {
+			rtx.Must(tf.Flush(), "Could not flush")
+			if tf.Size() <= 47 {
+				t.Errorf("The size %d does not count the deflated data", tf.Size())
+			}
+		}
+	}
+	link, err := tarfile.OpenSymlink(tmp + "/link")
+	rtx.Must(err, "Could not open the link")
+	rtx.Must(tf.Add("link", link, timerFactory), "Could not add the link")
+	rtx.Must(tf.UploadAndDelete(context.Background(), &uploaderThatSavesLocallyInstead{tmp + "/archive.zip"}), "Could not upload")
+
+	r, err := zip.OpenReader(tmp + "/archive.zip")
+	rtx.Must(err, "Could not open the zip archive")
+	defer r.Close()
+	if !strings.Contains(r.Comment, "MLAB.datatype=zipped") || !strings.Contains(r.Comment, "MLAB.pusher.version=v1.2.3") {
+		t.Errorf("The comment %q lacks the metadata", r.Comment)
+	}
+	want := []struct {
+		name   string
+		method uint16
+		mode   os.FileMode
+		data   string
+	}{
+		{"data.txt", zip.Deflate, 0666, contents["data.txt"]},
+		{"data.gz", zip.Store, 0666, contents["data.gz"]},
+		{"copy.txt", zip.Deflate, 0666, contents["copy.txt"]},
+		{"link", zip.Store, os.ModeSymlink | 0666, "data.txt"},
+	}
+	if len(r.File) != len(want) {
+		t.Fatalf("Wanted %d members, got %d", len(want), len(r.File))
+	}
+	for i, w := range want {
+		f := r.File[i]
+		rc, err := f.Open()
+		rtx.Must(err, "Could not open %s", f.Name)
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if f.Name != w.name || f.Method != w.method || f.Mode() != w.mode || string(data) != w.data || err != nil {
+			t.Errorf("Member %d was %q method %d mode %v %q (%v), wanted %v", i, f.Name, f.Method, f.Mode(), data, err, w)
+		}
+	}
+}
+
+func TestFileMetadata(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tarfile.TestFileMetadata")
+	rtx.Must(err, "Could not create temp dir")
+	defer os.RemoveAll(tmp)
+	extractor := tarfile.MetadataExtractorFunc(func(name filename.Internal, head []byte) (map[string]string, error) {
+		line := strings.SplitN(string(head), "\n", 2)
+		if len(line) < 2 {
+			return nil, errors.New("no first line")
+		}
+		// The extractor may not relabel the datatype.
+		return map[string]string{"MLAB.uuid": line[0], "MLAB.datatype": "other"}, nil
+	})
+
+	for _, format := range []tarfile.Format{tarfile.Tar, tarfile.Zip} {
+		t.Run(string(format), func(t *testing.T) {
+			// Uploading deletes the files, so each archive needs its own.
+			rtx.Must(ioutil.WriteFile(tmp+"/a.json", []byte("uuid-a\n{}"), 0666), "Could not write a.json")
+			rtx.Must(ioutil.WriteFile(tmp+"/b.json", []byte("no id here"), 0666), "Could not write b.json")
+			tf := tarfile.New("test", "ndt", 1, map[string]string{}, tarfile.Config{Format: format, FileMetadata: extractor})
+			for _, name := range []string{"a.json", "b.json"} {
+				f, err := os.Open(tmp + "/" + name)
+				rtx.Must(err, "Could not open %s", name)
+				rtx.Must(tf.Add(filename.Internal(name), f, nilTimerFactory), "Could not add %s", name)
+				f.Close()
+			}
+			archive := tmp + "/archive." + string(format)
+			rtx.Must(tf.UploadAndDelete(context.Background(), &uploaderThatSavesLocallyInstead{archive}), "Could not upload")
+
+			if format == tarfile.Zip {
+				r, err := zip.OpenReader(archive)
+				rtx.Must(err, "Could not open the zip archive")
+				defer r.Close()
+				if r.Comment != "MLAB.datatype=ndt" || r.File[0].Comment != "MLAB.uuid=uuid-a" || r.File[1].Comment != "" {
+					t.Errorf("Bad comments %q, %q and %q", r.Comment, r.File[0].Comment, r.File[1].Comment)
+				}
+				return
+			}
+			headers := readHeaders(t, archive)
+			want := []map[string]string{
+				{"MLAB.datatype": "ndt", "MLAB.uuid": "uuid-a"},
+				{"MLAB.datatype": "ndt"},
+			}
+			for i, h := range headers {
+				if !reflect.DeepEqual(h.PAXRecords, want[i]) {
+					t.Errorf("%s has records %v, want %v", h.Name, h.PAXRecords, want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package tarfile
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// uploadAges exports, for each datatype, the seconds since the last upload
+// succeeded and since the last one was attempted. Unlike
+// pusher_success_timestamp, these are measured by pusher's own clock, so alerts
+// on them need not compare timestamps from hosts whose clocks disagree. A
+// datatype whose uploads are failing has a growing success age and a small
+// attempt age, while one with no data arriving has both ages growing.
+type uploadAges struct {
+	mu sync.Mutex
+	// The times of the last success and the last attempt of each datatype.
+	// Both start out as the time the datatype was first exported.
+	success map[string]time.Time
+	attempt map[string]time.Time
+}
+
+var (
+	ages = &uploadAges{
+		success: make(map[string]time.Time),
+		attempt: make(map[string]time.Time),
+	}
+	sinceSuccessDesc = prometheus.NewDesc(
+		"pusher_seconds_since_success",
+		"The seconds since the last tarfile was uploaded, or since pusher started if none has been",
+		[]string{"datatype"}, nil)
+	sinceAttemptDesc = prometheus.NewDesc(
+		"pusher_seconds_since_upload_attempt",
+		"The seconds since an upload was last attempted, successfully or not, or since pusher started if none has been",
+		[]string{"datatype"}, nil)
+)
+
+func init() {
+	collectors.Add(ages)
+}
+
+// ExportUploadAges starts exporting the upload ages of the datatype, counting
+// from now until its first upload. It does nothing if they are already being
+// exported, e.g. because the datatype's TarCache was restarted.
+func ExportUploadAges(datatype string) {
+	ages.start(datatype, time.Now())
+}
+
+// UploadAges returns how long ago an upload of the datatype last succeeded,
+// and how long ago one was last attempted, as exported by the metrics. It
+// returns false if they are not being exported.
+func UploadAges(datatype string) (sinceSuccess, sinceAttempt time.Duration, ok bool) {
+	ages.mu.Lock()
+	defer ages.mu.Unlock()
+	attempt, ok := ages.attempt[datatype]
+	if !ok {
+		return 0, 0, false
+	}
+	return time.Since(ages.success[datatype]), time.Since(attempt), true
+}
+
+func (a *uploadAges) start(datatype string, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.attempt[datatype]; ok {
+		return
+	}
+	a.success[datatype] = now
+	a.attempt[datatype] = now
+}
+
+// attempted records that an upload of the datatype was attempted, and whether
+// it succeeded.
+func (a *uploadAges) attempted(datatype string, succeeded bool, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.attempt[datatype] = now
+	if succeeded {
+		a.success[datatype] = now
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (a *uploadAges) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sinceSuccessDesc
+	ch <- sinceAttemptDesc
+}
+
+// Collect implements prometheus.Collector.
+func (a *uploadAges) Collect(ch chan<- prometheus.Metric) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for datatype, t := range a.success {
+		ch <- prometheus.MustNewConstMetric(sinceSuccessDesc, prometheus.GaugeValue, now.Sub(t).Seconds(), datatype)
+	}
+	for datatype, t := range a.attempt {
+		ch <- prometheus.MustNewConstMetric(sinceAttemptDesc, prometheus.GaugeValue, now.Sub(t).Seconds(), datatype)
+	}
+}
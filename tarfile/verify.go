@@ -0,0 +1,99 @@
+package tarfile
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrCorrupt is returned (wrapped) by UploadAndDelete when Config.Verify is set
+// and the finished tarfile can't be read back.
+var ErrCorrupt = errors.New("the tarfile is corrupt")
+
+// verify reads the whole of the finished archive back, as a loader would, so
+// that corruption introduced after the files were read, e.g. by bad RAM, is
+// caught before the tarfile is uploaded and its files deleted. Reading a gzip
+// layer to the end checks the CRC of every member, and reading each member of
+// a Zip archive checks its CRC.
+func (t *tarfile) verify() error {
+	contents := t.contents.Bytes()
+	if t.config.Format == Zip {
+		zr, err := zip.NewReader(bytes.NewReader(contents), int64(len(contents)))
+		if err != nil {
+			return fmt.Errorf("zip directory is broken: %w", err)
+		}
+		if len(zr.File) != len(t.members) {
+			return fmt.Errorf("archive has %d entries instead of %d", len(zr.File), len(t.members))
+		}
+		for _, f := range zr.File {
+			r, err := f.Open()
+			if err == nil {
+				_, err = io.Copy(ioutil.Discard, r)
+				r.Close()
+			}
+			if err != nil {
+				return fmt.Errorf("could not read %s: %w", f.Name, err)
+			}
+		}
+		return nil
+	}
+	var r io.Reader = bytes.NewReader(contents)
+	if !t.config.Uncompressed {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("gzip layer is broken: %w", err)
+		}
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	entries := 0
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("tar layer is broken after %d entries: %w", entries, err)
+		}
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			return fmt.Errorf("could not read %s: %w", h.Name, err)
+		}
+		entries++
+	}
+	// Reading to the end checks the gzip checksum of the last member.
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return fmt.Errorf("archive is broken after %d entries: %w", entries, err)
+	}
+	if entries != len(t.members) {
+		return fmt.Errorf("archive has %d entries instead of %d", entries, len(t.members))
+	}
+	return nil
+}
+
+// spoolCorrupt saves the contents of a tarfile that failed verification in
+// Config.VerifySpoolDir, so that the corruption can be examined later, and
+// returns the name of the file it wrote.
+func (t *tarfile) spoolCorrupt() (string, error) {
+	extension := ".tgz"
+	if t.config.Format == Zip {
+		extension = ".zip"
+	} else if t.config.Uncompressed {
+		extension = ".tar"
+	}
+	subdir := strings.Trim(strings.ReplaceAll(string(t.subdir), string(filepath.Separator), "-"), "-")
+	name := filepath.Join(t.config.VerifySpoolDir, fmt.Sprintf("%s-%s-%s%s", t.datatype, time.Now().UTC().Format("20060102T150405.000000000Z"), subdir, extension))
+	if err := ioutil.WriteFile(name, t.contents.Bytes(), 0644); err != nil {
+		os.Remove(name)
+		return "", err
+	}
+	return name, nil
+}
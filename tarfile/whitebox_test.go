@@ -0,0 +1,447 @@
+package tarfile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/m-lab/pusher/filename"
+	"github.com/m-lab/pusher/uploader"
+)
+
+// compressibleData returns n bytes of data that compresses about as well as
+// typical measurement data does.
+func compressibleData(n int) []byte {
+	r := rand.New(rand.NewSource(1))
+	words := []string{"alpha", "bravo", "charlie", "delta", "echo", "foxtrot", "0", "1", "2", "3", "\n", "{", "}"}
+	b := &bytes.Buffer{}
+	for b.Len() < n {
+		b.WriteString(words[r.Intn(len(words))])
+	}
+	return b.Bytes()[:n]
+}
+
+func TestParallelGzipWriterRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, 1000, 4096, 4097, 50000} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			data := compressibleData(size)
+			buf := &bytes.Buffer{}
+			p := newParallelGzipWriter(buf, gzip.DefaultCompression, 3, 4096)
+			// Write in odd-sized pieces, with flushes in between, the way a
+			// tarfile does.
+			for i := 0; i < len(data); i += 777 {
+				end := i + 777
+				if end > len(data) {
+					end = len(data)
+				}
+				if _, err := p.Write(data[i:end]); err != nil {
+					t.Fatal(err)
+				}
+				if i%(3*777) == 0 {
+					if err := p.Flush(); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if err := p.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := p.Write([]byte("x")); err == nil {
+				t.Error("Writes after Close should fail")
+			}
+			g, err := gzip.NewReader(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := ioutil.ReadAll(g)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, data) {
+				t.Errorf("Round trip of %d bytes produced %d different bytes", len(data), len(out))
+			}
+		})
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, fmt.Errorf("this writer always fails")
+}
+
+func TestParallelGzipWriterPropagatesErrors(t *testing.T) {
+	p := newParallelGzipWriter(failingWriter{}, gzip.DefaultCompression, 2, 10)
+	p.Write(compressibleData(100))
+	if err := p.Flush(); err == nil {
+		t.Error("Flush should have returned the write error")
+	}
+	if _, err := p.Write([]byte("more")); err == nil {
+		t.Error("Write should keep returning the write error")
+	}
+}
+
+// Compare the throughput of the serial and parallel compressors with e.g.
+//
+//	go test -bench=Compress -benchmem ./tarfile
+func benchmarkCompress(b *testing.B, cores int) {
+	data := compressibleData(16 << 20)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var c compressor
+		if cores > 1 {
+			c = newParallelGzipWriter(ioutil.Discard, gzip.DefaultCompression, cores, parallelGzipBlockSize)
+		} else {
+			c = gzip.NewWriter(ioutil.Discard)
+		}
+		c.Write(data)
+		c.Close()
+	}
+}
+
+func BenchmarkCompress1(b *testing.B) { benchmarkCompress(b, 1) }
+func BenchmarkCompress2(b *testing.B) { benchmarkCompress(b, 2) }
+func BenchmarkCompress4(b *testing.B) { benchmarkCompress(b, 4) }
+func BenchmarkCompress8(b *testing.B) { benchmarkCompress(b, 8) }
+
+// Compare adding small files with and without flushing after each one, and the
+// size of the resulting tarfiles, with e.g.
+//
+//	go test -bench=Add -benchmem ./tarfile
+func benchmarkAdd(b *testing.B, flushEach bool) {
+	dir, err := ioutil.TempDir("", "tarfile.benchmarkAdd")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const files, fileSize = 1000, 1024
+	data := compressibleData(files * fileSize)
+	for i := 0; i < files; i++ {
+		if err := ioutil.WriteFile(fmt.Sprintf("%s/%d", dir, i), data[i*fileSize:(i+1)*fileSize], 0666); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.SetBytes(files * fileSize)
+	b.ResetTimer()
+	size := 0
+	for i := 0; i < b.N; i++ {
+		tf := New("test", "test", 1, map[string]string{}, Config{}).(*tarfile)
+		for j := 0; j < files; j++ {
+			f, err := os.Open(fmt.Sprintf("%s/%d", dir, j))
+			if err != nil {
+				b.Fatal(err)
+			}
+			tf.Add(filename.Internal(fmt.Sprint(j)), f, func(string) *time.Timer { return nil })
+			f.Close()
+			if flushEach {
+				tf.Flush()
+			}
+		}
+		tf.archive.Close()
+		size = tf.contents.Len()
+		tf.release()
+	}
+	b.ReportMetric(float64(size)/files, "tarfile-bytes/file")
+}
+
+func BenchmarkAddFlushingEach(b *testing.B) { benchmarkAdd(b, true) }
+func BenchmarkAdd(b *testing.B)             { benchmarkAdd(b, false) }
+
+func TestBufferPool(t *testing.T) {
+	b := getBuffer(1000)
+	if b.Len() != 0 || b.Cap() < 1000 {
+		t.Errorf("getBuffer(1000) returned len %d cap %d", b.Len(), b.Cap())
+	}
+	b.WriteString("leftover data")
+	putBuffer(b)
+	if b2 := getBuffer(0); b2.Len() != 0 {
+		t.Errorf("A recycled buffer should be empty, not %q", b2.String())
+	}
+	// Neither of these should crash or pollute the pool.
+	putBuffer(nil)
+	big := getBuffer(maxPooledBufferSize + 1)
+	putBuffer(big)
+}
+
+func TestSizeAfterUpload(t *testing.T) {
+	tf := New("test", "", 1, map[string]string{}, Config{InitialSize: 1000})
+	tf.UploadAndDelete(context.Background(), nil)
+	if tf.Size() != 0 {
+		t.Errorf("A released tarfile should have size 0, not %d", tf.Size())
+	}
+}
+
+// failingCompressor fails every write, the way a tarfile would if its
+// in-memory buffer could not be written.
+type failingCompressor struct{}
+
+func (failingCompressor) Write([]byte) (int, error) { return 0, fmt.Errorf("write failed") }
+func (failingCompressor) Flush() error              { return fmt.Errorf("flush failed") }
+func (failingCompressor) Close() error              { return fmt.Errorf("close failed") }
+
+func TestWriteErrorsAbandonTheTarfile(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tarfile.TestWriteErrorsAbandonTheTarfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	for _, name := range []string{"good", "bad"} {
+		if err := ioutil.WriteFile(tmp+"/"+name, []byte("abcdefgh"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	timerFactory := func(string) *time.Timer { return time.NewTimer(time.Hour) }
+	tf := New("test", "", 1, map[string]string{}, Config{}).(*tarfile)
+	good, _ := os.Open(tmp + "/good")
+	if err := tf.Add("good", good, timerFactory); err != nil {
+		t.Fatal("Adding to a working tarfile should succeed:", err)
+	}
+
+	// Break the tarfile.
+	tf.archive = newTarArchive(failingCompressor{})
+	bad, _ := os.Open(tmp + "/bad")
+	if err := tf.Add("bad", bad, timerFactory); err == nil {
+		t.Error("Adding to a broken tarfile should fail")
+	}
+	if err := tf.UploadAndDelete(context.Background(), nil); err == nil {
+		t.Error("Uploading a broken tarfile should fail")
+	}
+	files := tf.Abandon()
+	if len(files) != 1 || files[0] != filename.System(tmp+"/good") {
+		t.Errorf("Abandon should return only the good file, not %v", files)
+	}
+	// Nothing should have been deleted.
+	for _, name := range []string{"good", "bad"} {
+		if _, err := os.Stat(tmp + "/" + name); err != nil {
+			t.Errorf("%s should not have been deleted: %v", name, err)
+		}
+	}
+}
+
+func TestUploadAges(t *testing.T) {
+	a := &uploadAges{success: make(map[string]time.Time), attempt: make(map[string]time.Time)}
+	start := time.Now().Add(-time.Hour)
+	a.start("ndt7", start)
+	a.attempted("ndt7", false, start.Add(50*time.Minute))
+	// Starting it again, as a restarted TarCache does, changes nothing.
+	a.start("ndt7", start.Add(55*time.Minute))
+
+	ch := make(chan prometheus.Metric, 10)
+	a.Collect(ch)
+	close(ch)
+	got := map[string]float64{}
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		got[m.Desc().String()] = pb.GetGauge().GetValue()
+	}
+	if len(got) != 2 {
+		t.Fatalf("Collected %d metrics instead of 2: %v", len(got), got)
+	}
+	for desc, want := range map[*prometheus.Desc]float64{sinceSuccessDesc: 3600, sinceAttemptDesc: 600} {
+		if v := got[desc.String()]; v < want || v > want+60 {
+			t.Errorf("%v = %v, want about %v", desc, v, want)
+		}
+	}
+}
+
+// countingUploader counts its uploads, which always succeed.
+type countingUploader struct {
+	calls int
+}
+
+func (c *countingUploader) Upload(_ context.Context, _ uploader.ID, dir filename.System, contents []byte, _ map[string]string) (uploader.Result, error) {
+	c.calls++
+	return uploader.Result{Destination: "fake://" + string(dir), Size: int64(len(contents))}, nil
+}
+
+// closedArchive is an archive that has already been closed, so that its
+// contents can be changed before UploadAndDelete finishes it.
+type closedArchive struct {
+	archiveWriter
+}
+
+func (closedArchive) Close() error { return nil }
+
+func TestSkippedTarfilesAreNotUploads(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tarfile.TestSkippedTarfilesAreNotUploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	timerFactory := func(string) *time.Timer { return time.NewTimer(time.Hour) }
+	// Every file is skipped.
+	tf := New("2026/10/16", "skipped-test", 0, map[string]string{}, Config{})
+	name := tmp + "/a"
+	if err := ioutil.WriteFile(name, []byte("abcdefgh"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tf.Add("a", f, timerFactory); err != nil {
+		t.Fatal(err)
+	}
+	up := &countingUploader{}
+	if err := tf.UploadAndDelete(context.Background(), up); err != nil {
+		t.Fatal(err)
+	}
+	if up.calls != 0 {
+		t.Errorf("%d uploads of a tarfile whose files were all skipped", up.calls)
+	}
+	if got := testutil.ToFloat64(pusherEmptyUploads.WithLabelValues("skipped-test")); got != 1 {
+		t.Errorf("pusher_empty_uploads_total = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(pusherSuccessTimestamp.WithLabelValues("skipped-test")); got != 0 {
+		t.Errorf("The success timestamp was set to %v", got)
+	}
+	ages.mu.Lock()
+	_, succeeded := ages.success["skipped-test"]
+	_, attempted := ages.attempt["skipped-test"]
+	ages.mu.Unlock()
+	if succeeded || attempted {
+		t.Error("A tarfile which was not uploaded was recorded as an upload")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		config    Config
+		extension string
+	}{
+		{name: "tgz", extension: ".tgz"},
+		{name: "tar", config: Config{Uncompressed: true}, extension: ".tar"},
+		{name: "zip", config: Config{Format: Zip}, extension: ".zip"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "tarfile.TestVerify")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmp)
+			spool := tmp + "/spool"
+			if err := os.Mkdir(spool, 0777); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"a", "b"} {
+				if err := ioutil.WriteFile(tmp+"/"+name, compressibleData(10000), 0666); err != nil {
+					t.Fatal(err)
+				}
+			}
+			timerFactory := func(string) *time.Timer { return time.NewTimer(time.Hour) }
+			newTarfile := func() *tarfile {
+				config := tt.config
+				config.Verify = true
+				config.VerifySpoolDir = spool
+				config.KeepFiles = true
+				tf := New("2026/10/16", "ndt7", 1, map[string]string{}, config).(*tarfile)
+				for _, name := range []string{"a", "b"} {
+					f, err := os.Open(tmp + "/" + name)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if err := tf.Add(filename.Internal(name), f, timerFactory); err != nil {
+						t.Fatal(err)
+					}
+				}
+				return tf
+			}
+			up := &countingUploader{}
+
+			// An intact tarfile passes and is uploaded.
+			if err := newTarfile().UploadAndDelete(context.Background(), up); err != nil {
+				t.Fatal("An intact tarfile should be uploaded:", err)
+			}
+			if up.calls != 1 {
+				t.Fatalf("An intact tarfile was uploaded %d times", up.calls)
+			}
+
+			// A tarfile corrupted once it is finished is not.
+			tf := newTarfile()
+			if err := tf.archive.Close(); err != nil {
+				t.Fatal(err)
+			}
+			tf.archive = closedArchive{tf.archive}
+			// Byte 100 is in the mode field of the first tar header, or in
+			// the compressed contents of the first member.
+			tf.contents.Bytes()[100] ^= 0xff
+			err = tf.UploadAndDelete(context.Background(), up)
+			if !errors.Is(err, ErrCorrupt) {
+				t.Errorf("UploadAndDelete of a corrupt tarfile returned %v, not ErrCorrupt", err)
+			}
+			if up.calls != 1 {
+				t.Error("A corrupt tarfile should not be uploaded")
+			}
+			if files := tf.Abandon(); len(files) != 2 {
+				t.Errorf("Abandon returned %v instead of both files", files)
+			}
+			spooled, err := ioutil.ReadDir(spool)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(spooled) != 1 || !strings.HasSuffix(spooled[0].Name(), "-2026-10-16"+tt.extension) {
+				t.Errorf("The spool holds %v instead of one %s file", spooled, tt.extension)
+			}
+		})
+	}
+}
+
+func TestBytesRemovedAndUploaded(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tarfile.TestBytesRemovedAndUploaded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	timerFactory := func(string) *time.Timer { return time.NewTimer(time.Hour) }
+	// Half the files are skipped.
+	tf := New("2026/10/16", "bytes-test", 0.5, map[string]string{}, Config{})
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("%s/%d", tmp, i)
+		if err := ioutil.WriteFile(name, compressibleData(1000), 0666); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tf.Add(filename.Internal(fmt.Sprint(i)), f, timerFactory); err != nil {
+			t.Fatal(err)
+		}
+	}
+	added, skipped := tf.Count(), tf.SkippedCount()
+	// The counters are global, so only their increases are this test's.
+	removedBefore := testutil.ToFloat64(pusherBytesRemoved.WithLabelValues("bytes-test", addFile))
+	skippedBefore := testutil.ToFloat64(pusherBytesRemoved.WithLabelValues("bytes-test", skipFile))
+	uploadedBefore := testutil.ToFloat64(pusherBytesUploaded.WithLabelValues("bytes-test"))
+	up := &countingUploader{}
+	if err := tf.UploadAndDelete(context.Background(), up); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(pusherBytesRemoved.WithLabelValues("bytes-test", addFile)) - removedBefore; got != float64(1000*added) {
+		t.Errorf("Counted %v bytes of added files removed, not %d", got, 1000*added)
+	}
+	if got := testutil.ToFloat64(pusherBytesRemoved.WithLabelValues("bytes-test", skipFile)) - skippedBefore; got != float64(1000*skipped) {
+		t.Errorf("Counted %v bytes of skipped files removed, not %d", got, 1000*skipped)
+	}
+	got := testutil.ToFloat64(pusherBytesUploaded.WithLabelValues("bytes-test")) - uploadedBefore
+	if (added > 0) != (got > 0) || (added > 0 && got >= float64(1000*added)) {
+		t.Errorf("Counted %v compressed bytes uploaded for %d bytes of files", got, 1000*added)
+	}
+}
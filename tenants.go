@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/m-lab/go/flagx"
+	"github.com/m-lab/go/uniformnames"
+)
+
+// A tenant is an experiment whose files pusher uploads. There is usually just
+// the one configured by the flags, but --experiments_file lets one pusher
+// serve several experiments, which share its metrics server, its upload
+// transport, its GCS client, and its emergency upload limit, instead of each
+// needing a pusher of its own.
+type tenant struct {
+	// Experiment is the name of the experiment.
+	Experiment string `json:"experiment"`
+	// NodeName identifies the host in the names of uploaded tarfiles. If
+	// empty, the --node_name is used.
+	NodeName string `json:"node_name"`
+	// Directory holds a subdirectory for each datatype. If empty, the
+	// --directory is used.
+	Directory string `json:"directory"`
+	// Buckets are the GCS buckets to upload to, in order of preference. If
+	// empty, the --bucket list is used.
+	Buckets []string `json:"buckets"`
+	// Datatypes maps each datatype to its file upload ratio, like --datatype.
+	Datatypes map[string]string `json:"datatypes"`
+}
+
+// loadTenants reads a JSON list of tenants from the file. The fields which a
+// tenant leaves empty are taken from the defaults.
+func loadTenants(path string, defaults tenant) ([]tenant, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tenants []tenant
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return nil, fmt.Errorf("Could not parse the experiments in %s: %w", path, err)
+	}
+	for i := range tenants {
+		if tenants[i].NodeName == "" {
+			tenants[i].NodeName = defaults.NodeName
+		}
+		if tenants[i].Directory == "" {
+			tenants[i].Directory = defaults.Directory
+		}
+		if len(tenants[i].Buckets) == 0 {
+			tenants[i].Buckets = defaults.Buckets
+		}
+	}
+	return tenants, nil
+}
+
+// checkTenants returns an error unless there is at least one tenant, every
+// tenant has at least one datatype, and every name conforms to the unified
+// naming convention. Experiments may share datatype names, but an experiment
+// may not have the same datatype twice.
+func checkTenants(tenants []tenant) error {
+	if len(tenants) == 0 {
+		return errors.New("no experiments were configured")
+	}
+	seen := make(map[string]bool)
+	for _, tn := range tenants {
+		if err := uniformnames.Check(tn.Experiment); err != nil {
+			return fmt.Errorf("Experiment name %q did not conform to the unified naming convention: %w", tn.Experiment, err)
+		}
+		if len(tn.Datatypes) == 0 {
+			return fmt.Errorf("Experiment %q has no datatypes", tn.Experiment)
+		}
+		for d := range tn.Datatypes {
+			if err := uniformnames.Check(d); err != nil {
+				return fmt.Errorf("Datatype name %q did not conform to the unified naming convention: %w", d, err)
+			}
+			id := qualifiedDatatype(tn.Experiment, d)
+			if seen[id] {
+				return fmt.Errorf("Datatype %q of experiment %q is configured twice", d, tn.Experiment)
+			}
+			seen[id] = true
+		}
+	}
+	return nil
+}
+
+// qualifiedDatatype names the datatype of the experiment unambiguously, since
+// experiments may share datatype names.
+func qualifiedDatatype(experiment, datatype string) string {
+	return experiment + "/" + datatype
+}
+
+// datatypeID returns the name by which a datatype of the tenant is known to
+// the metrics, the admin and control APIs, the decision log and the ledger of
+// undeletable files. With more than one experiment, as configured by
+// --experiments_file, it is experiment/datatype. Otherwise it is the datatype
+// alone, as it was before one pusher could serve several experiments.
+func datatypeID(tn tenant, datatype string, multiTenant bool) string {
+	if multiTenant {
+		return qualifiedDatatype(tn.Experiment, datatype)
+	}
+	return datatype
+}
+
+// ledgerName returns the name of the ledger file of undeletable files for the
+// datatype with the given ID, which has no slashes, so that the ledgers of
+// every datatype share one directory. Names have no dashes, so it is unique.
+func ledgerName(id string) string {
+	return strings.ReplaceAll(id, "/", "-") + ".json"
+}
+
+// datatypeValue returns the value a per-datatype flag gives the datatype of
+// the experiment. The flag may name it as experiment/datatype, or by the
+// datatype alone, for that datatype of every experiment. The former wins.
+func datatypeValue[V any](values map[string]V, experiment, datatype string) (V, bool) {
+	if v, ok := values[qualifiedDatatype(experiment, datatype)]; ok {
+		return v, true
+	}
+	v, ok := values[datatype]
+	return v, ok
+}
+
+// datatypeListed returns whether a per-datatype list flag names the datatype
+// of the experiment, either as experiment/datatype or by the datatype alone.
+func datatypeListed(list flagx.StringArray, experiment, datatype string) bool {
+	return list.Contains(qualifiedDatatype(experiment, datatype)) || list.Contains(datatype)
+}
@@ -0,0 +1,36 @@
+package uploader
+
+import (
+	"context"
+
+	"github.com/m-lab/pusher/filename"
+	"github.com/m-lab/pusher/namer"
+)
+
+// discard names tarfiles like any other uploader, but throws them away.
+type discard struct {
+	namer namer.Namer
+}
+
+// NewDiscard returns an Uploader which names each tarfile and then discards it,
+// for dry runs which exercise everything but the upload. Its side files are
+// discarded too.
+func NewDiscard(namer namer.Namer) Uploader {
+	return &discard{namer: namer}
+}
+
+// Upload discards the contents, unless the context is already done.
+func (d *discard) Upload(ctx context.Context, id ID, directory filename.System, contents []byte, metadata map[string]string) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+	name := d.namer.ObjectName(directory, id.Time())
+	return Result{
+		Name:        name,
+		Destination: "discarded:" + name,
+		Size:        int64(len(contents)),
+		Side: func(ctx context.Context, _ string, _ []byte) error {
+			return ctx.Err()
+		},
+	}, nil
+}
@@ -0,0 +1,111 @@
+package uploader
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/m-lab/pusher/filename"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	pusherBucketUploads = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_bucket_uploads_total",
+			Help: "The number of tarfiles successfully uploaded to each bucket",
+		},
+		[]string{"bucket"})
+	pusherBucketFailovers = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_bucket_failovers_total",
+			Help: "The number of times uploads switched from one bucket to another",
+		},
+		[]string{"from", "to"})
+)
+
+// FailoverConfig controls when a failover Uploader switches buckets.
+type FailoverConfig struct {
+	// MaxFailures is the number of consecutive failed uploads to a bucket
+	// after which the next bucket is used.
+	MaxFailures int
+	// RetryPrimary is how long to wait after a failover before using the
+	// first bucket again.
+	RetryPrimary time.Duration
+	// Registerer is where the uploaders' metrics are registered. Nil means
+	// prometheus.DefaultRegisterer.
+	Registerer prometheus.Registerer
+}
+
+// failover uploads to one of several buckets. It uses the first bucket until
+// that bucket fails MaxFailures times in a row, then moves on to the next one,
+// and so on, wrapping around after the last. RetryPrimary after a failover, it
+// goes back to the first bucket.
+type failover struct {
+	buckets   []string
+	uploaders []Uploader
+	config    FailoverConfig
+
+	mutex      sync.Mutex // Protects the fields below.
+	active     int
+	failures   int
+	failedOver time.Time
+}
+
+// NewFailover returns an Uploader that uploads to uploaders[0] and fails over
+// to the others, in order, when uploads persistently fail. The buckets are the
+// names of the destinations of the uploaders, used in logs and metrics. With a
+// single uploader, it behaves like that uploader but also records metrics.
+func NewFailover(buckets []string, uploaders []Uploader, config FailoverConfig) Uploader {
+	RegisterMetrics(config.Registerer)
+	if config.MaxFailures < 1 {
+		config.MaxFailures = 1
+	}
+	return &failover{
+		buckets:   buckets,
+		uploaders: uploaders,
+		config:    config,
+	}
+}
+
+// Upload uploads to the active bucket. An error is returned whenever that
+// upload fails, because the caller retries, and the retry will go to the next
+// bucket if this failure was one too many.
+func (f *failover) Upload(ctx context.Context, id ID, dir filename.System, contents []byte, metadata map[string]string) (Result, error) {
+	f.mutex.Lock()
+	if f.active != 0 && time.Since(f.failedOver) > f.config.RetryPrimary {
+		log.Printf("Trying to upload to the primary bucket %s again\n", f.buckets[0])
+		f.active = 0
+		f.failures = 0
+	}
+	i := f.active
+	f.mutex.Unlock()
+
+	result, err := f.uploaders[i].Upload(ctx, id, dir, contents, metadata)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err == nil {
+		pusherBucketUploads.WithLabelValues(f.buckets[i]).Inc()
+		if i == f.active {
+			f.failures = 0
+		}
+		return result, nil
+	}
+	if i != f.active || len(f.uploaders) == 1 || ctx.Err() != nil {
+		// Another upload already failed over, or there is nowhere to go, or
+		// the upload was canceled, which is not the bucket's fault.
+		return Result{}, err
+	}
+	f.failures++
+	if f.failures >= f.config.MaxFailures {
+		next := (i + 1) % len(f.uploaders)
+		log.Printf("Failing over from bucket %s to bucket %s after %d failed uploads\n", f.buckets[i], f.buckets[next], f.failures)
+		pusherBucketFailovers.WithLabelValues(f.buckets[i], f.buckets[next]).Inc()
+		f.active = next
+		f.failures = 0
+		f.failedOver = time.Now()
+	}
+	return Result{}, err
+}
@@ -0,0 +1,104 @@
+package uploader_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/m-lab/pusher/filename"
+	"github.com/m-lab/pusher/uploader"
+)
+
+// fakeBucket is an Uploader which fails while down is true.
+type fakeBucket struct {
+	name    string
+	down    bool
+	uploads int
+}
+
+func (f *fakeBucket) Upload(_ context.Context, _ uploader.ID, _ filename.System, contents []byte, _ map[string]string) (uploader.Result, error) {
+	if f.down {
+		return uploader.Result{}, errors.New("the bucket is down")
+	}
+	f.uploads++
+	return uploader.Result{Destination: f.name, Size: int64(len(contents))}, nil
+}
+
+func TestFailover(t *testing.T) {
+	primary := &fakeBucket{name: "primary"}
+	backup := &fakeBucket{name: "backup"}
+	up := uploader.NewFailover([]string{"primary", "backup"}, []uploader.Uploader{primary, backup}, uploader.FailoverConfig{MaxFailures: 2, RetryPrimary: 50 * time.Millisecond})
+
+	if _, err := up.Upload(context.Background(), uploader.NewID(), "a/", nil, nil); err != nil || primary.uploads != 1 {
+		t.Fatal("The first upload should go to the primary", err)
+	}
+	primary.down = true
+	// The first failure is retried on the primary, the second fails over.
+	for i := 0; i < 2; i++ {
+		if _, err := up.Upload(context.Background(), uploader.NewID(), "a/", nil, nil); err == nil {
+			t.Fatal("Uploads to a down bucket should fail")
+		}
+	}
+	if result, err := up.Upload(context.Background(), uploader.NewID(), "a/", nil, nil); err != nil || backup.uploads != 1 || result.Destination != "backup" {
+		t.Fatal("After two failures, uploads should go to the backup", result, err)
+	}
+	if _, err := up.Upload(context.Background(), uploader.NewID(), "a/", nil, nil); err != nil || backup.uploads != 2 {
+		t.Fatal("Uploads should stay with the backup", err)
+	}
+
+	// After RetryPrimary, uploads go to the primary again.
+	primary.down = false
+	time.Sleep(100 * time.Millisecond)
+	if _, err := up.Upload(context.Background(), uploader.NewID(), "a/", nil, nil); err != nil || primary.uploads != 2 {
+		t.Fatal("Uploads should have gone back to the primary", err)
+	}
+
+	// If every bucket is down, uploads cycle through all of them.
+	primary.down = true
+	backup.down = true
+	for i := 0; i < 5; i++ {
+		if _, err := up.Upload(context.Background(), uploader.NewID(), "a/", nil, nil); err == nil {
+			t.Fatal("Uploads should fail when every bucket is down")
+		}
+	}
+	// Two failures on the primary, two on the backup, and one more on the
+	// primary leave the primary one failure away from failing over.
+	backup.down = false
+	if _, err := up.Upload(context.Background(), uploader.NewID(), "a/", nil, nil); err == nil {
+		t.Fatal("The upload should have gone to the primary, which is down")
+	}
+	if _, err := up.Upload(context.Background(), uploader.NewID(), "a/", nil, nil); err != nil || backup.uploads != 3 {
+		t.Fatal("Uploads should go to whichever bucket is up", err)
+	}
+}
+
+func TestFailoverWithOneBucket(t *testing.T) {
+	only := &fakeBucket{down: true}
+	up := uploader.NewFailover([]string{"only"}, []uploader.Uploader{only}, uploader.FailoverConfig{})
+	for i := 0; i < 3; i++ {
+		if _, err := up.Upload(context.Background(), uploader.NewID(), "a/", nil, nil); err == nil {
+			t.Fatal("Uploads to a down bucket should fail")
+		}
+	}
+	only.down = false
+	if _, err := up.Upload(context.Background(), uploader.NewID(), "a/", nil, nil); err != nil || only.uploads != 1 {
+		t.Fatal("The upload should have succeeded", err)
+	}
+}
+
+func TestFailoverIgnoresCanceledUploads(t *testing.T) {
+	primary := &fakeBucket{down: true}
+	backup := &fakeBucket{}
+	up := uploader.NewFailover([]string{"primary", "backup"}, []uploader.Uploader{primary, backup}, uploader.FailoverConfig{MaxFailures: 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// Uploads canceled during shutdown are not the bucket's fault.
+	if _, err := up.Upload(ctx, uploader.NewID(), "a/", nil, nil); err == nil {
+		t.Fatal("Uploads to a down bucket should fail")
+	}
+	primary.down = false
+	if _, err := up.Upload(context.Background(), uploader.NewID(), "a/", nil, nil); err != nil || primary.uploads != 1 {
+		t.Fatal("A canceled upload should not have failed over", err)
+	}
+}
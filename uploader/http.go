@@ -0,0 +1,98 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/m-lab/pusher/filename"
+	"github.com/m-lab/pusher/namer"
+)
+
+// NamePlaceholder is replaced, in the URL template of an HTTP uploader, by the
+// name the namer gives the tarfile.
+const NamePlaceholder = "{name}"
+
+// httpUploader PUTs tarfiles to an HTTP server.
+type httpUploader struct {
+	timeout     time.Duration
+	client      *http.Client
+	urlTemplate string
+	tokenFile   string
+	namer       namer.Namer
+}
+
+// NewHTTP returns an Uploader which PUTs each tarfile to the URL made by
+// replacing NamePlaceholder in the urlTemplate with the tarfile's name. If the
+// tokenFile is not empty, its contents are sent as a bearer token. The file is
+// read for every upload, so that the token can be rotated while pusher runs.
+func NewHTTP(timeout time.Duration, client *http.Client, urlTemplate string, tokenFile string, namer namer.Namer) Uploader {
+	return &httpUploader{
+		timeout:     timeout,
+		client:      client,
+		urlTemplate: urlTemplate,
+		tokenFile:   tokenFile,
+		namer:       namer,
+	}
+}
+
+// escapePath escapes each element of a slash-separated path.
+func escapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	return strings.Join(parts, "/")
+}
+
+// Upload PUTs the tarfile. Any response other than a 2xx is an error.
+func (h *httpUploader) Upload(ctx context.Context, id ID, directory filename.System, contents []byte, metadata map[string]string) (Result, error) {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	name := h.namer.ObjectName(directory, id.Time())
+	target := strings.ReplaceAll(h.urlTemplate, NamePlaceholder, escapePath(name))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, bytes.NewReader(contents))
+	if err != nil {
+		return Result{}, err
+	}
+	contentType, format := objectType(name)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Content-Disposition", contentDisposition(name))
+	if format != "" {
+		req.Header.Set("X-Pusher-Archive-Format", format)
+	}
+	for k, v := range metadata {
+		req.Header.Set("X-"+k, v)
+	}
+	if h.tokenFile != "" {
+		token, err := ioutil.ReadFile(h.tokenFile)
+		if err != nil {
+			return Result{}, fmt.Errorf("Could not read the token for %s (%v)", target, err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		countTimeout(ctx, "http")
+		return Result{}, fmt.Errorf("Could not PUT %s (%v)", target, err)
+	}
+	defer resp.Body.Close()
+	// Read the body so that the connection can be reused.
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return Result{}, fmt.Errorf("Could not PUT %s (%s: %q)", target, resp.Status, body)
+	}
+	return Result{
+		Name:        name,
+		Destination: target,
+		Size:        int64(len(contents)),
+		Duration:    time.Since(start),
+	}, nil
+}
@@ -0,0 +1,111 @@
+package uploader_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/m-lab/pusher/uploader"
+)
+
+func TestHTTPUpload(t *testing.T) {
+	var method, path, auth, contentType, disposition string
+	var body []byte
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		path = r.URL.EscapedPath()
+		auth = r.Header.Get("Authorization")
+		contentType = r.Header.Get("Content-Type")
+		disposition = r.Header.Get("Content-Disposition")
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	token, err := ioutil.TempFile("", "uploader.TestHTTPUpload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(token.Name())
+	token.WriteString("secret\n")
+	token.Close()
+
+	up := uploader.NewHTTP(time.Minute, server.Client(), server.URL+"/ingest/"+uploader.NamePlaceholder, token.Name(), &testNamer{"exp/type/2019/05/01/a b.tgz"})
+	result, err := up.Upload(context.Background(), uploader.NewID(), "2019/05/01", []byte("contents"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Name != "exp/type/2019/05/01/a b.tgz" || result.Destination != server.URL+"/ingest/exp/type/2019/05/01/a%20b.tgz" || result.Size != 8 {
+		t.Errorf("Bad result %+v", result)
+	}
+	if method != http.MethodPut || path != "/ingest/exp/type/2019/05/01/a%20b.tgz" || auth != "Bearer secret" || string(body) != "contents" {
+		t.Errorf("Bad request: %s %s %q %q", method, path, auth, body)
+	}
+	if contentType != "application/gzip" || disposition != `attachment; filename="a b.tgz"` {
+		t.Errorf("Bad request headers: Content-Type %q, Content-Disposition %q", contentType, disposition)
+	}
+
+	status = http.StatusServiceUnavailable
+	if _, err := up.Upload(context.Background(), uploader.NewID(), "2019/05/01", []byte("contents"), nil); err == nil {
+		t.Error("A 503 should be an error")
+	}
+
+	// Without a token file, no token is sent.
+	status = http.StatusCreated
+	up = uploader.NewHTTP(time.Minute, server.Client(), server.URL+"/"+uploader.NamePlaceholder, "", &testNamer{"a.tgz"})
+	if _, err := up.Upload(context.Background(), uploader.NewID(), "", []byte("contents"), nil); err != nil || auth != "" {
+		t.Errorf("Upload without a token failed (%v) or sent a token (%q)", err, auth)
+	}
+
+	// A missing token file is an error.
+	up = uploader.NewHTTP(time.Minute, server.Client(), server.URL+"/"+uploader.NamePlaceholder, "/this/file/does/not/exist", &testNamer{"a.tgz"})
+	if _, err := up.Upload(context.Background(), uploader.NewID(), "", []byte("contents"), nil); err == nil {
+		t.Error("A missing token file should be an error")
+	}
+
+	// An unreachable server is an error.
+	server.Close()
+	up = uploader.NewHTTP(time.Minute, http.DefaultClient, server.URL+"/"+uploader.NamePlaceholder, "", &testNamer{"a.tgz"})
+	if _, err := up.Upload(context.Background(), uploader.NewID(), "", []byte("contents"), nil); err == nil {
+		t.Error("An unreachable server should be an error")
+	}
+}
+
+func TestHTTPUploadTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	before := counterValue(t, "pusher_upload_attempt_timeouts_total", "uploader", "http")
+	up := uploader.NewHTTP(10*time.Millisecond, server.Client(), server.URL+"/"+uploader.NamePlaceholder, "", &testNamer{"a.tgz"})
+	if _, err := up.Upload(context.Background(), uploader.NewID(), "", []byte("contents"), nil); err == nil {
+		t.Error("An upload that takes too long should be an error")
+	}
+	if after := counterValue(t, "pusher_upload_attempt_timeouts_total", "uploader", "http"); after != before+1 {
+		t.Errorf("The timeout should have been counted: %v -> %v", before, after)
+	}
+}
+
+func TestHTTPUploadCanceled(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	up := uploader.NewHTTP(time.Hour, server.Client(), server.URL+"/"+uploader.NamePlaceholder, "", &testNamer{"a.tgz"})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := up.Upload(ctx, uploader.NewID(), "", []byte("contents"), nil); err == nil {
+		t.Error("An upload whose context is canceled should be an error")
+	}
+}
@@ -0,0 +1,84 @@
+package uploader
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/m-lab/pusher/filename"
+	"github.com/m-lab/pusher/namer"
+)
+
+// local saves tarfiles to a directory on local disk, using the same names that
+// they would have in GCS.
+type local struct {
+	root  string
+	namer namer.Namer
+}
+
+// NewLocal returns an Uploader which saves each tarfile under the root
+// directory, at the path that it would have in a GCS bucket.
+func NewLocal(root string, namer namer.Namer) Uploader {
+	return &local{
+		root:  root,
+		namer: namer,
+	}
+}
+
+// Upload saves the contents to a file. The file is written under a temporary
+// name and then renamed, so that no partial tarfile is ever visible. Local
+// writes are not interrupted, so the context is only checked before starting.
+func (l *local) Upload(ctx context.Context, id ID, directory filename.System, contents []byte, metadata map[string]string) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+	objectName := l.namer.ObjectName(directory, id.Time())
+	result, err := l.save(objectName, contents)
+	if err != nil {
+		return Result{}, err
+	}
+	result.Side = func(ctx context.Context, suffix string, contents []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, err := l.save(objectName+suffix, contents)
+		return err
+	}
+	return result, nil
+}
+
+// save writes the contents to the file for the named object.
+func (l *local) save(objectName string, contents []byte) (Result, error) {
+	start := time.Now()
+	name := filepath.Join(l.root, filepath.FromSlash(objectName))
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return Result{}, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(name), ".partial-")
+	if err != nil {
+		return Result{}, err
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly after the rename.
+	if _, err = tmp.Write(contents); err != nil {
+		tmp.Close()
+		return Result{}, err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return Result{}, err
+	}
+	if err = tmp.Close(); err != nil {
+		return Result{}, err
+	}
+	if err = os.Rename(tmp.Name(), name); err != nil {
+		return Result{}, err
+	}
+	return Result{
+		Name:        objectName,
+		Destination: name,
+		Size:        int64(len(contents)),
+		Duration:    time.Since(start),
+	}, nil
+}
@@ -0,0 +1,134 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/m-lab/pusher/filename"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var pusherReplicaUploads = collectors.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pusher_replica_uploads_total",
+		Help: "The number of tarfile uploads to each destination of a replicated uploader, by success",
+	},
+	[]string{"destination", "success"})
+
+// replicated uploads every tarfile to several destinations.
+type replicated struct {
+	names     []string
+	uploaders []Uploader
+
+	mutex sync.Mutex // Protects done.
+	// For each upload that has partly failed, the results of the uploads to
+	// the destinations that already have a copy, and nil for the others.
+	// Entries are removed when the upload succeeds, or when the context of
+	// its attempts is done, because the caller has then given up on it.
+	done map[ID][]*Result
+}
+
+// NewReplicated returns an Uploader which uploads each tarfile to every one of
+// the uploaders, and succeeds only once all of them have. When some of them
+// fail, the error is returned, and a retry of the same upload only goes to the
+// ones that failed. Callers must therefore retry a failed upload with the same
+// ID, contents and context, as tarfiles do, and cancel the context when they
+// give up, so that what was kept for the retry is dropped. The names describe the
+// destinations in errors and metrics. The Result of a successful upload is the
+// first destination's, except that side files go to every destination that
+// can take them.
+func NewReplicated(names []string, uploaders []Uploader) Uploader {
+	return &replicated{
+		names:     names,
+		uploaders: uploaders,
+		done:      make(map[ID][]*Result),
+	}
+}
+
+// Upload uploads the contents to every destination that does not already have
+// them.
+func (r *replicated) Upload(ctx context.Context, id ID, dir filename.System, contents []byte, metadata map[string]string) (Result, error) {
+	r.mutex.Lock()
+	done, ok := r.done[id]
+	r.mutex.Unlock()
+	if !ok {
+		done = make([]*Result, len(r.uploaders))
+	}
+
+	failures := []string{}
+	for i, u := range r.uploaders {
+		if done[i] != nil {
+			continue
+		}
+		result, err := u.Upload(ctx, id, dir, contents, metadata)
+		if err != nil {
+			pusherReplicaUploads.WithLabelValues(r.names[i], "false").Inc()
+			failures = append(failures, fmt.Sprintf("%s: %v", r.names[i], err))
+			continue
+		}
+		pusherReplicaUploads.WithLabelValues(r.names[i], "true").Inc()
+		done[i] = &result
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(failures) == 0 {
+		delete(r.done, id)
+		if len(done) == 0 {
+			return Result{}, nil
+		}
+		result := *done[0]
+		result.Side = r.side(done)
+		return result, nil
+	}
+	err := fmt.Errorf("could not upload to %d of %d destinations (%s)", len(failures), len(r.uploaders), strings.Join(failures, "; "))
+	if ctx.Err() != nil {
+		// The caller has given up, and will not retry.
+		delete(r.done, id)
+		return Result{}, err
+	}
+	if !ok {
+		go r.forget(ctx, id)
+	}
+	r.done[id] = done
+	return Result{}, err
+}
+
+// forget drops what was kept for the retries of the upload once the context of
+// its attempts is done.
+func (r *replicated) forget(ctx context.Context, id ID) {
+	<-ctx.Done()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.done, id)
+}
+
+// side returns a function which uploads a side file next to each copy of the
+// tarfile, or nil if none of the destinations can take side files. Every
+// destination is tried, and the errors are returned together.
+func (r *replicated) side(done []*Result) func(context.Context, string, []byte) error {
+	can := false
+	for _, d := range done {
+		can = can || d.Side != nil
+	}
+	if !can {
+		return nil
+	}
+	return func(ctx context.Context, suffix string, contents []byte) error {
+		failures := []string{}
+		for i, d := range done {
+			if d.Side == nil {
+				continue
+			}
+			if err := d.Side(ctx, suffix, contents); err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %v", r.names[i], err))
+			}
+		}
+		if len(failures) > 0 {
+			return fmt.Errorf("could not upload the side file to %d destinations (%s)", len(failures), strings.Join(failures, "; "))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,111 @@
+package uploader_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/m-lab/pusher/uploader"
+)
+
+func TestReplicated(t *testing.T) {
+	primary := &fakeBucket{name: "primary"}
+	replica := &fakeBucket{name: "replica", down: true}
+	up := uploader.NewReplicated([]string{"primary", "replica"}, []uploader.Uploader{primary, replica})
+	contents := []byte("a tarfile")
+	id := uploader.NewID()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := up.Upload(ctx, id, "a/", contents, nil); err == nil {
+		t.Fatal("The upload should fail while the replica is down")
+	}
+	if primary.uploads != 1 {
+		t.Fatal("The primary should have a copy")
+	}
+	// Retries only go to the destination that failed.
+	if _, err := up.Upload(ctx, id, "a/", contents, nil); err == nil {
+		t.Fatal("The upload should fail while the replica is down")
+	}
+	replica.down = false
+	result, err := up.Upload(ctx, id, "a/", contents, nil)
+	if err != nil {
+		t.Fatal("The upload should succeed once the replica is up", err)
+	}
+	// The result is the primary's, even though its upload was the first try.
+	if result.Destination != "primary" || result.Size != int64(len(contents)) {
+		t.Errorf("The result should be the primary's, not %+v", result)
+	}
+	if primary.uploads != 1 || replica.uploads != 1 {
+		t.Errorf("Each destination should have one copy, not %d and %d", primary.uploads, replica.uploads)
+	}
+
+	// A new tarfile goes everywhere, even if its contents are the same.
+	if _, err := up.Upload(context.Background(), uploader.NewID(), "a/", contents, nil); err != nil {
+		t.Fatal(err)
+	}
+	if primary.uploads != 2 || replica.uploads != 2 {
+		t.Errorf("Each destination should have two copies, not %d and %d", primary.uploads, replica.uploads)
+	}
+}
+
+func TestReplicatedForgetsCanceledUploads(t *testing.T) {
+	primary := &fakeBucket{name: "primary"}
+	replica := &fakeBucket{name: "replica", down: true}
+	up := uploader.NewReplicated([]string{"primary", "replica"}, []uploader.Uploader{primary, replica})
+	id := uploader.NewID()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// The attempt fails once the caller has given up, and nothing is kept for
+	// retries, so the same ID starts over.
+	cancel()
+	if _, err := up.Upload(ctx, id, "a/", []byte("a tarfile"), nil); err == nil {
+		t.Fatal("The upload should fail while the replica is down")
+	}
+	replica.down = false
+	if _, err := up.Upload(context.Background(), id, "a/", []byte("a tarfile"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if primary.uploads != 2 || replica.uploads != 1 {
+		t.Errorf("The canceled upload was not forgotten: %d and %d uploads", primary.uploads, replica.uploads)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "uploader.TestLocal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	up := uploader.NewLocal(tmp, &testNamer{"exp/type/2019/05/01/tarfile.tgz"})
+	result, err := up.Upload(context.Background(), uploader.NewID(), "2019/05/01", []byte("contents"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Name != "exp/type/2019/05/01/tarfile.tgz" || result.Destination != filepath.Join(tmp, "exp/type/2019/05/01/tarfile.tgz") {
+		t.Errorf("Bad result %+v", result)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(tmp, "exp/type/2019/05/01/tarfile.tgz"))
+	if err != nil || string(b) != "contents" {
+		t.Errorf("Wanted the contents to be saved, got %q, %v", b, err)
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(tmp, "exp/type/2019/05/01"))
+	if len(files) != 1 {
+		t.Errorf("Only the tarfile should be in the directory, not %v", files)
+	}
+	if err := result.Side(context.Background(), ".index.json", []byte("[]")); err != nil {
+		t.Fatal(err)
+	}
+	b, err = ioutil.ReadFile(filepath.Join(tmp, "exp/type/2019/05/01/tarfile.tgz.index.json"))
+	if err != nil || string(b) != "[]" {
+		t.Errorf("Wanted the side file to be saved next to the tarfile, got %q, %v", b, err)
+	}
+
+	// An unwritable root causes an error.
+	up = uploader.NewLocal(filepath.Join(tmp, "exp/type/2019/05/01/tarfile.tgz"), &testNamer{"x.tgz"})
+	if _, err := up.Upload(context.Background(), uploader.NewID(), "", []byte("contents"), nil); err == nil {
+		t.Error("Saving under a regular file should fail")
+	}
+}
@@ -0,0 +1,142 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-lab/pusher/ratelog"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+var pusherSecretReloads = collectors.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pusher_secret_reloads_total",
+		Help: "The number of times a file holding a secret was read again because it changed, by secret and by whether the new contents could be used",
+	},
+	[]string{"secret", "result"})
+
+// secretFile is a file holding a secret, such as a mounted Kubernetes secret,
+// which is read again whenever it changes, so that the secret can be rotated
+// without restarting pusher. Secrets in files, unlike those in flags and
+// environment variables, do not show up in process listings.
+type secretFile struct {
+	path    string
+	modTime time.Time
+	size    int64
+	read    bool
+}
+
+// changed returns the contents of the file, and true, if it has changed since
+// it was last read. Kubernetes replaces a secret's files rather than rewriting
+// them, so a change is noticed by the new modification time.
+func (s *secretFile) changed() ([]byte, bool, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, false, err
+	}
+	if s.read && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return nil, false, nil
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, false, err
+	}
+	s.modTime, s.size, s.read = info.ModTime(), info.Size(), true
+	return data, true, nil
+}
+
+// fileTokenSource gets tokens with the credentials in a secretFile.
+type fileTokenSource struct {
+	ctx    context.Context
+	scopes []string
+	mu     sync.Mutex
+	file   secretFile
+	source oauth2.TokenSource
+}
+
+// NewFileTokenSource returns a token source which uses the Google credentials
+// in the file, which may hold a service account key or a workload identity
+// federation configuration. The file is read again whenever it changes. If the
+// new credentials can't be used, the old ones are kept.
+func NewFileTokenSource(ctx context.Context, path string, scopes ...string) (oauth2.TokenSource, error) {
+	f := &fileTokenSource{ctx: ctx, scopes: scopes, file: secretFile{path: path}}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// reload reads the credentials again if the file changed. The mutex must be
+// held, except by NewFileTokenSource.
+func (f *fileTokenSource) reload() error {
+	data, changed, err := f.file.changed()
+	if err != nil || !changed {
+		return err
+	}
+	creds, err := google.CredentialsFromJSON(f.ctx, data, f.scopes...)
+	if err != nil {
+		return fmt.Errorf("bad credentials in %s: %w", f.file.path, err)
+	}
+	f.source = creds.TokenSource
+	return nil
+}
+
+// Token returns a token from the current credentials.
+func (f *fileTokenSource) Token() (*oauth2.Token, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	old := f.source
+	if err := f.reload(); err != nil {
+		pusherSecretReloads.WithLabelValues("credentials", "error").Inc()
+		ratelog.Printf("Could not reload the credentials, so the old ones are still used (error: %q)\n", err)
+	} else if f.source != old {
+		pusherSecretReloads.WithLabelValues("credentials", "success").Inc()
+	}
+	return f.source.Token()
+}
+
+// fileProxy returns a proxy function for http.Transport which uses the proxy
+// URL in the file. The file is read again whenever it changes. If the new URL
+// is bad, the old one is kept.
+func fileProxy(path string) (func(*http.Request) (*url.URL, error), error) {
+	file := secretFile{path: path}
+	var mu sync.Mutex
+	var current *url.URL
+	reload := func() error {
+		data, changed, err := file.changed()
+		if err != nil || !changed {
+			return err
+		}
+		u, err := url.Parse(strings.TrimSpace(string(data)))
+		if err != nil || u.Host == "" {
+			// The URL is not in the error, because it may hold a password.
+			return fmt.Errorf("bad proxy URL in %s", path)
+		}
+		current = u
+		return nil
+	}
+	if err := reload(); err != nil {
+		return nil, err
+	}
+	return func(*http.Request) (*url.URL, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		old := current
+		if err := reload(); err != nil {
+			pusherSecretReloads.WithLabelValues("proxy", "error").Inc()
+			ratelog.Printf("Could not reload the proxy, so the old one is still used (error: %q)\n", err)
+		} else if current != old {
+			pusherSecretReloads.WithLabelValues("proxy", "success").Inc()
+		}
+		return current, nil
+	}, nil
+}
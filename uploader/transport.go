@@ -0,0 +1,143 @@
+package uploader
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var pusherProxyErrors = collectors.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pusher_upload_proxy_errors_total",
+		Help: "The number of uploads which failed because of the proxy rather than the destination, by whether connecting to the proxy failed or the proxy refused to connect onward",
+	},
+	[]string{"reason"})
+
+// proxyProbeURL is used to find out which proxy, if any, the environment
+// specifies for uploads.
+var proxyProbeURL = &url.URL{Scheme: "https", Host: "storage.googleapis.com"}
+
+// TransportConfig holds the tunable settings of the HTTP transport used for
+// uploads. The zero value is a transport like http.DefaultTransport.
+type TransportConfig struct {
+	// MaxIdleConns is the number of idle connections to keep open, both in
+	// total and to any single host. Zero means the http.DefaultTransport
+	// setting.
+	MaxIdleConns int
+	// DisableHTTP2 makes the transport use only HTTP/1.1.
+	DisableHTTP2 bool
+	// KeepAlive is the interval between TCP keepalive probes. Zero means the
+	// http.DefaultTransport setting, and a negative value disables them.
+	KeepAlive time.Duration
+	// CABundle, if not empty, is a PEM file of the certificate authorities to
+	// trust instead of the system's.
+	CABundle string
+	// Proxy, if not empty, is the URL of the proxy for all uploads. It may
+	// contain a username and password. If it is empty, the HTTPS_PROXY and
+	// NO_PROXY environment variables are honored.
+	Proxy string
+	// ProxyFile, if not empty, is a file holding the URL of the proxy for all
+	// uploads, which is read again whenever it changes. It keeps a password
+	// in the URL out of the process listing. It overrides Proxy.
+	ProxyFile string
+	// Registerer is where the uploaders' metrics, including those of the
+	// proxy, are registered. Nil means prometheus.DefaultRegisterer.
+	Registerer prometheus.Registerer
+}
+
+// NewTransport returns an HTTP transport with the given settings. The same
+// transport should be used for every upload, so that connections (and the
+// cost of their TLS handshakes) are reused from one upload to the next.
+func NewTransport(config TransportConfig) (*http.Transport, error) {
+	RegisterMetrics(config.Registerer)
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if config.MaxIdleConns > 0 {
+		t.MaxIdleConns = config.MaxIdleConns
+		t.MaxIdleConnsPerHost = config.MaxIdleConns
+	}
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if config.KeepAlive != 0 {
+		dialer.KeepAlive = config.KeepAlive
+	}
+	proxy := t.Proxy
+	if config.Proxy != "" {
+		u, err := url.Parse(config.Proxy)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("bad proxy URL %q (%v)", config.Proxy, err)
+		}
+		proxy = http.ProxyURL(u)
+		t.Proxy = proxy
+	}
+	if config.ProxyFile != "" {
+		var err error
+		if proxy, err = fileProxy(config.ProxyFile); err != nil {
+			return nil, err
+		}
+		t.Proxy = proxy
+	}
+	// Failures to reach the proxy, and refusals by the proxy to connect to
+	// the destination, are counted separately from other upload failures.
+	// The proxy is looked up on failure, because it may have changed.
+	isProxy := func(addr string) bool {
+		if proxy == nil {
+			return false
+		}
+		u, err := proxy(&http.Request{URL: proxyProbeURL})
+		return err == nil && u != nil && canonicalAddr(u) == addr
+	}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil && isProxy(addr) {
+			pusherProxyErrors.WithLabelValues("dial").Inc()
+		}
+		return conn, err
+	}
+	t.OnProxyConnectResponse = func(_ context.Context, _ *url.URL, _ *http.Request, resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK {
+			pusherProxyErrors.WithLabelValues("connect").Inc()
+		}
+		return nil
+	}
+	if config.DisableHTTP2 {
+		// A non-nil, empty map is how net/http is told not to use HTTP/2.
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	if config.CABundle != "" {
+		pem, err := ioutil.ReadFile(config.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + config.CABundle)
+		}
+		t.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return t, nil
+}
+
+// canonicalAddr returns the host:port of a proxy URL, with the default port of
+// its scheme if it has none.
+func canonicalAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
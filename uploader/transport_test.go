@@ -0,0 +1,138 @@
+package uploader_test
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/pusher/uploader"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestNewTransport(t *testing.T) {
+	tr, err := uploader.NewTransport(uploader.TransportConfig{})
+	if err != nil || (tr.TLSClientConfig != nil && tr.TLSClientConfig.RootCAs != nil) {
+		t.Errorf("The zero config should produce a default transport: %v", err)
+	}
+
+	tr, err = uploader.NewTransport(uploader.TransportConfig{MaxIdleConns: 7, DisableHTTP2: true, KeepAlive: time.Minute})
+	if err != nil || tr.MaxIdleConns != 7 || tr.MaxIdleConnsPerHost != 7 || tr.TLSNextProto == nil || tr.ForceAttemptHTTP2 {
+		t.Errorf("Bad transport: %v", err)
+	}
+
+	if _, err = uploader.NewTransport(uploader.TransportConfig{CABundle: "/this/file/does/not/exist"}); err == nil {
+		t.Error("A missing CA bundle should be an error")
+	}
+	empty, err := ioutil.TempFile("", "uploader.TestNewTransport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(empty.Name())
+	empty.Close()
+	if _, err = uploader.NewTransport(uploader.TransportConfig{CABundle: empty.Name()}); err == nil {
+		t.Error("A CA bundle without certificates should be an error")
+	}
+}
+
+func TestNewTransportTrustsCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// The test server's certificate is not trusted by default.
+	tr, err := uploader.NewTransport(uploader.TransportConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&http.Client{Transport: tr}).Get(server.URL); err == nil {
+		t.Error("The test server should not be trusted without the CA bundle")
+	}
+
+	bundle, err := ioutil.TempFile("", "uploader.TestNewTransportTrustsCABundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(bundle.Name())
+	bundle.Write(pemEncode(server.Certificate().Raw))
+	bundle.Close()
+	tr, err = uploader.NewTransport(uploader.TransportConfig{CABundle: bundle.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: tr}).Get(server.URL)
+	if err != nil {
+		t.Fatal("The test server should be trusted with the CA bundle:", err)
+	}
+	resp.Body.Close()
+}
+
+func pemEncode(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestNewTransportCountsProxyErrors(t *testing.T) {
+	if _, err := uploader.NewTransport(uploader.TransportConfig{Proxy: "not a url"}); err == nil {
+		t.Error("A bad proxy URL should be an error")
+	}
+
+	// A proxy that can't be reached.
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+	tr, err := uploader.NewTransport(uploader.TransportConfig{Proxy: closed.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := counterValue(t, "pusher_upload_proxy_errors_total", "reason", "dial")
+	if _, err := (&http.Client{Transport: tr}).Get("https://storage.googleapis.com/"); err == nil {
+		t.Error("The request should fail when the proxy is down")
+	}
+	if after := counterValue(t, "pusher_upload_proxy_errors_total", "reason", "dial"); after != before+1 {
+		t.Errorf("The dial error should have been counted: %v -> %v", before, after)
+	}
+
+	// A proxy that refuses to connect.
+	refusing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect || r.Header.Get("Proxy-Authorization") == "" {
+			t.Errorf("Wanted an authenticated CONNECT, got %s %v", r.Method, r.Header)
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer refusing.Close()
+	tr, err = uploader.NewTransport(uploader.TransportConfig{Proxy: strings.Replace(refusing.URL, "http://", "http://user:password@", 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before = counterValue(t, "pusher_upload_proxy_errors_total", "reason", "connect")
+	if _, err := (&http.Client{Transport: tr}).Get("https://storage.googleapis.com/"); err == nil {
+		t.Error("The request should fail when the proxy refuses it")
+	}
+	if after := counterValue(t, "pusher_upload_proxy_errors_total", "reason", "connect"); after != before+1 {
+		t.Errorf("The refusal should have been counted: %v -> %v", before, after)
+	}
+}
+
+// counterValue returns the current value of the counter with the given label
+// value.
+func counterValue(t *testing.T, name, label, value string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == label && l.GetValue() == value {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
@@ -4,18 +4,147 @@ package uploader
 import (
 	"errors"
 	"fmt"
+	"mime"
+	"path"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"cloud.google.com/go/storage"
 	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
 	"github.com/m-lab/pusher/filename"
+	"github.com/m-lab/pusher/metrics"
 	"github.com/m-lab/pusher/namer"
+	"github.com/m-lab/pusher/ratelog"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/net/context"
 	"google.golang.org/api/googleapi"
 )
 
-// Uploader is an interface for uploading data.
+var collectors metrics.Collectors
+
+// RegisterMetrics registers the metrics of every uploader on r, or on
+// prometheus.DefaultRegisterer if r is nil. NewTransport and NewFailover
+// register them on the registerer in their config, and tarfiles on theirs when
+// they are made, so the uploaders need not be given one of their own.
+func RegisterMetrics(r prometheus.Registerer) {
+	collectors.Register(r)
+	ratelog.RegisterMetrics(r)
+}
+
+var (
+	pusherAttemptTimeouts = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_upload_attempt_timeouts_total",
+			Help: "The number of upload attempts which failed because they took longer than the per-attempt timeout",
+		},
+		[]string{"uploader"})
+	pusherUploadVerifications = collectors.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pusher_upload_verifications_total",
+			Help: "The number of uploaded objects checked for the right size before their files were deleted, by whether the check passed",
+		},
+		[]string{"result"})
+)
+
+// verifyDelay is how much longer to wait before each successive check that an
+// uploaded object exists with the right size.
+const verifyDelay = 500 * time.Millisecond
+
+// countTimeout counts the attempt as timed out if its context's deadline has
+// passed.
+func countTimeout(ctx context.Context, kind string) {
+	if ctx.Err() == context.DeadlineExceeded {
+		pusherAttemptTimeouts.WithLabelValues(kind).Inc()
+	}
+}
+
+// objectType returns the MIME type of the tarfile with the given name, and the
+// format of the archive, which is a plain tarfile if the name ends in .tar, a
+// zip archive if it ends in .zip, and gzipped otherwise. Objects whose names
+// end in .json, such as heartbeats, are not archives, and have no format.
+//
+// The gzip layer of a gzipped tarfile is part of its content, not a
+// Content-Encoding. GCS decompresses objects with a gzip Content-Encoding for
+// most clients, including its own Go library, which would get a plain tarfile
+// with a .tgz name.
+func objectType(name string) (contentType, format string) {
+	switch {
+	case strings.HasSuffix(name, ".tar"):
+		return "application/x-tar", "tar"
+	case strings.HasSuffix(name, ".zip"):
+		return "application/zip", "zip"
+	case strings.HasSuffix(name, ".json"):
+		return "application/json", ""
+	}
+	return "application/gzip", "tar+gzip"
+}
+
+// contentDisposition returns the Content-Disposition which makes browsers save
+// the object under its own name, rather than try to display it.
+func contentDisposition(name string) string {
+	return mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(name)})
+}
+
+// Result describes a successful upload.
+type Result struct {
+	// Name is the name the namer gave the tarfile.
+	Name string
+	// Destination is where the tarfile ended up, e.g. gs://bucket/name, a
+	// URL, or a path on local disk.
+	Destination string
+	// Generation is the generation of the GCS object, or zero if the
+	// destination has none.
+	Generation int64
+	// Size is the number of bytes uploaded.
+	Size int64
+	// Duration is how long the upload took.
+	Duration time.Duration
+	// Side, if not nil, uploads a side file of the tarfile, such as its
+	// index, to the same destination, under the tarfile's name plus the
+	// suffix. Uploaders which can't put files next to their tarfiles leave
+	// it nil.
+	Side func(ctx context.Context, suffix string, contents []byte) error
+}
+
+// ID identifies the upload of one tarfile, which may take many attempts. Every
+// attempt to upload the tarfile must be given the same ID, and no other
+// tarfile may be given it. Uploaders which keep track of an upload from one
+// attempt to the next, such as the one returned by NewReplicated, key it by the
+// ID. Uploaders name the tarfile by the time of its ID, rather than of the
+// attempt, so that every attempt writes the same object, and a retry replaces
+// an attempt which failed after it was written, rather than duplicating it.
+type ID struct {
+	n    uint64
+	time time.Time
+}
+
+// lastID is the number of the ID most recently returned by NewID.
+var lastID uint64
+
+// NewID returns an ID that has never been returned before.
+func NewID() ID {
+	return ID{n: atomic.AddUint64(&lastID, 1), time: time.Now().UTC().Round(0)}
+}
+
+// Time returns when the ID was made, which is the time to name its tarfile by.
+func (id ID) Time() time.Time {
+	return id.time
+}
+
+// Uploader is an interface for uploading data. Implementations must not retain
+// the contents after Upload returns, because the memory is reused.
 type Uploader interface {
-	Upload(dir filename.System, contents []byte) error
+	// Upload makes one attempt to upload the contents of a tarfile of files
+	// from the directory. It gives up when the context is done. If the upload
+	// succeeds, the Result says where the tarfile went. The id is the same for
+	// every attempt to upload the same tarfile.
+	//
+	// The metadata, which may be nil, is recorded with the uploaded object: as
+	// custom metadata in GCS, and as X-<key> headers over HTTP. Keys should be
+	// lower case, with dashes, like "pusher-digest", which becomes the
+	// X-Pusher-Digest header. Local copies have no metadata.
+	Upload(ctx context.Context, id ID, dir filename.System, contents []byte, metadata map[string]string) (Result, error)
 }
 
 // We split the Uploader into a struct and Interface to allow for mocking of the
@@ -25,35 +154,72 @@ type Uploader interface {
 // instead of raw pointers to allow for mocking of the Google Cloud Storage
 // interface to aid in whitebox testing.
 type uploader struct {
-	context    context.Context
-	timeout    time.Duration
-	namer      namer.Namer
-	client     stiface.Client
-	bucket     stiface.BucketHandle
-	bucketName string
+	timeout        time.Duration
+	namer          namer.Namer
+	client         stiface.Client
+	bucket         stiface.BucketHandle
+	bucketName     string
+	verifyAttempts int
 }
 
 // Create and return a new object that implements Uploader.
-func Create(ctx context.Context, timeout time.Duration, client stiface.Client, bucketName string, namer namer.Namer) Uploader {
+func Create(timeout time.Duration, client stiface.Client, bucketName string, namer namer.Namer) Uploader {
+	return CreateVerified(timeout, client, bucketName, namer, 0)
+}
+
+// CreateVerified is like Create, but the returned Uploader checks, after each
+// upload, that the object can be found and has the right size. It checks up to
+// verifyAttempts times, waiting a little longer before each check, and if no
+// check passes the upload fails, so that no files are deleted. If
+// verifyAttempts is not positive, nothing is checked.
+func CreateVerified(timeout time.Duration, client stiface.Client, bucketName string, namer namer.Namer, verifyAttempts int) Uploader {
 	// TODO: add timeouts and error handling to this.
 	bucketHandle := client.Bucket(bucketName)
 	return &uploader{
-		context:    ctx,
-		timeout:    timeout,
-		namer:      namer,
-		client:     client,
-		bucket:     bucketHandle,
-		bucketName: bucketName,
+		timeout:        timeout,
+		namer:          namer,
+		client:         client,
+		bucket:         bucketHandle,
+		bucketName:     bucketName,
+		verifyAttempts: verifyAttempts,
 	}
 }
 
-// Upload the provided buffer to GCS.
-func (u *uploader) Upload(directory filename.System, contents []byte) error {
-	ctx, cancel := context.WithTimeout(u.context, u.timeout)
+// Upload the provided buffer to GCS. Each call is one attempt, which fails if
+// it takes longer than the timeout.
+func (u *uploader) Upload(ctx context.Context, id ID, directory filename.System, contents []byte, metadata map[string]string) (Result, error) {
+	result, err := u.put(ctx, u.namer.ObjectName(directory, id.Time()), contents, metadata)
+	if err != nil {
+		return Result{}, err
+	}
+	result.Side = func(ctx context.Context, suffix string, contents []byte) error {
+		_, err := u.put(ctx, result.Name+suffix, contents, nil)
+		return err
+	}
+	return result, nil
+}
+
+// put makes one attempt to upload the contents to the named object, with the
+// metadata.
+func (u *uploader) put(ctx context.Context, name string, contents []byte, metadata map[string]string) (Result, error) {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, u.timeout)
 	defer cancel()
-	name := u.namer.ObjectName(directory, time.Now().UTC())
 	object := u.bucket.Object(name)
 	writer := object.NewWriter(ctx)
+	attrs := writer.ObjectAttrs()
+	var format string
+	attrs.ContentType, format = objectType(name)
+	attrs.ContentDisposition = contentDisposition(name)
+	attrs.Metadata = map[string]string{
+		"pusher-upload-time": time.Now().UTC().Format(time.RFC3339),
+	}
+	if format != "" {
+		attrs.Metadata["pusher-archive-format"] = format
+	}
+	for k, v := range metadata {
+		attrs.Metadata[k] = v
+	}
 	n, err := writer.Write(contents)
 	for n != len(contents) || err != nil {
 		if err != nil {
@@ -64,11 +230,54 @@ func (u *uploader) Upload(directory filename.System, contents []byte) error {
 			}
 			// NOTE: the canceled context given to NewWriter should recover
 			// resources allocated by the writer.
-			return errors.New(msg)
+			countTimeout(ctx, "gcs")
+			return Result{}, errors.New(msg)
 		}
 		var newWrite int
 		newWrite, err = writer.Write(contents[n:])
 		n += newWrite
 	}
-	return writer.Close()
+	if err := writer.Close(); err != nil {
+		countTimeout(ctx, "gcs")
+		return Result{}, err
+	}
+	if err := u.verify(ctx, object, name, int64(len(contents))); err != nil {
+		return Result{}, err
+	}
+	result := Result{
+		Name:        name,
+		Destination: fmt.Sprintf("gs://%s/%s", u.bucketName, name),
+		Size:        int64(len(contents)),
+		Duration:    time.Since(start),
+	}
+	if written := writer.Attrs(); written != nil {
+		result.Generation = written.Generation
+	}
+	return result, nil
+}
+
+// verify checks that the object exists and has the given size.
+func (u *uploader) verify(ctx context.Context, object stiface.ObjectHandle, name string, size int64) error {
+	if u.verifyAttempts <= 0 {
+		return nil
+	}
+	var err error
+	for i := 0; i < u.verifyAttempts; i++ {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Could not verify gs://%s/%s (%v)", u.bucketName, name, ctx.Err())
+		case <-time.After(time.Duration(i) * verifyDelay):
+		}
+		var attrs *storage.ObjectAttrs
+		attrs, err = object.Attrs(ctx)
+		if err == nil && attrs.Size != size {
+			err = fmt.Errorf("the object has %d bytes instead of %d", attrs.Size, size)
+		}
+		if err == nil {
+			pusherUploadVerifications.WithLabelValues("ok").Inc()
+			return nil
+		}
+	}
+	pusherUploadVerifications.WithLabelValues("failed").Inc()
+	return fmt.Errorf("Could not verify gs://%s/%s after %d attempts (%v)", u.bucketName, name, u.verifyAttempts, err)
 }
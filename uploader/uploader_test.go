@@ -1,15 +1,12 @@
 package uploader_test
 
 import (
-	"bytes"
-	"encoding/base64"
-	"math/rand"
-	"os/exec"
 	"testing"
 	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
+	"github.com/m-lab/pusher/fakegcs"
 	"github.com/m-lab/pusher/filename"
 	"github.com/m-lab/pusher/uploader"
 	"golang.org/x/net/context"
@@ -25,50 +22,105 @@ func (tn testNamer) ObjectName(s filename.System, t time.Time) string {
 }
 
 func TestUploading(t *testing.T) {
-	buff := make([]byte, 16)
-	rand.Seed(time.Now().UnixNano())
-	rand.Read(buff)
-	dir := filename.System("TestUploading." + base64.RawURLEncoding.EncodeToString(buff) + "/")
+	server := fakegcs.NewServer("archive-mlab-testing")
+	defer server.Close()
+	dir := filename.System("TestUploading/")
 	fileName := dir + "test.txt"
 	namer := &testNamer{
 		newName: string(fileName),
 	}
 	ctx := context.Background()
-	client, err := storage.NewClient(ctx)
+	client, err := server.Client(ctx)
 	if err != nil {
 		t.Error("Could not create storage client:", err)
 	}
-	up := uploader.Create(ctx, time.Minute, stiface.AdaptClient(client), "archive-mlab-testing", namer)
+	up := uploader.Create(time.Minute, stiface.AdaptClient(client), "archive-mlab-testing", namer)
 	contents := "contentofatarfile"
-	if err := up.Upload(dir, []byte(contents)); err != nil {
+	result, err := up.Upload(context.Background(), uploader.NewID(), dir, []byte(contents), nil)
+	if err != nil {
+		t.Error("Could not Upload():", err)
+	}
+	obj, ok := server.Object("archive-mlab-testing", string(fileName))
+	if !ok {
+		t.Fatalf("Object %q was not uploaded", fileName)
+	}
+	if result.Name != string(fileName) || result.Destination != "gs://archive-mlab-testing/"+string(fileName) ||
+		result.Generation != obj.Generation || result.Generation == 0 || result.Size != int64(len(contents)) {
+		t.Errorf("Bad result %+v for object generation %d", result, obj.Generation)
+	}
+	if s := string(obj.Contents); s != contents {
+		t.Errorf("File contents %q != %q", s, contents)
+	}
+	if _, err := time.Parse(time.RFC3339, obj.Metadata["pusher-upload-time"]); err != nil {
+		t.Errorf("Object metadata %v lacks the upload time: %v", obj.Metadata, err)
+	}
+	// The gzip layer is not a Content-Encoding, or GCS would serve the
+	// tarfile decompressed.
+	if obj.ContentType != "application/gzip" || obj.ContentEncoding != "" || obj.Metadata["pusher-archive-format"] != "tar+gzip" {
+		t.Errorf("Object is labeled %q, encoding %q, metadata %v instead of as a gzipped tarfile", obj.ContentType, obj.ContentEncoding, obj.Metadata)
+	}
+	if obj.ContentDisposition != `attachment; filename=test.txt` {
+		t.Errorf("Object has Content-Disposition %q", obj.ContentDisposition)
+	}
+
+	// Side files go next to the tarfile.
+	if result.Side == nil {
+		t.Fatal("The result can't upload side files")
+	}
+	if err := result.Side(ctx, ".index.json", []byte("[]")); err != nil {
+		t.Error("Could not upload a side file:", err)
+	}
+	if obj, ok := server.Object("archive-mlab-testing", string(fileName)+".index.json"); !ok || string(obj.Contents) != "[]" || obj.ContentType != "application/json" {
+		t.Errorf("The side file was not uploaded next to the tarfile: %+v", obj)
+	}
+
+	// Metadata given with the upload is recorded with the object.
+	if _, err := up.Upload(ctx, uploader.NewID(), dir, []byte(contents), map[string]string{"pusher-digest": "sha256:0"}); err != nil {
 		t.Error("Could not Upload():", err)
 	}
-	url := "https://storage.googleapis.com/archive-mlab-testing/" + string(fileName)
-	defer func() {
-		cmd := exec.Command("gsutil", "rm", "-f", "gs://archive-mlab-testing/"+string(fileName))
-		cmd.Run()
-	}()
+	if obj, _ := server.Object("archive-mlab-testing", string(fileName)); obj.Metadata["pusher-digest"] != "sha256:0" {
+		t.Errorf("Object metadata %v lacks the digest", obj.Metadata)
+	}
+
+	// Plain tarfiles and zip archives are labeled as such.
+	for name, want := range map[string]string{"TestUploading/test.tar": "application/x-tar", "TestUploading/test.zip": "application/zip"} {
+		namer.newName = name
+		if _, err := up.Upload(context.Background(), uploader.NewID(), dir, []byte(contents), nil); err != nil {
+			t.Error("Could not Upload():", err)
+		}
+		if obj, ok := server.Object("archive-mlab-testing", name); !ok || obj.ContentType != want || obj.ContentEncoding != "" {
+			t.Errorf("Object %q was not uploaded as %s: %+v", name, want, obj)
+		}
+	}
+}
 
-	getter := exec.Command("curl", url)
-	var out bytes.Buffer
-	getter.Stdout = &out
-	if err := getter.Run(); err != nil {
-		t.Errorf("curl command failed: %q", err)
+func TestDiscard(t *testing.T) {
+	up := uploader.NewDiscard(&testNamer{"exp/type/2019/05/01/tarfile.tgz"})
+	result, err := up.Upload(context.Background(), uploader.NewID(), "2019/05/01", []byte("contents"), nil)
+	if err != nil || result.Name != "exp/type/2019/05/01/tarfile.tgz" || result.Size != 8 {
+		t.Errorf("Bad result %+v (%v)", result, err)
 	}
-	if s := string(out.Bytes()); s != contents {
-		t.Errorf("File contents %q != %q (url: %q)", s, contents, url)
+	if err := result.Side(context.Background(), ".index.json", []byte("[]")); err != nil {
+		t.Errorf("Side files should be discarded too: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := up.Upload(ctx, uploader.NewID(), "2019/05/01", []byte("contents"), nil); err == nil {
+		t.Error("A canceled upload should fail")
 	}
 }
 
 func TestUploadBadFilename(t *testing.T) {
+	server := fakegcs.NewServer("archive-mlab-testing")
+	defer server.Close()
 	namer := &testNamer{"Bad\nFilename"}
 	ctx := context.Background()
-	client, err := storage.NewClient(ctx)
+	client, err := server.Client(ctx)
 	if err != nil {
 		t.Error("Could not create storage client:", err)
 	}
-	up := uploader.Create(ctx, time.Minute, stiface.AdaptClient(client), "archive-mlab-testing", namer)
-	err = up.Upload("test/", []byte("contents"))
+	up := uploader.Create(time.Minute, stiface.AdaptClient(client), "archive-mlab-testing", namer)
+	_, err = up.Upload(context.Background(), uploader.NewID(), "test/", []byte("contents"), nil)
 	if err == nil {
 		t.Error("Should not have been able to Upload() badfilename")
 	}
@@ -104,6 +156,11 @@ func (f fakeBucketHandle) Object(name string) stiface.ObjectHandle {
 type failingWriter struct {
 	stiface.Writer
 	calls int
+	attrs storage.ObjectAttrs
+}
+
+func (f *failingWriter) ObjectAttrs() *storage.ObjectAttrs {
+	return &f.attrs
 }
 
 // The first three writes succeed and each writes one byte to this slice.
@@ -127,8 +184,8 @@ func (f fakeErroringObjectHandle) NewWriter(ctx context.Context) stiface.Writer
 
 // A test to execute error paths.
 func TestUploadFailure(t *testing.T) {
-	up := uploader.Create(context.Background(), time.Minute, &fakeClient{}, "archive-mlab-testing", &testNamer{"OkayFilename"})
-	err := up.Upload("test/", []byte("contents"))
+	up := uploader.Create(time.Minute, &fakeClient{}, "archive-mlab-testing", &testNamer{"OkayFilename"})
+	_, err := up.Upload(context.Background(), uploader.NewID(), "test/", []byte("contents"), nil)
 	if err == nil {
 		t.Error("Should not have been able to Upload() the writer that fails.")
 	}
@@ -136,3 +193,140 @@ func TestUploadFailure(t *testing.T) {
 		t.Error("The contents of the string were not partially written correctly")
 	}
 }
+
+// A fake object whose writes succeed, and whose size is reported wrongly the
+// first badAttrs times it is asked.
+type verifiableObjectHandle struct {
+	stiface.ObjectHandle
+	written  *int64
+	badAttrs *int
+	attrs    *storage.ObjectAttrs
+}
+
+type countingWriter struct {
+	stiface.Writer
+	written *int64
+	attrs   *storage.ObjectAttrs
+}
+
+func (c *countingWriter) ObjectAttrs() *storage.ObjectAttrs {
+	return c.attrs
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c.written += int64(len(p))
+	return len(p), nil
+}
+
+func (c *countingWriter) Close() error {
+	return nil
+}
+
+func (c *countingWriter) Attrs() *storage.ObjectAttrs {
+	return nil
+}
+
+func (v verifiableObjectHandle) NewWriter(ctx context.Context) stiface.Writer {
+	return &countingWriter{written: v.written, attrs: v.attrs}
+}
+
+func (v verifiableObjectHandle) Attrs(ctx context.Context) (*storage.ObjectAttrs, error) {
+	if *v.badAttrs > 0 {
+		*v.badAttrs--
+		return &storage.ObjectAttrs{Size: *v.written - 1}, nil
+	}
+	return &storage.ObjectAttrs{Size: *v.written}, nil
+}
+
+type verifiableClient struct {
+	stiface.Client
+	object verifiableObjectHandle
+}
+
+func (v verifiableClient) Bucket(name string) stiface.BucketHandle {
+	return verifiableBucketHandle{object: v.object}
+}
+
+type verifiableBucketHandle struct {
+	stiface.BucketHandle
+	object verifiableObjectHandle
+}
+
+func (v verifiableBucketHandle) Object(name string) stiface.ObjectHandle {
+	return v.object
+}
+
+func TestUploadVerification(t *testing.T) {
+	tests := []struct {
+		name     string
+		badAttrs int
+		attempts int
+		wantErr  bool
+	}{
+		{name: "no verification", badAttrs: 5, attempts: 0},
+		{name: "verified at once", badAttrs: 0, attempts: 2},
+		{name: "verified on retry", badAttrs: 1, attempts: 2},
+		{name: "never verified", badAttrs: 2, attempts: 2, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			written := int64(0)
+			badAttrs := tt.badAttrs
+			client := verifiableClient{object: verifiableObjectHandle{written: &written, badAttrs: &badAttrs, attrs: &storage.ObjectAttrs{}}}
+			up := uploader.CreateVerified(time.Minute, client, "bucket", &testNamer{"a.tgz"}, tt.attempts)
+			if _, err := up.Upload(context.Background(), uploader.NewID(), "test/", []byte("contents"), nil); (err != nil) != tt.wantErr {
+				t.Errorf("Upload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// timeNamer names each object by its time.
+type timeNamer struct{}
+
+func (timeNamer) ObjectName(_ filename.System, t time.Time) string {
+	return t.Format(time.RFC3339Nano) + ".tgz"
+}
+
+func TestUploadRetriesReplaceTheSameObject(t *testing.T) {
+	server := fakegcs.NewServer("archive-mlab-testing")
+	defer server.Close()
+	client, err := server.Client(context.Background())
+	if err != nil {
+		t.Fatal("Could not create storage client:", err)
+	}
+	up := uploader.Create(time.Minute, stiface.AdaptClient(client), "archive-mlab-testing", timeNamer{})
+	id := uploader.NewID()
+	first, err := up.Upload(context.Background(), id, "test/", []byte("first attempt"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	retry, err := up.Upload(context.Background(), id, "test/", []byte("retry"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retry.Name != first.Name || retry.Name != id.Time().Format(time.RFC3339Nano)+".tgz" {
+		t.Errorf("Every attempt of an upload should write the same object, not %q and %q", first.Name, retry.Name)
+	}
+	if obj, ok := server.Object("archive-mlab-testing", retry.Name); !ok || string(obj.Contents) != "retry" {
+		t.Error("The retry should have replaced the first attempt")
+	}
+	if other, err := up.Upload(context.Background(), uploader.NewID(), "test/", []byte("other"), nil); err != nil || other.Name == first.Name {
+		t.Errorf("Another upload should write another object, not %q (error: %v)", other.Name, err)
+	}
+}
+
+func TestUploadRecordsTheUploadTime(t *testing.T) {
+	written := int64(0)
+	badAttrs := 0
+	attrs := &storage.ObjectAttrs{}
+	client := verifiableClient{object: verifiableObjectHandle{written: &written, badAttrs: &badAttrs, attrs: attrs}}
+	up := uploader.Create(time.Minute, client, "bucket", &testNamer{"a.tgz"})
+	if _, err := up.Upload(context.Background(), uploader.NewID(), "test/", []byte("contents"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := time.Parse(time.RFC3339, attrs.Metadata["pusher-upload-time"]); err != nil {
+		t.Errorf("The upload time was not recorded in the object metadata: %v", attrs.Metadata)
+	}
+}